@@ -0,0 +1,77 @@
+package connection
+
+import (
+	"fmt"
+
+	"github.com/moov-io/iso8583"
+	"github.com/moov-io/iso8583-connection/iso8583util"
+)
+
+// adviceAckFields are the fields of the advice copied into the ack by the
+// default ack builder
+var adviceAckFields = []int{2, 3, 4, 7, 11, 12, 13, 32, 37, 41, 42, 49, 70}
+
+// ackAdvice sends the ack of the inbound advice which MTI is one of
+// AdviceAckMTIs before the advice is passed to its handler. Nothing is
+// sent when acks are deferred to the handler.
+func (c *Connection) ackAdvice(message *iso8583.Message) {
+	if len(c.options().AdviceAckMTIs) == 0 || c.options().DeferAdviceAcks {
+		return
+	}
+
+	mti, err := message.GetMTI()
+	if err != nil {
+		return
+	}
+
+	if _, found := c.options().AdviceAckMTIs[mti]; !found {
+		return
+	}
+
+	ack, err := c.AdviceAck(message)
+	if err != nil {
+		c.handleError(err)
+		return
+	}
+
+	// ack is written in the background like NAK of rejected frames, as
+	// the advice may be handled by the read loop
+	go func() {
+		if err := c.reply(ack); err != nil {
+			c.handleError(fmt.Errorf("sending ack of advice %s: %w", mti, err))
+		}
+	}()
+}
+
+// AdviceAck returns the ack of the advice built by the AdviceAckBuilder or,
+// if it's not set, the response with advice fields copied and MTI from
+// AdviceAckMTIs. It's used by the handler to reply with the ack when
+// DeferAdviceAcks is set.
+func (c *Connection) AdviceAck(advice *iso8583.Message) (*iso8583.Message, error) {
+	mti, err := advice.GetMTI()
+	if err != nil {
+		return nil, fmt.Errorf("getting MTI of advice: %w", err)
+	}
+
+	ackMTI, found := c.options().AdviceAckMTIs[mti]
+	if !found {
+		return nil, fmt.Errorf("no ack MTI for advice %s", mti)
+	}
+
+	if c.options().AdviceAckBuilder != nil {
+		ack := c.options().AdviceAckBuilder(advice)
+		if ack == nil {
+			return nil, fmt.Errorf("building ack of advice %s: builder returned nil", mti)
+		}
+
+		return ack, nil
+	}
+
+	ack, err := iso8583util.NewResponseFrom(advice, adviceAckFields)
+	if err != nil {
+		return nil, fmt.Errorf("building ack of advice %s: %w", mti, err)
+	}
+	ack.MTI(ackMTI)
+
+	return ack, nil
+}
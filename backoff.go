@@ -0,0 +1,81 @@
+package connection
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// StopReconnecting is returned by BackoffPolicy to stop reconnecting
+const StopReconnecting time.Duration = -1
+
+// BackoffPolicy defines how long to wait before the reconnect attempt.
+// Attempts are counted from 1 and lastErr is the error the connection was
+// lost with or the error of the previous attempt. Policy returns
+// StopReconnecting (or any negative duration) to give up.
+type BackoffPolicy interface {
+	Next(attempt int, lastErr error) time.Duration
+}
+
+// ExponentialBackoff multiplies the delay by Multiplier after each attempt
+// starting from Initial up to Max. Delay is randomly changed by Jitter
+// fraction of it, so many clients don't reconnect at the same time.
+type ExponentialBackoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	Jitter     float64
+}
+
+// Next returns the delay before the attempt
+func (b ExponentialBackoff) Next(attempt int, lastErr error) time.Duration {
+	multiplier := b.Multiplier
+	if multiplier == 0 {
+		multiplier = 2
+	}
+
+	delay := float64(b.Initial) * math.Pow(multiplier, float64(attempt-1))
+	if b.Max > 0 && delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+
+	if b.Jitter > 0 {
+		// #nosec G404 -- jitter doesn't need secure random numbers
+		delay += delay * b.Jitter * (2*rand.Float64() - 1)
+	}
+
+	if delay > math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+
+	return time.Duration(delay)
+}
+
+// ConstantBackoff waits the same Interval before each attempt
+type ConstantBackoff struct {
+	Interval time.Duration
+}
+
+// Next returns the delay before the attempt
+func (b ConstantBackoff) Next(attempt int, lastErr error) time.Duration {
+	return b.Interval
+}
+
+// NoRetry doesn't reconnect
+type NoRetry struct{}
+
+// Next returns StopReconnecting
+func (NoRetry) Next(attempt int, lastErr error) time.Duration {
+	return StopReconnecting
+}
+
+// defaultBackoffPolicy is used when AutoReconnect is enabled and
+// BackoffPolicy is not set
+func defaultBackoffPolicy() BackoffPolicy {
+	return ExponentialBackoff{
+		Initial:    time.Second,
+		Max:        time.Minute,
+		Multiplier: 2,
+		Jitter:     0.2,
+	}
+}
@@ -0,0 +1,63 @@
+package connection_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoffPolicy(t *testing.T) {
+	lastErr := errors.New("connection reset")
+
+	t.Run("ExponentialBackoff", func(t *testing.T) {
+		policy := connection.ExponentialBackoff{
+			Initial:    100 * time.Millisecond,
+			Max:        time.Second,
+			Multiplier: 2,
+		}
+
+		expected := []time.Duration{
+			100 * time.Millisecond,
+			200 * time.Millisecond,
+			400 * time.Millisecond,
+			800 * time.Millisecond,
+			time.Second,
+			time.Second,
+		}
+
+		for i, delay := range expected {
+			require.Equal(t, delay, policy.Next(i+1, lastErr), "attempt %d", i+1)
+		}
+
+		// huge attempt numbers don't overflow
+		require.Equal(t, time.Second, policy.Next(10000, lastErr))
+	})
+
+	t.Run("ExponentialBackoff with jitter", func(t *testing.T) {
+		policy := connection.ExponentialBackoff{
+			Initial: time.Second,
+			Jitter:  0.2,
+		}
+
+		for i := 0; i < 100; i++ {
+			delay := policy.Next(2, lastErr)
+			require.GreaterOrEqual(t, delay, 1600*time.Millisecond)
+			require.LessOrEqual(t, delay, 2400*time.Millisecond)
+		}
+	})
+
+	t.Run("ConstantBackoff", func(t *testing.T) {
+		policy := connection.ConstantBackoff{Interval: 5 * time.Second}
+
+		for attempt := 1; attempt < 5; attempt++ {
+			require.Equal(t, 5*time.Second, policy.Next(attempt, lastErr))
+		}
+	})
+
+	t.Run("NoRetry", func(t *testing.T) {
+		require.Equal(t, connection.StopReconnecting, connection.NoRetry{}.Next(1, lastErr))
+	})
+}
@@ -0,0 +1,91 @@
+package connection
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/moov-io/iso8583"
+)
+
+// BatchResult is the outcome of sending one message of the batch
+type BatchResult struct {
+	// Index is the index of the message in the batch
+	Index int
+
+	// Response is the response to the message
+	Response *iso8583.Message
+
+	// Err is the error of sending the message. It's ctx.Err() when the
+	// batch was stopped before the message was sent.
+	Err error
+
+	// Info contains details of the request processing
+	Info SendInfo
+
+	// Duration is the time Send of the message took
+	Duration time.Duration
+}
+
+// SendBatch sends messages with up to concurrency Sends running at the same
+// time and returns their results in the order of messages. Each message is
+// sent like with SendCtx, so the outgoing queue and other limits of Send
+// apply. When ctx is done, messages not sent yet are not sent and their
+// results have ctx.Err(). Concurrency less than 1 means 1.
+func (c *Connection) SendBatch(ctx context.Context, messages []*iso8583.Message, concurrency int) []BatchResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	results := make([]BatchResult, len(messages))
+	for i := range results {
+		results[i].Index = i
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, concurrency)
+
+	// acquire waits for the free slot. It returns false when ctx is done.
+	acquire := func() bool {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return false
+		}
+
+		// both may be ready, so ctx is checked again
+		if ctx.Err() != nil {
+			<-slots
+			return false
+		}
+
+		return true
+	}
+
+	for i, message := range messages {
+		if !acquire() {
+			for j := i; j < len(messages); j++ {
+				results[j].Err = ctx.Err()
+			}
+			break
+		}
+
+		wg.Add(1)
+		go func(result *BatchResult, message *iso8583.Message) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			started := c.options().Clock.Now()
+			resp, info, err := c.send(ctx, message)
+
+			result.Response = resp
+			result.Info = info
+			result.Err = c.wrapError(err)
+			result.Duration = c.options().Clock.Now().Sub(started)
+		}(&results[i], message)
+	}
+
+	wg.Wait()
+
+	return results
+}
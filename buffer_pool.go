@@ -0,0 +1,63 @@
+package connection
+
+import (
+	"bytes"
+	"sync"
+)
+
+// maxPooledBufferSize is the capacity above which buffers are not returned
+// into the pool, so a single large message doesn't keep memory allocated
+const maxPooledBufferSize = 64 * 1024
+
+// bufferPool keeps buffers used to assemble message length header and
+// packed message before they are written into the connection
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// putBuffer returns buffer into the pool. Buffer must not be used after it
+// was returned.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+// framePool keeps buffers inbound frames are read into. Frame is returned
+// into the pool once message was unpacked from it, as fields of the
+// unpacked message don't reference the packed message.
+var framePool = sync.Pool{
+	New: func() interface{} {
+		return new([]byte)
+	},
+}
+
+// getFrame returns buffer of length n from the pool
+func getFrame(n int) *[]byte {
+	frame := framePool.Get().(*[]byte)
+	if cap(*frame) < n {
+		*frame = make([]byte, n)
+	}
+	*frame = (*frame)[:n]
+
+	return frame
+}
+
+// putFrame returns frame into the pool. Frame must not be used after it was
+// returned.
+func putFrame(frame *[]byte) {
+	if cap(*frame) > maxPooledBufferSize {
+		return
+	}
+
+	framePool.Put(frame)
+}
@@ -0,0 +1,43 @@
+package connection
+
+import "time"
+
+// Clock provides current time and timers used by the connection for send
+// timeouts and idle time. It makes it possible to control time in tests.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a single event timer created by Clock
+type Timer interface {
+	// C returns channel the current time is sent on when timer fires
+	C() <-chan time.Time
+
+	// Stop prevents the timer from firing and reports whether it was
+	// stopped before it fired
+	Stop() bool
+}
+
+// realClock is Clock backed by the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return &realTimer{t: time.NewTimer(d)}
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t *realTimer) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t *realTimer) Stop() bool {
+	return t.t.Stop()
+}
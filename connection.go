@@ -3,13 +3,16 @@ package connection
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/moov-io/iso8583"
@@ -18,9 +21,74 @@ import (
 var (
 	ErrConnectionClosed = errors.New("connection closed")
 	ErrSendTimeout      = errors.New("message send timeout")
+	ErrAlreadyConnected = errors.New("already connected")
+	ErrWriteTimeout     = errors.New("message write timeout")
+
+	// ErrOutgoingQueueFull is returned when DropWhenFull is set and
+	// there is no space for the message in the outgoing queue
+	ErrOutgoingQueueFull = errors.New("outgoing queue is full")
+
+	// ErrReconnectExhausted is returned by Send and Reply when connection
+	// gave up reconnecting after MaxReconnectAttempts
+	ErrReconnectExhausted = errors.New("reconnect attempts exhausted")
+
+	// ErrMessageExpired is returned by Send and Reply and passed to
+	// DeadLetterHandler when message waited in the outgoing queue longer
+	// than its TTL
+	ErrMessageExpired = errors.New("message expired in outgoing queue")
+
+	// ErrSTANExhausted is returned by Send when auto-STAN is enabled and
+	// all STANs are used by the pending requests
+	ErrSTANExhausted = errors.New("all STANs are in flight")
+
+	// ErrTLSUpgradeNotAllowed is returned when connection can't be
+	// upgraded to TLS, e.g. it's not created with TLSUpgrade or
+	// AcceptTLSUpgrade option or it's upgraded already
+	ErrTLSUpgradeNotAllowed = errors.New("TLS upgrade is not allowed")
+
+	// ErrTLSUpgradePendingRequests is returned when connection has pending
+	// requests when it's upgraded to TLS
+	ErrTLSUpgradePendingRequests = errors.New("TLS upgrade with pending requests")
+
+	// ErrResponseDeclined is returned by validator of ApproveOnDE39 when
+	// response code is not one of the approval codes
+	ErrResponseDeclined = errors.New("response declined")
+
+	// ErrSessionExists is returned by Session when session with the ID
+	// is open
+	ErrSessionExists = errors.New("session already exists")
+
+	// ErrSessionClosed is returned by Send of the closed session and by
+	// its Sends that were pending when session was closed
+	ErrSessionClosed = errors.New("session closed")
+
+	// ErrSessionPendingLimit is returned by Send of the session which has
+	// SessionMaxPending pending requests
+	ErrSessionPendingLimit = errors.New("session pending requests limit reached")
+
+	// ErrMultiRequestPending is returned by SendMulti when request with
+	// the same request ID is waiting for its responses
+	ErrMultiRequestPending = errors.New("request with the same ID is waiting for responses")
+
+	// ErrNotSignedOn is returned by Send when RequireSignOn is set and
+	// message is not allowed before the connection is signed on
+	ErrNotSignedOn = errors.New("not signed on")
+
+	// ErrMessageTooLong is returned, wrapped into MessageTooLongError, by
+	// Send and Reply when the packed message is longer than the length
+	// header can encode
+	ErrMessageTooLong = errors.New("message too long")
+
+	// ErrFrameIntegrity is matched by FrameIntegrityError reported when
+	// checksum of the inbound frame doesn't match its body
+	ErrFrameIntegrity = errors.New("frame integrity check failed")
+
+	// ErrExpvarPrefixTaken is returned by New and Connect when counters
+	// of another connection are published with the same ExpvarPrefix
+	ErrExpvarPrefixTaken = errors.New("expvar prefix is used by another connection")
 )
 
-const DefaultTransmissionDateTimeFormat string = "0102150405" // YYMMDDhhmmss
+const DefaultTransmissionDateTimeFormat string = "0102150405" // MMDDhhmmss
 
 // MessageLengthReader reads message header from the r and returns message length
 type MessageLengthReader func(r io.Reader) (int, error)
@@ -31,13 +99,43 @@ type MessageLengthWriter func(w io.Writer, length int) (int, error)
 // Connection represents an ISO 8583 Connection. Connection may be used
 // by multiple goroutines simultaneously.
 type Connection struct {
-	addr       string
-	Opts       Options
+	// number of auto-STAN values skipped because they were pending,
+	// number of inbound messages with invalid MAC, numbers of late,
+	// unmatched, dropped, all received and not unpacked inbound messages,
+	// numbers of written messages, timed out requests, reconnects,
+	// deduplicated Sends, correlation ID mismatches and frames which
+	// failed the integrity check, depth of the inbound queue and time (in
+	// nanoseconds) when the last inbound message was received. They are
+	// updated atomically and kept first to be 64-bit aligned.
+	stanSkips               uint64
+	macVerificationFailures uint64
+	lateResponses           uint64
+	unmatchedResponses      uint64
+	inboundDropped          uint64
+	messagesReceived        uint64
+	messagesSent            uint64
+	sendTimeouts            uint64
+	reconnects              uint64
+	deduplicatedSends       uint64
+	correlationIDMismatches uint64
+	unpackErrors            uint64
+	frameIntegrityFailures  uint64
+	inboundQueueDepth       int64
+	lastReceived            int64
+
+	addr string
+
+	// Opts are the options of the connection. They are read by the
+	// connection as set by New and SetOptions, so direct changes of
+	// them have no effect.
+	Opts Options
+
 	conn       io.ReadWriteCloser
 	requestsCh chan request
 	done       chan struct{}
 
-	// spec that will be used to unpack received messages
+	// spec that will be used to unpack received messages unless
+	// InboundSpec option is set
 	spec *iso8583.MessageSpec
 
 	// readMessageLength is the function that reads message length header
@@ -48,17 +146,111 @@ type Connection struct {
 	// writes message length header into the connection
 	writeMessageLength MessageLengthWriter
 
-	pendingRequestsMu sync.Mutex
-	respMap           map[string]response
+	// requests waiting for the reply
+	pendingRequests *pendingRequests
+
+	// timer wheel to time out pending requests
+	timeouts *timerWheel
+
+	// inbound messages to reuse when MessagePool option is set
+	messages sync.Pool
+
+	// TPDUs of the messages passed to InboundMessageHandler
+	inboundTPDUs sync.Map
+
+	// original messages of timed out requests that were reversed, keyed
+	// by request ID, to detect their late responses
+	reversed sync.Map
+
+	// requests of SendMulti waiting for their responses
+	multiRequests *multiRequests
+
+	// timed out requests waiting for the late response during
+	// LateResponseGrace
+	lateRequests *lateRequests
+
+	// read loops and inbound handlers that are running
+	readers sync.WaitGroup
+
+	// TTLs of the messages set with SetMessageTTL
+	messageTTLs sync.Map
+
+	// Sends with idempotency keys
+	idempotentSends *idempotencyCache
+
+	// messages passed to SkipValidation
+	skipValidation sync.Map
+
+	// contexts of SendCtx calls by their messages
+	requestContexts *requestContexts
+
+	// open sessions by their IDs and their number
+	sessions     sync.Map
+	openSessions int32
+
+	// messages waiting to be rendered to TraceWriter
+	traces *tracer
+
+	// set to 1 when outgoing queue depth reaches high watermark and back
+	// to 0 when it goes below it
+	highWatermarkReached int32
+
+	// SignOnState of the connection, accessed atomically
+	signOnState int32
+
+	// set to 1 by Drain until connection is signed on or reconnected
+	draining int32
+
+	// business date set by the cutover message from the host
+	businessDate atomic.Value
+
+	// prefix the counters are published under, guarded by expvarMu
+	expvarPrefix string
+
+	// *Options read by the connection, replaced by SetOptions, so Opts
+	// can be changed while connection is used
+	current atomic.Value
 
 	// WaitGroup to wait for all Send calls to finish
 	wg sync.WaitGroup
 
-	// to protect following: closing, STAN
+	// WaitGroup to wait for Send calls that use the current network
+	// connection, so it can be closed after migration to other address
+	inflight *sync.WaitGroup
+
+	// WaitGroup to wait for read and write loops of the connection
+	// established with Connect, so Close returns when they exited
+	loops *sync.WaitGroup
+
+	// to protect following: Opts, addr, conn, requestsCh, done, inflight, loops,
+	// closing, closed, closeErr, connectedAt, reconnecting, reconnectAttempts,
+	// reconnectExhausted
 	mutex sync.Mutex
 
+	// migrateMu serializes SetAddr calls, as they dial without mutex
+	migrateMu sync.Mutex
+
 	// user has called Close
 	closing bool
+
+	// closed when the connection that is closed without the mutex is
+	// closed, nil when no connection is being closed
+	closed chan struct{}
+
+	// error the connection was closed because of
+	closeErr error
+
+	// time when the connection was established with Connect
+	connectedAt time.Time
+
+	// closed to stop the reconnect loop, nil when loop is not running
+	reconnecting chan struct{}
+
+	// number of reconnect attempts since the connection was stable
+	reconnectAttempts int
+
+	// reconnect loop gave up after MaxReconnectAttempts
+	reconnectExhausted bool
 }
 
 // New creates and configures Connection. To establish network connection, call `Connect()`.
@@ -70,16 +262,36 @@ func New(addr string, spec *iso8583.MessageSpec, mlReader MessageLengthReader, m
 		}
 	}
 
-	return &Connection{
+	timeouts := newTimerWheel(opts.Clock)
+
+	c := &Connection{
 		addr:               addr,
 		Opts:               opts,
-		requestsCh:         make(chan request),
+		requestsCh:         make(chan request, opts.OutgoingQueueSize),
 		done:               make(chan struct{}),
-		respMap:            make(map[string]response),
+		inflight:           &sync.WaitGroup{},
+		loops:              &sync.WaitGroup{},
+		pendingRequests:    newPendingRequests(opts.PendingRequestsShards),
+		timeouts:           timeouts,
+		multiRequests:      newMultiRequests(timeouts),
+		lateRequests:       newLateRequests(),
+		idempotentSends:    newIdempotencyCache(),
+		requestContexts:    newRequestContexts(),
+		traces:             &tracer{},
 		spec:               spec,
 		readMessageLength:  mlReader,
 		writeMessageLength: mlWriter,
-	}, nil
+	}
+
+	c.current.Store(&opts)
+
+	if opts.ExpvarPrefix != "" {
+		if err := c.publishExpvar(); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
 }
 
 // NewFrom accepts conn (net.Conn, or any io.ReadWriteCloser) which will be
@@ -90,81 +302,297 @@ func NewFrom(conn io.ReadWriteCloser, spec *iso8583.MessageSpec, mlReader Messag
 	if err != nil {
 		return nil, fmt.Errorf("creating client: %w", err)
 	}
+	if err := c.configureConn(conn); err != nil {
+		return nil, fmt.Errorf("configuring connection: %w", err)
+	}
+
+	conn, err = c.wrapTransport(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	// TLS handshake is accepted on the same connection later
+	if netConn, ok := conn.(net.Conn); ok && c.options().AcceptTLSUpgradeConfig != nil {
+		conn = newUpgradableConn(netConn, "")
+	}
 	c.conn = conn
 	c.run()
 	return c, nil
 }
 
-// SetOptions sets connection options
+// SetOptions sets connection options. It's safe to call it while
+// connection is used: Send calls and read and write loops see either all
+// options or none of them. Options are not changed if any of them fails.
 func (c *Connection) SetOptions(options ...Option) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	opts := c.Opts
 	for _, opt := range options {
-		if err := opt(&c.Opts); err != nil {
+		if err := opt(&opts); err != nil {
 			return fmt.Errorf("setting client option: %v %w", opt, err)
 		}
 	}
 
+	c.Opts = opts
+	c.current.Store(&opts)
+
 	return nil
 }
 
-// Connect establishes the connection to the server using configured Addr
+// options returns the options set by New and SetOptions
+func (c *Connection) options() *Options {
+	return c.current.Load().(*Options)
+}
+
+// Options returns the copy of the options set by New and SetOptions. Unlike
+// Opts, it can be read while SetOptions is called concurrently.
+func (c *Connection) Options() Options {
+	return *c.options()
+}
+
+// Connect establishes the connection to the server using configured Addr.
+// It returns ErrAlreadyConnected if connection is already established. After
+// Close, Connect establishes a new connection.
 func (c *Connection) Connect() error {
-	var conn net.Conn
-	var err error
+	// counters unpublished by Close are published again
+	if c.options().ExpvarPrefix != "" {
+		if err := c.publishExpvar(); err != nil {
+			return err
+		}
+	}
 
-	if c.conn != nil {
-		c.run()
-		return nil
+	c.mutex.Lock()
+
+	// explicit Connect takes over from the reconnect loop
+	c.stopReconnecting()
+	c.reconnectExhausted = false
+
+	err := c.connect()
+	conn := c.conn
+	c.mutex.Unlock()
+
+	if err != nil {
+		return c.wrapError(err)
 	}
 
-	if c.Opts.TLSConfig != nil {
-		conn, err = tls.Dial("tcp", c.addr, c.Opts.TLSConfig)
-	} else {
-		conn, err = net.Dial("tcp", c.addr)
+	// hello is sent with the connection running, so without the lock
+	if err := c.helloAndUpgrade(conn); err != nil {
+		return c.wrapError(err)
 	}
 
+	c.connectionEstablished()
+
+	return nil
+}
+
+// connectionEstablished calls ConnectionEstablishedHandler
+func (c *Connection) connectionEstablished() {
+	if c.options().ConnectionEstablishedHandler != nil {
+		go c.options().ConnectionEstablishedHandler(c)
+	}
+}
+
+// connect establishes the connection. It should be called with mutex held.
+func (c *Connection) connect() error {
+	c.waitClosed()
+
+	if c.conn != nil && !c.closing {
+		return ErrAlreadyConnected
+	}
+
+	conn, err := c.dial(c.addr)
 	if err != nil {
-		return fmt.Errorf("connecting to server %s: %w", c.addr, err)
+		return c.connectError(c.addr, err)
 	}
 
+	c.establish(conn)
+
+	return nil
+}
+
+// waitClosed waits for the connection that is being closed to be closed, so
+// the new one doesn't replace it meanwhile. It should be called with mutex
+// held, which is released while waiting.
+func (c *Connection) waitClosed() {
+	for c.closed != nil {
+		closed := c.closed
+		c.mutex.Unlock()
+		<-closed
+		c.mutex.Lock()
+	}
+}
+
+// beginClose marks the connection as closing and returns the channel that
+// is closed by endClose. It should be called with mutex held.
+func (c *Connection) beginClose() chan struct{} {
+	c.closing = true
+	c.closed = make(chan struct{})
+
+	return c.closed
+}
+
+// endClose is called when the connection that was marked as closing by
+// beginClose is closed
+func (c *Connection) endClose(closed chan struct{}) {
+	c.mutex.Lock()
+	if c.closed == closed {
+		c.closed = nil
+	}
+	c.mutex.Unlock()
+
+	close(closed)
+}
+
+// connectError returns the error of connecting to the server at addr or
+// to the SRV service when it's set
+func (c *Connection) connectError(addr string, err error) error {
+	if c.options().SRV != nil {
+		addr = c.options().SRV.String()
+	}
+
+	return fmt.Errorf("connecting to server %s: %w", addr, err)
+}
+
+// establish makes conn the connection of the client, resets the state of
+// the previous connection and starts read and write loops. It should be
+// called with mutex held.
+func (c *Connection) establish(conn net.Conn) {
+	c.closing = false
+	c.loops = &sync.WaitGroup{}
+	c.closeErr = nil
+
+	c.switchConn(conn)
+}
+
+// switchConn makes conn the connection Send and Reply use, resets the
+// state of the session with the server and starts read and write loops of
+// conn. It should be called with mutex held.
+func (c *Connection) switchConn(conn net.Conn) {
 	c.conn = conn
+	c.done = make(chan struct{})
+	c.requestsCh = make(chan request, c.options().OutgoingQueueSize)
+	c.inflight = &sync.WaitGroup{}
+	c.connectedAt = c.options().Clock.Now()
+	atomic.StoreInt32(&c.highWatermarkReached, 0)
+	atomic.StoreInt32(&c.draining, 0)
+	c.setSignOnState(SignedOff)
 
 	c.run()
+}
+
+// dial establishes TCP connection with the server, configures it and
+// performs TLS handshake if TLSConfig is set, and wraps it with WrapConn.
+// Host of the server is resolved on each call, so DNS changes are picked
+// up on reconnect.
+func (c *Connection) dial(addr string) (net.Conn, error) {
+	conn, host, err := c.dialResolved(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.configureConn(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// TLS is established after the hello exchange
+	if c.options().TLSUpgrade != nil {
+		// wrapping layer can't stay below TLS switched on later
+		if c.options().WrapConn != nil {
+			conn.Close()
+			return nil, fmt.Errorf("wrapping connection with TLS upgrade: %w", ErrTLSUpgradeNotAllowed)
+		}
+
+		return newUpgradableConn(conn, host), nil
+	}
+
+	if c.options().TLSConfig == nil {
+		return c.wrapConn(conn)
+	}
+
+	tlsConfig := c.options().TLSConfig
+	if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+
+	ctx, cancel := c.dialContext()
+	defer cancel()
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c.wrapConn(tlsConn)
+}
+
+// configureConn applies TCP options to the conn. It does nothing if conn is
+// not a TCP connection.
+func (c *Connection) configureConn(conn io.ReadWriteCloser) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	if err := tcpConn.SetNoDelay(c.options().TCPNoDelay); err != nil {
+		return fmt.Errorf("setting TCP_NODELAY: %w", err)
+	}
 
 	return nil
 }
 
-// run starts read and write loops in goroutines
+// run starts read and write loops in goroutines. It should be called with
+// mutex held or before connection is shared.
 func (c *Connection) run() {
-	go c.writeLoop()
-	go c.readLoop()
+	// new connection is healthy until it's idle for PingWindow
+	atomic.StoreInt64(&c.lastReceived, c.options().Clock.Now().UnixNano())
+
+	conn, requestsCh, done, loops := c.conn, c.requestsCh, c.done, c.loops
+	loops.Add(2)
+
+	go func() {
+		defer loops.Done()
+		c.writeLoop(conn, requestsCh, done)
+	}()
+
+	c.readers.Add(1)
+	go func() {
+		defer loops.Done()
+		c.readLoop(conn, done)
+	}()
 }
 
-func (c *Connection) handleConnectionError(err error) {
-	// lock to check and update `closing`
+// handleConnectionError closes the connection if err happened on the conn
+// that is currently used. Errors from connections that were already
+// replaced by Connect are ignored.
+func (c *Connection) handleConnectionError(conn io.ReadWriteCloser, err error) {
 	c.mutex.Lock()
-	if err == nil || c.closing {
+	if err == nil || c.closing || c.conn != conn {
 		c.mutex.Unlock()
 		return
 	}
 
-	c.closing = true
-	c.mutex.Unlock()
+	closed := c.beginClose()
+	c.closeErr = err
 
 	// channel to wait for all goroutines to exit
 	done := make(chan bool)
 
-	c.pendingRequestsMu.Lock()
-	for _, resp := range c.respMap {
+	for _, resp := range c.pendingRequests.removeAll() {
 		resp.errCh <- ErrConnectionClosed
 	}
-	c.pendingRequestsMu.Unlock()
 
 	// return error to all Send methods
+	requestsCh := c.requestsCh
 	go func() {
 		for {
 			select {
-			case req := <-c.requestsCh:
-				req.errCh <- ErrConnectionClosed
+			case req := <-requestsCh:
+				c.dropRequest(req)
+				c.failRequest(req, ErrConnectionClosed)
 			case <-done:
 				return
 			}
@@ -177,22 +605,38 @@ func (c *Connection) handleConnectionError(err error) {
 		done <- true
 	}()
 
+	connDone := c.done
+
+	// connections created with NewFrom can't be reconnected
+	if c.options().AutoReconnect && (c.addr != "" || c.options().SRV != nil) {
+		c.startReconnecting(err, closed)
+	}
+	c.mutex.Unlock()
+
 	// close everything else we close normally
-	c.close()
+	c.close(conn, connDone)
+	c.endClose(closed)
 
-	if c.Opts.ConnectionClosedHandler != nil {
-		go c.Opts.ConnectionClosedHandler(c)
+	if c.options().ConnectionClosedHandler != nil {
+		go c.options().ConnectionClosedHandler(c)
 	}
 }
 
-func (c *Connection) close() error {
+// close waits for pending requests and closes conn and its done channel.
+// It's called without mutex, so Status, Stats and Send don't wait for the
+// pending requests, with conn and done taken while it was held.
+func (c *Connection) close(conn io.ReadWriteCloser, done chan struct{}) error {
 	// wait for all requests to complete before closing the connection
 	c.wg.Wait()
 
-	close(c.done)
+	close(done)
 
-	if c.conn != nil {
-		err := c.conn.Close()
+	// reset pending requests so connection can be established again
+	c.pendingRequests.removeAll()
+	c.multiRequests.finishAll()
+
+	if conn != nil {
+		err := conn.Close()
 		if err != nil {
 			return fmt.Errorf("closing connection: %w", err)
 		}
@@ -201,29 +645,137 @@ func (c *Connection) close() error {
 	return nil
 }
 
+// Err returns the error the connection was closed because of, e.g. the
+// network error or io.EOF when peer closed the connection. It returns nil
+// if connection is open or it was closed with Close.
+func (c *Connection) Err() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.closeErr
+}
+
+// WaitInbound waits for the read loops of the closed connection to exit
+// and for the inbound handlers they started to return. It must not be
+// called from the inbound handler.
+func (c *Connection) WaitInbound() {
+	c.readers.Wait()
+}
+
 // Close waits for pending requests to complete and then closes network
-// connection with ISO 8583 server
+// connection with ISO 8583 server. It returns when read and write loops of
+// the connection exited, so it must not be called from the handlers that
+// are run by them synchronously.
 func (c *Connection) Close() error {
+	c.unpublishExpvar()
+
 	c.mutex.Lock()
+
+	c.stopReconnecting()
+	c.reconnectExhausted = false
+
+	// loops exit when connection is closed, but they need the mutex
+	// to report the error, so we wait for them after it's unlocked
+	loops := c.loops
+	defer loops.Wait()
+
 	// if we are closing already, just return
 	if c.closing {
 		c.mutex.Unlock()
 		return nil
 	}
-	c.closing = true
+	closed := c.beginClose()
+	conn, done := c.conn, c.done
 	c.mutex.Unlock()
 
-	return c.close()
+	err := c.close(conn, done)
+	c.endClose(closed)
+
+	return c.wrapError(err)
 }
 
+// Done returns channel that is closed when the current connection is closed
 func (c *Connection) Done() <-chan struct{} {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	return c.done
 }
 
+// currentConn returns the network connection or nil when connection is not
+// established or closed
+func (c *Connection) currentConn() io.ReadWriteCloser {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closing {
+		return nil
+	}
+
+	return c.conn
+}
+
+// LocalAddr returns the local network address of the connection. It
+// returns nil when connection is not established or it's not a network
+// connection.
+func (c *Connection) LocalAddr() net.Addr {
+	if conn, ok := c.currentConn().(interface{ LocalAddr() net.Addr }); ok {
+		return conn.LocalAddr()
+	}
+
+	return nil
+}
+
+// RemoteAddr returns the remote network address of the connection. It
+// returns nil when connection is not established or it's not a network
+// connection.
+func (c *Connection) RemoteAddr() net.Addr {
+	if conn, ok := c.currentConn().(interface{ RemoteAddr() net.Addr }); ok {
+		return conn.RemoteAddr()
+	}
+
+	return nil
+}
+
+// PeerCertificates returns the certificates presented by the peer of the
+// TLS connection, leaf certificate first, e.g. the verified client
+// certificate on the server side of mTLS connection. It returns nil when
+// connection is not established, it's not a TLS connection or peer didn't
+// present certificates.
+func (c *Connection) PeerCertificates() []*x509.Certificate {
+	state, ok := c.TLSConnectionState()
+	if !ok {
+		return nil
+	}
+
+	return state.PeerCertificates
+}
+
+// TLSConnectionState returns the state of the TLS connection, e.g. the
+// negotiated version and the server certificates. It returns false when
+// connection is not established or it's not a TLS connection.
+func (c *Connection) TLSConnectionState() (tls.ConnectionState, bool) {
+	if conn, ok := tlsConn(c.currentConn()); ok {
+		return conn.ConnectionState(), true
+	}
+
+	return tls.ConnectionState{}, false
+}
+
 // request represents request to the ISO 8583 server
 type request struct {
-	// includes length header and message itself
-	rawMessage []byte
+	// context of the SendCtx call
+	ctx context.Context
+
+	// includes length header and message itself. Buffer is owned by
+	// the write loop once request is queued.
+	rawMessage *bytes.Buffer
+
+	// message to be packed by the write loop when rawMessage is nil
+	late *lateMessage
+
+	// message passed to DeadLetterHandler if it's never written
+	message *iso8583.Message
 
 	// ID of the request (based on STAN, RRN, etc.)
 	requestID string
@@ -233,217 +785,687 @@ type request struct {
 
 	// channel to receive error that may happen down the road
 	errCh chan error
+
+	// timestamps of the request processing
+	timing *requestTiming
+
+	// generation of the pending request replyCh, errCh and timing
+	// belong to
+	gen uint64
+
+	// time after which request is not written, zero if it doesn't
+	// expire
+	expiresAt time.Time
 }
 
 type response struct {
+	// request message or nil when message sent with SendMessage is not
+	// *iso8583.Message
+	message *iso8583.Message
+
 	// channel to receive reply from the server
 	replyCh chan *iso8583.Message
 
 	// channel to receive error that may happen down the road
 	errCh chan error
+
+	// timestamps of the request processing
+	timing *requestTiming
+
+	// generation of the pending request replyCh, errCh and timing
+	// belong to
+	gen uint64
 }
 
-// Send sends message and waits for the response
-func (c *Connection) Send(message *iso8583.Message) (*iso8583.Message, error) {
-	c.wg.Add(1)
-	defer c.wg.Done()
+// requestTiming keeps timestamps of the request processing. They are set by
+// the write and read loops.
+type requestTiming struct {
+	mu           sync.Mutex
+	queued       time.Time
+	writeStarted time.Time
+	written      time.Time
+	received     time.Time
+	tpdu         *TPDUHeader
+
+	// returned is set when Send returned, so the message which write was
+	// not started is not written
+	returned bool
+
+	// gen is incremented when timing is reused by another Send
+	gen uint64
+}
+
+// reuse resets timing for the next Send and returns its generation
+func (t *requestTiming) reuse() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.queued = time.Time{}
+	t.writeStarted = time.Time{}
+	t.written = time.Time{}
+	t.received = time.Time{}
+	t.tpdu = nil
+	t.returned = false
+	t.gen++
+
+	return t.gen
+}
+
+func (t *requestTiming) setQueued(queued time.Time) {
+	t.mu.Lock()
+	t.queued = queued
+	t.mu.Unlock()
+}
+
+// startWrite sets the time write started and reports whether message
+// should be written, i.e. Send of generation gen has not returned yet
+func (t *requestTiming) startWrite(gen uint64, writeStarted time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.returned || t.gen != gen {
+		return false
+	}
+	t.writeStarted = writeStarted
+
+	return true
+}
+
+func (t *requestTiming) setWritten(gen uint64, written time.Time) {
+	t.mu.Lock()
+	if t.gen == gen {
+		t.written = written
+	}
+	t.mu.Unlock()
+}
+
+func (t *requestTiming) setReceived(received time.Time, tpdu *TPDUHeader) {
+	t.mu.Lock()
+	t.received = received
+	t.tpdu = tpdu
+	t.mu.Unlock()
+}
+
+// SendInfo contains details of the request processing
+type SendInfo struct {
+	// RequestID is the ID used to match the reply with the request
+	RequestID string
+
+	// QueueWait is the time message waited in the outgoing queue
+	QueueWait time.Duration
+
+	// WriteDuration is the time it took to write message into the
+	// connection
+	WriteDuration time.Duration
+
+	// ResponseWait is the time from the moment message was written till
+	// the reply was received
+	ResponseWait time.Duration
+
+	// TPDU is the TPDU header of the response when TPDU option is set
+	TPDU *TPDUHeader
+
+	// Written reports whether writing message into the connection was
+	// started, so message may have reached the server. When it's false,
+	// message is not written after Send returns and it's safe to send
+	// it again, e.g. over another connection.
+	Written bool
+}
+
+// finish marks that Send returned and returns details of the request
+func (t *requestTiming) finish(reqID string) SendInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.returned = true
+
+	info := SendInfo{
+		RequestID: reqID,
+		TPDU:      t.tpdu,
+		Written:   !t.writeStarted.IsZero(),
+	}
+
+	if !t.writeStarted.IsZero() {
+		info.QueueWait = t.writeStarted.Sub(t.queued)
+	}
+
+	if !t.written.IsZero() {
+		info.WriteDuration = t.written.Sub(t.writeStarted)
+	}
+
+	if !t.received.IsZero() {
+		info.ResponseWait = t.received.Sub(t.written)
+	}
+
+	return info
+}
+
+// Send sends message and waits for the response. It returns
+// ErrConnectionClosed when connection is not established or it's closed.
+func (c *Connection) Send(message *iso8583.Message, opts ...SendOption) (*iso8583.Message, error) {
+	resp, _, err := c.SendWithInfo(message, opts...)
+
+	return resp, err
+}
+
+// SendWithInfo sends message and waits for the response. In addition to
+// the response it returns time spent by the message in the outgoing queue,
+// writing it into the connection and waiting for the response.
+func (c *Connection) SendWithInfo(message *iso8583.Message, opts ...SendOption) (*iso8583.Message, SendInfo, error) {
+	resp, info, err := c.send(context.Background(), message, opts...)
+
+	return resp, info, c.wrapError(err)
+}
+
+// send sends message with the context and send options
+func (c *Connection) send(ctx context.Context, message *iso8583.Message, opts ...SendOption) (*iso8583.Message, SendInfo, error) {
+	var o sendOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.idempotencyKey != "" {
+		return c.sendIdempotent(ctx, message, o.idempotencyKey)
+	}
+
+	return c.sendWithInfo(ctx, message)
+}
+
+func (c *Connection) sendWithInfo(ctx context.Context, m Message) (*iso8583.Message, SendInfo, error) {
+	// options which modify the message or keep it after Send returns
+	// apply to *iso8583.Message only
+	message, isMessage := m.(*iso8583.Message)
+
+	ttl := c.options().QueuedMessageTTL
+	if isMessage {
+		ttl = c.messageTTL(message)
+	}
+
+	if err := c.checkRequest(m); err != nil {
+		return nil, SendInfo{}, err
+	}
+
+	if isMessage {
+		defer c.requestContexts.acquire(ctx, message)()
+	}
 
 	c.mutex.Lock()
-	if c.closing {
+	// messages sent before Connect would wait for the send timeout
+	if c.closing || c.conn == nil {
+		err := c.closedError()
 		c.mutex.Unlock()
-		return nil, ErrConnectionClosed
+		return nil, SendInfo{}, err
 	}
+	c.wg.Add(1)
+	requestsCh := c.requestsCh
+	inflight := c.inflight
+	inflight.Add(1)
 	c.mutex.Unlock()
+	defer c.wg.Done()
+	defer inflight.Done()
+	defer c.scrubFields(message)
 
-	var buf bytes.Buffer
-	packed, err := message.Pack()
-	if err != nil {
-		return nil, fmt.Errorf("packing message: %w", err)
+	if isMessage {
+		if err := c.setRequestFields(ctx, message); err != nil {
+			return nil, SendInfo{}, err
+		}
 	}
 
-	// create header
-	_, err = c.writeMessageLength(&buf, len(packed))
-	if err != nil {
-		return nil, fmt.Errorf("writing message header to buffer: %w", err)
+	var buf *bytes.Buffer
+	var late *lateMessage
+	var err error
+	if isMessage {
+		buf, late, err = c.prepareMessage(message)
+	} else {
+		buf, err = c.packInterface(m)
 	}
-
-	_, err = buf.Write(packed)
 	if err != nil {
-		return nil, fmt.Errorf("writing packed message to buffer: %w", err)
+		return nil, SendInfo{}, err
+	}
+	if late != nil {
+		defer late.abandon()
 	}
 
 	// prepare request
-	reqID, err := requestID(message)
+	reqID, err := c.requestID(m)
 	if err != nil {
-		return nil, fmt.Errorf("creating request ID: %w", err)
+		if buf != nil {
+			c.releaseBuffer(buf)
+		}
+		return nil, SendInfo{}, fmt.Errorf("creating request ID: %w", err)
 	}
 
+	// pending request is returned into the pool only when the reply or
+	// error delivered to it was received
+	pending, gen := getPendingRequest()
+
 	req := request{
-		rawMessage: buf.Bytes(),
+		ctx:        ctx,
+		rawMessage: buf,
+		late:       late,
+		message:    message,
 		requestID:  reqID,
-		replyCh:    make(chan *iso8583.Message),
-		errCh:      make(chan error),
+		replyCh:    pending.replyCh,
+		errCh:      pending.errCh,
+		timing:     &pending.timing,
+		gen:        gen,
 	}
 
 	var resp *iso8583.Message
 
-	c.requestsCh <- req
+	// register request before it's written so reply can't arrive before
+	// we wait for it
+	c.pendingRequests.add(req.requestID, response{
+		message: message,
+		replyCh: req.replyCh,
+		errCh:   req.errCh,
+		timing:  req.timing,
+		gen:     gen,
+	})
+
+	// if request is still pending when timer fires, we remove it, so reply
+	// received after the timeout will be handled by InboundMessageHandler
+	timer := c.timeouts.afterFunc(c.options().SendTimeout, func() {
+		if c.pendingRequests.removeRequest(req.requestID, req.errCh, req.gen) {
+			req.errCh <- ErrSendTimeout
+		}
+	})
+	defer c.timeouts.stop(timer)
+
+	queuedAt := c.options().Clock.Now()
+	req.timing.setQueued(queuedAt)
+	req.expiresAt = expiresAt(queuedAt, ttl)
+
+	select {
+	case requestsCh <- req:
+	default:
+		if c.options().DropWhenFull {
+			info := req.timing.finish(reqID)
+			// when request was removed already, the error is
+			// delivered to it and it can't be reused
+			if c.pendingRequests.removeRequest(req.requestID, req.errCh, req.gen) {
+				putPendingRequest(pending)
+			}
+			return nil, info, ErrOutgoingQueueFull
+		}
+
+		// wait for the space in the queue, send timeout, connection
+		// closure or cancellation
+		select {
+		case requestsCh <- req:
+		case err = <-req.errCh:
+			info := req.timing.finish(reqID)
+			putPendingRequest(pending)
+			return nil, info, err
+		case <-ctx.Done():
+			return nil, c.cancelRequest(req, pending), ctx.Err()
+		}
+	}
+	c.checkHighWatermark(requestsCh)
 
 	select {
 	case resp = <-req.replyCh:
+		if c.options().CorrelationIDGenerator != nil && isMessage {
+			c.checkCorrelationID(message, resp)
+		}
+		if c.options().ResponseValidator != nil {
+			release := c.requestContexts.acquire(ctx, resp)
+			err = c.validateResponse(message, resp)
+			release()
+		}
+		if err == nil && isMessage {
+			c.detectSignOn(message, resp)
+		}
 	case err = <-req.errCh:
-	case <-time.After(c.Opts.SendTimeout):
-		err = ErrSendTimeout
-		// reply can still be sent after SendTimeout received.
-		// if we have UnmatchedMessageHandler set, then we want reply
-		// to not be lost but handled by it.
-		if c.Opts.InboundMessageHandler != nil {
-			go func() {
-				select {
-				case resp := <-req.replyCh:
-					go c.Opts.InboundMessageHandler(c, resp)
-				case <-time.After(1 * time.Second):
-					// if no reply received within 1 second
-					// we return from the goroutine
-					return
-				}
-			}()
+		if errors.Is(err, ErrSendTimeout) {
+			atomic.AddUint64(&c.sendTimeouts, 1)
+			if isMessage {
+				c.handleTimeout(ctx, message, reqID)
+			}
 		}
+	case <-ctx.Done():
+		return nil, c.cancelRequest(req, pending), ctx.Err()
 	}
 
-	c.pendingRequestsMu.Lock()
-	delete(c.respMap, req.requestID)
-	c.pendingRequestsMu.Unlock()
+	info := req.timing.finish(reqID)
+	putPendingRequest(pending)
 
-	return resp, err
+	return resp, info, err
+}
+
+// checkRequest checks that the message can be sent as the request
+func (c *Connection) checkRequest(m Message) error {
+	if err := c.validateRequiredFields(m); err != nil {
+		return err
+	}
+
+	return c.checkSignedOn(m)
+}
+
+// setRequestFields sets STAN and correlation ID of the message sent as the
+// request with ctx
+func (c *Connection) setRequestFields(ctx context.Context, message *iso8583.Message) error {
+	if c.options().STANProvider != nil {
+		if err := c.setSTAN(message); err != nil {
+			return err
+		}
+	}
+
+	if c.options().CorrelationIDGenerator != nil {
+		if err := c.setCorrelationID(ctx, message); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// cancelRequest removes the request which context is done and returns its
+// details. Pending request is reused only if reply or error was not
+// delivered to it.
+func (c *Connection) cancelRequest(req request, pending *pendingRequest) SendInfo {
+	info := req.timing.finish(req.requestID)
+	if c.pendingRequests.removeRequest(req.requestID, req.errCh, req.gen) {
+		putPendingRequest(pending)
+	}
+
+	return info
+}
+
+// checkHighWatermark calls OutgoingQueueHighWatermarkHandler when depth of
+// the outgoing queue reaches the high watermark
+func (c *Connection) checkHighWatermark(requestsCh chan request) {
+	if c.options().OutgoingQueueHighWatermarkHandler == nil {
+		return
+	}
+
+	depth := len(requestsCh)
+	if depth < c.options().OutgoingQueueHighWatermark {
+		return
+	}
+
+	if atomic.CompareAndSwapInt32(&c.highWatermarkReached, 0, 1) {
+		go c.options().OutgoingQueueHighWatermarkHandler(c, depth)
+	}
+}
+
+// PendingRequests returns the number of requests waiting for the reply
+func (c *Connection) PendingRequests() int {
+	return c.pendingRequests.len()
 }
 
 // Reply sends the message and does not wait for a reply to be received
 // any reaply received for message send using Reply will be handled with
 // unmatchedMessageHandler
 func (c *Connection) Reply(message *iso8583.Message) error {
-	c.wg.Add(1)
-	defer c.wg.Done()
+	return c.wrapError(c.reply(message))
+}
+
+func (c *Connection) reply(message *iso8583.Message) error {
+	ttl := c.messageTTL(message)
 
 	c.mutex.Lock()
-	if c.closing {
+	// messages sent before Connect would wait for the send timeout
+	if c.closing || c.conn == nil {
+		err := c.closedError()
 		c.mutex.Unlock()
-		return ErrConnectionClosed
+		return err
 	}
+	c.wg.Add(1)
+	requestsCh := c.requestsCh
+	inflight := c.inflight
+	inflight.Add(1)
 	c.mutex.Unlock()
+	defer c.wg.Done()
+	defer inflight.Done()
+	defer c.scrubFields(message)
 
 	// prepare message for sending
-	var buf bytes.Buffer
-	packed, err := message.Pack()
-	if err != nil {
-		return fmt.Errorf("packing message: %w", err)
-	}
-
-	// create header
-	_, err = c.writeMessageLength(&buf, len(packed))
+	buf, late, err := c.prepareMessage(message)
 	if err != nil {
-		return fmt.Errorf("writing message header to buffer: %w", err)
+		return err
 	}
-
-	_, err = buf.Write(packed)
-	if err != nil {
-		return fmt.Errorf("writing packed message to buffer: %w", err)
+	if late != nil {
+		defer late.abandon()
 	}
 
 	req := request{
-		rawMessage: buf.Bytes(),
-		errCh:      make(chan error),
+		rawMessage: buf,
+		late:       late,
+		message:    message,
+		errCh:      make(chan error, 1),
+		expiresAt:  expiresAt(c.options().Clock.Now(), ttl),
 	}
 
-	c.requestsCh <- req
+	timeout := c.options().Clock.NewTimer(c.options().SendTimeout)
+	defer timeout.Stop()
+
+	select {
+	case requestsCh <- req:
+	default:
+		if c.options().DropWhenFull {
+			return ErrOutgoingQueueFull
+		}
+
+		// wait for the space in the queue or send timeout
+		select {
+		case requestsCh <- req:
+		case <-timeout.C():
+			return ErrSendTimeout
+		}
+	}
+	c.checkHighWatermark(requestsCh)
 
 	select {
 	case err = <-req.errCh:
-	case <-time.After(c.Opts.SendTimeout):
+	case <-timeout.C():
 		err = ErrSendTimeout
 	}
 
 	return err
 }
 
-// requestID is a unique identifier for a request.  responses from the server
-// are not guaranteed to return in order so we must have an id to reference the
-// original req. built from stan and datetime
-func requestID(message *iso8583.Message) (string, error) {
-	if message == nil {
-		return "", fmt.Errorf("message required")
+// packMessage packs the message and returns buffer with message length
+// header and the packed message. Buffer is taken from the pool and should be
+// returned into it with putBuffer when it's no longer used.
+func (c *Connection) packMessage(message *iso8583.Message) (*bytes.Buffer, error) {
+	var packed []byte
+	var err error
+
+	if c.options().MACGenerator != nil {
+		packed, err = c.packWithMAC(message)
+	} else {
+		packed, err = message.Pack()
+		if err != nil {
+			err = fmt.Errorf("packing message: %w", err)
+		}
 	}
+	if err != nil {
+		return nil, err
+	}
+
+	return c.frameMessage(packed)
+}
 
-	stan, err := message.GetString(11)
+// frameMessage writes the length header, TPDU and the packed message, or
+// the frame written by Framer, into the buffer from the pool. The write
+// loop writes the whole frame with one Write call, so bytes of frames of
+// concurrent Sends and Replies can't interleave on the wire.
+func (c *Connection) frameMessage(packed []byte) (*bytes.Buffer, error) {
+	wire, err := c.encodeWire(packed)
 	if err != nil {
-		return "", fmt.Errorf("getting STAN (field 11) of the message: %w", err)
+		return nil, fmt.Errorf("encoding message for the wire: %w", err)
 	}
 
-	if stan == "" {
-		return "", errors.New("STAN is missing")
+	buf := getBuffer()
+
+	length := len(wire) + c.checksumLength()
+	if c.options().TPDU != nil {
+		length += tpduLength
 	}
 
-	return stan, nil
-}
+	if err := c.checkEncodableLength(length); err != nil {
+		putBuffer(buf)
+		return nil, err
+	}
+
+	// Framer frames the payload written into the separate buffer
+	framer := c.options().Framer
+	payload := buf
+	if framer != nil {
+		payload = getBuffer()
+		defer c.releaseBuffer(payload)
+	} else {
+		// create header
+		_, err = c.writeMessageLength(buf, length)
+		if err != nil {
+			putBuffer(buf)
+			return nil, fmt.Errorf("writing message header to buffer: %w", err)
+		}
+	}
 
-const (
-	// position of the MTI specifies the message function which
-	// defines how the message should flow within the system.
-	messageFunctionIndex = 2
+	if c.options().TPDU != nil {
+		payload.Write(c.options().TPDU[:])
+	}
 
-	// following are responses to our requests
-	messageFunctionRequestResponse            = "1"
-	messageFunctionAdviceResponse             = "3"
-	messageFunctionNotificationAcknowledgment = "5"
-	messageFunctionInstructionAcknowledgment  = "7"
-)
+	_, err = payload.Write(wire)
+	c.writeChecksum(payload, wire)
+	if len(c.options().ScrubFields) > 0 {
+		zeroBytes(packed)
+		zeroBytes(wire)
+	}
+	if err != nil {
+		c.releaseBuffer(buf)
+		return nil, fmt.Errorf("writing packed message to buffer: %w", err)
+	}
 
-func isResponse(message *iso8583.Message) bool {
+	if framer != nil {
+		if err := framer.WriteFrame(buf, payload.Bytes()); err != nil {
+			c.releaseBuffer(buf)
+			return nil, fmt.Errorf("writing frame to buffer: %w", err)
+		}
+	}
+
+	return buf, nil
+}
+
+// isResponse reports whether message is the response following MTI
+// conventions of MTIVersion
+func (c *Connection) isResponse(message *iso8583.Message) bool {
 	if message == nil {
 		return false
 	}
 
 	mti, _ := message.GetMTI()
 
-	if len(mti) < 4 {
-		return false
+	return c.options().MTIVersion.IsResponse(mti)
+}
+
+// failRequest returns err to the sender of the request unless the error or
+// reply was already delivered to it
+func (c *Connection) failRequest(req request, err error) {
+	if req.replyCh != nil && !c.pendingRequests.removeRequest(req.requestID, req.errCh, req.gen) {
+		return
 	}
 
-	messageFunction := string(mti[messageFunctionIndex])
+	req.errCh <- err
+}
 
-	switch messageFunction {
-	case messageFunctionRequestResponse,
-		messageFunctionAdviceResponse,
-		messageFunctionNotificationAcknowledgment,
-		messageFunctionInstructionAcknowledgment:
-		return true
+// setWriteDeadline sets deadline for the next write into conn if WriteTimeout
+// is set and conn supports deadlines
+func (c *Connection) setWriteDeadline(conn io.ReadWriteCloser) error {
+	if c.options().WriteTimeout == 0 {
+		return nil
 	}
 
-	return false
+	deadlineConn, ok := conn.(interface{ SetWriteDeadline(time.Time) error })
+	if !ok {
+		return nil
+	}
+
+	if err := deadlineConn.SetWriteDeadline(time.Now().Add(c.options().WriteTimeout)); err != nil {
+		return fmt.Errorf("setting write deadline: %w", err)
+	}
+
+	return nil
 }
 
-// writeLoop reads requests from the channel and writes request message into
-// the socket connection. It also sends message when idle time passes
-func (c *Connection) writeLoop() {
+func isTimeout(err error) bool {
+	var netErr net.Error
+
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// writeLoop reads requests from the outgoing queue and writes request
+// message into the socket connection. As it's the only goroutine writing
+// into the connection, messages are written one by one in the order they
+// were queued. It also sends message when idle time passes
+func (c *Connection) writeLoop(conn io.ReadWriteCloser, requestsCh chan request, done chan struct{}) {
 	var err error
 
 	for err == nil {
+		idle := c.options().Clock.NewTimer(c.options().IdleTime)
+
 		select {
-		case req := <-c.requestsCh:
-			// if it's a request message, not a response
-			if req.replyCh != nil {
-				c.pendingRequestsMu.Lock()
-				c.respMap[req.requestID] = response{
-					replyCh: req.replyCh,
-					errCh:   req.errCh,
+		case req := <-requestsCh:
+			if len(requestsCh) < c.options().OutgoingQueueHighWatermark {
+				atomic.StoreInt32(&c.highWatermarkReached, 0)
+			}
+
+			if c.expired(req) {
+				c.dropExpired(req)
+				break
+			}
+
+			if req.late != nil {
+				var packErr error
+				req.rawMessage, packErr = c.packLate(req.late)
+				if packErr != nil {
+					// message can't be written, but connection is
+					// still fine
+					c.deadLetter(req, packErr)
+					c.failRequest(req, packErr)
+					break
 				}
-				c.pendingRequestsMu.Unlock()
 			}
 
-			_, err = c.conn.Write([]byte(req.rawMessage))
+			err = c.setWriteDeadline(conn)
+			if err != nil {
+				c.deadLetter(req, err)
+				c.releaseBuffer(req.rawMessage)
+				c.failRequest(req, err)
+				break
+			}
+
+			writeStarted := c.options().Clock.Now()
+			if req.timing != nil && !req.timing.startWrite(req.gen, writeStarted) {
+				// Send returned while message was queued
+				c.deadLetter(req, errMessageAbandoned)
+				c.releaseBuffer(req.rawMessage)
+				break
+			}
+
+			_, err = conn.Write(req.rawMessage.Bytes())
+			if req.timing != nil {
+				req.timing.setWritten(req.gen, c.options().Clock.Now())
+			}
+			if err == nil {
+				c.trace(true, writeStarted, req.message, req.rawMessage.Bytes())
+			}
+			c.releaseBuffer(req.rawMessage)
 			if err != nil {
+				// return write error to the sender of the message,
+				// other pending requests will get
+				// ErrConnectionClosed
+				writeErr := fmt.Errorf("writing message: %w", err)
+				if isTimeout(err) {
+					writeErr = ErrWriteTimeout
+				}
+				c.deadLetter(req, writeErr)
+				c.failRequest(req, writeErr)
 				break
 			}
+			atomic.AddUint64(&c.messagesSent, 1)
 
 			// for replies (requests without replyCh) we just
 			// return nil to errCh as caller is waiting for error
@@ -452,79 +1474,296 @@ func (c *Connection) writeLoop() {
 			if req.replyCh == nil {
 				req.errCh <- nil
 			}
-		case <-time.After(c.Opts.IdleTime):
+		case <-idle.C():
 			// if no message was sent during idle time, we have to send ping message
-			if c.Opts.PingHandler != nil {
-				go c.Opts.PingHandler(c)
+			if c.options().PingHandler != nil {
+				go c.options().PingHandler(c)
 			}
-		case <-c.done:
+		case <-done:
+			idle.Stop()
+			c.dropQueued(requestsCh)
 			return
 		}
 
+		idle.Stop()
 	}
 
-	c.handleConnectionError(err)
+	c.handleConnectionError(conn, err)
 }
 
 // readLoop reads data from the socket (message length header and raw message)
-// and runs a goroutine to handle the message
-func (c *Connection) readLoop() {
+// and runs a goroutine to handle the message. When InboundWorkers or
+// SerialInboundProcessing are set, messages are matched with requests in
+// the loop and inbound handlers are run by the workers. All reads go
+// through the buffered reader, so many small frames can be read with a
+// single read from the socket.
+func (c *Connection) readLoop(conn io.ReadWriteCloser, done <-chan struct{}) {
 	var err error
-	var messageLength int
 
-	r := bufio.NewReader(c.conn)
+	defer c.readers.Done()
+
+	var inbound chan inboundJob
+	if workers := c.inboundWorkers(); workers > 0 {
+		inbound = c.startInboundWorkers(workers)
+		defer close(inbound)
+	}
+
+	r := bufio.NewReaderSize(&retryReader{r: conn, done: done}, c.options().ReadBufferSize)
 	for {
-		messageLength, err = c.readMessageLength(r)
-		if err != nil {
+		var buf *[]byte
+		var frame []byte
+		var headerLength int
+
+		buf, headerLength, err = c.readFrame(r)
+		if buf != nil {
+			frame = *buf
+		}
+		if err == nil && c.options().TPDU != nil && len(frame)-headerLength < tpduLength {
+			err = &FramingError{Err: fmt.Errorf("message is shorter than TPDU: %d bytes", len(frame)-headerLength)}
+		}
+
+		if err == nil {
+			receivedAt := c.options().Clock.Now()
+
+			// TPDU goes between the length header and the message
+			var tpdu *TPDUHeader
+			if c.options().TPDU != nil {
+				tpdu = &TPDUHeader{}
+				copy(tpdu[:], frame[headerLength:])
+				headerLength += tpduLength
+			}
+
+			packed, integrityErr := c.verifyFrameIntegrity(frame[headerLength:])
+			if integrityErr != nil {
+				// frame is kept by the error
+				err = c.rejectFrame(integrityErr)
+				if err != nil {
+					break
+				}
+				continue
+			}
+
+			message := c.newMessage()
+			var decoded []byte
+			decoded, err = c.decodeWire(packed)
+			if err == nil {
+				packed = decoded
+				err = c.unpackMessage(message, packed)
+			}
+			if err == nil && c.options().MACVerifier != nil {
+				if macErr := c.verifyMAC(packed, message); macErr != nil {
+					c.ReleaseMessage(message)
+					putFrame(buf)
+					if c.options().MACVerificationFatal {
+						err = macErr
+						break
+					}
+					continue
+				}
+			}
+			if err == nil {
+				atomic.StoreInt64(&c.lastReceived, receivedAt.UnixNano())
+				atomic.AddUint64(&c.messagesReceived, 1)
+				c.trace(false, receivedAt, message, frame)
+				if !c.deliverMulti(message) {
+					c.readers.Add(1)
+					if inbound != nil {
+						c.handleResponse(message, receivedAt, tpdu, inbound)
+					} else {
+						go c.handleResponse(message, receivedAt, tpdu, nil)
+					}
+				}
+				if len(c.options().ScrubFields) > 0 {
+					zeroBytes(frame)
+				}
+				// frames of messages that were not
+				// delivered are kept by the errors
+				putFrame(buf)
+				continue
+			}
+			c.ReleaseMessage(message)
+
+			atomic.AddUint64(&c.unpackErrors, 1)
+
+			unpackErr := &UnpackError{
+				Err:        err,
+				Header:     frame[:headerLength],
+				RawMessage: packed,
+			}
+			if c.options().DumpOnError != nil {
+				unpackErr.writeDump(c.options().DumpOnError)
+			}
+
+			if c.options().UnpackErrorPolicy != nil {
+				err = c.handleUnpackError(unpackErr)
+				if err != nil {
+					break
+				}
+				continue
+			}
+
+			err = &FramingError{Err: unpackErr}
+		}
+
+		var framingErr *FramingError
+		if !errors.As(err, &framingErr) {
 			break
 		}
 
-		// read the packed message
-		rawMessage := make([]byte, messageLength)
-		_, err = io.ReadFull(r, rawMessage)
+		err = c.recoverFraming(r, framingErr, len(frame))
 		if err != nil {
 			break
 		}
-
-		go c.handleResponse(rawMessage)
 	}
 
-	c.handleConnectionError(err)
+	c.handleConnectionError(conn, err)
 }
 
-// handleResponse unpacks the message and then sends it to the reply channel
-// that corresponds to the message ID (request ID)
-func (c *Connection) handleResponse(rawMessage []byte) {
-	// create message
-	message := iso8583.NewMessage(c.spec)
-	err := message.Unpack(rawMessage)
+// readFrame reads the length header and the packed message into the buffer
+// from the frame pool. It returns the frame with both of them and the
+// length of the header. The length header is consumed only when it's valid.
+func (c *Connection) readFrame(r *bufio.Reader) (*[]byte, int, error) {
+	if c.options().Framer != nil {
+		return c.readFramerFrame(r)
+	}
+
+	header := &peekReader{r: r}
+	messageLength, err := c.readMessageLength(header)
+	if header.err != nil {
+		return nil, 0, header.err
+	}
 	if err != nil {
-		log.Printf("unpacking message: %v", err)
-		return
+		return nil, 0, &FramingError{Err: fmt.Errorf("reading message length: %w", err)}
 	}
 
-	if isResponse(message) {
-		reqID, err := requestID(message)
-		if err != nil {
-			log.Printf("creating request ID: %v", err)
+	if !c.validLength(messageLength) {
+		return nil, 0, &FramingError{Err: fmt.Errorf("%w: %d", ErrInvalidMessageLength, messageLength)}
+	}
+
+	// header bytes were peeked, so they are in the buffer
+	buf := getFrame(header.off + messageLength)
+	frame := *buf
+	_, _ = io.ReadFull(r, frame[:header.off])
+
+	// read the packed message
+	_, err = io.ReadFull(r, frame[header.off:])
+	if err != nil {
+		putFrame(buf)
+		return nil, 0, err
+	}
+
+	return buf, header.off, nil
+}
+
+// handleResponse sends the message to the reply channel that corresponds
+// to the message ID (request ID) or to the InboundMessageHandler
+func (c *Connection) handleResponse(message *iso8583.Message, receivedAt time.Time, tpdu *TPDUHeader, inbound chan inboundJob) {
+	defer c.readers.Done()
+
+	if c.isResponse(message) {
+		// Matcher doesn't need the request ID of the response
+		reqID, err := c.requestID(message)
+		if err != nil && c.options().Matcher == nil {
+			c.handleError(fmt.Errorf("creating request ID: %w", err))
+			c.releaseInbound(message)
 			return
 		}
 
 		// send response message to the reply channel
-		c.pendingRequestsMu.Lock()
-		response, found := c.respMap[reqID]
-		c.pendingRequestsMu.Unlock()
+		response, found := c.matchResponse(reqID, message)
+
+		if found && tpdu != nil {
+			if err := c.validateTPDU(*tpdu); err != nil {
+				response.errCh <- err
+				c.releaseInbound(message)
+				return
+			}
+		}
 
 		if found {
+			response.timing.setReceived(receivedAt, tpdu)
 			response.replyCh <- message
-		} else if c.Opts.InboundMessageHandler != nil {
-			go c.Opts.InboundMessageHandler(c, message)
+			return
+		}
+
+		if c.deliverLate(reqID, message, inbound) {
+			return
+		}
+
+		atomic.AddUint64(&c.unmatchedResponses, 1)
+
+		if handler := c.inboundHandler(message); handler != nil {
+			c.runInbound(inbound, message, func() {
+				c.checkLateAfterReversal(reqID, message)
+				c.handleInbound(handler, message, tpdu)
+			})
 		} else {
-			log.Printf("can't find request for ID: %s", reqID)
+			c.checkLateAfterReversal(reqID, message)
+			c.handleError(fmt.Errorf("can't find request for ID: %s", reqID))
+			c.releaseInbound(message)
 		}
 	} else {
-		if c.Opts.InboundMessageHandler != nil {
-			go c.Opts.InboundMessageHandler(c, message)
+		c.detectSignOff(message)
+		if c.handleHostNetworkManagement(message) {
+			c.releaseInbound(message)
+			return
+		}
+		c.ackAdvice(message)
+
+		if handler := c.inboundHandler(message); handler != nil {
+			c.runInbound(inbound, message, func() {
+				c.handleInbound(handler, message, tpdu)
+			})
+		} else {
+			c.releaseInbound(message)
+		}
+	}
+}
+
+// inboundHandler returns the handler registered with
+// InboundMessageHandlerFor for the longest prefix of the message MTI,
+// NetworkManagementHandler for network management requests or
+// InboundMessageHandler if no prefix matches
+func (c *Connection) inboundHandler(message *iso8583.Message) InboundMessageHandlerFunc {
+	if len(c.options().InboundMessageHandlers) == 0 && c.options().NetworkManagementHandler == nil {
+		return c.options().InboundMessageHandler
+	}
+
+	mti, _ := message.GetMTI()
+
+	for n := len(mti); n > 0; n-- {
+		if handler, found := c.options().InboundMessageHandlers[mti[:n]]; found {
+			return handler
 		}
 	}
+
+	version := c.options().MTIVersion
+	if c.options().NetworkManagementHandler != nil && version.IsNetworkManagement(mti) && !version.IsResponse(mti) {
+		return c.options().NetworkManagementHandler
+	}
+
+	return c.options().InboundMessageHandler
+}
+
+// handleInbound calls handler and releases the message when handler
+// returns
+func (c *Connection) handleInbound(handler InboundMessageHandlerFunc, message *iso8583.Message, tpdu *TPDUHeader) {
+	if tpdu != nil {
+		c.inboundTPDUs.Store(message, *tpdu)
+		defer c.inboundTPDUs.Delete(message)
+	}
+
+	handler(c, message)
+	c.releaseInbound(message)
+}
+
+// handleError reports error that can't be returned to the caller to the
+// ErrorHandler or logs it when handler is not set
+func (c *Connection) handleError(err error) {
+	if c.options().ErrorHandler != nil {
+		go c.options().ErrorHandler(c, c.wrapError(err))
+		return
+	}
+
+	log.Printf("%s%v", c.logPrefix(), err)
 }
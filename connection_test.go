@@ -1,18 +1,41 @@
 package connection_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+	_ "time/tzdata"
 
 	"github.com/moov-io/iso8583"
 	connection "github.com/moov-io/iso8583-connection"
+	"github.com/moov-io/iso8583-connection/connectiontest"
+	"github.com/moov-io/iso8583-connection/iso8583util"
 	"github.com/moov-io/iso8583-connection/server"
+	"github.com/moov-io/iso8583-connection/websocket"
+	"github.com/moov-io/iso8583/encoding"
 	"github.com/moov-io/iso8583/field"
+	"github.com/moov-io/iso8583/padding"
+	"github.com/moov-io/iso8583/prefix"
+	isosort "github.com/moov-io/iso8583/sort"
 	"github.com/stretchr/testify/require"
 )
 
@@ -48,9 +71,23 @@ func TestClient_Connect(t *testing.T) {
 		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength)
 		require.NoError(t, err)
 
+		require.Nil(t, c.LocalAddr())
+		require.Nil(t, c.RemoteAddr())
+
 		err = c.Connect()
 		require.NoError(t, err)
+
+		require.NotNil(t, c.LocalAddr())
+		require.Equal(t, server.Addr, c.RemoteAddr().String())
+
+		_, ok := c.TLSConnectionState()
+		require.False(t, ok)
+		require.Nil(t, c.PeerCertificates())
+
 		require.NoError(t, c.Close())
+
+		require.Nil(t, c.LocalAddr())
+		require.Nil(t, c.RemoteAddr())
 	})
 
 	t.Run("with TLS", func(t *testing.T) {
@@ -82,7 +119,128 @@ func TestClient_Connect(t *testing.T) {
 		err = c.Connect()
 		require.NoError(t, err)
 
+		state, ok := c.TLSConnectionState()
+		require.True(t, ok)
+		require.True(t, state.HandshakeComplete)
+		require.NotEmpty(t, state.PeerCertificates)
+		require.Equal(t, "127.0.0.1", state.PeerCertificates[0].Subject.CommonName)
+		require.Equal(t, ln.Addr().String(), c.RemoteAddr().String())
+
+		require.NoError(t, c.Close())
+
+		_, ok = c.TLSConnectionState()
+		require.False(t, ok)
+	})
+
+	t.Run("it returns ErrAlreadyConnected when called twice", func(t *testing.T) {
+		server, err := NewTestServer()
+		require.NoError(t, err)
+		defer server.Close()
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer c.Close()
+
+		err = c.Connect()
+		require.ErrorIs(t, err, connection.ErrAlreadyConnected)
+
+		// existing connection is not affected
+		message := iso8583.NewMessage(testSpec)
+		err = message.Marshal(baseFields{
+			MTI:  field.NewStringValue("0800"),
+			STAN: field.NewStringValue(getSTAN()),
+		})
+		require.NoError(t, err)
+
+		_, err = c.Send(message)
+		require.NoError(t, err)
+	})
+
+	t.Run("only one concurrent Connect establishes connection", func(t *testing.T) {
+		server, err := NewTestServer()
+		require.NoError(t, err)
+		defer server.Close()
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+		defer c.Close()
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var connected, alreadyConnected int
+
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				err := c.Connect()
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				switch {
+				case err == nil:
+					connected++
+				case errors.Is(err, connection.ErrAlreadyConnected):
+					alreadyConnected++
+				default:
+					t.Errorf("unexpected error: %v", err)
+				}
+			}()
+		}
+
+		wg.Wait()
+
+		require.Equal(t, 1, connected)
+		require.Equal(t, 9, alreadyConnected)
+	})
+
+	t.Run("Connect after Close establishes new connection", func(t *testing.T) {
+		server, err := NewTestServer()
+		require.NoError(t, err)
+		defer server.Close()
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+
+		require.NoError(t, c.Connect())
 		require.NoError(t, c.Close())
+
+		require.NoError(t, c.Connect())
+		require.NoError(t, c.Close())
+	})
+
+	t.Run("connection can be reused after Close", func(t *testing.T) {
+		server, err := NewTestServer()
+		require.NoError(t, err)
+		defer server.Close()
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+
+		for i := 0; i < 50; i++ {
+			require.NoError(t, c.Connect())
+
+			message := iso8583.NewMessage(testSpec)
+			err = message.Marshal(baseFields{
+				MTI:  field.NewStringValue("0800"),
+				STAN: field.NewStringValue(getSTAN()),
+			})
+			require.NoError(t, err)
+
+			response, err := c.Send(message)
+			require.NoError(t, err)
+
+			mti, err := response.GetMTI()
+			require.NoError(t, err)
+			require.Equal(t, "0810", mti)
+
+			require.NoError(t, c.Close())
+		}
 	})
 
 	t.Run("no panic when Close before Connect", func(t *testing.T) {
@@ -127,6 +285,37 @@ func TestClient_Send(t *testing.T) {
 		require.NoError(t, c.Close())
 	})
 
+	t.Run("it returns timing details of the request", func(t *testing.T) {
+		// in-process server replies the same way as the test server
+		c, err := connectiontest.NewPipeConnection(testSpec, readMessageLength, writeMessageLength, (&testServer{}).Handle)
+		require.NoError(t, err)
+		defer c.Close()
+
+		stan := getSTAN()
+		message := iso8583.NewMessage(testSpec)
+		err = message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(TestCaseDelayedResponse),
+			STAN:         field.NewStringValue(stan),
+		})
+		require.NoError(t, err)
+
+		start := time.Now()
+		response, info, err := c.SendWithInfo(message)
+		elapsed := time.Since(start)
+		require.NoError(t, err)
+		require.NotNil(t, response)
+
+		require.Equal(t, stan, info.RequestID)
+		require.GreaterOrEqual(t, info.QueueWait, time.Duration(0))
+		require.Greater(t, info.WriteDuration, time.Duration(0))
+		require.True(t, info.Written)
+
+		// server delays response for 500ms
+		require.GreaterOrEqual(t, info.ResponseWait, 500*time.Millisecond)
+		require.LessOrEqual(t, info.QueueWait+info.WriteDuration+info.ResponseWait, elapsed)
+	})
+
 	t.Run("it returns ErrConnectionClosed when Close was called", func(t *testing.T) {
 		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength)
 		require.NoError(t, err)
@@ -181,6 +370,91 @@ func TestClient_Send(t *testing.T) {
 		require.Equal(t, connection.ErrSendTimeout, err)
 	})
 
+	t.Run("it returns ErrSendTimeout not earlier than SendTimeout", func(t *testing.T) {
+		clock := connectiontest.NewFakeClock(time.Now())
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(50*time.Millisecond),
+			connection.WithClock(clock),
+		)
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer c.Close()
+
+		message := iso8583.NewMessage(testSpec)
+		err = message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(TestCaseNoResponse),
+			STAN:         field.NewStringValue(getSTAN()),
+		})
+		require.NoError(t, err)
+
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := c.Send(message)
+			errCh <- err
+		}()
+
+		// wait for the idle timer of the writer and the send timeout
+		// timer
+		clock.BlockUntil(2)
+
+		clock.Advance(49 * time.Millisecond)
+		clock.BlockUntil(2)
+
+		select {
+		case err := <-errCh:
+			t.Fatalf("Send returned before SendTimeout: %v", err)
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		clock.Advance(1 * time.Millisecond)
+
+		select {
+		case err := <-errCh:
+			require.Equal(t, connection.ErrSendTimeout, err)
+		case <-time.After(time.Second):
+			t.Fatal("Send did not return after SendTimeout")
+		}
+	})
+
+	t.Run("it removes pending requests when response was not received during SendTimeout time", func(t *testing.T) {
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength, connection.SendTimeout(10*time.Millisecond))
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer c.Close()
+
+		// 100 senders with 100 timed out messages each
+		var wg sync.WaitGroup
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				for j := 0; j < 100; j++ {
+					message := iso8583.NewMessage(testSpec)
+					err := message.Marshal(baseFields{
+						MTI:          field.NewStringValue("0800"),
+						TestCaseCode: field.NewStringValue(TestCaseNoResponse),
+						STAN:         field.NewStringValue(getSTAN()),
+					})
+					require.NoError(t, err)
+
+					_, err = c.Send(message)
+					require.Equal(t, connection.ErrSendTimeout, err)
+				}
+			}()
+		}
+
+		wg.Wait()
+
+		require.Equal(t, 0, c.PendingRequests())
+	})
+
 	t.Run("it returns error when message does not have STAN", func(t *testing.T) {
 		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength, connection.SendTimeout(100*time.Millisecond))
 		require.NoError(t, err)
@@ -208,10 +482,15 @@ func TestClient_Send(t *testing.T) {
 		require.NoError(t, err)
 		defer c.Close()
 
-		var wg sync.WaitGroup
+		stans := make(map[string]bool)
 		for i := 0; i < 10; i++ {
+			stans[getSTAN()] = true
+		}
+
+		var wg sync.WaitGroup
+		for stan := range stans {
 			wg.Add(1)
-			go func(i int) {
+			go func(stan string) {
 				defer func() {
 					wg.Done()
 				}()
@@ -221,7 +500,7 @@ func TestClient_Send(t *testing.T) {
 				err := message.Marshal(baseFields{
 					MTI:          field.NewStringValue("0800"),
 					TestCaseCode: field.NewStringValue(TestCaseDelayedResponse),
-					STAN:         field.NewStringValue(getSTAN()),
+					STAN:         field.NewStringValue(stan),
 				})
 				require.NoError(t, err)
 
@@ -231,17 +510,114 @@ func TestClient_Send(t *testing.T) {
 				mti, err := response.GetMTI()
 				require.NoError(t, err)
 				require.Equal(t, "0810", mti)
-			}(i)
+			}(stan)
 		}
 
-		// let's wait all messages to be sent
-		time.Sleep(200 * time.Millisecond)
+		// let's wait all messages to be received by the server
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		err = server.WaitForMessages(ctx, len(stans), func(message *iso8583.Message) bool {
+			stan, _ := message.GetString(11)
+			return stans[stan]
+		})
+		require.NoError(t, err)
 
 		// while server is waiting, we will close the connection
 		require.NoError(t, c.Close())
 		wg.Wait()
 	})
 
+	t.Run("Status doesn't wait for pending requests while Close waits for them", func(t *testing.T) {
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+
+		stan := getSTAN()
+		sent := make(chan struct{})
+		go func() {
+			defer close(sent)
+
+			message := iso8583.NewMessage(testSpec)
+			err := message.Marshal(baseFields{
+				MTI:          field.NewStringValue("0800"),
+				TestCaseCode: field.NewStringValue(TestCaseDelayedResponse),
+				STAN:         field.NewStringValue(stan),
+			})
+			require.NoError(t, err)
+
+			_, err = c.Send(message)
+			require.NoError(t, err)
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		err = server.WaitForMessages(ctx, 1, func(message *iso8583.Message) bool {
+			s, _ := message.GetString(11)
+			return s == stan
+		})
+		require.NoError(t, err)
+
+		closed := make(chan error)
+		go func() {
+			closed <- c.Close()
+		}()
+
+		// server replies in 500ms, Close waits for the reply
+		require.Eventually(t, func() bool {
+			return c.Status() == connection.StatusOffline
+		}, 200*time.Millisecond, 10*time.Millisecond)
+
+		select {
+		case <-sent:
+			t.Fatal("Send returned before the delayed response")
+		default:
+		}
+
+		require.NoError(t, <-closed)
+		<-sent
+	})
+
+	t.Run("it matches responses for many concurrent requests", func(t *testing.T) {
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength, connection.PendingRequestsShards(8))
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer c.Close()
+
+		// 500 senders with 100 messages each
+		var wg sync.WaitGroup
+		for i := 0; i < 500; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				for j := 0; j < 100; j++ {
+					stan := getSTAN()
+					message := iso8583.NewMessage(testSpec)
+					err := message.Marshal(baseFields{
+						MTI:  field.NewStringValue("0800"),
+						STAN: field.NewStringValue(stan),
+					})
+					require.NoError(t, err)
+
+					response, err := c.Send(message)
+					require.NoError(t, err)
+
+					responseSTAN, err := response.GetString(11)
+					require.NoError(t, err)
+					require.Equal(t, stan, responseSTAN)
+				}
+			}()
+		}
+
+		wg.Wait()
+
+		require.Equal(t, 0, c.PendingRequests())
+	})
+
 	t.Run("responses received asynchronously", func(t *testing.T) {
 		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength)
 		require.NoError(t, err)
@@ -327,9 +703,7 @@ func TestClient_Send(t *testing.T) {
 
 	t.Run("automatically sends ping messages after ping interval", func(t *testing.T) {
 		// we create server instance here to isolate pings count
-		server, err := NewTestServer()
-		require.NoError(t, err)
-		defer server.Close()
+		server := &testServer{}
 
 		pingHandler := func(c *connection.Connection) {
 			pingMessage := iso8583.NewMessage(testSpec)
@@ -348,23 +722,34 @@ func TestClient_Send(t *testing.T) {
 			require.Equal(t, "0810", mti)
 		}
 
-		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+		clock := connectiontest.NewFakeClock(time.Now())
+
+		record := func(c *connection.Connection, message *iso8583.Message) {
+			server.record(message)
+			server.Handle(c, message)
+		}
+
+		c, err := connectiontest.NewPipeConnection(testSpec, readMessageLength, writeMessageLength, record,
 			connection.IdleTime(50*time.Millisecond),
 			connection.PingHandler(pingHandler),
+			connection.WithClock(clock),
 		)
 		require.NoError(t, err)
-
-		err = c.Connect()
-		require.NoError(t, err)
 		defer c.Close()
 
+		// wait for the idle timer of the writer
+		clock.BlockUntil(1)
+		clock.Advance(49 * time.Millisecond)
+
 		// we expect that ping interval in 50ms has not passed yet
 		// and server has not being pinged
-		require.Equal(t, 0, server.ReceivedPings())
+		require.Empty(t, server.ReceivedMessages())
 
-		time.Sleep(200 * time.Millisecond)
+		clock.Advance(1 * time.Millisecond)
 
-		require.True(t, server.ReceivedPings() > 0)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		require.NoError(t, server.WaitForMessages(ctx, 1, isPingMessage))
 	})
 
 	t.Run("it handles unrecognized responses", func(t *testing.T) {
@@ -462,7 +847,7 @@ func TestClient_Send(t *testing.T) {
 		require.NoError(t, err)
 
 		err = c.Connect()
-		require.NoError(t, err)
+		require.ErrorIs(t, err, connection.ErrAlreadyConnected)
 		defer c.Close()
 
 		msg := iso8583.NewMessage(testSpec)
@@ -472,46 +857,130 @@ func TestClient_Send(t *testing.T) {
 		require.Equal(t, closer.Used, true, "client didn't use custom connection")
 	})
 
-	// if server closed the connection, we want Send method to receive
-	// ErrConnectionClosed and not ErrSendTimeout
-	t.Run("pending requests get ErrConnectionClosed if server closed the connection", func(t *testing.T) {
-		server, err := NewTestServer()
-		require.NoError(t, err)
-		defer server.Close()
-
-		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength, connection.SendTimeout(500*time.Millisecond))
-		require.NoError(t, err)
+	t.Run("it writes messages into connection in the order they were sent", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
 
-		err = c.Connect()
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength)
 		require.NoError(t, err)
 		defer c.Close()
 
-		done := make(chan bool)
+		var stans []string
+		for i := 0; i < 100; i++ {
+			stans = append(stans, getSTAN())
+		}
 
-		// send message that will trigger server handler to sleep
-		// trigger server to close connection
 		go func() {
-			// regardless of the test result, we have to finish parent t.Run
-			defer func() {
-				done <- true
-			}()
+			for _, stan := range stans {
+				message := iso8583.NewMessage(testSpec)
+				err := message.Marshal(baseFields{
+					MTI:  field.NewStringValue("0810"),
+					STAN: field.NewStringValue(stan),
+				})
+				require.NoError(t, err)
 
-			message := iso8583.NewMessage(testSpec)
-			err := message.Marshal(baseFields{
-				MTI:          field.NewStringValue("0800"),
-				TestCaseCode: field.NewStringValue(TestCaseDelayedResponse),
-				STAN:         field.NewStringValue(getSTAN()),
-			})
+				require.NoError(t, c.Reply(message))
+			}
+		}()
+
+		for _, stan := range stans {
+			length, err := readMessageLength(serverConn)
 			require.NoError(t, err)
 
-			_, err = c.Send(message)
+			rawMessage := make([]byte, length)
+			_, err = io.ReadFull(serverConn, rawMessage)
+			require.NoError(t, err)
 
-			// instead of ErrSendTimeout we want to receive
-			// ErrConnectionClosed
-			require.Equal(t, connection.ErrConnectionClosed, err)
-		}()
+			message := iso8583.NewMessage(testSpec)
+			require.NoError(t, message.Unpack(rawMessage))
 
-		time.Sleep(50 * time.Millisecond)
+			receivedSTAN, err := message.GetString(11)
+			require.NoError(t, err)
+			require.Equal(t, stan, receivedSTAN)
+		}
+	})
+
+	t.Run("it returns ErrWriteTimeout when message was not written during WriteTimeout time", func(t *testing.T) {
+		// nobody reads from the server side of the pipe, so writes
+		// block
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength, connection.WriteTimeout(100*time.Millisecond))
+		require.NoError(t, err)
+		defer c.Close()
+
+		message := iso8583.NewMessage(testSpec)
+		err = message.Marshal(baseFields{
+			MTI:  field.NewStringValue("0800"),
+			STAN: field.NewStringValue(getSTAN()),
+		})
+		require.NoError(t, err)
+
+		_, err = c.Send(message)
+		require.ErrorIs(t, err, connection.ErrWriteTimeout)
+
+		// connection is closed after write timeout
+		_, err = c.Send(message)
+		require.Equal(t, connection.ErrConnectionClosed, err)
+	})
+
+	t.Run("it returns write error to the sender of the message", func(t *testing.T) {
+		c, err := connection.NewFrom(NewFailingWriteRWCloser(), testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+		defer c.Close()
+
+		message := iso8583.NewMessage(testSpec)
+		err = message.Marshal(baseFields{
+			MTI:  field.NewStringValue("0800"),
+			STAN: field.NewStringValue(getSTAN()),
+		})
+		require.NoError(t, err)
+
+		_, err = c.Send(message)
+		require.ErrorIs(t, err, errWriteFailed)
+	})
+
+	// if server closed the connection, we want Send method to receive
+	// ErrConnectionClosed and not ErrSendTimeout
+	t.Run("pending requests get ErrConnectionClosed if server closed the connection", func(t *testing.T) {
+		server, err := NewTestServer()
+		require.NoError(t, err)
+		defer server.Close()
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength, connection.SendTimeout(500*time.Millisecond))
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer c.Close()
+
+		done := make(chan bool)
+
+		// send message that will trigger server handler to sleep
+		// trigger server to close connection
+		go func() {
+			// regardless of the test result, we have to finish parent t.Run
+			defer func() {
+				done <- true
+			}()
+
+			message := iso8583.NewMessage(testSpec)
+			err := message.Marshal(baseFields{
+				MTI:          field.NewStringValue("0800"),
+				TestCaseCode: field.NewStringValue(TestCaseDelayedResponse),
+				STAN:         field.NewStringValue(getSTAN()),
+			})
+			require.NoError(t, err)
+
+			_, err = c.Send(message)
+
+			// instead of ErrSendTimeout we want to receive
+			// ErrConnectionClosed
+			require.Equal(t, connection.ErrConnectionClosed, err)
+		}()
+
+		time.Sleep(50 * time.Millisecond)
 
 		// trigger server to close connection
 		message := iso8583.NewMessage(testSpec)
@@ -528,50 +997,8466 @@ func TestClient_Send(t *testing.T) {
 		_, err = c.Send(message)
 		require.NoError(t, err)
 
-		<-done
+		<-done
+	})
+
+	t.Run("it returns ErrConnectionClosed when connection was closed by server", func(t *testing.T) {
+		server, err := NewTestServer()
+		require.NoError(t, err)
+		defer server.Close()
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength, connection.SendTimeout(2*time.Second))
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.NoError(t, err)
+		defer func() {
+			c.Close()
+		}()
+
+		// trigger server to close connection
+		message := iso8583.NewMessage(testSpec)
+		err = message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(TestCaseCloseConnection),
+			STAN:         field.NewStringValue(getSTAN()),
+		})
+		require.NoError(t, err)
+
+		_, err = c.Send(message)
+		require.NoError(t, err)
+
+		// let's wait for connection to be close
+		time.Sleep(100 * time.Millisecond)
+
+		// because connection was closed (by server) we should receive
+		// ErrConnectionClosed error
+		message = iso8583.NewMessage(testSpec)
+		err = message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(TestCaseReply),
+			STAN:         field.NewStringValue(getSTAN()),
+		})
+		require.NoError(t, err)
+
+		_, err = c.Send(message)
+		require.Equal(t, connection.ErrConnectionClosed, err)
+	})
+}
+
+func TestClient_ReadMessages(t *testing.T) {
+	// writeByByte writes data one byte per write
+	writeByByte := func(t *testing.T, w io.Writer, data []byte) {
+		for i := range data {
+			_, err := w.Write(data[i : i+1])
+			require.NoError(t, err)
+		}
+	}
+
+	receivedSTANs := func() (connection.Option, chan string) {
+		stans := make(chan string, 10)
+		handler := func(c *connection.Connection, message *iso8583.Message) {
+			stan, _ := message.GetString(11)
+			stans <- stan
+		}
+
+		return connection.InboundMessageHandler(handler), stans
+	}
+
+	t.Run("frames split across reads", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		handler, stans := receivedSTANs()
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength, handler, connection.ReadBufferSize(16))
+		require.NoError(t, err)
+		defer c.Close()
+
+		stan1, stan2 := getSTAN(), getSTAN()
+		writeByByte(t, serverConn, append(packedFrame(t, stan1), packedFrame(t, stan2)...))
+
+		require.ElementsMatch(t, []string{stan1, stan2}, []string{<-stans, <-stans})
+	})
+
+	t.Run("frames split across reads with TLS", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+
+		cert, err := tls.LoadX509KeyPair("./testdata/server.crt", "./testdata/server.key")
+		require.NoError(t, err)
+
+		tlsServerConn := tls.Server(serverConn, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		})
+		defer tlsServerConn.Close()
+
+		// we test framing here, not certificate verification
+		tlsClientConn := tls.Client(clientConn, &tls.Config{
+			InsecureSkipVerify: true, // #nosec G402
+			MinVersion:         tls.VersionTLS12,
+		})
+
+		handler, stans := receivedSTANs()
+		c, err := connection.NewFrom(tlsClientConn, testSpec, readMessageLength, writeMessageLength, handler)
+		require.NoError(t, err)
+		defer c.Close()
+
+		stan1, stan2 := getSTAN(), getSTAN()
+		writeByByte(t, tlsServerConn, append(packedFrame(t, stan1), packedFrame(t, stan2)...))
+
+		// read close_notify alert sent when client closes connection
+		go io.Copy(io.Discard, tlsServerConn)
+
+		require.ElementsMatch(t, []string{stan1, stan2}, []string{<-stans, <-stans})
+	})
+}
+
+func TestClient_FramingRecovery(t *testing.T) {
+	// garbage has invalid length at each position when read with the
+	// 2 bytes binary length header
+	garbage := []byte{0xff, 0xff, 0xff, 0xff, 0xff}
+
+	// brokenFrame has valid length header but can't be unpacked
+	brokenFrame := []byte{0x00, 0x03, 'x', 'y', 'z'}
+
+	setup := func(t *testing.T, options ...connection.Option) (*connection.Connection, net.Conn, chan string, chan error) {
+		clientConn, serverConn := net.Pipe()
+		t.Cleanup(func() { serverConn.Close() })
+
+		stans := make(chan string, 10)
+		errs := make(chan error, 10)
+
+		options = append(options,
+			connection.MaxMessageLength(1024),
+			connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+				stan, _ := message.GetString(11)
+				stans <- stan
+			}),
+			connection.ErrorHandler(func(c *connection.Connection, err error) {
+				errs <- err
+			}),
+		)
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength, options...)
+		require.NoError(t, err)
+		t.Cleanup(func() { c.Close() })
+
+		return c, serverConn, stans, errs
+	}
+
+	t.Run("it closes connection on invalid length by default", func(t *testing.T) {
+		c, serverConn, stans, errs := setup(t)
+
+		stan1, stan2 := getSTAN(), getSTAN()
+
+		var data []byte
+		data = append(data, packedFrame(t, stan1)...)
+		data = append(data, garbage...)
+		data = append(data, packedFrame(t, stan2)...)
+		go serverConn.Write(data)
+
+		require.Equal(t, stan1, <-stans)
+
+		var framingErr *connection.FramingError
+		require.ErrorAs(t, <-errs, &framingErr)
+		require.ErrorIs(t, framingErr, connection.ErrInvalidMessageLength)
+		require.Equal(t, connection.FramingRecoveryClose, framingErr.Recovery)
+
+		select {
+		case <-c.Done():
+		case <-time.After(time.Second):
+			t.Fatal("connection was not closed")
+		}
+	})
+
+	t.Run("it resyncs on invalid length", func(t *testing.T) {
+		_, serverConn, stans, errs := setup(t, connection.ResyncOnFramingError(nil))
+
+		stan1, stan2 := getSTAN(), getSTAN()
+
+		var data []byte
+		data = append(data, packedFrame(t, stan1)...)
+		data = append(data, garbage...)
+		data = append(data, packedFrame(t, stan2)...)
+		go serverConn.Write(data)
+
+		require.ElementsMatch(t, []string{stan1, stan2}, []string{<-stans, <-stans})
+
+		var framingErr *connection.FramingError
+		require.ErrorAs(t, <-errs, &framingErr)
+		require.ErrorIs(t, framingErr, connection.ErrInvalidMessageLength)
+		require.Equal(t, connection.FramingRecoveryResync, framingErr.Recovery)
+		require.Equal(t, len(garbage), framingErr.Discarded)
+	})
+
+	t.Run("it resyncs on unpack error", func(t *testing.T) {
+		_, serverConn, stans, errs := setup(t, connection.ResyncOnFramingError(nil))
+
+		stan1, stan2 := getSTAN(), getSTAN()
+
+		var data []byte
+		data = append(data, packedFrame(t, stan1)...)
+		data = append(data, brokenFrame...)
+		data = append(data, packedFrame(t, stan2)...)
+		go serverConn.Write(data)
+
+		require.ElementsMatch(t, []string{stan1, stan2}, []string{<-stans, <-stans})
+
+		var framingErr *connection.FramingError
+		require.ErrorAs(t, <-errs, &framingErr)
+		require.Equal(t, connection.FramingRecoveryResync, framingErr.Recovery)
+		require.Equal(t, len(brokenFrame), framingErr.Discarded)
+	})
+
+	t.Run("it resyncs to the sync marker", func(t *testing.T) {
+		_, serverConn, stans, errs := setup(t, connection.ResyncOnFramingError([]byte{0x00}))
+
+		stan1, stan2 := getSTAN(), getSTAN()
+
+		var data []byte
+		data = append(data, packedFrame(t, stan1)...)
+		data = append(data, garbage...)
+		data = append(data, packedFrame(t, stan2)...)
+		go serverConn.Write(data)
+
+		require.ElementsMatch(t, []string{stan1, stan2}, []string{<-stans, <-stans})
+
+		var framingErr *connection.FramingError
+		require.ErrorAs(t, <-errs, &framingErr)
+		require.Equal(t, len(garbage), framingErr.Discarded)
+	})
+
+	t.Run("it dumps truncated message that can't be unpacked", func(t *testing.T) {
+		var dump bytes.Buffer
+		_, serverConn, _, errs := setup(t, connection.DumpOnError(&dump))
+
+		frame := packedFrame(t, getSTAN())
+		header, packed := frame[:2], frame[2:]
+
+		// message without its last field with the header with the length
+		// of the truncated message
+		truncated := packed[:len(packed)-3]
+		var data bytes.Buffer
+		_, err := writeMessageLength(&data, len(truncated))
+		require.NoError(t, err)
+		data.Write(truncated)
+		go serverConn.Write(data.Bytes())
+
+		var unpackErr *connection.UnpackError
+		require.ErrorAs(t, <-errs, &unpackErr)
+		require.Equal(t, truncated, unpackErr.RawMessage)
+		require.Equal(t, data.Bytes()[:2], unpackErr.Header)
+		require.NotEqual(t, header, unpackErr.Header)
+
+		require.Contains(t, dump.String(), unpackErr.Error())
+		require.Contains(t, dump.String(), hex.Dump(truncated))
+		require.Contains(t, dump.String(), hex.Dump(unpackErr.Header))
+		require.Equal(t, dump.String(), unpackErr.Dump())
+	})
+}
+
+// sequenceSTANProvider returns STANs from the fixed sequence
+type sequenceSTANProvider struct {
+	mu    sync.Mutex
+	stans []string
+}
+
+func (p *sequenceSTANProvider) Next() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.stans) == 0 {
+		return "", errors.New("no more STANs")
+	}
+
+	stan := p.stans[0]
+	p.stans = p.stans[1:]
+
+	return stan, nil
+}
+
+var errSTANStorage = errors.New("STAN storage is not available")
+
+// failingSTANProvider always returns an error
+type failingSTANProvider struct{}
+
+func (failingSTANProvider) Next() (string, error) {
+	return "", errSTANStorage
+}
+
+func TestClient_InboundSpec(t *testing.T) {
+	// client sends field 63 with fixed length
+	clientSpec := specWithFields(map[int]field.Field{
+		63: field.NewString(&field.Spec{
+			Length:      4,
+			Description: "Client Private Data",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+	})
+
+	// host responds with field 63 with variable length
+	hostSpec := specWithFields(map[int]field.Field{
+		63: field.NewString(&field.Spec{
+			Length:      99,
+			Description: "Host Private Data",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.LL,
+		}),
+	})
+
+	received := make(chan string, 1)
+	hostHandler := func(c *connection.Connection, message *iso8583.Message) {
+		data, err := message.GetString(63)
+		require.NoError(t, err)
+		received <- data
+
+		stan, err := message.GetString(11)
+		require.NoError(t, err)
+
+		response := iso8583.NewMessage(hostSpec)
+		response.MTI("0810")
+		require.NoError(t, response.Field(11, stan))
+		require.NoError(t, response.Field(63, "host data"))
+		require.NoError(t, c.Reply(response))
+	}
+
+	srv := server.New(hostSpec, readMessageLength, writeMessageLength,
+		connection.InboundSpec(clientSpec),
+		connection.InboundMessageHandler(hostHandler),
+	)
+	require.NoError(t, srv.Start("127.0.0.1:"))
+	defer srv.Close()
+
+	c, err := connection.New(srv.Addr, clientSpec, readMessageLength, writeMessageLength,
+		connection.InboundSpec(hostSpec),
+	)
+	require.NoError(t, err)
+	require.NoError(t, c.Connect())
+	defer c.Close()
+
+	message := iso8583.NewMessage(clientSpec)
+	message.MTI("0800")
+	require.NoError(t, message.Field(11, getSTAN()))
+	require.NoError(t, message.Field(63, "ABCD"))
+
+	response, err := c.Send(message)
+	require.NoError(t, err)
+
+	// host unpacked message with the client spec
+	require.Equal(t, "ABCD", <-received)
+
+	// client unpacked response with the host spec
+	require.Equal(t, hostSpec, response.GetSpec())
+	data, err := response.GetString(63)
+	require.NoError(t, err)
+	require.Equal(t, "host data", data)
+}
+
+func TestClient_TPDU(t *testing.T) {
+	clientAddr, hostAddr := [2]byte{0x00, 0x01}, [2]byte{0x00, 0x02}
+
+	// startHost starts server which replies to 0800 messages and sends
+	// TPDUs of received messages to tpdus
+	startHost := func(t *testing.T, options ...connection.Option) (*server.Server, chan connection.TPDUHeader) {
+		tpdus := make(chan connection.TPDUHeader, 1)
+
+		handler := func(c *connection.Connection, message *iso8583.Message) {
+			tpdu, found := c.InboundTPDU(message)
+			require.True(t, found)
+			tpdus <- tpdu
+
+			stan, err := message.GetString(11)
+			require.NoError(t, err)
+
+			response := iso8583.NewMessage(testSpec)
+			response.MTI("0810")
+			require.NoError(t, response.Field(11, stan))
+			require.NoError(t, c.Reply(response))
+		}
+
+		options = append(options, connection.InboundMessageHandler(handler))
+		srv := server.New(testSpec, readMessageLength, writeMessageLength, options...)
+		require.NoError(t, srv.Start("127.0.0.1:"))
+		t.Cleanup(srv.Close)
+
+		return srv, tpdus
+	}
+
+	send := func(t *testing.T, c *connection.Connection) (connection.SendInfo, error) {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		_, info, err := c.SendWithInfo(message)
+
+		return info, err
+	}
+
+	t.Run("TPDU is prepended to outgoing messages and read from inbound messages", func(t *testing.T) {
+		srv, tpdus := startHost(t, connection.TPDU(clientAddr, hostAddr))
+
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.TPDU(hostAddr, clientAddr),
+			connection.ValidateTPDU(),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		info, err := send(t, c)
+		require.NoError(t, err)
+
+		received := <-tpdus
+		require.Equal(t, byte(0x60), received.ID())
+		require.Equal(t, hostAddr, received.Destination())
+		require.Equal(t, clientAddr, received.Source())
+
+		require.NotNil(t, info.TPDU)
+		require.Equal(t, connection.NewTPDUHeader(clientAddr, hostAddr), *info.TPDU)
+	})
+
+	t.Run("it returns ErrTPDUMismatch when addresses are not swapped", func(t *testing.T) {
+		srv, tpdus := startHost(t, connection.TPDU(hostAddr, clientAddr))
+
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.TPDU(hostAddr, clientAddr),
+			connection.ValidateTPDU(),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		_, err = send(t, c)
+		require.ErrorIs(t, err, connection.ErrTPDUMismatch)
+		<-tpdus
+	})
+}
+
+func TestClient_AutoSetTransmissionTime(t *testing.T) {
+	// readMessage reads message written by the client
+	readMessage := func(t *testing.T, r io.Reader) *iso8583.Message {
+		length, err := readMessageLength(r)
+		require.NoError(t, err)
+
+		packed := make([]byte, length)
+		_, err = io.ReadFull(r, packed)
+		require.NoError(t, err)
+
+		message := iso8583.NewMessage(testSpec)
+		require.NoError(t, message.Unpack(packed))
+
+		return message
+	}
+
+	now := time.Date(2026, time.March, 4, 5, 6, 7, 0, time.UTC)
+
+	t.Run("it sets field 7 when message is written", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		clock := connectiontest.NewFakeClock(now)
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.AutoSetTransmissionTime(true),
+			connection.WithClock(clock),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		// the first message has field 7 set by the caller and it blocks
+		// the writer until we read it from the pipe
+		first := iso8583.NewMessage(testSpec)
+		first.MTI("0800")
+		require.NoError(t, first.Field(7, "0101000000"))
+		require.NoError(t, first.Field(11, getSTAN()))
+
+		second := iso8583.NewMessage(testSpec)
+		second.MTI("0800")
+		require.NoError(t, second.Field(11, getSTAN()))
+
+		go c.Send(first)
+		require.Eventually(t, func() bool {
+			return c.Stats().PendingRequests == 1
+		}, time.Second, 10*time.Millisecond)
+
+		go c.Send(second)
+		require.Eventually(t, func() bool {
+			return c.Stats().OutgoingQueueDepth == 1
+		}, time.Second, 10*time.Millisecond)
+
+		// message waits in the queue
+		clock.Advance(2 * time.Second)
+
+		received := readMessage(t, serverConn)
+		transmissionTime, err := received.GetString(7)
+		require.NoError(t, err)
+		require.Equal(t, "0101000000", transmissionTime)
+
+		received = readMessage(t, serverConn)
+		transmissionTime, err = received.GetString(7)
+		require.NoError(t, err)
+		require.Equal(t, "0304050609", transmissionTime)
+
+		// nobody replies, so let both requests time out before Close
+		expirePendingRequests(t, c, clock)
+	})
+
+	t.Run("server receives field 7 of replies", func(t *testing.T) {
+		clock := connectiontest.NewFakeClock(now)
+
+		srv := server.New(testSpec, readMessageLength, writeMessageLength,
+			connection.AutoSetTransmissionTime(true),
+			connection.WithClock(clock),
+			connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+				stan, err := message.GetString(11)
+				require.NoError(t, err)
+
+				response := iso8583.NewMessage(testSpec)
+				response.MTI("0810")
+				require.NoError(t, response.Field(11, stan))
+				require.NoError(t, c.Reply(response))
+			}),
+		)
+		require.NoError(t, srv.Start("127.0.0.1:"))
+		defer srv.Close()
+
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		response, err := c.Send(message)
+		require.NoError(t, err)
+
+		transmissionTime, err := response.GetString(7)
+		require.NoError(t, err)
+		require.Equal(t, "0304050607", transmissionTime)
+	})
+
+	t.Run("local time fields are formatted in TimeLocation", func(t *testing.T) {
+		spec := specWithFields(map[int]field.Field{
+			12: field.NewString(&field.Spec{
+				Length:      6,
+				Description: "Local Transaction Time",
+				Enc:         encoding.ASCII,
+				Pref:        prefix.ASCII.Fixed,
+			}),
+			13: field.NewString(&field.Spec{
+				Length:      4,
+				Description: "Local Transaction Date",
+				Enc:         encoding.ASCII,
+				Pref:        prefix.ASCII.Fixed,
+			}),
+		})
+
+		newYork, err := time.LoadLocation("America/New_York")
+		require.NoError(t, err)
+
+		tests := []struct {
+			name     string
+			location *time.Location
+			now      time.Time
+			expected map[int]string
+		}{
+			{
+				name:     "fixed offset",
+				location: time.FixedZone("UTC+3", 3*60*60),
+				now:      time.Date(2026, time.December, 31, 22, 30, 0, 0, time.UTC),
+				expected: map[int]string{7: "1231223000", 12: "013000", 13: "0101"},
+			},
+			{
+				name:     "before DST starts",
+				location: newYork,
+				now:      time.Date(2026, time.March, 8, 6, 59, 59, 0, time.UTC),
+				expected: map[int]string{7: "0308065959", 12: "015959", 13: "0308"},
+			},
+			{
+				name:     "after DST starts",
+				location: newYork,
+				now:      time.Date(2026, time.March, 8, 7, 0, 0, 0, time.UTC),
+				expected: map[int]string{7: "0308070000", 12: "030000", 13: "0308"},
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				clientConn, serverConn := net.Pipe()
+				defer serverConn.Close()
+
+				clock := connectiontest.NewFakeClock(tt.now)
+
+				c, err := connection.NewFrom(clientConn, spec, readMessageLength, writeMessageLength,
+					connection.AutoSetFields(map[int]connection.TimeFieldKind{
+						7:  connection.TimeFieldTransmissionDateTime,
+						12: connection.TimeFieldLocalTime,
+						13: connection.TimeFieldLocalDate,
+					}),
+					connection.TimeLocation(tt.location),
+					connection.WithClock(clock),
+				)
+				require.NoError(t, err)
+				defer c.Close()
+
+				message := iso8583.NewMessage(spec)
+				message.MTI("0800")
+				require.NoError(t, message.Field(11, getSTAN()))
+				go c.Send(message)
+
+				length, err := readMessageLength(serverConn)
+				require.NoError(t, err)
+				packed := make([]byte, length)
+				_, err = io.ReadFull(serverConn, packed)
+				require.NoError(t, err)
+
+				received := iso8583.NewMessage(spec)
+				require.NoError(t, received.Unpack(packed))
+
+				for id, expected := range tt.expected {
+					value, err := received.GetString(id)
+					require.NoError(t, err)
+					require.Equal(t, expected, value, "field %d", id)
+				}
+
+				// nobody replies, so let request time out before Close
+				expirePendingRequests(t, c, clock)
+			})
+		}
+	})
+}
+
+func TestClient_MAC(t *testing.T) {
+	spec := specWithFields(map[int]field.Field{
+		64: field.NewBinary(&field.Spec{
+			Length:      8,
+			Description: "Message Authentication Code (MAC)",
+			Enc:         encoding.Binary,
+			Pref:        prefix.Binary.Fixed,
+		}),
+	})
+
+	key := []byte("test key")
+
+	// hmacGenerator is the fake MAC implementation: truncated HMAC-SHA256
+	hmacGenerator := func(packedWithoutMAC []byte, message *iso8583.Message) ([]byte, error) {
+		h := hmac.New(sha256.New, key)
+		h.Write(packedWithoutMAC)
+
+		return h.Sum(nil)[:8], nil
+	}
+
+	// readPacked reads packed message written by the client
+	readPacked := func(t *testing.T, r io.Reader) []byte {
+		length, err := readMessageLength(r)
+		require.NoError(t, err)
+
+		packed := make([]byte, length)
+		_, err = io.ReadFull(r, packed)
+		require.NoError(t, err)
+
+		return packed
+	}
+
+	// requireValidMAC checks that packed message ends with MAC computed
+	// over the rest of the message
+	requireValidMAC := func(t *testing.T, packed []byte) {
+		expected, err := hmacGenerator(packed[:len(packed)-8], nil)
+		require.NoError(t, err)
+		require.Equal(t, expected, packed[len(packed)-8:])
+
+		message := iso8583.NewMessage(spec)
+		require.NoError(t, message.Unpack(packed))
+
+		mac, err := message.GetBytes(64)
+		require.NoError(t, err)
+		require.Equal(t, expected, mac)
+	}
+
+	newMessage := func(t *testing.T, mti string) *iso8583.Message {
+		message := iso8583.NewMessage(spec)
+		message.MTI(mti)
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		return message
+	}
+
+	t.Run("MAC is set for Send and Reply", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		c, err := connection.NewFrom(clientConn, spec, readMessageLength, writeMessageLength,
+			connection.MACGenerator(hmacGenerator),
+			connection.SendTimeout(100*time.Millisecond),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		go c.Send(newMessage(t, "0800"))
+		requireValidMAC(t, readPacked(t, serverConn))
+
+		go c.Reply(newMessage(t, "0810"))
+		requireValidMAC(t, readPacked(t, serverConn))
+	})
+
+	t.Run("it returns ErrMACGeneration when generator fails", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		c, err := connection.NewFrom(clientConn, spec, readMessageLength, writeMessageLength,
+			connection.MACGenerator(func(packedWithoutMAC []byte, message *iso8583.Message) ([]byte, error) {
+				return nil, errors.New("HSM is not available")
+			}),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		_, err = c.Send(newMessage(t, "0800"))
+		require.ErrorIs(t, err, connection.ErrMACGeneration)
+
+		err = c.Reply(newMessage(t, "0810"))
+		require.ErrorIs(t, err, connection.ErrMACGeneration)
+	})
+
+	t.Run("MACVerifier rejects tampered responses", func(t *testing.T) {
+		hmacVerifier := func(packed []byte, message *iso8583.Message) error {
+			expected, _ := hmacGenerator(packed[:len(packed)-8], message)
+			if !hmac.Equal(expected, packed[len(packed)-8:]) {
+				return errors.New("invalid MAC")
+			}
+			return nil
+		}
+
+		// host replies with invalid MAC to messages with tampered test
+		// case code
+		const tampered = "999"
+		hostGenerator := func(packedWithoutMAC []byte, message *iso8583.Message) ([]byte, error) {
+			mac, err := hmacGenerator(packedWithoutMAC, message)
+			if code, _ := message.GetString(2); code == tampered {
+				mac[0] ^= 0xff
+			}
+			return mac, err
+		}
+
+		srv := server.New(spec, readMessageLength, writeMessageLength,
+			connection.MACGenerator(hostGenerator),
+			connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+				stan, err := message.GetString(11)
+				require.NoError(t, err)
+				code, err := message.GetString(2)
+				require.NoError(t, err)
+
+				response := iso8583.NewMessage(spec)
+				response.MTI("0810")
+				require.NoError(t, response.Field(2, code))
+				require.NoError(t, response.Field(11, stan))
+				require.NoError(t, c.Reply(response))
+			}),
+		)
+		require.NoError(t, srv.Start("127.0.0.1:"))
+		defer srv.Close()
+
+		send := func(t *testing.T, c *connection.Connection, code string) error {
+			message := newMessage(t, "0800")
+			require.NoError(t, message.Field(2, code))
+
+			_, err := c.Send(message)
+			return err
+		}
+
+		for _, fatal := range []bool{false, true} {
+			t.Run(fmt.Sprintf("fatal: %v", fatal), func(t *testing.T) {
+				errs := make(chan error, 1)
+
+				c, err := connection.New(srv.Addr, spec, readMessageLength, writeMessageLength,
+					connection.MACGenerator(hmacGenerator),
+					connection.MACVerifier(hmacVerifier, fatal),
+					connection.ErrorHandler(func(c *connection.Connection, err error) {
+						errs <- err
+					}),
+				)
+				require.NoError(t, err)
+				require.NoError(t, c.Connect())
+				defer c.Close()
+
+				require.NoError(t, send(t, c, "000"))
+
+				err = send(t, c, tampered)
+				require.ErrorIs(t, err, connection.ErrMACVerification)
+
+				var macErr *connection.MACVerificationError
+				require.ErrorAs(t, <-errs, &macErr)
+
+				// error keeps the rejected message
+				rejected := iso8583.NewMessage(spec)
+				require.NoError(t, rejected.Unpack(macErr.RawMessage))
+				code, err := rejected.GetString(2)
+				require.NoError(t, err)
+				require.Equal(t, tampered, code)
+
+				require.Equal(t, uint64(1), c.Stats().MACVerificationFailures)
+
+				if !fatal {
+					require.NoError(t, send(t, c, "000"))
+					return
+				}
+
+				select {
+				case <-c.Done():
+				case <-time.After(time.Second):
+					t.Fatal("connection was not closed")
+				}
+			})
+		}
+	})
+}
+
+func TestClient_MessagePool(t *testing.T) {
+	// frameWithCode returns network management message with optional test
+	// case code (field 2) with length header
+	frameWithCode := func(t *testing.T, stan, code string) []byte {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, stan))
+		if code != "" {
+			require.NoError(t, message.Field(2, code))
+		}
+
+		packed, err := message.Pack()
+		require.NoError(t, err)
+
+		var buf bytes.Buffer
+		_, err = writeMessageLength(&buf, len(packed))
+		require.NoError(t, err)
+		buf.Write(packed)
+
+		return buf.Bytes()
+	}
+
+	t.Run("reused messages don't keep fields of previous messages", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		type received struct {
+			stan   string
+			fields []int
+			code   string
+		}
+		receivedCh := make(chan received)
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.MessagePool(true),
+			connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+				var r received
+				r.stan, _ = message.GetString(11)
+				for id := range message.GetFields() {
+					r.fields = append(r.fields, id)
+				}
+				r.code, _ = message.GetString(2)
+				receivedCh <- r
+			}),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		// messages are received one by one, so the second message may
+		// reuse the first one
+		for _, code := range []string{"777", ""} {
+			stan := getSTAN()
+			go serverConn.Write(frameWithCode(t, stan, code))
+
+			r := <-receivedCh
+			require.Equal(t, stan, r.stan)
+			require.Equal(t, code, r.code)
+			if code == "" {
+				require.NotContains(t, r.fields, 2)
+			}
+		}
+	})
+
+	t.Run("concurrent inbound messages", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		const messages = 1000
+		stans := make(chan string, messages)
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.MessagePool(true),
+			connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+				stan, _ := message.GetString(11)
+				stans <- stan
+			}),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		var data []byte
+		expected := make([]string, messages)
+		for i := range expected {
+			expected[i] = getSTAN()
+			data = append(data, frameWithCode(t, expected[i], "777")...)
+		}
+		go serverConn.Write(data)
+
+		actual := make([]string, messages)
+		for i := range actual {
+			actual[i] = <-stans
+		}
+		require.ElementsMatch(t, expected, actual)
+	})
+
+	t.Run("responses may be released by the caller", func(t *testing.T) {
+		server, err := NewTestServer()
+		require.NoError(t, err)
+		defer server.Close()
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.MessagePool(true),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		for i := 0; i < 10; i++ {
+			stan := getSTAN()
+
+			message := iso8583.NewMessage(testSpec)
+			message.MTI("0800")
+			require.NoError(t, message.Field(11, stan))
+
+			response, err := c.Send(message)
+			require.NoError(t, err)
+
+			responseSTAN, err := response.GetString(11)
+			require.NoError(t, err)
+			require.Equal(t, stan, responseSTAN)
+
+			c.ReleaseMessage(response)
+		}
+	})
+}
+
+func TestClient_ScrubFields(t *testing.T) {
+	spec := specWithFields(map[int]field.Field{
+		35: field.NewString(&field.Spec{
+			Length:      37,
+			Description: "Track 2 Data",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.LL,
+		}),
+		52: field.NewBinary(&field.Spec{
+			Length:      8,
+			Description: "PIN Data",
+			Enc:         encoding.Binary,
+			Pref:        prefix.Binary.Fixed,
+		}),
+	})
+
+	track2 := "4242424242424242=25121011000012300000"
+	pinBlock := []byte{0x04, 0x12, 0x34, 0xfd, 0xdd, 0xee, 0xff, 0x01}
+
+	newMessage := func(t *testing.T, mti string, pin []byte) *iso8583.Message {
+		message := iso8583.NewMessage(spec)
+		message.MTI(mti)
+		require.NoError(t, message.Field(2, "777"))
+		require.NoError(t, message.Field(11, getSTAN()))
+		require.NoError(t, message.Field(35, track2))
+		require.NoError(t, message.BinaryField(52, pin))
+
+		return message
+	}
+
+	writePacked := func(t *testing.T, w io.Writer, message *iso8583.Message) {
+		packed, err := message.Pack()
+		require.NoError(t, err)
+
+		_, err = writeMessageLength(w, len(packed))
+		require.NoError(t, err)
+		_, err = w.Write(packed)
+		require.NoError(t, err)
+	}
+
+	t.Run("fields are scrubbed after Send returns", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		c, err := connection.NewFrom(clientConn, spec, readMessageLength, writeMessageLength,
+			connection.ScrubFields([]int{2, 35, 52}),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		pin := append([]byte(nil), pinBlock...)
+		message := newMessage(t, "0800", pin)
+		stan, err := message.GetString(11)
+		require.NoError(t, err)
+
+		sendErr := make(chan error, 1)
+		go func() {
+			_, err := c.Send(message)
+			sendErr <- err
+		}()
+
+		length, err := readMessageLength(serverConn)
+		require.NoError(t, err)
+		packed := make([]byte, length)
+		_, err = io.ReadFull(serverConn, packed)
+		require.NoError(t, err)
+
+		// message was written with the sensitive data
+		received := iso8583.NewMessage(spec)
+		require.NoError(t, received.Unpack(packed))
+
+		value, err := received.GetString(2)
+		require.NoError(t, err)
+		require.Equal(t, "777", value)
+
+		value, err = received.GetString(35)
+		require.NoError(t, err)
+		require.Equal(t, track2, value)
+
+		receivedPin, err := received.GetBytes(52)
+		require.NoError(t, err)
+		require.Equal(t, pinBlock, receivedPin)
+
+		response := iso8583.NewMessage(spec)
+		response.MTI("0810")
+		require.NoError(t, response.Field(11, stan))
+		writePacked(t, serverConn, response)
+
+		require.NoError(t, <-sendErr)
+
+		// sensitive fields are empty and PIN block is zeroed
+		value, err = message.GetString(2)
+		require.NoError(t, err)
+		require.Empty(t, value)
+
+		value, err = message.GetString(35)
+		require.NoError(t, err)
+		require.Empty(t, value)
+
+		scrubbedPin, err := message.GetBytes(52)
+		require.NoError(t, err)
+		require.Empty(t, scrubbedPin)
+		require.Equal(t, make([]byte, len(pinBlock)), pin)
+
+		// other fields are left as is
+		value, err = message.GetString(11)
+		require.NoError(t, err)
+		require.Equal(t, stan, value)
+	})
+
+	t.Run("inbound fields are scrubbed when handler returns", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		c, err := connection.NewFrom(clientConn, spec, readMessageLength, writeMessageLength,
+			connection.ScrubFields([]int{2, 35, 52}),
+			connection.ScrubInbound(true),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		pin := append([]byte(nil), pinBlock...)
+		message := newMessage(t, "0800", pin)
+
+		c.ReleaseInbound(message)
+
+		value, err := message.GetString(35)
+		require.NoError(t, err)
+		require.Empty(t, value)
+		require.Equal(t, make([]byte, len(pinBlock)), pin)
+	})
+}
+
+func TestClient_Healthy(t *testing.T) {
+	t.Run("connection is healthy", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.PingHandler(func(c *connection.Connection) {}),
+			connection.SaturationThreshold(10),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		require.NoError(t, c.Healthy())
+	})
+
+	t.Run("ping is stale when nothing is received within ping window", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		clock := connectiontest.NewFakeClock(time.Now())
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.WithClock(clock),
+			connection.PingHandler(func(c *connection.Connection) {}),
+			connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {}),
+			connection.PingWindow(time.Minute),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		clock.Advance(time.Minute)
+		require.NoError(t, c.Healthy())
+
+		clock.Advance(time.Second)
+		err = c.Healthy()
+		require.ErrorIs(t, err, connection.ErrUnhealthy)
+		require.Contains(t, err.Error(), "ping is stale")
+
+		// any inbound message shows that the link is alive
+		_, err = serverConn.Write(packedFrame(t, getSTAN()))
+		require.NoError(t, err)
+
+		require.Eventually(t, func() bool {
+			return c.Healthy() == nil
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("saturated connection is unhealthy", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		clock := connectiontest.NewFakeClock(time.Now())
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.WithClock(clock),
+			connection.SaturationThreshold(1),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+		go c.Send(message)
+
+		require.Eventually(t, func() bool {
+			return c.PendingRequests() == 1
+		}, time.Second, 10*time.Millisecond)
+
+		err = c.Healthy()
+		require.ErrorIs(t, err, connection.ErrUnhealthy)
+		require.Contains(t, err.Error(), "saturation threshold")
+
+		// nobody reads the message, so let request time out before Close
+		expirePendingRequests(t, c, clock)
+	})
+
+	t.Run("disconnected connection is unhealthy", func(t *testing.T) {
+		c, err := connection.New("127.0.0.1:0", testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+
+		err = c.Healthy()
+		require.ErrorIs(t, err, connection.ErrUnhealthy)
+		require.Contains(t, err.Error(), "connection is offline")
+
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		c, err = connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+		require.NoError(t, c.Healthy())
+
+		require.NoError(t, c.Close())
+
+		err = c.Healthy()
+		require.ErrorIs(t, err, connection.ErrUnhealthy)
+	})
+}
+
+func TestClient_Name(t *testing.T) {
+	t.Run("errors include connection name", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		clock := connectiontest.NewFakeClock(time.Now())
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.WithClock(clock),
+			connection.Name("visa-eu-primary"),
+			connection.Tags(map[string]string{"currency": "EUR"}),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		sendErr := make(chan error, 1)
+		go func() {
+			_, err := c.Send(message)
+			sendErr <- err
+		}()
+
+		// nobody reads the message, so it times out
+		expirePendingRequests(t, c, clock)
+
+		err = <-sendErr
+		require.ErrorIs(t, err, connection.ErrSendTimeout)
+		require.EqualError(t, err, "connection visa-eu-primary: message send timeout")
+	})
+
+	t.Run("errors passed to ErrorHandler include connection name", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		errs := make(chan error, 1)
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.Name("visa-eu-primary"),
+			connection.ErrorHandler(func(c *connection.Connection, err error) {
+				errs <- err
+			}),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		// response to the request that was never sent
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0810")
+		require.NoError(t, message.Field(11, getSTAN()))
+		packed, err := message.Pack()
+		require.NoError(t, err)
+
+		_, err = writeMessageLength(serverConn, len(packed))
+		require.NoError(t, err)
+		_, err = serverConn.Write(packed)
+		require.NoError(t, err)
+
+		select {
+		case err := <-errs:
+			require.Contains(t, err.Error(), "connection visa-eu-primary: can't find request for ID")
+		case <-time.After(time.Second):
+			t.Fatal("error was not reported")
+		}
+	})
+
+	t.Run("errors are not wrapped without name", func(t *testing.T) {
+		c, err := connection.New("127.0.0.1:0", testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		require.NoError(t, c.Close())
+		_, err = c.Send(message)
+		require.Equal(t, connection.ErrConnectionClosed, err)
+	})
+}
+
+func TestClient_DeadLetterHandler(t *testing.T) {
+	type deadLetter struct {
+		stan   string
+		reason error
+	}
+
+	newDeadLetterHandler := func(t *testing.T) (connection.Option, chan deadLetter) {
+		deadLetters := make(chan deadLetter, 10)
+
+		return connection.DeadLetterHandler(func(message *iso8583.Message, reason error) {
+			stan, err := message.GetString(11)
+			require.NoError(t, err)
+
+			deadLetters <- deadLetter{stan: stan, reason: reason}
+		}), deadLetters
+	}
+
+	receive := func(t *testing.T, deadLetters chan deadLetter) deadLetter {
+		t.Helper()
+
+		select {
+		case dl := <-deadLetters:
+			return dl
+		case <-time.After(time.Second):
+			t.Fatal("message was not dead-lettered")
+		}
+
+		return deadLetter{}
+	}
+
+	t.Run("queued messages are dead-lettered when connection is closed", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+
+		deadLetterHandler, deadLetters := newDeadLetterHandler(t)
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			deadLetterHandler,
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		// one advice blocks the writer as nobody reads from the pipe,
+		// the other one waits in the queue
+		replyErrs := make(chan error, 2)
+		stans := map[string]bool{}
+		for i := 0; i < 2; i++ {
+			message := iso8583.NewMessage(testSpec)
+			message.MTI("0820")
+			stan := getSTAN()
+			require.NoError(t, message.Field(11, stan))
+			stans[stan] = true
+
+			go func() { replyErrs <- c.Reply(message) }()
+		}
+
+		require.Eventually(t, func() bool {
+			return c.Stats().OutgoingQueueDepth == 1
+		}, time.Second, 10*time.Millisecond)
+
+		require.NoError(t, serverConn.Close())
+
+		var written, dropped deadLetter
+		for i := 0; i < 2; i++ {
+			dl := receive(t, deadLetters)
+			require.True(t, stans[dl.stan])
+			delete(stans, dl.stan)
+
+			if errors.Is(dl.reason, connection.ErrConnectionClosed) {
+				dropped = dl
+			} else {
+				written = dl
+			}
+		}
+
+		require.Contains(t, written.reason.Error(), "writing message")
+		require.Contains(t, dropped.reason.Error(), "dropped from outgoing queue")
+
+		require.Error(t, <-replyErrs)
+		require.Error(t, <-replyErrs)
+
+		// each message is dead-lettered once
+		select {
+		case dl := <-deadLetters:
+			t.Fatalf("message %s was dead-lettered twice", dl.stan)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+
+	t.Run("message that can't be packed is dead-lettered", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		deadLetterHandler, deadLetters := newDeadLetterHandler(t)
+
+		// field 7 is set when message is written, so packing fails in
+		// the write loop after message was queued
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.AutoSetTransmissionTime(true),
+			deadLetterHandler,
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		// field 2 has fixed length 3
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0820")
+		require.NoError(t, message.Field(2, "12345"))
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		err = c.Reply(message)
+		require.Error(t, err)
+
+		dl := receive(t, deadLetters)
+		require.Equal(t, err.Error(), dl.reason.Error())
+	})
+}
+
+func TestClient_AutoReconnect(t *testing.T) {
+	// closeConnection makes test server close the connection after the
+	// reply and waits for the client to notice it
+	closeConnection := func(t *testing.T, c *connection.Connection, closed chan struct{}) {
+		message := iso8583.NewMessage(testSpec)
+		err := message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(TestCaseCloseConnection),
+			STAN:         field.NewStringValue(getSTAN()),
+		})
+		require.NoError(t, err)
+
+		_, err = c.Send(message)
+		require.NoError(t, err)
+
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Fatal("connection was not closed")
+		}
+	}
+
+	closedHandler := func() (connection.Option, chan struct{}) {
+		closed := make(chan struct{}, 10)
+
+		return connection.ConnectionClosedHandler(func(c *connection.Connection) {
+			closed <- struct{}{}
+		}), closed
+	}
+
+	requireOnline := func(t *testing.T, c *connection.Connection) {
+		require.Eventually(t, func() bool {
+			return c.Status() == connection.StatusOnline
+		}, time.Second, 10*time.Millisecond)
+
+		message := iso8583.NewMessage(testSpec)
+		err := message.Marshal(baseFields{
+			MTI:  field.NewStringValue("0800"),
+			STAN: field.NewStringValue(getSTAN()),
+		})
+		require.NoError(t, err)
+
+		_, err = c.Send(message)
+		require.NoError(t, err)
+	}
+
+	t.Run("attempts grow while server is flapping", func(t *testing.T) {
+		server, err := NewTestServer()
+		require.NoError(t, err)
+		defer server.Close()
+
+		policy := &recordingBackoff{delay: 10 * time.Millisecond}
+		closedOption, closed := closedHandler()
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			closedOption,
+			connection.AutoReconnect(true),
+			connection.ReconnectBackoff(policy),
+			connection.ReconnectStablePeriod(time.Hour),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		for i := 0; i < 3; i++ {
+			closeConnection(t, c, closed)
+			requireOnline(t, c)
+		}
+
+		require.Equal(t, []int{1, 2, 3}, policy.Attempts())
+	})
+
+	t.Run("attempts are reset after stable period", func(t *testing.T) {
+		server, err := NewTestServer()
+		require.NoError(t, err)
+		defer server.Close()
+
+		policy := &recordingBackoff{delay: 10 * time.Millisecond}
+		closedOption, closed := closedHandler()
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			closedOption,
+			connection.AutoReconnect(true),
+			connection.ReconnectBackoff(policy),
+			connection.ReconnectStablePeriod(time.Nanosecond),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		for i := 0; i < 3; i++ {
+			closeConnection(t, c, closed)
+			requireOnline(t, c)
+		}
+
+		require.Equal(t, []int{1, 1, 1}, policy.Attempts())
+	})
+
+	t.Run("dial to unreachable host doesn't block the connection", func(t *testing.T) {
+		server, err := NewTestServer()
+		require.NoError(t, err)
+		defer server.Close()
+
+		closedOption, closed := closedHandler()
+
+		// the first dial connects, the following ones hang until
+		// DialTimeout like the dial of blackholed host
+		var dials int32
+		dialing := make(chan struct{}, 10)
+		dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if atomic.AddInt32(&dials, 1) == 1 {
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			}
+
+			dialing <- struct{}{}
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+
+		dialErrs := make(chan error, 10)
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			closedOption,
+			connection.WithDialFunc(dial),
+			connection.DialTimeout(200*time.Millisecond),
+			connection.AutoReconnect(true),
+			connection.ReconnectBackoff(connection.ConstantBackoff{Interval: 10 * time.Millisecond}),
+			connection.ErrorHandler(func(c *connection.Connection, err error) {
+				dialErrs <- err
+			}),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+
+		closeConnection(t, c, closed)
+
+		select {
+		case <-dialing:
+		case <-time.After(time.Second):
+			t.Fatal("connection was not reconnecting")
+		}
+
+		started := time.Now()
+		require.Equal(t, connection.StatusReconnecting, c.Status())
+
+		message := iso8583.NewMessage(testSpec)
+		require.NoError(t, message.Marshal(baseFields{
+			MTI:  field.NewStringValue("0800"),
+			STAN: field.NewStringValue(getSTAN()),
+		}))
+		_, err = c.Send(message)
+		require.ErrorIs(t, err, connection.ErrConnectionClosed)
+		require.Less(t, time.Since(started), 100*time.Millisecond)
+
+		// dial is limited by DialTimeout
+		select {
+		case err := <-dialErrs:
+			require.ErrorIs(t, err, context.DeadlineExceeded)
+		case <-time.After(time.Second):
+			t.Fatal("dial did not time out")
+		}
+
+		select {
+		case <-dialing:
+		case <-time.After(time.Second):
+			t.Fatal("connection was not reconnecting")
+		}
+
+		started = time.Now()
+		require.NoError(t, c.Close())
+		require.Less(t, time.Since(started), 100*time.Millisecond)
+		require.Equal(t, connection.StatusOffline, c.Status())
+	})
+
+	t.Run("it retries until server is back", func(t *testing.T) {
+		srv, err := NewTestServer()
+		require.NoError(t, err)
+		addr := srv.Addr
+
+		policy := &recordingBackoff{delay: 10 * time.Millisecond}
+
+		c, err := connection.New(addr, testSpec, readMessageLength, writeMessageLength,
+			connection.AutoReconnect(true),
+			connection.ReconnectBackoff(policy),
+			connection.ErrorHandler(func(c *connection.Connection, err error) {}),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		srv.Close()
+
+		require.Eventually(t, func() bool {
+			return len(policy.Attempts()) >= 3
+		}, time.Second, 10*time.Millisecond)
+		require.Equal(t, connection.StatusReconnecting, c.Status())
+
+		// server is back on the same address
+		restarted := server.New(testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, restarted.Start(addr))
+		defer restarted.Close()
+
+		require.Eventually(t, func() bool {
+			return c.Status() == connection.StatusOnline
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("NoRetry leaves connection offline", func(t *testing.T) {
+		server, err := NewTestServer()
+		require.NoError(t, err)
+		defer server.Close()
+
+		closedOption, closed := closedHandler()
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			closedOption,
+			connection.AutoReconnect(true),
+			connection.ReconnectBackoff(connection.NoRetry{}),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		closeConnection(t, c, closed)
+
+		require.Eventually(t, func() bool {
+			return c.Status() == connection.StatusOffline
+		}, time.Second, 10*time.Millisecond)
+
+		// application can connect again
+		require.NoError(t, c.Connect())
+		requireOnline(t, c)
+	})
+
+	t.Run("it gives up after MaxReconnectAttempts", func(t *testing.T) {
+		srv, err := NewTestServer()
+		require.NoError(t, err)
+
+		policy := &recordingBackoff{delay: 10 * time.Millisecond}
+		exhausted := make(chan error, 10)
+
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.AutoReconnect(true),
+			connection.ReconnectBackoff(policy),
+			connection.MaxReconnectAttempts(3),
+			connection.ReconnectsExhaustedHandler(func(lastErr error) {
+				exhausted <- lastErr
+			}),
+			connection.ErrorHandler(func(c *connection.Connection, err error) {}),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		// server is shut down permanently
+		srv.Close()
+
+		select {
+		case lastErr := <-exhausted:
+			require.Contains(t, lastErr.Error(), "connecting to server")
+		case <-time.After(time.Second):
+			t.Fatal("ReconnectsExhaustedHandler was not called")
+		}
+
+		require.Equal(t, []int{1, 2, 3}, policy.Attempts())
+		require.Equal(t, connection.StatusOffline, c.Status())
+
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		_, err = c.Send(message)
+		require.ErrorIs(t, err, connection.ErrReconnectExhausted)
+		require.ErrorIs(t, c.Reply(message), connection.ErrReconnectExhausted)
+
+		// no more attempts are made
+		time.Sleep(50 * time.Millisecond)
+		require.Len(t, policy.Attempts(), 3)
+		require.Len(t, exhausted, 0)
+
+		// explicit Connect resets the state
+		require.Error(t, c.Connect())
+		_, err = c.Send(message)
+		require.ErrorIs(t, err, connection.ErrConnectionClosed)
+	})
+
+	t.Run("Close stops reconnecting", func(t *testing.T) {
+		srv, err := NewTestServer()
+		require.NoError(t, err)
+
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.AutoReconnect(true),
+			connection.ReconnectBackoff(connection.ConstantBackoff{Interval: time.Hour}),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+
+		srv.Close()
+
+		require.Eventually(t, func() bool {
+			return c.Status() == connection.StatusReconnecting
+		}, time.Second, 10*time.Millisecond)
+
+		require.NoError(t, c.Close())
+		require.Equal(t, connection.StatusOffline, c.Status())
+	})
+}
+
+// recordingBackoff is the constant backoff policy that records attempts
+type recordingBackoff struct {
+	delay time.Duration
+
+	mu       sync.Mutex
+	attempts []int
+}
+
+func (b *recordingBackoff) Next(attempt int, lastErr error) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.attempts = append(b.attempts, attempt)
+
+	return b.delay
+}
+
+func (b *recordingBackoff) Attempts() []int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]int(nil), b.attempts...)
+}
+
+func TestClient_Resolve(t *testing.T) {
+	// hostAddrs maps fake IP addresses to the addresses of the test
+	// servers, so the stub resolver can point the host to any of them
+	newDialFunc := func(hostAddrs map[string]string) connection.DialFunc {
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+
+			serverAddr, found := hostAddrs[host]
+			if !found {
+				return nil, fmt.Errorf("host %s is unreachable", host)
+			}
+
+			return (&net.Dialer{}).DialContext(ctx, network, serverAddr)
+		}
+	}
+
+	t.Run("host is resolved on each reconnect", func(t *testing.T) {
+		primary, err := NewTestServer()
+		require.NoError(t, err)
+		defer primary.Close()
+
+		secondary, err := NewTestServer()
+		require.NoError(t, err)
+		defer secondary.Close()
+
+		resolver := &stubResolver{addrs: []string{"10.0.0.1"}}
+		closed := make(chan struct{}, 1)
+
+		c, err := connection.New("iso.example.com:9999", testSpec, readMessageLength, writeMessageLength,
+			connection.WithResolver(resolver),
+			connection.WithDialFunc(newDialFunc(map[string]string{
+				"10.0.0.1": primary.Addr,
+				"10.0.0.2": secondary.Addr,
+			})),
+			connection.AutoReconnect(true),
+			connection.ReconnectBackoff(connection.ConstantBackoff{Interval: 10 * time.Millisecond}),
+			connection.ConnectionClosedHandler(func(c *connection.Connection) {
+				closed <- struct{}{}
+			}),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		require.Equal(t, primary.Addr, c.RemoteAddr().String())
+
+		// DNS record is changed and primary server closes the connection
+		resolver.SetAddrs([]string{"10.0.0.2"})
+
+		message := iso8583.NewMessage(testSpec)
+		err = message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(TestCaseCloseConnection),
+			STAN:         field.NewStringValue(getSTAN()),
+		})
+		require.NoError(t, err)
+
+		_, err = c.Send(message)
+		require.NoError(t, err)
+		<-closed
+
+		require.Eventually(t, func() bool {
+			addr := c.RemoteAddr()
+			return addr != nil && addr.String() == secondary.Addr
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("all resolved addresses are dialed", func(t *testing.T) {
+		server, err := NewTestServer()
+		require.NoError(t, err)
+		defer server.Close()
+
+		resolver := &stubResolver{addrs: []string{"10.0.0.9", "10.0.0.1"}}
+		dialFunc := newDialFunc(map[string]string{"10.0.0.1": server.Addr})
+
+		c, err := connection.New("iso.example.com:9999", testSpec, readMessageLength, writeMessageLength,
+			connection.WithResolver(resolver),
+			connection.WithDialFunc(dialFunc),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		require.Equal(t, server.Addr, c.RemoteAddr().String())
+		require.NoError(t, c.Close())
+
+		// only the first unreachable address is dialed
+		c, err = connection.New("iso.example.com:9999", testSpec, readMessageLength, writeMessageLength,
+			connection.WithResolver(resolver),
+			connection.WithDialFunc(dialFunc),
+			connection.DialAllAddresses(false),
+		)
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "host 10.0.0.9 is unreachable")
+	})
+
+	t.Run("SRV targets are dialed by priority", func(t *testing.T) {
+		primary, err := NewTestServer()
+		require.NoError(t, err)
+		defer primary.Close()
+
+		backup, err := NewTestServer()
+		require.NoError(t, err)
+		defer backup.Close()
+
+		resolver := &stubSRVResolver{targets: []*net.SRV{
+			{Target: "10.0.0.2.", Port: 9999, Priority: 20, Weight: 10},
+			{Target: "10.0.0.1.", Port: 9999, Priority: 10, Weight: 10},
+		}}
+		hostAddrs := map[string]string{
+			"10.0.0.1": primary.Addr,
+			"10.0.0.2": backup.Addr,
+		}
+
+		closed := make(chan struct{}, 1)
+
+		c, err := connection.New("", testSpec, readMessageLength, writeMessageLength,
+			connection.SRVDiscovery("iso", "tcp", "payments.internal"),
+			connection.WithSRVResolver(resolver),
+			connection.WithDialFunc(newDialFunc(hostAddrs)),
+			connection.AutoReconnect(true),
+			connection.ReconnectBackoff(connection.ConstantBackoff{Interval: 10 * time.Millisecond}),
+			connection.ConnectionClosedHandler(func(c *connection.Connection) {
+				closed <- struct{}{}
+			}),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		require.Equal(t, primary.Addr, c.RemoteAddr().String())
+
+		require.Equal(t, "_iso._tcp.payments.internal", resolver.LookedUp())
+
+		// connection is reconnected to the discovered target
+		message := iso8583.NewMessage(testSpec)
+		err = message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(TestCaseCloseConnection),
+			STAN:         field.NewStringValue(getSTAN()),
+		})
+		require.NoError(t, err)
+
+		_, err = c.Send(message)
+		require.NoError(t, err)
+		<-closed
+
+		require.Eventually(t, func() bool {
+			return c.Status() == connection.StatusOnline
+		}, time.Second, 10*time.Millisecond)
+		require.NoError(t, c.Close())
+
+		// target with lower priority is dialed when primary is down
+		delete(hostAddrs, "10.0.0.1")
+
+		require.NoError(t, c.Connect())
+		require.Equal(t, backup.Addr, c.RemoteAddr().String())
+		require.NoError(t, c.Close())
+
+		// connect fails when all targets are down
+		delete(hostAddrs, "10.0.0.2")
+
+		err = c.Connect()
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "connecting to server _iso._tcp.payments.internal")
+	})
+
+	t.Run("SRV targets with the same priority are dialed by weight", func(t *testing.T) {
+		light, err := NewTestServer()
+		require.NoError(t, err)
+		defer light.Close()
+
+		heavy, err := NewTestServer()
+		require.NoError(t, err)
+		defer heavy.Close()
+
+		resolver := &stubSRVResolver{targets: []*net.SRV{
+			{Target: "10.0.0.1.", Port: 9999, Priority: 10, Weight: 0},
+			{Target: "10.0.0.2.", Port: 9999, Priority: 10, Weight: 65535},
+		}}
+
+		c, err := connection.New("", testSpec, readMessageLength, writeMessageLength,
+			connection.SRVDiscovery("iso", "tcp", "payments.internal"),
+			connection.WithSRVResolver(resolver),
+			connection.WithDialFunc(newDialFunc(map[string]string{
+				"10.0.0.1": light.Addr,
+				"10.0.0.2": heavy.Addr,
+			})),
+		)
+		require.NoError(t, err)
+
+		// target with zero weight is chosen first with 1/65536 chance
+		for i := 0; i < 10; i++ {
+			require.NoError(t, c.Connect())
+			require.Equal(t, heavy.Addr, c.RemoteAddr().String())
+			require.NoError(t, c.Close())
+		}
+	})
+
+	t.Run("resolution time is limited", func(t *testing.T) {
+		resolver := &stubResolver{block: true}
+
+		c, err := connection.New("iso.example.com:9999", testSpec, readMessageLength, writeMessageLength,
+			connection.WithResolver(resolver),
+			connection.ResolveTimeout(50*time.Millisecond),
+		)
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
+
+// stubSRVResolver returns targets for any SRV lookup and remembers the
+// name of the last lookup
+type stubSRVResolver struct {
+	targets []*net.SRV
+
+	mu       sync.Mutex
+	lookedUp string
+}
+
+func (r *stubSRVResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lookedUp = fmt.Sprintf("_%s._%s.%s", service, proto, name)
+
+	return r.lookedUp, r.targets, nil
+}
+
+func (r *stubSRVResolver) LookedUp() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.lookedUp
+}
+
+// stubResolver resolves any host into addrs. When block is set, it waits
+// for the context to be done.
+type stubResolver struct {
+	block bool
+
+	mu    sync.Mutex
+	addrs []string
+}
+
+func (r *stubResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if r.block {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]string(nil), r.addrs...), nil
+}
+
+func (r *stubResolver) SetAddrs(addrs []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.addrs = addrs
+}
+
+func TestClient_SetAddr(t *testing.T) {
+	newMessage := func(t *testing.T, testCase string) *iso8583.Message {
+		message := iso8583.NewMessage(testSpec)
+		err := message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(testCase),
+			STAN:         field.NewStringValue(getSTAN()),
+		})
+		require.NoError(t, err)
+
+		return message
+	}
+
+	t.Run("connection is migrated to the new address", func(t *testing.T) {
+		oldServer, err := NewTestServer()
+		require.NoError(t, err)
+		defer oldServer.Close()
+
+		newServer, err := NewTestServer()
+		require.NoError(t, err)
+		defer newServer.Close()
+
+		changes := make(chan [2]string, 1)
+
+		c, err := connection.New(oldServer.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.AddrChangedHandler(func(c *connection.Connection, oldAddr, newAddr string) {
+				changes <- [2]string{oldAddr, newAddr}
+			}),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		// request is pending on the old server when address is changed
+		pendingErr := make(chan error, 1)
+		go func() {
+			_, err := c.Send(newMessage(t, TestCaseDelayedResponse))
+			pendingErr <- err
+		}()
+		require.Eventually(t, func() bool {
+			return c.PendingRequests() == 1
+		}, time.Second, 10*time.Millisecond)
+
+		require.NoError(t, c.SetAddr(newServer.Addr, true))
+		require.Equal(t, newServer.Addr, c.RemoteAddr().String())
+		require.Equal(t, [2]string{oldServer.Addr, newServer.Addr}, <-changes)
+
+		_, err = c.Send(newMessage(t, TestCasePingCounter))
+		require.NoError(t, err)
+
+		require.Equal(t, 1, newServer.ReceivedPings())
+		require.Equal(t, 0, oldServer.ReceivedPings())
+
+		// pending request gets its response from the old server
+		require.NoError(t, <-pendingErr)
+	})
+
+	t.Run("migrated connection is signed off and established", func(t *testing.T) {
+		oldServer, err := NewTestServer()
+		require.NoError(t, err)
+		defer oldServer.Close()
+
+		newServer, err := NewTestServer()
+		require.NoError(t, err)
+		defer newServer.Close()
+
+		established := make(chan struct{}, 10)
+
+		c, err := connection.New(oldServer.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.RequireSignOn(),
+			connection.SignOnDetector(func(request, response *iso8583.Message) bool {
+				return true
+			}),
+			connection.ConnectionEstablishedHandler(func(c *connection.Connection) {
+				established <- struct{}{}
+			}),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		requireEstablished := func(t *testing.T) {
+			t.Helper()
+
+			select {
+			case <-established:
+			case <-time.After(time.Second):
+				t.Fatal("ConnectionEstablishedHandler was not called")
+			}
+		}
+		requireEstablished(t)
+
+		_, err = c.Send(newMessage(t, TestCaseReply))
+		require.NoError(t, err)
+		require.Equal(t, connection.SignedOn, c.SignOnState())
+
+		require.NoError(t, c.SetAddr(newServer.Addr, true))
+		requireEstablished(t)
+
+		// new host has to be signed on
+		require.Equal(t, connection.SignedOff, c.SignOnState())
+
+		financial := newMessage(t, TestCaseReply)
+		financial.MTI("0200")
+		_, err = c.Send(financial)
+		require.ErrorIs(t, err, connection.ErrNotSignedOn)
+	})
+
+	t.Run("Send is not blocked while new address is dialed", func(t *testing.T) {
+		server, err := NewTestServer()
+		require.NoError(t, err)
+		defer server.Close()
+
+		newServer, err := NewTestServer()
+		require.NoError(t, err)
+		defer newServer.Close()
+
+		// dial of the new address waits until it's released
+		release := make(chan struct{})
+		dialing := make(chan struct{})
+		dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if addr == newServer.Addr {
+				close(dialing)
+				<-release
+			}
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		}
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.WithDialFunc(dial),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		migrated := make(chan error, 1)
+		go func() {
+			migrated <- c.SetAddr(newServer.Addr, true)
+		}()
+		<-dialing
+
+		_, err = c.Send(newMessage(t, TestCaseReply))
+		require.NoError(t, err)
+		require.Equal(t, server.Addr, c.RemoteAddr().String())
+
+		close(release)
+		require.NoError(t, <-migrated)
+		require.Equal(t, newServer.Addr, c.RemoteAddr().String())
+	})
+
+	t.Run("new address is used by the next Connect", func(t *testing.T) {
+		oldServer, err := NewTestServer()
+		require.NoError(t, err)
+		defer oldServer.Close()
+
+		newServer, err := NewTestServer()
+		require.NoError(t, err)
+		defer newServer.Close()
+
+		c, err := connection.New(oldServer.Addr, testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+
+		require.NoError(t, c.SetAddr(newServer.Addr, false))
+		require.Equal(t, oldServer.Addr, c.RemoteAddr().String())
+
+		require.NoError(t, c.Close())
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		require.Equal(t, newServer.Addr, c.RemoteAddr().String())
+	})
+
+	t.Run("connection is not changed when new address is unreachable", func(t *testing.T) {
+		server, err := NewTestServer()
+		require.NoError(t, err)
+		defer server.Close()
+
+		// address of the closed listener
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		unreachable := ln.Addr().String()
+		require.NoError(t, ln.Close())
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		require.Error(t, c.SetAddr(unreachable, true))
+		require.Equal(t, server.Addr, c.RemoteAddr().String())
+
+		_, err = c.Send(newMessage(t, TestCaseReply))
+		require.NoError(t, err)
+	})
+}
+
+func TestClient_TimeoutReversal(t *testing.T) {
+	server, err := NewTestServer()
+	require.NoError(t, err)
+	defer server.Close()
+
+	newRequest := func(t *testing.T, testCase string) *iso8583.Message {
+		message := iso8583.NewMessage(testSpec)
+		err := message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(testCase),
+			STAN:         field.NewStringValue(getSTAN()),
+		})
+		require.NoError(t, err)
+
+		return message
+	}
+
+	t.Run("timed out request is reversed and its late response is reported", func(t *testing.T) {
+		type reversalResult struct {
+			stan string
+			mti  string
+			err  error
+		}
+		results := make(chan reversalResult, 1)
+		lateResponses := make(chan string, 1)
+		inbound := make(chan string, 1)
+
+		var reversalSTAN string
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			// test server handles only 0800 messages
+			connection.ReversalMTIs("0800"),
+			connection.SendTimeout(300*time.Millisecond),
+			connection.TimeoutReversalHandler(func(original *iso8583.Message) *iso8583.Message {
+				reversal := newRequest(t, TestCaseReply)
+				reversalSTAN, _ = reversal.GetString(11)
+
+				return reversal
+			}),
+			connection.ReversalResultHandler(func(c *connection.Connection, reversal, response *iso8583.Message, err error) {
+				stan, _ := reversal.GetString(11)
+				var mti string
+				if response != nil {
+					mti, _ = response.GetMTI()
+				}
+				results <- reversalResult{stan: stan, mti: mti, err: err}
+			}),
+			connection.LateResponseAfterReversalHandler(func(c *connection.Connection, original, response *iso8583.Message) {
+				stan, _ := response.GetString(11)
+				lateResponses <- stan
+			}),
+			connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+				stan, _ := message.GetString(11)
+				inbound <- stan
+			}),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		original := newRequest(t, TestCaseDelayedResponse)
+		originalSTAN, err := original.GetString(11)
+		require.NoError(t, err)
+
+		_, err = c.Send(original)
+		require.ErrorIs(t, err, connection.ErrSendTimeout)
+
+		select {
+		case result := <-results:
+			require.NoError(t, result.err)
+			require.Equal(t, reversalSTAN, result.stan)
+			require.Equal(t, "0810", result.mti)
+		case <-time.After(time.Second):
+			t.Fatal("reversal result was not reported")
+		}
+
+		select {
+		case stan := <-lateResponses:
+			require.Equal(t, originalSTAN, stan)
+		case <-time.After(time.Second):
+			t.Fatal("late response after reversal was not reported")
+		}
+
+		select {
+		case stan := <-inbound:
+			require.Equal(t, originalSTAN, stan)
+		case <-time.After(time.Second):
+			t.Fatal("late response was not passed to InboundMessageHandler")
+		}
+	})
+
+	t.Run("requests with other MTIs are not reversed", func(t *testing.T) {
+		var reversals int32
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(100*time.Millisecond),
+			connection.TimeoutReversalHandler(func(original *iso8583.Message) *iso8583.Message {
+				atomic.AddInt32(&reversals, 1)
+				return nil
+			}),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		_, err = c.Send(newRequest(t, TestCaseDelayedResponse))
+		require.ErrorIs(t, err, connection.ErrSendTimeout)
+
+		require.Equal(t, int32(0), atomic.LoadInt32(&reversals))
+	})
+}
+
+func TestClient_QueuedMessageTTL(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+
+	now := time.Date(2026, time.March, 4, 5, 6, 7, 0, time.UTC)
+	clock := connectiontest.NewFakeClock(now)
+
+	deadLetters := make(chan error, 1)
+
+	c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+		connection.WithClock(clock),
+		connection.SendTimeout(time.Hour),
+		connection.QueuedMessageTTL(time.Minute),
+		connection.AutoSetTransmissionTime(true),
+		connection.DeadLetterHandler(func(message *iso8583.Message, reason error) {
+			deadLetters <- reason
+		}),
+	)
+	require.NoError(t, err)
+	defer c.Close()
+
+	newMessage := func(mti string) *iso8583.Message {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI(mti)
+		require.NoError(t, message.Field(7, "0101000000"))
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		return message
+	}
+
+	// the first message blocks the writer until we read it from the pipe
+	go c.Send(newMessage("0800"))
+	require.Eventually(t, func() bool {
+		return c.Stats().PendingRequests == 1
+	}, time.Second, 10*time.Millisecond)
+
+	expiredErr := make(chan error, 1)
+	go func() { expiredErr <- c.Reply(newMessage("0820")) }()
+	require.Eventually(t, func() bool {
+		return c.Stats().OutgoingQueueDepth == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// TTL of this message is overridden, so it doesn't expire and its
+	// field 7 is set when it's written
+	notExpired := iso8583.NewMessage(testSpec)
+	notExpired.MTI("0820")
+	require.NoError(t, notExpired.Field(11, getSTAN()))
+	c.SetMessageTTL(notExpired, 0)
+
+	notExpiredErr := make(chan error, 1)
+	go func() { notExpiredErr <- c.Reply(notExpired) }()
+	require.Eventually(t, func() bool {
+		return c.Stats().OutgoingQueueDepth == 2
+	}, time.Second, 10*time.Millisecond)
+
+	// messages wait in the queue longer than TTL
+	clock.Advance(2 * time.Minute)
+
+	readMessage := func() *iso8583.Message {
+		length, err := readMessageLength(serverConn)
+		require.NoError(t, err)
+
+		packed := make([]byte, length)
+		_, err = io.ReadFull(serverConn, packed)
+		require.NoError(t, err)
+
+		message := iso8583.NewMessage(testSpec)
+		require.NoError(t, message.Unpack(packed))
+
+		return message
+	}
+
+	mti, err := readMessage().GetMTI()
+	require.NoError(t, err)
+	require.Equal(t, "0800", mti)
+
+	// expired message is skipped
+	received := readMessage()
+	stan, err := received.GetString(11)
+	require.NoError(t, err)
+	expectedSTAN, err := notExpired.GetString(11)
+	require.NoError(t, err)
+	require.Equal(t, expectedSTAN, stan)
+
+	transmissionTime, err := received.GetString(7)
+	require.NoError(t, err)
+	require.Equal(t, "0304050807", transmissionTime)
+
+	require.ErrorIs(t, <-expiredErr, connection.ErrMessageExpired)
+	require.NoError(t, <-notExpiredErr)
+
+	select {
+	case reason := <-deadLetters:
+		require.ErrorIs(t, reason, connection.ErrMessageExpired)
+	case <-time.After(time.Second):
+		t.Fatal("expired message was not dead-lettered")
+	}
+
+	// nobody replies to the first message
+	expirePendingRequests(t, c, clock)
+}
+
+func TestClient_LateResponseGrace(t *testing.T) {
+	server, err := NewTestServer()
+	require.NoError(t, err)
+	defer server.Close()
+
+	newRequest := func(t *testing.T, testCase string) *iso8583.Message {
+		message := iso8583.NewMessage(testSpec)
+		err := message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(testCase),
+			STAN:         field.NewStringValue(getSTAN()),
+		})
+		require.NoError(t, err)
+
+		return message
+	}
+
+	type lateResponse struct {
+		requestID string
+		stan      string
+	}
+
+	newClient := func(t *testing.T, sendTimeout, grace time.Duration) (*connection.Connection, chan lateResponse, chan string, chan struct{}) {
+		lateResponses := make(chan lateResponse, 1)
+		inbound := make(chan string, 1)
+		reversals := make(chan struct{}, 1)
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(sendTimeout),
+			connection.LateResponseGrace(grace),
+			connection.LateResponseHandler(func(requestID string, response *iso8583.Message) {
+				stan, _ := response.GetString(11)
+				lateResponses <- lateResponse{requestID: requestID, stan: stan}
+			}),
+			connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+				stan, _ := message.GetString(11)
+				inbound <- stan
+			}),
+			// test server handles only 0800 messages
+			connection.ReversalMTIs("0800"),
+			connection.TimeoutReversalHandler(func(original *iso8583.Message) *iso8583.Message {
+				return newRequest(t, TestCaseReply)
+			}),
+			connection.ReversalResultHandler(func(c *connection.Connection, reversal, response *iso8583.Message, err error) {
+				reversals <- struct{}{}
+			}),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+
+		return c, lateResponses, inbound, reversals
+	}
+
+	t.Run("response received during grace period is passed to LateResponseHandler", func(t *testing.T) {
+		// response is delayed for 500ms
+		c, lateResponses, inbound, reversals := newClient(t, 300*time.Millisecond, 500*time.Millisecond)
+		defer c.Close()
+
+		message := newRequest(t, TestCaseDelayedResponse)
+		stan, err := message.GetString(11)
+		require.NoError(t, err)
+
+		_, err = c.Send(message)
+		require.ErrorIs(t, err, connection.ErrSendTimeout)
+
+		select {
+		case late := <-lateResponses:
+			require.Equal(t, stan, late.requestID)
+			require.Equal(t, stan, late.stan)
+		case <-time.After(time.Second):
+			t.Fatal("late response was not delivered")
+		}
+
+		// request is not reversed as response was received
+		select {
+		case <-inbound:
+			t.Fatal("late response was passed to InboundMessageHandler")
+		case <-reversals:
+			t.Fatal("request was reversed")
+		case <-time.After(600 * time.Millisecond):
+		}
+
+		stats := c.Stats()
+		require.Equal(t, uint64(1), stats.LateResponses)
+		require.Equal(t, uint64(0), stats.UnmatchedResponses)
+	})
+
+	t.Run("response received after grace period is unmatched", func(t *testing.T) {
+		c, lateResponses, inbound, reversals := newClient(t, 100*time.Millisecond, 100*time.Millisecond)
+		defer c.Close()
+
+		message := newRequest(t, TestCaseDelayedResponse)
+		stan, err := message.GetString(11)
+		require.NoError(t, err)
+
+		_, err = c.Send(message)
+		require.ErrorIs(t, err, connection.ErrSendTimeout)
+
+		select {
+		case <-reversals:
+		case <-time.After(time.Second):
+			t.Fatal("request was not reversed after grace period")
+		}
+
+		select {
+		case inboundSTAN := <-inbound:
+			require.Equal(t, stan, inboundSTAN)
+		case <-lateResponses:
+			t.Fatal("response was delivered after grace period")
+		case <-time.After(time.Second):
+			t.Fatal("response was not passed to InboundMessageHandler")
+		}
+
+		stats := c.Stats()
+		require.Equal(t, uint64(0), stats.LateResponses)
+		require.Equal(t, uint64(1), stats.UnmatchedResponses)
+	})
+}
+
+func TestClient_InboundMessageHandlerFor(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+
+	type routed struct {
+		handler string
+		mti     string
+	}
+	messages := make(chan routed, 10)
+
+	handler := func(name string) func(c *connection.Connection, message *iso8583.Message) {
+		return func(c *connection.Connection, message *iso8583.Message) {
+			mti, err := message.GetMTI()
+			require.NoError(t, err)
+
+			messages <- routed{handler: name, mti: mti}
+		}
+	}
+
+	c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+		connection.InboundMessageHandler(handler("catch-all")),
+		connection.InboundMessageHandlerFor("08", handler("08")),
+		connection.InboundMessageHandlerFor("02", handler("02")),
+		connection.InboundMessageHandlerFor("021", handler("021")),
+	)
+	require.NoError(t, err)
+	defer c.Close()
+
+	tests := []routed{
+		{mti: "0810", handler: "08"},
+		{mti: "0200", handler: "02"},
+		{mti: "0210", handler: "021"},
+		{mti: "0430", handler: "catch-all"},
+	}
+
+	for _, tt := range tests {
+		message := iso8583.NewMessage(testSpec)
+		err := message.Marshal(baseFields{
+			MTI:  field.NewStringValue(tt.mti),
+			STAN: field.NewStringValue(getSTAN()),
+		})
+		require.NoError(t, err)
+
+		packed, err := message.Pack()
+		require.NoError(t, err)
+
+		_, err = writeMessageLength(serverConn, len(packed))
+		require.NoError(t, err)
+		_, err = serverConn.Write(packed)
+		require.NoError(t, err)
+
+		select {
+		case msg := <-messages:
+			require.Equal(t, tt, msg)
+		case <-time.After(time.Second):
+			t.Fatalf("message %s was not handled", tt.mti)
+		}
+	}
+
+	t.Run("empty prefix is rejected", func(t *testing.T) {
+		_, err := connection.New("", testSpec, readMessageLength, writeMessageLength,
+			connection.InboundMessageHandlerFor("", handler("none")),
+		)
+		require.Error(t, err)
+	})
+}
+
+func TestClient_NetworkManagementHandler(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+
+	type routed struct {
+		handler string
+		mti     string
+	}
+	messages := make(chan routed, 10)
+
+	handler := func(name string) func(c *connection.Connection, message *iso8583.Message) {
+		return func(c *connection.Connection, message *iso8583.Message) {
+			mti, err := message.GetMTI()
+			require.NoError(t, err)
+
+			messages <- routed{handler: name, mti: mti}
+		}
+	}
+
+	c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+		connection.InboundMessageHandler(handler("catch-all")),
+		connection.NetworkManagementHandler(handler("network management")),
+		connection.InboundMessageHandlerFor("0200", handler("0200")),
+		connection.InboundMessageHandlerFor("084", handler("084")),
+	)
+	require.NoError(t, err)
+	defer c.Close()
+
+	tests := []routed{
+		{mti: "0800", handler: "network management"},
+		{mti: "0820", handler: "network management"},
+		{mti: "1804", handler: "network management"},
+		{mti: "0200", handler: "0200"},
+		{mti: "0840", handler: "084"},
+		// unmatched responses are not handled as network management
+		{mti: "0810", handler: "catch-all"},
+		{mti: "0100", handler: "catch-all"},
+	}
+
+	for _, tt := range tests {
+		message := iso8583.NewMessage(testSpec)
+		err := message.Marshal(baseFields{
+			MTI:  field.NewStringValue(tt.mti),
+			STAN: field.NewStringValue(getSTAN()),
+		})
+		require.NoError(t, err)
+
+		packed, err := message.Pack()
+		require.NoError(t, err)
+
+		_, err = writeMessageLength(serverConn, len(packed))
+		require.NoError(t, err)
+		_, err = serverConn.Write(packed)
+		require.NoError(t, err)
+
+		select {
+		case msg := <-messages:
+			require.Equal(t, tt, msg)
+		case <-time.After(time.Second):
+			t.Fatalf("message %s was not handled", tt.mti)
+		}
+	}
+}
+
+func TestClient_InboundWorkers(t *testing.T) {
+	// writeMessage writes unsolicited message to the client
+	writeMessage := func(t *testing.T, w io.Writer, stan string) {
+		message := iso8583.NewMessage(testSpec)
+		err := message.Marshal(baseFields{
+			MTI:  field.NewStringValue("0800"),
+			STAN: field.NewStringValue(stan),
+		})
+		require.NoError(t, err)
+
+		packed, err := message.Pack()
+		require.NoError(t, err)
+
+		_, err = writeMessageLength(w, len(packed))
+		require.NoError(t, err)
+		_, err = w.Write(packed)
+		require.NoError(t, err)
+	}
+
+	t.Run("no messages are lost when reading waits for workers", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		const messages = 10000
+
+		var mu sync.Mutex
+		handled := map[string]bool{}
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.InboundWorkers(4, 10),
+			connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+				stan, err := message.GetString(11)
+				require.NoError(t, err)
+
+				mu.Lock()
+				handled[stan] = true
+				mu.Unlock()
+			}),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		for i := 1; i <= messages; i++ {
+			writeMessage(t, serverConn, fmt.Sprintf("%06d", i))
+		}
+
+		require.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+
+			return len(handled) == messages
+		}, 5*time.Second, 10*time.Millisecond)
+
+		stats := c.Stats()
+		require.Equal(t, uint64(0), stats.InboundDropped)
+		require.Equal(t, 0, stats.InboundQueueDepth)
+	})
+
+	t.Run("messages are dropped when inbound queue is full", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		started := make(chan string, 10)
+		release := make(chan struct{})
+		dropped := make(chan string, 10)
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.InboundWorkers(1, 1),
+			connection.DropInboundWhenFull(),
+			connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+				stan, _ := message.GetString(11)
+				started <- stan
+				<-release
+			}),
+			connection.InboundDropHandler(func(c *connection.Connection, message *iso8583.Message) {
+				stan, _ := message.GetString(11)
+				dropped <- stan
+			}),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		// the first message blocks the only worker
+		writeMessage(t, serverConn, "000001")
+		require.Equal(t, "000001", <-started)
+
+		// the second one waits in the queue
+		writeMessage(t, serverConn, "000002")
+		require.Eventually(t, func() bool {
+			return c.Stats().InboundQueueDepth == 1
+		}, time.Second, 10*time.Millisecond)
+
+		// there is no space for the third one
+		writeMessage(t, serverConn, "000003")
+		select {
+		case stan := <-dropped:
+			require.Equal(t, "000003", stan)
+		case <-time.After(time.Second):
+			t.Fatal("message was not dropped")
+		}
+		require.Equal(t, uint64(1), c.Stats().InboundDropped)
+
+		close(release)
+		require.Equal(t, "000002", <-started)
+	})
+}
+
+func TestClient_SerialInboundProcessing(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+
+	const messages = 1000
+
+	var mu sync.Mutex
+	var stans []string
+	var running int32
+
+	c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+		connection.SerialInboundProcessing(true),
+		connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+			require.Equal(t, int32(1), atomic.AddInt32(&running, 1), "handlers run concurrently")
+			defer atomic.AddInt32(&running, -1)
+
+			stan, err := message.GetString(11)
+			require.NoError(t, err)
+
+			// give the following messages a chance to overtake this one
+			if len(stan) > 0 && stan[len(stan)-1] == '0' {
+				time.Sleep(time.Millisecond)
+			}
+
+			mu.Lock()
+			stans = append(stans, stan)
+			mu.Unlock()
+		}),
+	)
+	require.NoError(t, err)
+	defer c.Close()
+
+	var expected []string
+	for i := 1; i <= messages; i++ {
+		stan := fmt.Sprintf("%06d", i)
+		expected = append(expected, stan)
+
+		message := iso8583.NewMessage(testSpec)
+		err := message.Marshal(baseFields{
+			MTI:  field.NewStringValue("0800"),
+			STAN: field.NewStringValue(stan),
+		})
+		require.NoError(t, err)
+
+		packed, err := message.Pack()
+		require.NoError(t, err)
+
+		_, err = writeMessageLength(serverConn, len(packed))
+		require.NoError(t, err)
+		_, err = serverConn.Write(packed)
+		require.NoError(t, err)
+	}
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return len(stans) == messages
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, expected, stans)
+}
+
+func TestServer_Connections(t *testing.T) {
+	srv := server.New(testSpec, readMessageLength, writeMessageLength,
+		connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+			message.MTI("0810")
+			c.Reply(message)
+		}),
+	)
+
+	connected := make(chan string, 3)
+	srv.OnConnect = func(id string, c *connection.Connection) {
+		connected <- id
+	}
+	srv.CloseNotification = func(reason string) *iso8583.Message {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0820")
+		message.Field(2, reason)
+		message.Field(11, getSTAN())
+
+		return message
+	}
+
+	require.NoError(t, srv.Start("127.0.0.1:"))
+	defer srv.Close()
+
+	send := func(c *connection.Connection) error {
+		message := iso8583.NewMessage(testSpec)
+		err := message.Marshal(baseFields{
+			MTI:  field.NewStringValue("0800"),
+			STAN: field.NewStringValue(getSTAN()),
+		})
+		require.NoError(t, err)
+
+		_, err = c.Send(message)
+
+		return err
+	}
+
+	notifications := make(chan string, 1)
+
+	var clients []*connection.Connection
+	for i := 0; i < 3; i++ {
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+				reason, _ := message.GetString(2)
+				notifications <- reason
+			}),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		require.NoError(t, send(c))
+		clients = append(clients, c)
+	}
+
+	ids := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		ids[<-connected] = true
+	}
+
+	infos := srv.Connections()
+	require.Len(t, infos, 3)
+
+	// find the connection of the second client by its address
+	var evictedID string
+	for _, info := range infos {
+		require.True(t, ids[info.ID])
+		require.Equal(t, uint64(1), info.MessagesHandled)
+		require.False(t, info.LastActivity.Before(info.ConnectedAt))
+
+		if info.RemoteAddr.String() == clients[1].LocalAddr().String() {
+			evictedID = info.ID
+		}
+	}
+	require.NotEmpty(t, evictedID)
+
+	require.NoError(t, srv.CloseConnection(evictedID, "bye"))
+
+	select {
+	case reason := <-notifications:
+		require.Equal(t, "bye", reason)
+	case <-time.After(time.Second):
+		t.Fatal("close notification was not received")
+	}
+
+	require.Eventually(t, func() bool {
+		return send(clients[1]) != nil
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, send(clients[0]))
+	require.NoError(t, send(clients[2]))
+
+	require.Eventually(t, func() bool {
+		return len(srv.Connections()) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	err := srv.CloseConnection(evictedID, "bye")
+	require.ErrorIs(t, err, server.ErrConnectionNotFound)
+}
+
+func TestServer_Broadcast(t *testing.T) {
+	// Close waits for the requests without response to time out
+	srv := server.New(testSpec, readMessageLength, writeMessageLength,
+		connection.SendTimeout(300*time.Millisecond),
+	)
+
+	connected := make(chan string, 3)
+	srv.OnConnect = func(id string, c *connection.Connection) {
+		connected <- id
+	}
+
+	require.NoError(t, srv.Start("127.0.0.1:"))
+	defer srv.Close()
+
+	received := make(chan string, 10)
+	replyHandler := connection.InboundMessageHandlerFor("08", func(c *connection.Connection, message *iso8583.Message) {
+		received <- c.LocalAddr().String()
+
+		message.MTI("0810")
+		c.Reply(message)
+	})
+
+	// the last client doesn't reply
+	var clients []*connection.Connection
+	for i := 0; i < 3; i++ {
+		var options []connection.Option
+		if i < 2 {
+			options = append(options, replyHandler)
+		}
+
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength, options...)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		clients = append(clients, c)
+		<-connected
+	}
+
+	newMessage := func() *iso8583.Message {
+		message := iso8583.NewMessage(testSpec)
+		err := message.Marshal(baseFields{
+			MTI:  field.NewStringValue("0800"),
+			STAN: field.NewStringValue(getSTAN()),
+		})
+		require.NoError(t, err)
+
+		return message
+	}
+
+	t.Run("message is sent to each client", func(t *testing.T) {
+		results := srv.Broadcast(newMessage())
+		require.Len(t, results, 3)
+
+		for i, result := range results {
+			require.NoError(t, result.Err)
+			require.Nil(t, result.Response)
+			require.Equal(t, clients[i].LocalAddr().String(), result.RemoteAddr.String())
+		}
+
+		addrs := map[string]bool{}
+		for i := 0; i < 2; i++ {
+			select {
+			case addr := <-received:
+				addrs[addr] = true
+			case <-time.After(time.Second):
+				t.Fatal("message was not received")
+			}
+		}
+		require.True(t, addrs[clients[0].LocalAddr().String()])
+		require.True(t, addrs[clients[1].LocalAddr().String()])
+	})
+
+	t.Run("responses of each client are returned", func(t *testing.T) {
+		results := srv.Broadcast(newMessage(), server.WaitForResponses(200*time.Millisecond))
+		require.Len(t, results, 3)
+
+		for _, result := range results[:2] {
+			require.NoError(t, result.Err)
+
+			mti, err := result.Response.GetMTI()
+			require.NoError(t, err)
+			require.Equal(t, "0810", mti)
+			<-received
+		}
+
+		// client that doesn't reply doesn't affect the others
+		require.ErrorIs(t, results[2].Err, connection.ErrSendTimeout)
+		require.Nil(t, results[2].Response)
+	})
+}
+
+func TestServer_ConnectionDetails(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("./testdata/server.crt", "./testdata/server.key")
+	require.NoError(t, err)
+
+	caCert, err := os.ReadFile("./testdata/ca.crt")
+	require.NoError(t, err)
+
+	clientCAs := x509.NewCertPool()
+	require.True(t, clientCAs.AppendCertsFromPEM(caCert))
+
+	type details struct {
+		remoteAddr string
+		commonName string
+	}
+	received := make(chan details, 1)
+
+	srv := server.New(testSpec, readMessageLength, writeMessageLength,
+		connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+			var commonName string
+			if certs := c.PeerCertificates(); len(certs) > 0 {
+				commonName = certs[0].Subject.CommonName
+			}
+
+			received <- details{
+				remoteAddr: c.RemoteAddr().String(),
+				commonName: commonName,
+			}
+
+			message.MTI("0810")
+			c.Reply(message)
+		}),
+	)
+
+	err = srv.StartTLS("127.0.0.1:", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS12,
+	})
+	require.NoError(t, err)
+	defer srv.Close()
+
+	c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength,
+		connection.ClientCert("./testdata/client.crt", "./testdata/client.key"),
+		connection.RootCAs("./testdata/ca.crt"),
+	)
+	require.NoError(t, err)
+	require.NoError(t, c.Connect())
+	defer c.Close()
+
+	message := iso8583.NewMessage(testSpec)
+	err = message.Marshal(baseFields{
+		MTI:  field.NewStringValue("0800"),
+		STAN: field.NewStringValue(getSTAN()),
+	})
+	require.NoError(t, err)
+
+	_, err = c.Send(message)
+	require.NoError(t, err)
+
+	d := <-received
+	require.Equal(t, c.LocalAddr().String(), d.remoteAddr)
+	require.Equal(t, "127.0.0.1", d.commonName)
+
+}
+
+func TestServer_OnDisconnect(t *testing.T) {
+	type disconnect struct {
+		id             string
+		err            error
+		handlerRunning bool
+	}
+
+	var handlerRunning int32
+
+	newServer := func(t *testing.T) (*server.Server, chan string, chan disconnect) {
+		srv := server.New(testSpec, readMessageLength, writeMessageLength,
+			connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+				atomic.StoreInt32(&handlerRunning, 1)
+				time.Sleep(100 * time.Millisecond)
+				atomic.StoreInt32(&handlerRunning, 0)
+			}),
+		)
+
+		connected := make(chan string, 1)
+		disconnected := make(chan disconnect, 2)
+
+		srv.OnConnect = func(id string, c *connection.Connection) {
+			connected <- id
+		}
+		srv.OnDisconnect = func(id string, c *connection.Connection, err error) {
+			disconnected <- disconnect{
+				id:             id,
+				err:            err,
+				handlerRunning: atomic.LoadInt32(&handlerRunning) == 1,
+			}
+		}
+
+		require.NoError(t, srv.Start("127.0.0.1:"))
+
+		return srv, connected, disconnected
+	}
+
+	receive := func(t *testing.T, disconnected chan disconnect) disconnect {
+		t.Helper()
+
+		select {
+		case d := <-disconnected:
+			// it's called only once
+			select {
+			case <-disconnected:
+				t.Fatal("OnDisconnect was called twice")
+			case <-time.After(50 * time.Millisecond):
+			}
+			return d
+		case <-time.After(time.Second):
+			t.Fatal("OnDisconnect was not called")
+		}
+
+		return disconnect{}
+	}
+
+	t.Run("client closes connection after message", func(t *testing.T) {
+		srv, connected, disconnected := newServer(t)
+		defer srv.Close()
+
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		id := <-connected
+
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0820")
+		require.NoError(t, message.Field(11, getSTAN()))
+		require.NoError(t, c.Reply(message))
+
+		require.Eventually(t, func() bool {
+			return atomic.LoadInt32(&handlerRunning) == 1
+		}, time.Second, time.Millisecond)
+
+		require.NoError(t, c.Close())
+
+		d := receive(t, disconnected)
+		require.Equal(t, id, d.id)
+		require.NoError(t, d.err)
+		require.False(t, d.handlerRunning, "OnDisconnect was called before handler returned")
+	})
+
+	t.Run("server evicts connection", func(t *testing.T) {
+		srv, connected, disconnected := newServer(t)
+		defer srv.Close()
+
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+		id := <-connected
+
+		require.NoError(t, srv.CloseConnection(id, "evicted"))
+
+		d := receive(t, disconnected)
+		require.Equal(t, id, d.id)
+		require.NoError(t, d.err)
+	})
+
+	t.Run("connection is reset", func(t *testing.T) {
+		srv, connected, disconnected := newServer(t)
+		defer srv.Close()
+
+		conn, err := net.Dial("tcp", srv.Addr)
+		require.NoError(t, err)
+		id := <-connected
+
+		// closing with zero linger resets the connection
+		require.NoError(t, conn.(*net.TCPConn).SetLinger(0))
+		require.NoError(t, conn.Close())
+
+		d := receive(t, disconnected)
+		require.Equal(t, id, d.id)
+		require.Error(t, d.err)
+	})
+}
+
+func TestServer_AcceptFilter(t *testing.T) {
+	newServer := func(t *testing.T, filter func(remoteAddr net.Addr) error) (*server.Server, chan error) {
+		srv := server.New(testSpec, readMessageLength, writeMessageLength,
+			connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+				message.MTI("0810")
+				c.Reply(message)
+			}),
+		)
+
+		errs := make(chan error, 1)
+		srv.AcceptFilter = filter
+		srv.RejectionFrame = []byte("rejected")
+		srv.ErrorHandler = func(err error) {
+			errs <- err
+		}
+
+		require.NoError(t, srv.Start("127.0.0.1:"))
+
+		return srv, errs
+	}
+
+	t.Run("rejected connection is closed", func(t *testing.T) {
+		errNotAllowed := errors.New("address is not allowed")
+
+		srv, errs := newServer(t, func(remoteAddr net.Addr) error {
+			if remoteAddr.(*net.TCPAddr).IP.IsLoopback() {
+				return errNotAllowed
+			}
+			return nil
+		})
+		defer srv.Close()
+
+		conn, err := net.Dial("tcp", srv.Addr)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		// rejection frame is written before connection is closed
+		data, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		require.Equal(t, "rejected", string(data))
+
+		select {
+		case err := <-errs:
+			require.ErrorIs(t, err, errNotAllowed)
+			require.Contains(t, err.Error(), conn.LocalAddr().String())
+		case <-time.After(time.Second):
+			t.Fatal("rejection was not reported")
+		}
+
+		require.Empty(t, srv.Connections())
+	})
+
+	t.Run("allowed connection is handled", func(t *testing.T) {
+		srv, errs := newServer(t, func(remoteAddr net.Addr) error {
+			return nil
+		})
+		defer srv.Close()
+
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		_, err = c.Send(message)
+		require.NoError(t, err)
+
+		require.Empty(t, errs)
+	})
+
+	t.Run("rejection doesn't hold up the accept loop", func(t *testing.T) {
+		srv := server.New(testSpec, readMessageLength, writeMessageLength,
+			connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+				message.MTI("0810")
+				c.Reply(message)
+			}),
+		)
+
+		// only the first connection is rejected and writing of its
+		// rejection frame blocks until it's released
+		release := make(chan struct{})
+		var accepted int32
+		srv.AcceptFilter = func(remoteAddr net.Addr) error {
+			if atomic.AddInt32(&accepted, 1) == 1 {
+				return errors.New("address is not allowed")
+			}
+			return nil
+		}
+		srv.RejectionFrame = []byte("rejected")
+		srv.ErrorHandler = func(err error) {}
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		srv.Serve(&blockingWriteListener{Listener: ln, release: release})
+		defer srv.Close()
+		defer close(release)
+
+		rejected, err := net.Dial("tcp", srv.Addr)
+		require.NoError(t, err)
+		defer rejected.Close()
+
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(time.Second),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		_, err = c.Send(message)
+		require.NoError(t, err)
+	})
+}
+
+// blockingWriteListener accepts connections which writes of the
+// rejection frame block until release is closed
+type blockingWriteListener struct {
+	net.Listener
+	release chan struct{}
+	first   int32
+}
+
+func (l *blockingWriteListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if atomic.AddInt32(&l.first, 1) > 1 {
+		return conn, nil
+	}
+
+	return &blockingWriteConn{Conn: conn, release: l.release}, nil
+}
+
+type blockingWriteConn struct {
+	net.Conn
+	release chan struct{}
+}
+
+func (c *blockingWriteConn) Write(p []byte) (int, error) {
+	<-c.release
+	return c.Conn.Write(p)
+}
+
+type fakeLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *fakeLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func (l *fakeLogger) Lines() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]string(nil), l.lines...)
+}
+
+func TestServer_LoggingMiddleware(t *testing.T) {
+	spec := specWithFields(map[int]field.Field{
+		2: field.NewString(&field.Spec{
+			Length:      19,
+			Description: "Primary Account Number",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.LL,
+		}),
+		39: field.NewString(&field.Spec{
+			Length:      2,
+			Description: "Response Code",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+	})
+
+	srv := server.New(spec, readMessageLength, writeMessageLength,
+		connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+			time.Sleep(100 * time.Millisecond)
+
+			message.MTI("0810")
+			message.Field(39, "00")
+			c.Reply(message)
+		}),
+	)
+
+	logger := &fakeLogger{}
+	srv.Use(server.LoggingMiddleware(logger, []int{2}))
+
+	require.NoError(t, srv.Start("127.0.0.1:"))
+	defer srv.Close()
+
+	c, err := connection.New(srv.Addr, spec, readMessageLength, writeMessageLength)
+	require.NoError(t, err)
+	require.NoError(t, c.Connect())
+	defer c.Close()
+
+	stan := getSTAN()
+	message := iso8583.NewMessage(spec)
+	message.MTI("0800")
+	require.NoError(t, message.Field(2, "4111111111111111"))
+	require.NoError(t, message.Field(11, stan))
+
+	_, err = c.Send(message)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return len(logger.Lines()) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	line := logger.Lines()[0]
+	require.Contains(t, line, "mti=0800 ")
+	require.Contains(t, line, "stan="+stan)
+	require.Contains(t, line, "remote_addr="+c.LocalAddr().String())
+	require.Contains(t, line, "response_mti=0810 response_code=00")
+	require.Contains(t, line, "411111******1111")
+	require.NotContains(t, line, "4111111111111111")
+
+	// handler duration is logged
+	var duration time.Duration
+	for _, part := range strings.Split(line, " ") {
+		if strings.HasPrefix(part, "duration=") {
+			duration, err = time.ParseDuration(strings.TrimPrefix(part, "duration="))
+			require.NoError(t, err)
+		}
+	}
+	require.GreaterOrEqual(t, duration, 100*time.Millisecond)
+}
+
+func TestServer_LoggingMiddlewareLogsRepliesAndErrors(t *testing.T) {
+	spec := specWithFields(map[int]field.Field{
+		39: field.NewString(&field.Spec{
+			Length:      2,
+			Description: "Response Code",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+	})
+
+	srv := server.New(spec, readMessageLength, writeMessageLength)
+	srv.RespondFor("08", func(c *connection.Connection, message *iso8583.Message) (*iso8583.Message, error) {
+		response, err := iso8583util.NewResponseFrom(message, []int{11})
+		if err != nil {
+			return nil, err
+		}
+		if err := response.Field(39, "00"); err != nil {
+			return nil, err
+		}
+
+		return response, nil
+	})
+	srv.HandleFor("02", func(c *connection.Connection, message *iso8583.Message) error {
+		return errors.New("card blocked")
+	})
+
+	logger := &fakeLogger{}
+	srv.Use(server.LoggingMiddleware(logger, nil))
+
+	require.NoError(t, srv.Start("127.0.0.1:"))
+	defer srv.Close()
+
+	c, err := connection.New(srv.Addr, spec, readMessageLength, writeMessageLength)
+	require.NoError(t, err)
+	require.NoError(t, c.Connect())
+	defer c.Close()
+
+	send := func(mti string) string {
+		stan := getSTAN()
+		message := iso8583.NewMessage(spec)
+		message.MTI(mti)
+		require.NoError(t, message.Field(11, stan))
+
+		_, err := c.Send(message)
+		require.NoError(t, err)
+
+		var line string
+		require.Eventually(t, func() bool {
+			for _, l := range logger.Lines() {
+				if strings.Contains(l, "stan="+stan) {
+					line = l
+					return true
+				}
+			}
+			return false
+		}, time.Second, 10*time.Millisecond)
+
+		return line
+	}
+
+	t.Run("response built as new message", func(t *testing.T) {
+		line := send("0800")
+		require.Contains(t, line, "response_mti=0810 response_code=00")
+		require.NotContains(t, line, "error=")
+	})
+
+	t.Run("handler error and error response", func(t *testing.T) {
+		line := send("0200")
+		require.Contains(t, line, "response_mti=0210 response_code="+server.DefaultErrorResponseCode)
+		require.Contains(t, line, `error="card blocked"`)
+	})
+}
+
+func TestServer_LoggingMiddlewareSameSTAN(t *testing.T) {
+	spec := specWithFields(map[int]field.Field{
+		39: field.NewString(&field.Spec{
+			Length:      2,
+			Description: "Response Code",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+	})
+
+	// both messages are handled when the error is returned
+	received := make(chan struct{})
+	srv := server.New(spec, readMessageLength, writeMessageLength)
+	srv.RespondFor("08", func(c *connection.Connection, message *iso8583.Message) (*iso8583.Message, error) {
+		<-received
+
+		response, err := iso8583util.NewResponseFrom(message, []int{11})
+		if err != nil {
+			return nil, err
+		}
+
+		return response, response.Field(39, "00")
+	})
+	srv.HandleFor("02", func(c *connection.Connection, message *iso8583.Message) error {
+		close(received)
+
+		return errors.New("card blocked")
+	})
+
+	logger := &fakeLogger{}
+	srv.Use(server.LoggingMiddleware(logger, nil))
+
+	require.NoError(t, srv.Start("127.0.0.1:"))
+	defer srv.Close()
+
+	// responses are not matched with requests sent with Reply
+	c, err := connection.New(srv.Addr, spec, readMessageLength, writeMessageLength,
+		connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {}),
+	)
+	require.NoError(t, err)
+	require.NoError(t, c.Connect())
+	defer c.Close()
+
+	stan := getSTAN()
+	for _, mti := range []string{"0800", "0200"} {
+		message := iso8583.NewMessage(spec)
+		message.MTI(mti)
+		require.NoError(t, message.Field(11, stan))
+		require.NoError(t, c.Reply(message))
+	}
+
+	require.Eventually(t, func() bool {
+		return len(logger.Lines()) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	for _, line := range logger.Lines() {
+		if strings.Contains(line, "mti=0800 ") {
+			require.Contains(t, line, "response_mti=0810 response_code=00")
+			require.NotContains(t, line, "error=")
+			continue
+		}
+
+		require.Contains(t, line, "mti=0200 ")
+		require.Contains(t, line, "response_mti=0210 response_code="+server.DefaultErrorResponseCode)
+		require.Contains(t, line, `error="card blocked"`)
+	}
+}
+
+func TestServer_HandleUnregistered(t *testing.T) {
+	spec := specWithFields(map[int]field.Field{
+		39: field.NewString(&field.Spec{
+			Length:      2,
+			Description: "Response Code",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+	})
+
+	echoHandler := connection.InboundMessageHandlerFor("08", func(c *connection.Connection, message *iso8583.Message) {
+		message.MTI("0810")
+		message.Field(39, "00")
+		c.Reply(message)
+	})
+
+	send := func(t *testing.T, addr string, mti string) *iso8583.Message {
+		t.Helper()
+
+		c, err := connection.New(addr, spec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		message := iso8583.NewMessage(spec)
+		message.MTI(mti)
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		response, err := c.Send(message)
+		require.NoError(t, err)
+
+		return response
+	}
+
+	t.Run("responds with invalid transaction by default", func(t *testing.T) {
+		srv := server.New(spec, readMessageLength, writeMessageLength, echoHandler)
+		require.NoError(t, srv.Start("127.0.0.1:"))
+		defer srv.Close()
+
+		response := send(t, srv.Addr, "0200")
+
+		mti, err := response.GetMTI()
+		require.NoError(t, err)
+		require.Equal(t, "0210", mti)
+
+		code, err := response.GetString(39)
+		require.NoError(t, err)
+		require.Equal(t, server.DefaultInvalidTransactionCode, code)
+
+		// registered MTI is handled by its handler
+		response = send(t, srv.Addr, "0800")
+		code, err = response.GetString(39)
+		require.NoError(t, err)
+		require.Equal(t, "00", code)
+
+		require.Equal(t, uint64(1), srv.Stats().UnregisteredMessages)
+	})
+
+	t.Run("response code is configurable", func(t *testing.T) {
+		srv := server.New(spec, readMessageLength, writeMessageLength, echoHandler)
+		srv.InvalidTransactionCode = "58"
+		require.NoError(t, srv.Start("127.0.0.1:"))
+		defer srv.Close()
+
+		response := send(t, srv.Addr, "0100")
+
+		mti, err := response.GetMTI()
+		require.NoError(t, err)
+		require.Equal(t, "0110", mti)
+
+		code, err := response.GetString(39)
+		require.NoError(t, err)
+		require.Equal(t, "58", code)
+	})
+
+	t.Run("responds without response code when spec has no field 39", func(t *testing.T) {
+		serverErrs := make(chan error, 10)
+
+		srv := server.New(testSpec, readMessageLength, writeMessageLength)
+		srv.ErrorHandler = func(err error) {
+			serverErrs <- err
+		}
+		require.NoError(t, srv.Start("127.0.0.1:"))
+		defer srv.Close()
+
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0200")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		response, err := c.Send(message)
+		require.NoError(t, err)
+
+		mti, err := response.GetMTI()
+		require.NoError(t, err)
+		require.Equal(t, "0210", mti)
+		require.Len(t, serverErrs, 0)
+	})
+
+	t.Run("custom handler", func(t *testing.T) {
+		srv := server.New(spec, readMessageLength, writeMessageLength, echoHandler)
+		srv.HandleUnregistered(func(c *connection.Connection, message *iso8583.Message) {
+			message.MTI("0210")
+			message.Field(39, "96")
+			c.Reply(message)
+		})
+		require.NoError(t, srv.Start("127.0.0.1:"))
+		defer srv.Close()
+
+		response := send(t, srv.Addr, "0200")
+
+		code, err := response.GetString(39)
+		require.NoError(t, err)
+		require.Equal(t, "96", code)
+		require.Equal(t, uint64(1), srv.Stats().UnregisteredMessages)
+	})
+
+	t.Run("unmatched responses are dropped", func(t *testing.T) {
+		serverErrs := make(chan error, 10)
+
+		srv := server.New(spec, readMessageLength, writeMessageLength, echoHandler)
+		srv.ErrorHandler = func(err error) {
+			serverErrs <- err
+		}
+		require.NoError(t, srv.Start("127.0.0.1:"))
+		defer srv.Close()
+
+		c, err := connection.New(srv.Addr, spec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		// late response to the request of the server with no
+		// registered handler
+		response := iso8583.NewMessage(spec)
+		response.MTI("0210")
+		require.NoError(t, response.Field(11, getSTAN()))
+		require.NoError(t, c.Reply(response))
+
+		require.Eventually(t, func() bool {
+			return srv.Stats().MessagesReceived == 1
+		}, time.Second, 10*time.Millisecond)
+
+		select {
+		case err := <-serverErrs:
+			t.Fatalf("unexpected server error: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		require.Zero(t, srv.Stats().UnregisteredMessages)
+		require.Zero(t, srv.Stats().MessagesSent)
+	})
+}
+
+func TestServer_Send(t *testing.T) {
+	connected := make(chan *connection.Connection, 1)
+
+	srv := server.New(testSpec, readMessageLength, writeMessageLength,
+		connection.SendTimeout(500*time.Millisecond),
+	)
+	srv.OnConnect = func(id string, c *connection.Connection) {
+		connected <- c
+	}
+	require.NoError(t, srv.Start("127.0.0.1:"))
+	defer srv.Close()
+
+	// client replies to the requests of the server
+	c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength,
+		connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+			message.MTI("0810")
+			c.Reply(message)
+		}),
+	)
+	require.NoError(t, err)
+	require.NoError(t, c.Connect())
+	defer c.Close()
+
+	var serverConn *connection.Connection
+	select {
+	case serverConn = <-connected:
+	case <-time.After(time.Second):
+		t.Fatal("connection was not accepted")
+	}
+
+	// server side of the connection matches responses to its requests
+	// the same way as the client does
+	stan := getSTAN()
+	message := iso8583.NewMessage(testSpec)
+	message.MTI("0800")
+	require.NoError(t, message.Field(11, stan))
+
+	response, err := serverConn.Send(message)
+	require.NoError(t, err)
+
+	mti, err := response.GetMTI()
+	require.NoError(t, err)
+	require.Equal(t, "0810", mti)
+
+	responseSTAN, err := response.GetString(11)
+	require.NoError(t, err)
+	require.Equal(t, stan, responseSTAN)
+
+	require.Equal(t, uint64(1), c.Stats().MessagesReceived)
+	require.Equal(t, 0, serverConn.Stats().PendingRequests)
+}
+
+func TestClient_WebSocket(t *testing.T) {
+	connected := make(chan *connection.Connection, 1)
+
+	srv := server.New(testSpec, websocket.ReadMessageLength, websocket.WriteMessageLength,
+		connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+			message.MTI("0810")
+			c.Reply(message)
+		}),
+	)
+	srv.OnConnect = func(id string, c *connection.Connection) {
+		connected <- c
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv.Serve(websocket.NewListener(ln))
+	defer srv.Close()
+
+	c, err := connection.New(srv.Addr, testSpec, websocket.ReadMessageLength, websocket.WriteMessageLength,
+		connection.WithDialFunc(websocket.DialFunc("ws://"+srv.Addr+"/iso8583", nil)),
+		connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+			message.MTI("0810")
+			c.Reply(message)
+		}),
+	)
+	require.NoError(t, err)
+	require.NoError(t, c.Connect())
+	defer c.Close()
+
+	t.Run("client sends requests", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			stan := getSTAN()
+			message := iso8583.NewMessage(testSpec)
+			message.MTI("0800")
+			require.NoError(t, message.Field(11, stan))
+
+			response, err := c.Send(message)
+			require.NoError(t, err)
+
+			mti, err := response.GetMTI()
+			require.NoError(t, err)
+			require.Equal(t, "0810", mti)
+
+			responseSTAN, err := response.GetString(11)
+			require.NoError(t, err)
+			require.Equal(t, stan, responseSTAN)
+		}
+	})
+
+	t.Run("server sends requests", func(t *testing.T) {
+		var serverConn *connection.Connection
+		select {
+		case serverConn = <-connected:
+		case <-time.After(time.Second):
+			t.Fatal("connection was not accepted")
+		}
+
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		response, err := serverConn.Send(message)
+		require.NoError(t, err)
+
+		mti, err := response.GetMTI()
+		require.NoError(t, err)
+		require.Equal(t, "0810", mti)
+	})
+
+	t.Run("plain TCP client is rejected", func(t *testing.T) {
+		tcpClient, err := connection.New(srv.Addr, testSpec, websocket.ReadMessageLength, websocket.WriteMessageLength,
+			connection.SendTimeout(200*time.Millisecond),
+		)
+		require.NoError(t, err)
+		require.NoError(t, tcpClient.Connect())
+		defer tcpClient.Close()
+
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		_, err = tcpClient.Send(message)
+		require.Error(t, err)
+	})
+}
+
+func TestClient_TLSUpgrade(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("./testdata/server.crt", "./testdata/server.key")
+	require.NoError(t, err)
+
+	serverTLSConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	// server replies to the hello in plaintext, then accepts TLS
+	// handshake and replies to the rest of messages over TLS
+	tlsReplies := make(chan bool, 10)
+	srv := server.New(testSpec, readMessageLength, writeMessageLength,
+		connection.AcceptTLSUpgrade(serverTLSConfig),
+		connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+			message.MTI("0810")
+
+			_, upgraded := c.TLSConnectionState()
+			if !upgraded {
+				if err := c.ReplyAndUpgradeTLS(message); err != nil {
+					t.Logf("upgrading to TLS: %v", err)
+				}
+				return
+			}
+
+			tlsReplies <- true
+			c.Reply(message)
+		}),
+	)
+	require.NoError(t, srv.Start("127.0.0.1:"))
+	defer srv.Close()
+
+	hello := func(c *connection.Connection) error {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		message.Field(11, getSTAN())
+
+		_, err := c.Send(message)
+		return err
+	}
+
+	c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength,
+		connection.TLSUpgrade(hello),
+		connection.RootCAs("./testdata/ca.crt"),
+	)
+	require.NoError(t, err)
+	require.NoError(t, c.Connect())
+	defer c.Close()
+
+	state, ok := c.TLSConnectionState()
+	require.True(t, ok)
+	require.True(t, state.HandshakeComplete)
+
+	for i := 0; i < 3; i++ {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		response, err := c.Send(message)
+		require.NoError(t, err)
+
+		mti, err := response.GetMTI()
+		require.NoError(t, err)
+		require.Equal(t, "0810", mti)
+		require.True(t, <-tlsReplies)
+	}
+
+	t.Run("connection without TLS upgrade option can't be upgraded", func(t *testing.T) {
+		server, err := NewTestServer()
+		require.NoError(t, err)
+		defer server.Close()
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0810")
+		require.ErrorIs(t, c.ReplyAndUpgradeTLS(message), connection.ErrTLSUpgradeNotAllowed)
+	})
+
+	t.Run("failed hello closes connection", func(t *testing.T) {
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.TLSUpgrade(func(c *connection.Connection) error {
+				return errors.New("hello rejected")
+			}),
+			connection.RootCAs("./testdata/ca.crt"),
+		)
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.EqualError(t, err, "upgrading to TLS: sending hello before TLS upgrade: hello rejected")
+		require.Equal(t, connection.StatusOffline, c.Status())
+	})
+}
+
+func TestClient_TLSSessionCache(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("./testdata/server.crt", "./testdata/server.key")
+	require.NoError(t, err)
+
+	srv := server.New(testSpec, readMessageLength, writeMessageLength,
+		connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+			message.MTI("0810")
+			c.Reply(message)
+		}),
+	)
+	err = srv.StartTLS("127.0.0.1:", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	})
+	require.NoError(t, err)
+	defer srv.Close()
+
+	// session ticket is received after the handshake, so a message is
+	// exchanged before connection is closed
+	exchange := func(t *testing.T, c *connection.Connection) {
+		t.Helper()
+
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		_, err := c.Send(message)
+		require.NoError(t, err)
+	}
+
+	t.Run("session is resumed on the next Connect", func(t *testing.T) {
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.RootCAs("./testdata/ca.crt"),
+			connection.TLSSessionCache(10),
+		)
+		require.NoError(t, err)
+
+		require.NoError(t, c.Connect())
+		state, ok := c.TLSConnectionState()
+		require.True(t, ok)
+		require.False(t, state.DidResume)
+		exchange(t, c)
+		require.NoError(t, c.Close())
+
+		require.NoError(t, c.Connect())
+		defer c.Close()
+		state, ok = c.TLSConnectionState()
+		require.True(t, ok)
+		require.True(t, state.DidResume)
+		exchange(t, c)
+	})
+
+	t.Run("connections with the same option share the cache", func(t *testing.T) {
+		cache := connection.TLSSessionCache(10)
+
+		first, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.RootCAs("./testdata/ca.crt"),
+			cache,
+		)
+		require.NoError(t, err)
+		require.NoError(t, first.Connect())
+		exchange(t, first)
+		require.NoError(t, first.Close())
+
+		second, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.RootCAs("./testdata/ca.crt"),
+			cache,
+		)
+		require.NoError(t, err)
+		require.NoError(t, second.Connect())
+		defer second.Close()
+
+		state, ok := second.TLSConnectionState()
+		require.True(t, ok)
+		require.True(t, state.DidResume)
+	})
+
+	t.Run("TLS config in use is not changed", func(t *testing.T) {
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.RootCAs("./testdata/ca.crt"),
+		)
+		require.NoError(t, err)
+
+		inUse := c.Options().TLSConfig
+		require.NoError(t, c.SetOptions(connection.TLSSessionCache(10)))
+
+		require.Nil(t, inUse.ClientSessionCache)
+		require.NotNil(t, c.Options().TLSConfig.ClientSessionCache)
+	})
+
+	t.Run("capacity should not be negative", func(t *testing.T) {
+		_, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.TLSSessionCache(-1),
+		)
+		require.Error(t, err)
+	})
+
+	t.Run("without the cache session is not resumed", func(t *testing.T) {
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.RootCAs("./testdata/ca.crt"),
+		)
+		require.NoError(t, err)
+
+		require.NoError(t, c.Connect())
+		exchange(t, c)
+		require.NoError(t, c.Close())
+
+		require.NoError(t, c.Connect())
+		defer c.Close()
+		state, ok := c.TLSConnectionState()
+		require.True(t, ok)
+		require.False(t, state.DidResume)
+	})
+}
+
+func TestClient_PublishExpvar(t *testing.T) {
+	server, err := NewTestServer()
+	require.NoError(t, err)
+	defer server.Close()
+
+	prefix := "iso8583_connection_test_" + getSTAN()
+
+	c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+		connection.PublishExpvar(prefix),
+		connection.SendTimeout(100*time.Millisecond),
+	)
+	require.NoError(t, err)
+	require.NoError(t, c.Connect())
+	defer c.Close()
+
+	for i := 0; i < 3; i++ {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		_, err := c.Send(message)
+		require.NoError(t, err)
+	}
+
+	// request without response times out
+	message := iso8583.NewMessage(testSpec)
+	message.MTI("0800")
+	require.NoError(t, message.Field(2, TestCaseNoResponse))
+	require.NoError(t, message.Field(11, getSTAN()))
+	_, err = c.Send(message)
+	require.ErrorIs(t, err, connection.ErrSendTimeout)
+
+	vars, ok := expvar.Get(prefix).(*expvar.Map)
+	require.True(t, ok)
+
+	require.Equal(t, "4", vars.Get("sent").String())
+	require.Equal(t, "3", vars.Get("received").String())
+	require.Equal(t, "1", vars.Get("timeouts").String())
+	require.Equal(t, "0", vars.Get("unmatched").String())
+	require.Equal(t, "0", vars.Get("reconnects").String())
+	require.Equal(t, "0", vars.Get("pending").String())
+
+	stats := c.Stats()
+	require.Equal(t, uint64(4), stats.MessagesSent)
+	require.Equal(t, uint64(1), stats.SendTimeouts)
+
+	t.Run("prefix used by another connection", func(t *testing.T) {
+		_, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.PublishExpvar(prefix),
+		)
+		require.ErrorIs(t, err, connection.ErrExpvarPrefixTaken)
+
+		// values of the connection are kept
+		require.Equal(t, "4", vars.Get("sent").String())
+	})
+
+	t.Run("values are removed on Close and published again on Connect", func(t *testing.T) {
+		other, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.PublishExpvar(prefix+"_reconnect"),
+		)
+		require.NoError(t, err)
+
+		otherVars, ok := expvar.Get(prefix + "_reconnect").(*expvar.Map)
+		require.True(t, ok)
+		require.NotNil(t, otherVars.Get("sent"))
+
+		require.NoError(t, other.Close())
+		require.Nil(t, otherVars.Get("sent"))
+
+		// prefix can be used by the connection created later
+		next, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.PublishExpvar(prefix+"_reconnect"),
+		)
+		require.NoError(t, err)
+		require.NotNil(t, otherVars.Get("sent"))
+
+		err = other.Connect()
+		require.ErrorIs(t, err, connection.ErrExpvarPrefixTaken)
+
+		require.NoError(t, next.Close())
+		require.NoError(t, other.Connect())
+		defer other.Close()
+		require.NotNil(t, otherVars.Get("sent"))
+	})
+
+	t.Run("name used by other variable", func(t *testing.T) {
+		name := prefix + "_int"
+		expvar.NewInt(name)
+
+		_, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.PublishExpvar(name),
+		)
+		require.Error(t, err)
+	})
+}
+
+// syncBuffer is bytes.Buffer safe for concurrent use
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+func TestClient_TraceWriter(t *testing.T) {
+	server, err := NewTestServer()
+	require.NoError(t, err)
+	defer server.Close()
+
+	trace := &syncBuffer{}
+
+	c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+		connection.TraceWriter(trace, []int{2}),
+	)
+	require.NoError(t, err)
+	require.NoError(t, c.Connect())
+	defer c.Close()
+
+	stan := getSTAN()
+	message := iso8583.NewMessage(testSpec)
+	err = message.Marshal(baseFields{
+		MTI:          field.NewStringValue("0800"),
+		TestCaseCode: field.NewStringValue(TestCaseReply),
+		STAN:         field.NewStringValue(stan),
+	})
+	require.NoError(t, err)
+
+	_, err = c.Send(message)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return strings.Contains(trace.String(), "<- 0810")
+	}, time.Second, 10*time.Millisecond)
+
+	output := trace.String()
+	require.Len(t, strings.Split(strings.TrimSpace(output), "\n"), 6)
+
+	// both directions are rendered with the frame length
+	require.Contains(t, output, "-> 0800 frame=")
+	require.Contains(t, output, "<- 0810 frame=")
+
+	// fields are described by the spec, field 2 is masked
+	require.Contains(t, output, "F2   Test Case Code: ***")
+	require.Contains(t, output, "F11  Systems Trace Audit Number (STAN): "+stan)
+	require.NotContains(t, output, "Test Case Code: "+TestCaseReply)
+}
+
+func TestClient_TraceWriterWireFormat(t *testing.T) {
+	srv := server.New(testSpec, readMessageLength, writeMessageLength,
+		connection.FrameIntegrity(lrc, verifyLRC),
+		connection.WireEncoding(connection.EBCDIC1047),
+		connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+			message.MTI("0810")
+			c.Reply(message)
+		}),
+	)
+	require.NoError(t, srv.Start("127.0.0.1:"))
+	defer srv.Close()
+
+	trace := &syncBuffer{}
+
+	c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength,
+		connection.FrameIntegrity(lrc, verifyLRC),
+		connection.WireEncoding(connection.EBCDIC1047),
+		connection.TraceWriter(trace, nil),
+	)
+	require.NoError(t, err)
+	require.NoError(t, c.Connect())
+	defer c.Close()
+
+	stan := getSTAN()
+	message := iso8583.NewMessage(testSpec)
+	message.MTI("0800")
+	require.NoError(t, message.Field(11, stan))
+
+	_, err = c.Send(message)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return strings.Contains(trace.String(), "<- 0810")
+	}, time.Second, 10*time.Millisecond)
+
+	// messages are decoded from the wire without the checksum
+	output := trace.String()
+	require.NotContains(t, output, "unpacking message")
+	require.Contains(t, output, "<- 0810 frame=")
+	require.Contains(t, output, "-> 0800 frame=")
+	require.Contains(t, output, "F11  Systems Trace Audit Number (STAN): "+stan)
+}
+
+func TestClient_MessageFactory(t *testing.T) {
+	var created int32
+	factory := func() *iso8583.Message {
+		atomic.AddInt32(&created, 1)
+
+		message := iso8583.NewMessage(testSpec)
+		message.Field(2, TestCaseReply)
+		return message
+	}
+
+	received := make(chan *iso8583.Message, 1)
+	srv := server.New(testSpec, readMessageLength, writeMessageLength,
+		connection.MessageFactory(factory),
+		connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+			received <- message
+
+			message.MTI("0810")
+			c.Reply(message)
+		}),
+	)
+	require.NoError(t, srv.Start("127.0.0.1:"))
+	defer srv.Close()
+
+	c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength,
+		connection.MessageFactory(func() *iso8583.Message {
+			message := iso8583.NewMessage(testSpec)
+			message.Field(7, "1231235959")
+			return message
+		}),
+	)
+	require.NoError(t, err)
+	require.NoError(t, c.Connect())
+	defer c.Close()
+
+	stan := getSTAN()
+	message := iso8583.NewMessage(testSpec)
+	message.MTI("0800")
+	require.NoError(t, message.Field(11, stan))
+
+	response, err := c.Send(message)
+	require.NoError(t, err)
+
+	// field 2 wasn't on the wire, handler observes the preset value
+	inbound := <-received
+	require.Contains(t, inbound.GetFields(), 2)
+	code, err := inbound.GetString(2)
+	require.NoError(t, err)
+	require.Equal(t, TestCaseReply, code)
+	require.Equal(t, int32(1), atomic.LoadInt32(&created))
+
+	// fields from the wire are unpacked over the preset message
+	responseSTAN, err := response.GetString(11)
+	require.NoError(t, err)
+	require.Equal(t, stan, responseSTAN)
+
+	require.Contains(t, response.GetFields(), 7)
+	transmissionTime, err := response.GetString(7)
+	require.NoError(t, err)
+	require.Equal(t, "1231235959", transmissionTime)
+}
+
+// echoRequest is the domain message packed on its own
+type echoRequest struct {
+	stan string
+}
+
+func (r *echoRequest) Pack() ([]byte, error) {
+	message := iso8583.NewMessage(testSpec)
+	message.MTI("0800")
+	if err := message.Field(11, r.stan); err != nil {
+		return nil, err
+	}
+
+	return message.Pack()
+}
+
+func (r *echoRequest) GetMTI() (string, error) {
+	return "0800", nil
+}
+
+func (r *echoRequest) GetString(id int) (string, error) {
+	if id == 11 {
+		return r.stan, nil
+	}
+
+	return "", nil
+}
+
+func TestClient_SendMessage(t *testing.T) {
+	server, err := NewTestServer()
+	require.NoError(t, err)
+	defer server.Close()
+
+	c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength)
+	require.NoError(t, err)
+	require.NoError(t, c.Connect())
+	defer c.Close()
+
+	t.Run("sends custom message and receives the response", func(t *testing.T) {
+		stan := getSTAN()
+
+		response, err := c.SendMessage(&echoRequest{stan: stan})
+		require.NoError(t, err)
+
+		mti, err := response.GetMTI()
+		require.NoError(t, err)
+		require.Equal(t, "0810", mti)
+
+		responseSTAN, err := response.GetString(11)
+		require.NoError(t, err)
+		require.Equal(t, stan, responseSTAN)
+	})
+
+	t.Run("sends *iso8583.Message as Send does", func(t *testing.T) {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		response, err := c.SendMessage(message)
+		require.NoError(t, err)
+
+		mti, err := response.GetMTI()
+		require.NoError(t, err)
+		require.Equal(t, "0810", mti)
+	})
+
+	t.Run("returns error when STAN is missing", func(t *testing.T) {
+		_, err := c.SendMessage(&echoRequest{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "STAN is missing")
+		require.Equal(t, 0, c.PendingRequests())
+	})
+}
+
+func TestClient_ResponseValidator(t *testing.T) {
+	spec := specWithFields(map[int]field.Field{
+		39: field.NewString(&field.Spec{
+			Length:      2,
+			Description: "Response Code",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+	})
+
+	// server responds with the code from the last two digits of field 2
+	serverHandler := func(c *connection.Connection, message *iso8583.Message) {
+		response, err := iso8583util.NewResponseFrom(message, []int{11})
+		require.NoError(t, err)
+
+		testCase, err := message.GetString(2)
+		require.NoError(t, err)
+		require.NoError(t, response.Field(39, testCase[1:]))
+
+		require.NoError(t, c.Reply(response))
+	}
+
+	send := func(c *connection.Connection, testCase string) (*iso8583.Message, error) {
+		message := iso8583.NewMessage(spec)
+		message.MTI("0100")
+		require.NoError(t, message.Field(2, testCase))
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		return c.Send(message)
+	}
+
+	t.Run("returns approved response", func(t *testing.T) {
+		c, err := connectiontest.NewPipeConnection(spec, readMessageLength, writeMessageLength, serverHandler,
+			connection.ResponseValidator(connection.ApproveOnDE39("00", "10", "11")),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		response, err := send(c, "010")
+		require.NoError(t, err)
+
+		code, err := response.GetString(39)
+		require.NoError(t, err)
+		require.Equal(t, "10", code)
+	})
+
+	t.Run("returns ResponseError with declined response", func(t *testing.T) {
+		c, err := connectiontest.NewPipeConnection(spec, readMessageLength, writeMessageLength, serverHandler,
+			connection.ResponseValidator(connection.ApproveOnDE39("00", "10", "11")),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		response, err := send(c, "005")
+		require.ErrorIs(t, err, connection.ErrResponseDeclined)
+
+		var responseErr *connection.ResponseError
+		require.ErrorAs(t, err, &responseErr)
+		require.Same(t, response, responseErr.Response)
+
+		code, err := responseErr.Response.GetString(39)
+		require.NoError(t, err)
+		require.Equal(t, "05", code)
+	})
+
+	t.Run("returns error of the validator", func(t *testing.T) {
+		errUnexpectedResponse := errors.New("unexpected response")
+
+		var validatedRequest *iso8583.Message
+		c, err := connectiontest.NewPipeConnection(spec, readMessageLength, writeMessageLength, serverHandler,
+			connection.ResponseValidator(func(request, response *iso8583.Message) error {
+				validatedRequest = request
+
+				return errUnexpectedResponse
+			}),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		message := iso8583.NewMessage(spec)
+		message.MTI("0100")
+		require.NoError(t, message.Field(2, "000"))
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		response, err := c.Send(message)
+		require.ErrorIs(t, err, errUnexpectedResponse)
+		require.NotNil(t, response)
+		require.Same(t, message, validatedRequest)
+
+		var responseErr *connection.ResponseError
+		require.ErrorAs(t, err, &responseErr)
+		require.Same(t, response, responseErr.Response)
+	})
+}
+
+// countingSTANProvider returns sequential STANs and counts them
+type countingSTANProvider struct {
+	next int32
+}
+
+func (p *countingSTANProvider) Next() (string, error) {
+	return fmt.Sprintf("%06d", atomic.AddInt32(&p.next, 1)), nil
+}
+
+func TestClient_RequiredFields(t *testing.T) {
+	var received int32
+	serverHandler := func(c *connection.Connection, message *iso8583.Message) {
+		atomic.AddInt32(&received, 1)
+
+		response, err := iso8583util.NewResponseFrom(message, []int{11})
+		require.NoError(t, err)
+		require.NoError(t, c.Reply(response))
+	}
+
+	stans := &countingSTANProvider{}
+	c, err := connectiontest.NewPipeConnection(testSpec, readMessageLength, writeMessageLength, serverHandler,
+		connection.WithSTANProvider(stans),
+		connection.RequiredFields(map[string][]int{
+			"08":   {2, 7},
+			"0820": {7},
+			"01":   {2},
+		}),
+	)
+	require.NoError(t, err)
+	defer c.Close()
+
+	newMessage := func(mti string, fields map[int]string) *iso8583.Message {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI(mti)
+		for id, value := range fields {
+			require.NoError(t, message.Field(id, value))
+		}
+
+		return message
+	}
+
+	t.Run("fails with ValidationError listing missing fields", func(t *testing.T) {
+		_, err := c.Send(newMessage("0800", nil))
+
+		var validationErr *connection.ValidationError
+		require.ErrorAs(t, err, &validationErr)
+		require.Equal(t, "0800", validationErr.MTI)
+		require.Equal(t, []int{2, 7}, validationErr.MissingFields)
+
+		// nothing was sent and STAN was not consumed
+		require.Equal(t, int32(0), atomic.LoadInt32(&received))
+		require.Equal(t, int32(0), atomic.LoadInt32(&stans.next))
+	})
+
+	t.Run("treats empty fields as missing", func(t *testing.T) {
+		_, err := c.Send(newMessage("0800", map[int]string{2: TestCaseReply, 7: ""}))
+
+		var validationErr *connection.ValidationError
+		require.ErrorAs(t, err, &validationErr)
+		require.Equal(t, []int{7}, validationErr.MissingFields)
+	})
+
+	t.Run("checks fields of the longest MTI prefix", func(t *testing.T) {
+		_, err := c.Send(newMessage("0820", map[int]string{2: TestCaseReply}))
+
+		var validationErr *connection.ValidationError
+		require.ErrorAs(t, err, &validationErr)
+		require.Equal(t, []int{7}, validationErr.MissingFields)
+
+		_, err = c.Send(newMessage("0820", map[int]string{7: "1231235959"}))
+		require.NoError(t, err)
+	})
+
+	t.Run("sends messages with required fields and without rules", func(t *testing.T) {
+		_, err := c.Send(newMessage("0800", map[int]string{2: TestCaseReply, 7: "1231235959"}))
+		require.NoError(t, err)
+
+		_, err = c.Send(newMessage("0200", nil))
+		require.NoError(t, err)
+	})
+
+	t.Run("skips validation of the message once", func(t *testing.T) {
+		message := newMessage("0100", nil)
+
+		c.SkipValidation(message)
+		_, err := c.Send(message)
+		require.NoError(t, err)
+
+		require.NoError(t, message.Field(11, ""))
+		_, err = c.Send(message)
+
+		var validationErr *connection.ValidationError
+		require.ErrorAs(t, err, &validationErr)
+		require.Equal(t, []int{2}, validationErr.MissingFields)
+	})
+
+	t.Run("validates messages sent with SendMessage", func(t *testing.T) {
+		_, err := c.SendMessage(&echoRequest{stan: getSTAN()})
+
+		var validationErr *connection.ValidationError
+		require.ErrorAs(t, err, &validationErr)
+		require.Equal(t, []int{2, 7}, validationErr.MissingFields)
+	})
+}
+
+func TestClient_AutoAckAdvices(t *testing.T) {
+	newAdvice := func() *iso8583.Message {
+		advice := iso8583.NewMessage(testSpec)
+		advice.MTI("0620")
+		require.NoError(t, advice.Field(2, TestCaseReply))
+		require.NoError(t, advice.Field(11, getSTAN()))
+
+		return advice
+	}
+
+	// pipe connects client with options to the host, which sends advices
+	pipe := func(t *testing.T, opts ...connection.Option) (*connection.Connection, *connection.Connection) {
+		clientConn, hostConn := net.Pipe()
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength, opts...)
+		require.NoError(t, err)
+		t.Cleanup(func() { c.Close() })
+
+		host, err := connection.NewFrom(hostConn, testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+		t.Cleanup(func() { host.Close() })
+
+		return c, host
+	}
+
+	t.Run("sends ack before the handler finishes", func(t *testing.T) {
+		release := make(chan struct{})
+		handled := make(chan string, 1)
+
+		_, host := pipe(t,
+			connection.AutoAckAdvices(map[string]string{"0620": "0630", "0420": "0430"}, nil),
+			connection.InboundMessageHandlerFor("06", func(c *connection.Connection, message *iso8583.Message) {
+				<-release
+
+				stan, _ := message.GetString(11)
+				handled <- stan
+			}),
+		)
+		defer close(release)
+
+		advice := newAdvice()
+		ack, err := host.Send(advice)
+		require.NoError(t, err)
+
+		mti, err := ack.GetMTI()
+		require.NoError(t, err)
+		require.Equal(t, "0630", mti)
+
+		code, err := ack.GetString(2)
+		require.NoError(t, err)
+		require.Equal(t, TestCaseReply, code)
+
+		// handler is still running
+		select {
+		case <-handled:
+			t.Fatal("advice was handled before ack was received")
+		default:
+		}
+
+		release <- struct{}{}
+
+		adviceSTAN, err := advice.GetString(11)
+		require.NoError(t, err)
+		require.Equal(t, adviceSTAN, <-handled)
+	})
+
+	t.Run("sends ack built by the builder", func(t *testing.T) {
+		_, host := pipe(t,
+			connection.AutoAckAdvices(map[string]string{"0620": "0630"}, func(advice *iso8583.Message) *iso8583.Message {
+				ack := iso8583.NewMessage(testSpec)
+				ack.MTI("0630")
+				stan, _ := advice.GetString(11)
+				ack.Field(11, stan)
+				ack.Field(2, "123")
+
+				return ack
+			}),
+		)
+
+		ack, err := host.Send(newAdvice())
+		require.NoError(t, err)
+
+		code, err := ack.GetString(2)
+		require.NoError(t, err)
+		require.Equal(t, "123", code)
+	})
+
+	t.Run("handler sends deferred ack", func(t *testing.T) {
+		_, host := pipe(t,
+			connection.AutoAckAdvices(map[string]string{"0620": "0630"}, nil),
+			connection.DeferAdviceAcks(),
+			connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+				ack, err := c.AdviceAck(message)
+				require.NoError(t, err)
+
+				// result of the processing
+				require.NoError(t, ack.Field(7, "1231235959"))
+				require.NoError(t, c.Reply(ack))
+			}),
+		)
+
+		ack, err := host.Send(newAdvice())
+		require.NoError(t, err)
+
+		mti, err := ack.GetMTI()
+		require.NoError(t, err)
+		require.Equal(t, "0630", mti)
+
+		transmissionTime, err := ack.GetString(7)
+		require.NoError(t, err)
+		require.Equal(t, "1231235959", transmissionTime)
+	})
+}
+
+func TestClient_SendWithIdempotencyKey(t *testing.T) {
+	var received int32
+	release := make(chan struct{})
+	serverHandler := func(c *connection.Connection, message *iso8583.Message) {
+		atomic.AddInt32(&received, 1)
+		<-release
+
+		response, err := iso8583util.NewResponseFrom(message, []int{2, 11})
+		require.NoError(t, err)
+		require.NoError(t, c.Reply(response))
+	}
+
+	clock := connectiontest.NewFakeClock(time.Now())
+	c, err := connectiontest.NewPipeConnection(testSpec, readMessageLength, writeMessageLength, serverHandler,
+		connection.WithClock(clock),
+		connection.IdempotencyTTL(10*time.Second),
+		connection.IdempotencyCacheSize(2),
+	)
+	require.NoError(t, err)
+	defer c.Close()
+
+	newMessage := func() *iso8583.Message {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0100")
+		require.NoError(t, message.Field(2, TestCaseReply))
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		return message
+	}
+
+	t.Run("concurrent Sends with the same key write one message", func(t *testing.T) {
+		type result struct {
+			response *iso8583.Message
+			err      error
+		}
+
+		results := make(chan result, 2)
+		send := func() {
+			response, err := c.Send(newMessage(), connection.WithIdempotencyKey("order-1"))
+			results <- result{response, err}
+		}
+
+		go send()
+		require.Eventually(t, func() bool {
+			return atomic.LoadInt32(&received) == 1
+		}, time.Second, 10*time.Millisecond)
+
+		go send()
+		require.Eventually(t, func() bool {
+			return c.Stats().DeduplicatedSends == 1
+		}, time.Second, 10*time.Millisecond)
+
+		release <- struct{}{}
+
+		first, second := <-results, <-results
+		require.NoError(t, first.err)
+		require.NoError(t, second.err)
+		require.Same(t, first.response, second.response)
+		require.Equal(t, int32(1), atomic.LoadInt32(&received))
+	})
+
+	t.Run("returns cached response within TTL", func(t *testing.T) {
+		go func() { release <- struct{}{} }()
+		response, err := c.Send(newMessage(), connection.WithIdempotencyKey("order-2"))
+		require.NoError(t, err)
+
+		clock.Advance(5 * time.Second)
+
+		cached, err := c.Send(newMessage(), connection.WithIdempotencyKey("order-2"))
+		require.NoError(t, err)
+		require.Same(t, response, cached)
+		require.Equal(t, int32(2), atomic.LoadInt32(&received))
+		require.Equal(t, uint64(2), c.Stats().DeduplicatedSends)
+	})
+
+	t.Run("sends message again after TTL", func(t *testing.T) {
+		clock.Advance(6 * time.Second)
+
+		go func() { release <- struct{}{} }()
+		_, err := c.Send(newMessage(), connection.WithIdempotencyKey("order-2"))
+		require.NoError(t, err)
+		require.Equal(t, int32(3), atomic.LoadInt32(&received))
+	})
+
+	t.Run("evicts the oldest key when cache is full", func(t *testing.T) {
+		for _, key := range []string{"order-3", "order-4", "order-5"} {
+			go func() { release <- struct{}{} }()
+			_, err := c.Send(newMessage(), connection.WithIdempotencyKey(key))
+			require.NoError(t, err)
+		}
+		require.Equal(t, int32(6), atomic.LoadInt32(&received))
+
+		// order-5 is cached, order-3 was evicted
+		_, err := c.Send(newMessage(), connection.WithIdempotencyKey("order-5"))
+		require.NoError(t, err)
+		require.Equal(t, int32(6), atomic.LoadInt32(&received))
+
+		go func() { release <- struct{}{} }()
+		_, err = c.Send(newMessage(), connection.WithIdempotencyKey("order-3"))
+		require.NoError(t, err)
+		require.Equal(t, int32(7), atomic.LoadInt32(&received))
+	})
+
+	t.Run("sends message again after failed Send", func(t *testing.T) {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0100")
+
+		// message without STAN fails
+		_, err := c.Send(message, connection.WithIdempotencyKey("order-6"))
+		require.Error(t, err)
+
+		go func() { release <- struct{}{} }()
+		_, err = c.Send(newMessage(), connection.WithIdempotencyKey("order-6"))
+		require.NoError(t, err)
+		require.Equal(t, int32(8), atomic.LoadInt32(&received))
+	})
+
+	t.Run("pending Sends don't evict completed ones", func(t *testing.T) {
+		// no more messages wait for the release after the test
+		defer close(release)
+
+		// order-3 and order-6 are cached
+		results := make(chan error, 2)
+		for _, key := range []string{"order-7", "order-8"} {
+			go func(key string) {
+				_, err := c.Send(newMessage(), connection.WithIdempotencyKey(key))
+				results <- err
+			}(key)
+		}
+		require.Eventually(t, func() bool {
+			return atomic.LoadInt32(&received) == 10
+		}, time.Second, 10*time.Millisecond)
+
+		// Send of evicted order-3 would wait for the release
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err := c.SendCtx(ctx, newMessage(), connection.WithIdempotencyKey("order-3"))
+		require.NoError(t, err)
+		require.Equal(t, int32(10), atomic.LoadInt32(&received))
+
+		release <- struct{}{}
+		release <- struct{}{}
+		require.NoError(t, <-results)
+		require.NoError(t, <-results)
+	})
+}
+
+func TestClient_ConnectionEstablishedHandler(t *testing.T) {
+	server, err := NewTestServer()
+	require.NoError(t, err)
+	defer server.Close()
+
+	established := make(chan *connection.Connection, 1)
+	c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+		connection.ConnectionEstablishedHandler(func(c *connection.Connection) {
+			established <- c
+		}),
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, c.Connect())
+	defer c.Close()
+
+	select {
+	case got := <-established:
+		require.Same(t, c, got)
+	case <-time.After(time.Second):
+		t.Fatal("handler was not called")
+	}
+}
+
+func TestClient_OnUnpackError(t *testing.T) {
+	// frame returns the message with the length header
+	frame := func(t *testing.T, packed []byte) []byte {
+		var buf bytes.Buffer
+		_, err := writeMessageLength(&buf, len(packed))
+		require.NoError(t, err)
+		buf.Write(packed)
+
+		return buf.Bytes()
+	}
+
+	packed := func(t *testing.T, stan string) []byte {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, stan))
+
+		b, err := message.Pack()
+		require.NoError(t, err)
+
+		return b
+	}
+
+	// invalid message has MTI but its bitmap is truncated
+	invalid := []byte("0800ab")
+
+	// run writes valid, invalid and valid messages into the connection
+	// with opts and returns STANs of the handled messages and reported
+	// errors
+	run := func(t *testing.T, opts ...connection.Option) (*connection.Connection, chan string, chan error) {
+		clientConn, hostConn := net.Pipe()
+		t.Cleanup(func() { hostConn.Close() })
+
+		handled := make(chan string, 2)
+		errs := make(chan error, 2)
+		opts = append(opts,
+			connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+				stan, _ := message.GetString(11)
+				handled <- stan
+			}),
+			connection.ErrorHandler(func(c *connection.Connection, err error) {
+				errs <- err
+			}),
+		)
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength, opts...)
+		require.NoError(t, err)
+		t.Cleanup(func() { c.Close() })
+
+		go func() {
+			for _, f := range [][]byte{frame(t, packed(t, "000001")), frame(t, invalid), frame(t, packed(t, "000002"))} {
+				if _, err := hostConn.Write(f); err != nil {
+					return
+				}
+			}
+		}()
+
+		return c, handled, errs
+	}
+
+	t.Run("SkipOnUnpackError continues reading", func(t *testing.T) {
+		c, handled, errs := run(t, connection.OnUnpackError(connection.SkipOnUnpackError))
+
+		require.ElementsMatch(t, []string{"000001", "000002"}, []string{<-handled, <-handled})
+
+		var unpackErr *connection.UnpackError
+		require.ErrorAs(t, <-errs, &unpackErr)
+		require.Equal(t, invalid, unpackErr.RawMessage)
+		require.Equal(t, connection.StatusOnline, c.Status())
+	})
+
+	t.Run("CloseOnUnpackError closes the connection", func(t *testing.T) {
+		c, handled, errs := run(t, connection.OnUnpackError(connection.CloseOnUnpackError))
+
+		require.Equal(t, "000001", <-handled)
+
+		var unpackErr *connection.UnpackError
+		require.ErrorAs(t, <-errs, &unpackErr)
+
+		select {
+		case <-c.Done():
+		case <-time.After(time.Second):
+			t.Fatal("connection was not closed")
+		}
+		require.ErrorAs(t, c.Err(), &unpackErr)
+
+		select {
+		case stan := <-handled:
+			t.Fatalf("message %s was handled after connection was closed", stan)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+
+	t.Run("custom policy gets the raw message", func(t *testing.T) {
+		raws := make(chan []byte, 1)
+		c, handled, _ := run(t, connection.OnUnpackError(func(raw []byte, err error) connection.UnpackErrorAction {
+			raws <- append([]byte(nil), raw...)
+
+			if bytes.HasPrefix(raw, []byte("08")) {
+				return connection.UnpackErrorSkip
+			}
+			return connection.UnpackErrorClose
+		}))
+
+		require.ElementsMatch(t, []string{"000001", "000002"}, []string{<-handled, <-handled})
+		require.Equal(t, invalid, <-raws)
+		require.Equal(t, connection.StatusOnline, c.Status())
+	})
+}
+
+func TestClient_CloseDoesNotLeakGoroutines(t *testing.T) {
+	server, err := NewTestServer()
+	require.NoError(t, err)
+	defer server.Close()
+
+	baseline := runtime.NumGoroutine()
+
+	for i := 0; i < 1000; i++ {
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+
+		require.NoError(t, c.Connect())
+		require.NoError(t, c.Close())
+	}
+
+	// goroutines of the server handling the connections exit when they
+	// read EOF, so we give them time. require.Eventually is not used as
+	// it runs the condition in its own goroutine.
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.LessOrEqual(t, runtime.NumGoroutine(), baseline)
+
+	// without the server, goroutines of the client must exit by the
+	// time Close returns
+	for i := 0; i < 1000; i++ {
+		clientConn, hostConn := net.Pipe()
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+
+		require.NoError(t, c.Close())
+		require.LessOrEqual(t, runtime.NumGoroutine(), baseline)
+
+		hostConn.Close()
+	}
+}
+
+func TestClient_ConcurrentConnectCloseSend(t *testing.T) {
+	server, err := NewTestServer()
+	require.NoError(t, err)
+	defer server.Close()
+
+	c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+		connection.SendTimeout(100*time.Millisecond),
+		connection.ErrorHandler(func(c *connection.Connection, err error) {}),
+	)
+	require.NoError(t, err)
+	defer c.Close()
+
+	newMessage := func() (*iso8583.Message, error) {
+		message := iso8583.NewMessage(testSpec)
+		err := message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(TestCaseReply),
+			STAN:         field.NewStringValue(getSTAN()),
+		})
+
+		return message, err
+	}
+
+	// message sent before Connect is not queued
+	message, err := newMessage()
+	require.NoError(t, err)
+
+	_, err = c.Send(message)
+	require.ErrorIs(t, err, connection.ErrConnectionClosed)
+
+	// unexpected errors returned by the calls
+	unexpected := make(chan error, 100)
+	report := func(err error) {
+		select {
+		case unexpected <- err:
+		default:
+		}
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+
+	hammer := func(call func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				call()
+			}
+		}()
+	}
+
+	for i := 0; i < 4; i++ {
+		hammer(func() {
+			err := c.Connect()
+			if err != nil && !errors.Is(err, connection.ErrAlreadyConnected) {
+				report(fmt.Errorf("connect: %w", err))
+			}
+		})
+
+		hammer(func() {
+			if err := c.Close(); err != nil {
+				report(fmt.Errorf("close: %w", err))
+			}
+		})
+
+		hammer(func() {
+			err := c.SetOptions(connection.SendTimeout(100*time.Millisecond), connection.IdleTime(time.Second))
+			if err != nil {
+				report(fmt.Errorf("set options: %w", err))
+			}
+		})
+	}
+
+	for i := 0; i < 8; i++ {
+		hammer(func() {
+			message, err := newMessage()
+			if err != nil {
+				report(err)
+				return
+			}
+
+			_, err = c.Send(message)
+			if err != nil && !errors.Is(err, connection.ErrConnectionClosed) && !errors.Is(err, connection.ErrSendTimeout) {
+				report(fmt.Errorf("send: %w", err))
+			}
+		})
+	}
+
+	time.Sleep(2 * time.Second)
+	close(stop)
+	wg.Wait()
+	close(unexpected)
+
+	for err := range unexpected {
+		t.Error(err)
+	}
+
+	// connection is usable after all
+	err = c.Connect()
+	if !errors.Is(err, connection.ErrAlreadyConnected) {
+		require.NoError(t, err)
+	}
+	message, err = newMessage()
+	require.NoError(t, err)
+
+	_, err = c.Send(message)
+	require.NoError(t, err)
+}
+
+func TestClient_LateResponseToReusedPendingRequest(t *testing.T) {
+	clientConn, hostConn := net.Pipe()
+	defer hostConn.Close()
+
+	const iterations = 50
+
+	late := make(chan string, iterations)
+	c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+		connection.SendTimeout(20*time.Millisecond),
+		connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+			stan, _ := message.GetString(11)
+			late <- stan
+		}),
+	)
+	require.NoError(t, err)
+	defer c.Close()
+
+	readRequest := func() (*iso8583.Message, error) {
+		length, err := readMessageLength(hostConn)
+		if err != nil {
+			return nil, err
+		}
+
+		packed := make([]byte, length)
+		if _, err := io.ReadFull(hostConn, packed); err != nil {
+			return nil, err
+		}
+
+		message := iso8583.NewMessage(testSpec)
+		return message, message.Unpack(packed)
+	}
+
+	writeResponse := func(request *iso8583.Message) error {
+		stan, err := request.GetString(11)
+		if err != nil {
+			return err
+		}
+
+		response := iso8583.NewMessage(testSpec)
+		response.MTI("0810")
+		if err := response.Field(11, stan); err != nil {
+			return err
+		}
+
+		packed, err := response.Pack()
+		if err != nil {
+			return err
+		}
+
+		if _, err := writeMessageLength(hostConn, len(packed)); err != nil {
+			return err
+		}
+		_, err = hostConn.Write(packed)
+
+		return err
+	}
+
+	// host replies to the timed out request only when the next request
+	// was sent, so the late response arrives while the pending request
+	// of the timed out one may be reused
+	go func() {
+		for {
+			timedOut, err := readRequest()
+			if err != nil {
+				return
+			}
+
+			next, err := readRequest()
+			if err != nil {
+				return
+			}
+
+			if writeResponse(timedOut) != nil || writeResponse(next) != nil {
+				return
+			}
+		}
+	}()
+
+	newMessage := func(stan string) *iso8583.Message {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, stan))
+
+		return message
+	}
+
+	for i := 0; i < iterations; i++ {
+		timedOutSTAN := fmt.Sprintf("%06d", 2*i+1)
+		_, err := c.Send(newMessage(timedOutSTAN))
+		require.ErrorIs(t, err, connection.ErrSendTimeout)
+
+		stan := fmt.Sprintf("%06d", 2*i+2)
+		resp, err := c.Send(newMessage(stan))
+		require.NoError(t, err)
+
+		respSTAN, err := resp.GetString(11)
+		require.NoError(t, err)
+		require.Equal(t, stan, respSTAN)
+
+		select {
+		case lateSTAN := <-late:
+			require.Equal(t, timedOutSTAN, lateSTAN)
+		case <-time.After(time.Second):
+			t.Fatal("late response was not handled")
+		}
+	}
+}
+
+func TestClient_InboundFramesAreReused(t *testing.T) {
+	spec := specWithFields(map[int]field.Field{
+		52: field.NewBinary(&field.Spec{
+			Length:      8,
+			Description: "PIN Data",
+			Enc:         encoding.Binary,
+			Pref:        prefix.Binary.Fixed,
+		}),
+		63: field.NewString(&field.Spec{
+			Length:      99,
+			Description: "Private Data",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.LL,
+		}),
+	})
+
+	clientConn, hostConn := net.Pipe()
+	defer hostConn.Close()
+
+	const messages = 100
+
+	received := make(chan *iso8583.Message, messages)
+	c, err := connection.NewFrom(clientConn, spec, readMessageLength, writeMessageLength,
+		connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+			received <- message
+		}),
+	)
+	require.NoError(t, err)
+	defer c.Close()
+
+	pin := func(i int) []byte {
+		return bytes.Repeat([]byte{byte(i)}, 8)
+	}
+
+	privateData := func(i int) string {
+		return strings.Repeat(fmt.Sprintf("%02d", i%100), 10)
+	}
+
+	// each frame is read into the buffer of the previous one, so the
+	// buffer is overwritten after the message was delivered
+	var delivered []*iso8583.Message
+	for i := 0; i < messages; i++ {
+		message := iso8583.NewMessage(spec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, fmt.Sprintf("%06d", i)))
+		require.NoError(t, message.BinaryField(52, pin(i)))
+		require.NoError(t, message.Field(63, privateData(i)))
+
+		packed, err := message.Pack()
+		require.NoError(t, err)
+
+		_, err = writeMessageLength(hostConn, len(packed))
+		require.NoError(t, err)
+		_, err = hostConn.Write(packed)
+		require.NoError(t, err)
+
+		select {
+		case message := <-received:
+			delivered = append(delivered, message)
+		case <-time.After(time.Second):
+			t.Fatal("message was not delivered")
+		}
+	}
+
+	for i, message := range delivered {
+		stan, err := message.GetString(11)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("%06d", i), stan)
+
+		pinData, err := message.GetBytes(52)
+		require.NoError(t, err)
+		require.Equal(t, pin(i), pinData)
+
+		data, err := message.GetString(63)
+		require.NoError(t, err)
+		require.Equal(t, privateData(i), data)
+	}
+}
+
+func TestClient_SendCtx(t *testing.T) {
+	type traceKey struct{}
+
+	newMessage := func(t *testing.T, testCase string) *iso8583.Message {
+		message := iso8583.NewMessage(testSpec)
+		err := message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(testCase),
+			STAN:         field.NewStringValue(getSTAN()),
+		})
+		require.NoError(t, err)
+
+		return message
+	}
+
+	traceID := func(ctx context.Context) interface{} {
+		return ctx.Value(traceKey{})
+	}
+
+	t.Run("hooks get the context of the request", func(t *testing.T) {
+		server, err := NewTestServer()
+		require.NoError(t, err)
+		defer server.Close()
+
+		seen := make(chan string, 10)
+		see := func(hook string, message *iso8583.Message, c *connection.Connection) {
+			seen <- fmt.Sprintf("%s: %v", hook, traceID(c.RequestContext(message)))
+		}
+
+		var c *connection.Connection
+		c, err = connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(100*time.Millisecond),
+			connection.ResponseValidator(func(request, response *iso8583.Message) error {
+				see("request validator", request, c)
+				see("response validator", response, c)
+				return nil
+			}),
+			connection.ReversalMTIs("0800"),
+			connection.TimeoutReversalHandler(func(original *iso8583.Message) *iso8583.Message {
+				see("reversal", original, c)
+				return nil
+			}),
+			connection.LateResponseGrace(time.Second),
+			connection.LateResponseHandler(func(requestID string, response *iso8583.Message) {
+				see("late response", response, c)
+			}),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		ctx := context.WithValue(context.Background(), traceKey{}, "reply")
+		_, err = c.SendCtx(ctx, newMessage(t, TestCaseReply))
+		require.NoError(t, err)
+
+		require.Equal(t, "request validator: reply", <-seen)
+		require.Equal(t, "response validator: reply", <-seen)
+
+		ctx = context.WithValue(context.Background(), traceKey{}, "timeout")
+		_, err = c.SendCtx(ctx, newMessage(t, TestCaseDelayedResponse))
+		require.ErrorIs(t, err, connection.ErrSendTimeout)
+
+		require.Equal(t, "reversal: timeout", <-seen)
+		require.Equal(t, "late response: timeout", <-seen)
+
+		// messages sent without the context have the background one
+		_, err = c.Send(newMessage(t, TestCaseReply))
+		require.NoError(t, err)
+
+		require.Equal(t, "request validator: <nil>", <-seen)
+		require.Equal(t, "response validator: <nil>", <-seen)
+	})
+
+	t.Run("cancelled queued message is dead lettered with the context", func(t *testing.T) {
+		clientConn, hostConn := net.Pipe()
+		defer hostConn.Close()
+
+		deadLetters := make(chan interface{}, 1)
+
+		var c *connection.Connection
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(200*time.Millisecond),
+			connection.DeadLetterHandler(func(message *iso8583.Message, reason error) {
+				deadLetters <- traceID(c.RequestContext(message))
+			}),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		// host reads only the first byte, so writing of the first
+		// message blocks the write loop
+		go c.Send(newMessage(t, TestCaseReply))
+		_, err = hostConn.Read(make([]byte, 1))
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.WithValue(context.Background(), traceKey{}, "cancelled"))
+		time.AfterFunc(50*time.Millisecond, cancel)
+
+		_, err = c.SendCtx(ctx, newMessage(t, TestCaseReply))
+		require.ErrorIs(t, err, context.Canceled)
+		require.Equal(t, 1, c.PendingRequests())
+
+		// write loop gives up on the cancelled message
+		go io.Copy(io.Discard, hostConn)
+
+		select {
+		case trace := <-deadLetters:
+			require.Equal(t, "cancelled", trace)
+		case <-time.After(time.Second):
+			t.Fatal("message was not dead lettered")
+		}
+	})
+}
+
+func TestClient_CorrelationID(t *testing.T) {
+	spec := specWithFields(map[int]field.Field{
+		62: field.NewString(&field.Spec{
+			Length:      99,
+			Description: "Correlation ID",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.LL,
+		}),
+	})
+
+	type traceKey struct{}
+
+	// server echoes field 62 unless the test case tells to alter it
+	received := make(chan string, 10)
+	serverHandler := func(c *connection.Connection, message *iso8583.Message) {
+		id, err := message.GetString(62)
+		require.NoError(t, err)
+		received <- id
+
+		response, err := iso8583util.NewResponseFrom(message, []int{11, 62})
+		require.NoError(t, err)
+
+		if testCase, _ := message.GetString(2); testCase == "001" {
+			require.NoError(t, response.Field(62, "altered"))
+		}
+
+		require.NoError(t, c.Reply(response))
+	}
+
+	c, err := connectiontest.NewPipeConnection(spec, readMessageLength, writeMessageLength, serverHandler,
+		connection.CorrelationID(62, func(ctx context.Context) string {
+			if trace, ok := ctx.Value(traceKey{}).(string); ok {
+				return trace
+			}
+			return "generated"
+		}),
+	)
+	require.NoError(t, err)
+	defer c.Close()
+
+	newMessage := func(testCase string) *iso8583.Message {
+		message := iso8583.NewMessage(spec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(2, testCase))
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		return message
+	}
+
+	t.Run("sets the field from the context", func(t *testing.T) {
+		ctx := context.WithValue(context.Background(), traceKey{}, "trace-1")
+		response, err := c.SendCtx(ctx, newMessage(TestCaseReply))
+		require.NoError(t, err)
+		require.Equal(t, "trace-1", <-received)
+
+		id, err := response.GetString(62)
+		require.NoError(t, err)
+		require.Equal(t, "trace-1", id)
+	})
+
+	t.Run("sets the field without the context", func(t *testing.T) {
+		_, err := c.Send(newMessage(TestCaseReply))
+		require.NoError(t, err)
+		require.Equal(t, "generated", <-received)
+	})
+
+	t.Run("keeps the field that is set", func(t *testing.T) {
+		message := newMessage(TestCaseReply)
+		require.NoError(t, message.Field(62, "preset"))
+
+		_, err := c.Send(message)
+		require.NoError(t, err)
+		require.Equal(t, "preset", <-received)
+	})
+
+	require.Zero(t, c.Stats().CorrelationIDMismatches)
+
+	t.Run("counts mismatched response", func(t *testing.T) {
+		_, err := c.Send(newMessage("001"))
+		require.NoError(t, err)
+		require.Equal(t, "generated", <-received)
+
+		require.Equal(t, uint64(1), c.Stats().CorrelationIDMismatches)
+	})
+}
+
+func TestClient_MatchByField(t *testing.T) {
+	spec := specWithFields(map[int]field.Field{
+		41: field.NewString(&field.Spec{
+			Length:      8,
+			Description: "Card Acceptor Terminal Identification",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+		63: field.NewComposite(&field.Spec{
+			Length:      999,
+			Description: "Private Data",
+			Pref:        prefix.ASCII.LLL,
+			Tag: &field.TagSpec{
+				Sort: isosort.StringsByInt,
+			},
+			Subfields: map[string]field.Field{
+				"1": field.NewString(&field.Spec{
+					Length:      2,
+					Description: "Private Data Type",
+					Enc:         encoding.ASCII,
+					Pref:        prefix.ASCII.Fixed,
+				}),
+				"2": field.NewString(&field.Spec{
+					Length:      6,
+					Description: "Systems Trace",
+					Enc:         encoding.ASCII,
+					Pref:        prefix.ASCII.Fixed,
+				}),
+			},
+		}),
+	})
+
+	// server echoes fields 11, 41 and 63. Response to the delayed request
+	// is sent after responses to the requests received later.
+	serverHandler := func(c *connection.Connection, message *iso8583.Message) {
+		response, err := iso8583util.NewResponseFrom(message, []int{11, 41, 63})
+		require.NoError(t, err)
+
+		if testCase, _ := message.GetString(2); testCase == TestCaseDelayedResponse {
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				c.Reply(response)
+			}()
+			return
+		}
+
+		require.NoError(t, c.Reply(response))
+	}
+
+	t.Run("matches by terminal ID and STAN", func(t *testing.T) {
+		c, err := connectiontest.NewPipeConnection(spec, readMessageLength, writeMessageLength, serverHandler,
+			connection.MatchByField("41", "11"),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		stan := getSTAN()
+		send := func(testCase, terminalID string) (*iso8583.Message, error) {
+			message := iso8583.NewMessage(spec)
+			message.MTI("0800")
+			require.NoError(t, message.Field(2, testCase))
+			require.NoError(t, message.Field(11, stan))
+			require.NoError(t, message.Field(41, terminalID))
+
+			return c.Send(message)
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			response, err := send(TestCaseDelayedResponse, "TERM0001")
+			require.NoError(t, err)
+
+			terminalID, err := response.GetString(41)
+			require.NoError(t, err)
+			require.Equal(t, "TERM0001", terminalID)
+		}()
+
+		require.Eventually(t, func() bool {
+			return c.Stats().PendingRequests == 1
+		}, time.Second, 10*time.Millisecond)
+
+		// same STAN, so the request would be rejected as duplicate if
+		// it was matched by STAN only
+		response, err := send(TestCaseReply, "TERM0002")
+		require.NoError(t, err)
+
+		terminalID, err := response.GetString(41)
+		require.NoError(t, err)
+		require.Equal(t, "TERM0002", terminalID)
+
+		wg.Wait()
+	})
+
+	t.Run("fails when match field is missing", func(t *testing.T) {
+		c, err := connectiontest.NewPipeConnection(spec, readMessageLength, writeMessageLength, serverHandler,
+			connection.MatchByField("41", "11"),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		message := iso8583.NewMessage(spec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(2, TestCaseReply))
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		_, err = c.Send(message)
+		require.EqualError(t, err, "creating request ID: match field 41 is missing")
+	})
+
+	t.Run("auto-STAN sets subfield of the composite field", func(t *testing.T) {
+		c, err := connectiontest.NewPipeConnection(spec, readMessageLength, writeMessageLength, serverHandler,
+			connection.MatchByField("63.2"),
+			connection.AutoSTAN(),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		for i := 1; i <= 3; i++ {
+			message := iso8583.NewMessage(spec)
+			message.MTI("0800")
+			require.NoError(t, message.Field(2, TestCaseReply))
+			require.NoError(t, message.UnmarshalJSON([]byte(`{"63":{"1":"AB"}}`)))
+
+			response, err := c.Send(message)
+			require.NoError(t, err)
+
+			// field 11 is not set as it's not the match field
+			require.NotContains(t, message.GetFields(), 11)
+
+			data, err := json.Marshal(response.GetField(63))
+			require.NoError(t, err)
+			require.JSONEq(t, fmt.Sprintf(`{"1":"AB","2":"%06d"}`, i), string(data))
+		}
+	})
+
+	t.Run("validates paths", func(t *testing.T) {
+		_, err := connection.New("", nil, nil, nil, connection.MatchByField())
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "match fields should not be empty")
+
+		_, err = connection.New("", nil, nil, nil, connection.MatchByField("11", "63."))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), `field path should not have empty subfield tags, got "63."`)
+
+		_, err = connection.New("", nil, nil, nil, connection.MatchByField("1"))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), `field path should start with a data field, got "1"`)
+	})
+}
+
+func TestClient_Matcher(t *testing.T) {
+	spec := specWithFields(map[int]field.Field{
+		37: field.NewString(&field.Spec{
+			Length:      12,
+			Description: "Retrieval Reference Number",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.LL,
+		}),
+	})
+
+	// switch rewrites STAN and truncates RRN to its last 6 characters.
+	// Response to the delayed request is sent after responses to the
+	// requests received later.
+	serverHandler := func(c *connection.Connection, message *iso8583.Message) {
+		response, err := iso8583util.NewResponseFrom(message, nil)
+		require.NoError(t, err)
+
+		rrn, err := message.GetString(37)
+		require.NoError(t, err)
+		require.NoError(t, response.Field(11, "999999"))
+		require.NoError(t, response.Field(37, rrn[len(rrn)-6:]))
+
+		if testCase, _ := message.GetString(2); testCase == TestCaseDelayedResponse {
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				c.Reply(response)
+			}()
+			return
+		}
+
+		require.NoError(t, c.Reply(response))
+	}
+
+	// matcher pairs the response with the request by the RRN suffix
+	byRRN := func(pending []*connection.PendingRequest, response *iso8583.Message) (*connection.PendingRequest, bool) {
+		truncated, err := response.GetString(37)
+		if err != nil {
+			return nil, false
+		}
+
+		for _, p := range pending {
+			rrn, err := p.Message.GetString(37)
+			if err == nil && strings.HasSuffix(rrn, truncated) {
+				return p, true
+			}
+		}
+
+		return nil, false
+	}
+
+	newMessage := func(testCase, rrn string) *iso8583.Message {
+		message := iso8583.NewMessage(spec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(2, testCase))
+		require.NoError(t, message.Field(11, getSTAN()))
+		require.NoError(t, message.Field(37, rrn))
+
+		return message
+	}
+
+	t.Run("pairs responses with rewritten STAN", func(t *testing.T) {
+		c, err := connectiontest.NewPipeConnection(spec, readMessageLength, writeMessageLength, serverHandler,
+			connection.Matcher(byRRN),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			response, err := c.Send(newMessage(TestCaseDelayedResponse, "000000111111"))
+			require.NoError(t, err)
+
+			rrn, err := response.GetString(37)
+			require.NoError(t, err)
+			require.Equal(t, "111111", rrn)
+		}()
+
+		require.Eventually(t, func() bool {
+			return c.Stats().PendingRequests == 1
+		}, time.Second, 10*time.Millisecond)
+
+		response, err := c.Send(newMessage(TestCaseReply, "000000222222"))
+		require.NoError(t, err)
+
+		rrn, err := response.GetString(37)
+		require.NoError(t, err)
+		require.Equal(t, "222222", rrn)
+
+		wg.Wait()
+
+		require.Zero(t, c.Stats().UnmatchedResponses)
+	})
+
+	t.Run("response is unmatched when matcher finds no request", func(t *testing.T) {
+		c, err := connectiontest.NewPipeConnection(spec, readMessageLength, writeMessageLength, serverHandler,
+			connection.Matcher(func(pending []*connection.PendingRequest, response *iso8583.Message) (*connection.PendingRequest, bool) {
+				return nil, false
+			}),
+			connection.SendTimeout(200*time.Millisecond),
+			connection.ErrorHandler(func(c *connection.Connection, err error) {}),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		_, err = c.Send(newMessage(TestCaseReply, "000000333333"))
+		require.ErrorIs(t, err, connection.ErrSendTimeout)
+		require.Equal(t, uint64(1), c.Stats().UnmatchedResponses)
+	})
+}
+
+func TestClient_Session(t *testing.T) {
+	spec := specWithFields(map[int]field.Field{
+		41: field.NewString(&field.Spec{
+			Length:      8,
+			Description: "Card Acceptor Terminal Identification",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+	})
+
+	// server echoes fields 2, 11 and 41. Response to the delayed request
+	// is sent after responses to the requests received later.
+	serverHandler := func(c *connection.Connection, message *iso8583.Message) {
+		response, err := iso8583util.NewResponseFrom(message, []int{2, 11, 41})
+		require.NoError(t, err)
+
+		switch testCase, _ := message.GetString(2); testCase {
+		case TestCaseNoResponse:
+		case TestCaseDelayedResponse:
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				c.Reply(response)
+			}()
+		default:
+			require.NoError(t, c.Reply(response))
+		}
+	}
+
+	newMessage := func(testCase, stan string) *iso8583.Message {
+		message := iso8583.NewMessage(spec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(2, testCase))
+		require.NoError(t, message.Field(11, stan))
+
+		return message
+	}
+
+	t.Run("responses of sessions with colliding STANs are not cross-delivered", func(t *testing.T) {
+		c, err := connectiontest.NewPipeConnection(spec, readMessageLength, writeMessageLength, serverHandler)
+		require.NoError(t, err)
+		defer c.Close()
+
+		first, err := c.Session("TERM0001")
+		require.NoError(t, err)
+		defer first.Close()
+
+		second, err := c.Session("TERM0002")
+		require.NoError(t, err)
+		defer second.Close()
+
+		_, err = c.Session("TERM0001")
+		require.ErrorIs(t, err, connection.ErrSessionExists)
+
+		stan := getSTAN()
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			response, err := first.Send(newMessage(TestCaseDelayedResponse, stan))
+			require.NoError(t, err)
+
+			terminalID, err := response.GetString(41)
+			require.NoError(t, err)
+			require.Equal(t, "TERM0001", terminalID)
+
+			testCase, err := response.GetString(2)
+			require.NoError(t, err)
+			require.Equal(t, TestCaseDelayedResponse, testCase)
+		}()
+
+		require.Eventually(t, func() bool {
+			return first.Stats().PendingRequests == 1 && c.Stats().PendingRequests == 1
+		}, time.Second, 10*time.Millisecond)
+
+		response, err := second.Send(newMessage(TestCaseReply, stan))
+		require.NoError(t, err)
+
+		terminalID, err := response.GetString(41)
+		require.NoError(t, err)
+		require.Equal(t, "TERM0002", terminalID)
+
+		wg.Wait()
+
+		require.Equal(t, connection.SessionStats{Sent: 1}, first.Stats())
+		require.Equal(t, connection.SessionStats{Sent: 1}, second.Stats())
+		require.Zero(t, c.Stats().UnmatchedResponses)
+	})
+
+	t.Run("closing session fails only its pending requests", func(t *testing.T) {
+		c, err := connectiontest.NewPipeConnection(spec, readMessageLength, writeMessageLength, serverHandler)
+		require.NoError(t, err)
+		defer c.Close()
+
+		first, err := c.Session("TERM0001")
+		require.NoError(t, err)
+
+		second, err := c.Session("TERM0002")
+		require.NoError(t, err)
+		defer second.Close()
+
+		stan := getSTAN()
+
+		firstErr := make(chan error, 1)
+		go func() {
+			_, err := first.Send(newMessage(TestCaseNoResponse, stan))
+			firstErr <- err
+		}()
+
+		secondErr := make(chan error, 1)
+		go func() {
+			_, err := second.Send(newMessage(TestCaseDelayedResponse, stan))
+			secondErr <- err
+		}()
+
+		require.Eventually(t, func() bool {
+			return c.Stats().PendingRequests == 2
+		}, time.Second, 10*time.Millisecond)
+
+		require.NoError(t, first.Close())
+		require.ErrorIs(t, <-firstErr, connection.ErrSessionClosed)
+		require.Equal(t, connection.SessionStats{Failed: 1}, first.Stats())
+
+		require.NoError(t, <-secondErr)
+
+		_, err = first.Send(newMessage(TestCaseReply, getSTAN()))
+		require.ErrorIs(t, err, connection.ErrSessionClosed)
+
+		// ID of the closed session can be reused
+		reopened, err := c.Session("TERM0001")
+		require.NoError(t, err)
+		defer reopened.Close()
+
+		_, err = reopened.Send(newMessage(TestCaseReply, getSTAN()))
+		require.NoError(t, err)
+	})
+
+	t.Run("limits pending requests of the session", func(t *testing.T) {
+		c, err := connectiontest.NewPipeConnection(spec, readMessageLength, writeMessageLength, serverHandler)
+		require.NoError(t, err)
+		defer c.Close()
+
+		s, err := c.Session("TERM0001", connection.SessionMaxPending(1))
+		require.NoError(t, err)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			s.Send(newMessage(TestCaseNoResponse, getSTAN()))
+		}()
+
+		require.Eventually(t, func() bool {
+			return s.Stats().PendingRequests == 1
+		}, time.Second, 10*time.Millisecond)
+
+		_, err = s.Send(newMessage(TestCaseReply, getSTAN()))
+		require.ErrorIs(t, err, connection.ErrSessionPendingLimit)
+		require.Equal(t, uint64(1), s.Stats().Rejected)
+
+		require.NoError(t, s.Close())
+		<-done
+	})
+}
+
+func TestClient_SendMulti(t *testing.T) {
+	// server acknowledges the request with 0210 and completes it with
+	// 0230 for the same STAN
+	serverHandler := func(c *connection.Connection, message *iso8583.Message) {
+		ack, err := iso8583util.NewResponseFrom(message, []int{2, 11})
+		require.NoError(t, err)
+		require.NoError(t, c.Reply(ack))
+
+		completion, err := iso8583util.NewResponseFrom(message, []int{2, 11})
+		require.NoError(t, err)
+		completion.MTI("0230")
+		require.NoError(t, c.Reply(completion))
+	}
+
+	newMessage := func() *iso8583.Message {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0200")
+		require.NoError(t, message.Field(2, TestCaseReply))
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		return message
+	}
+
+	receiveMTIs := func(t *testing.T, responses <-chan *iso8583.Message) []string {
+		var mtis []string
+		for response := range responses {
+			mti, err := response.GetMTI()
+			require.NoError(t, err)
+			mtis = append(mtis, mti)
+		}
+		return mtis
+	}
+
+	newConnection := func(t *testing.T, opts ...connection.Option) *connection.Connection {
+		opts = append([]connection.Option{
+			connection.ErrorHandler(func(c *connection.Connection, err error) {}),
+		}, opts...)
+
+		c, err := connectiontest.NewPipeConnection(testSpec, readMessageLength, writeMessageLength, serverHandler, opts...)
+		require.NoError(t, err)
+		t.Cleanup(func() { c.Close() })
+
+		return c
+	}
+
+	t.Run("delivers responses until the final MTI", func(t *testing.T) {
+		c := newConnection(t)
+
+		responses, err := c.SendMulti(newMessage(), connection.FinalMTIs("0230"))
+		require.NoError(t, err)
+		require.Equal(t, []string{"0210", "0230"}, receiveMTIs(t, responses))
+		require.Zero(t, c.Stats().UnmatchedResponses)
+	})
+
+	t.Run("delivers max responses", func(t *testing.T) {
+		c := newConnection(t)
+
+		responses, err := c.SendMulti(newMessage(), connection.MaxResponses(1))
+		require.NoError(t, err)
+		require.Equal(t, []string{"0210"}, receiveMTIs(t, responses))
+
+		// completion is not matched after the request finished
+		require.Eventually(t, func() bool {
+			return c.Stats().UnmatchedResponses == 1
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("delivers responses until timeout", func(t *testing.T) {
+		c := newConnection(t)
+
+		start := time.Now()
+		responses, err := c.SendMulti(newMessage(), connection.MultiTimeout(200*time.Millisecond))
+		require.NoError(t, err)
+		require.Equal(t, []string{"0210", "0230"}, receiveMTIs(t, responses))
+		require.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+	})
+
+	t.Run("rejects request with the same ID", func(t *testing.T) {
+		c, err := connectiontest.NewPipeConnection(testSpec, readMessageLength, writeMessageLength,
+			func(c *connection.Connection, message *iso8583.Message) {},
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		message := newMessage()
+		_, err = c.SendMulti(message)
+		require.NoError(t, err)
+
+		_, err = c.SendMulti(message)
+		require.ErrorIs(t, err, connection.ErrMultiRequestPending)
+	})
+
+	t.Run("closes channel when connection is closed", func(t *testing.T) {
+		c, err := connectiontest.NewPipeConnection(testSpec, readMessageLength, writeMessageLength,
+			func(c *connection.Connection, message *iso8583.Message) {},
+		)
+		require.NoError(t, err)
+
+		responses, err := c.SendMulti(newMessage())
+		require.NoError(t, err)
+
+		require.NoError(t, c.Close())
+		require.Empty(t, receiveMTIs(t, responses))
+	})
+
+	t.Run("validates message like Send", func(t *testing.T) {
+		c := newConnection(t, connection.RequiredFields(map[string][]int{"02": {7}}))
+
+		_, err := c.SendMulti(newMessage(), connection.FinalMTIs("0230"))
+
+		var validationErr *connection.ValidationError
+		require.True(t, errors.As(err, &validationErr))
+		require.Equal(t, []int{7}, validationErr.MissingFields)
+		require.Zero(t, c.Stats().MessagesSent)
+	})
+
+	t.Run("Send returns the first response", func(t *testing.T) {
+		// responses are matched by the read loop in the order they
+		// were received only with inbound workers
+		c := newConnection(t, connection.InboundWorkers(1, 10))
+
+		response, err := c.Send(newMessage())
+		require.NoError(t, err)
+
+		mti, err := response.GetMTI()
+		require.NoError(t, err)
+		require.Equal(t, "0210", mti)
+
+		require.Eventually(t, func() bool {
+			return c.Stats().UnmatchedResponses == 1
+		}, time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestClient_MTIVersion(t *testing.T) {
+	// server responds following conventions of 2003, so instructions
+	// (xx6x) are acknowledged with xx7x
+	serverHandler := func(c *connection.Connection, message *iso8583.Message) {
+		response, err := iso8583util.Version2003.NewResponseFrom(message, []int{2, 11})
+		require.NoError(t, err)
+		require.NoError(t, c.Reply(response))
+	}
+
+	newMessage := func(mti string) *iso8583.Message {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI(mti)
+		require.NoError(t, message.Field(2, TestCaseReply))
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		return message
+	}
+
+	tests := []struct {
+		name     string
+		mti      string
+		expected string
+		opts     []connection.Option
+		err      error
+	}{
+		{name: "1987 network management", mti: "0800", expected: "0810"},
+		{name: "1993 network management", mti: "1804", expected: "1814"},
+		{name: "2003 instruction", mti: "2160", expected: "2170"},
+		{name: "1987 instruction is not matched", mti: "0160", err: connection.ErrSendTimeout},
+		{name: "1987 instruction of the nonconforming host", mti: "0160", expected: "0170",
+			opts: []connection.Option{connection.MTIVersion(iso8583util.Version2003)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append([]connection.Option{
+				connection.SendTimeout(200 * time.Millisecond),
+				connection.ErrorHandler(func(c *connection.Connection, err error) {}),
+			}, tt.opts...)
+
+			c, err := connectiontest.NewPipeConnection(testSpec, readMessageLength, writeMessageLength, serverHandler, opts...)
+			require.NoError(t, err)
+			defer c.Close()
+
+			response, err := c.Send(newMessage(tt.mti))
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+
+			mti, err := response.GetMTI()
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, mti)
+		})
+	}
+
+	t.Run("validates version", func(t *testing.T) {
+		_, err := connection.New("", nil, nil, nil, connection.MTIVersion(iso8583util.Version(42)))
+		require.Error(t, err)
+	})
+}
+
+func TestClient_SignOn(t *testing.T) {
+	const (
+		codeSignOn  = "SON"
+		codeSignOff = "SOF"
+		codeClose   = "CLS"
+	)
+
+	// host replies to all requests and closes the connection after the
+	// reply when it's asked to
+	var hostConn atomic.Value
+	srv := server.New(testSpec, readMessageLength, writeMessageLength, connection.InboundMessageHandler(
+		func(c *connection.Connection, message *iso8583.Message) {
+			hostConn.Store(c)
+
+			response, err := iso8583util.NewResponseFrom(message, []int{2, 11})
+			require.NoError(t, err)
+			c.Reply(response)
+
+			if code, _ := message.GetString(2); code == codeClose {
+				time.Sleep(50 * time.Millisecond)
+				c.Close()
+			}
+		},
+	))
+	require.NoError(t, srv.Start("127.0.0.1:"))
+	defer srv.Close()
+
+	states := make(chan connection.SignOnState, 10)
+	closed := make(chan struct{}, 10)
+
+	c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength,
+		connection.RequireSignOn(),
+		connection.SignOnDetector(func(request, response *iso8583.Message) bool {
+			code, _ := request.GetString(2)
+			return code == codeSignOn
+		}),
+		connection.SignOffDetector(func(message *iso8583.Message) bool {
+			code, _ := message.GetString(2)
+			return code == codeSignOff
+		}),
+		connection.SignOnStateHandler(func(c *connection.Connection, state connection.SignOnState) {
+			states <- state
+		}),
+		connection.AutoReconnect(true),
+		connection.ReconnectBackoff(connection.ExponentialBackoff{Initial: 10 * time.Millisecond}),
+		connection.ConnectionClosedHandler(func(c *connection.Connection) {
+			closed <- struct{}{}
+		}),
+	)
+	require.NoError(t, err)
+	require.NoError(t, c.Connect())
+	defer c.Close()
+
+	send := func(mti, code string) error {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI(mti)
+		require.NoError(t, message.Field(2, code))
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		_, err := c.Send(message)
+		return err
+	}
+
+	requireState := func(t *testing.T, expected connection.SignOnState) {
+		t.Helper()
+
+		select {
+		case state := <-states:
+			require.Equal(t, expected, state)
+		case <-time.After(time.Second):
+			t.Fatalf("state was not changed to %s", expected)
+		}
+		require.Equal(t, expected, c.SignOnState())
+	}
+
+	t.Run("financial messages are rejected before sign-on", func(t *testing.T) {
+		require.Equal(t, connection.SignedOff, c.SignOnState())
+		require.ErrorIs(t, send("0200", TestCaseReply), connection.ErrNotSignedOn)
+
+		// network management messages are allowed
+		require.NoError(t, send("0800", TestCaseReply))
+		require.Equal(t, connection.SignedOff, c.SignOnState())
+	})
+
+	t.Run("financial messages are sent after sign-on", func(t *testing.T) {
+		require.NoError(t, send("0800", codeSignOn))
+		requireState(t, connection.SignedOn)
+
+		require.NoError(t, send("0200", TestCaseReply))
+	})
+
+	t.Run("sign-off request from the host signs the connection off", func(t *testing.T) {
+		signOff := iso8583.NewMessage(testSpec)
+		signOff.MTI("0800")
+		require.NoError(t, signOff.Field(2, codeSignOff))
+		require.NoError(t, signOff.Field(11, getSTAN()))
+		require.NoError(t, hostConn.Load().(*connection.Connection).Reply(signOff))
+
+		requireState(t, connection.SignedOff)
+		require.ErrorIs(t, send("0200", TestCaseReply), connection.ErrNotSignedOn)
+
+		c.MarkSignedOn()
+		requireState(t, connection.SignedOn)
+		require.NoError(t, send("0200", TestCaseReply))
+	})
+
+	t.Run("connection is signed off after reconnect", func(t *testing.T) {
+		require.NoError(t, send("0800", codeClose))
+
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Fatal("connection was not closed")
+		}
+		requireState(t, connection.SignedOff)
+
+		require.Eventually(t, func() bool {
+			return c.Status() == connection.StatusOnline
+		}, time.Second, 10*time.Millisecond)
+
+		require.ErrorIs(t, send("0200", TestCaseReply), connection.ErrNotSignedOn)
+
+		require.NoError(t, send("0800", codeSignOn))
+		requireState(t, connection.SignedOn)
+		require.NoError(t, send("0200", TestCaseReply))
+	})
+
+	t.Run("allowed MTIs", func(t *testing.T) {
+		c, err := connectiontest.NewPipeConnection(testSpec, readMessageLength, writeMessageLength,
+			func(c *connection.Connection, message *iso8583.Message) {
+				response, err := iso8583util.NewResponseFrom(message, []int{2, 11})
+				require.NoError(t, err)
+				c.Reply(response)
+			},
+			connection.RequireSignOn("08", "01"),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		for mti, expected := range map[string]error{"0800": nil, "0100": nil, "0200": connection.ErrNotSignedOn} {
+			message := iso8583.NewMessage(testSpec)
+			message.MTI(mti)
+			require.NoError(t, message.Field(2, TestCaseReply))
+			require.NoError(t, message.Field(11, getSTAN()))
+
+			_, err := c.Send(message)
+			if expected == nil {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, expected)
+			}
+		}
+	})
+}
+
+func TestClient_HostSignOffBehavior(t *testing.T) {
+	spec := specWithFields(map[int]field.Field{
+		15: field.NewString(&field.Spec{
+			Length:      4,
+			Description: "Settlement Date",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+		39: field.NewString(&field.Spec{
+			Length:      2,
+			Description: "Response Code",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+		70: field.NewString(&field.Spec{
+			Length:      3,
+			Description: "Network Management Information Code",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+	})
+
+	// host replies to the requests, delaying the reply when it's asked
+	// to, and records acks of its own messages
+	hostConns := make(chan *connection.Connection, 1)
+	acks := make(chan *iso8583.Message, 10)
+	serverHandler := func(c *connection.Connection, message *iso8583.Message) {
+		select {
+		case hostConns <- c:
+		default:
+		}
+
+		if mti, _ := message.GetMTI(); mti == "0810" {
+			acks <- message
+			return
+		}
+
+		response, err := iso8583util.NewResponseFrom(message, []int{2, 11})
+		require.NoError(t, err)
+
+		if testCase, _ := message.GetString(2); testCase == TestCaseDelayedResponse {
+			time.Sleep(200 * time.Millisecond)
+		}
+		c.Reply(response)
+	}
+
+	events := make(chan connection.HostEvent, 10)
+	c, err := connectiontest.NewPipeConnection(spec, readMessageLength, writeMessageLength, serverHandler,
+		connection.HostSignOffBehavior(true, true),
+		connection.HostEventHandler(func(c *connection.Connection, event connection.HostEvent) {
+			events <- event
+		}),
+	)
+	require.NoError(t, err)
+	defer c.Close()
+
+	send := func(mti, testCase string) error {
+		message := iso8583.NewMessage(spec)
+		message.MTI(mti)
+		require.NoError(t, message.Field(2, testCase))
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		_, err := c.Send(message)
+		return err
+	}
+
+	// host pushes network management message with code in field 70
+	push := func(host *connection.Connection, code, settlementDate string) {
+		message := iso8583.NewMessage(spec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+		require.NoError(t, message.Field(70, code))
+		if settlementDate != "" {
+			require.NoError(t, message.Field(15, settlementDate))
+		}
+		require.NoError(t, host.Reply(message))
+	}
+
+	requireEvent := func(t *testing.T, expected connection.HostEvent) {
+		t.Helper()
+
+		select {
+		case event := <-events:
+			require.Equal(t, expected, event)
+		case <-time.After(time.Second):
+			t.Fatalf("event %s was not emitted", expected.Type)
+		}
+	}
+
+	requireAck := func(t *testing.T, code string) {
+		t.Helper()
+
+		select {
+		case ack := <-acks:
+			for id, expected := range map[int]string{39: "00", 70: code} {
+				value, err := ack.GetString(id)
+				require.NoError(t, err)
+				require.Equal(t, expected, value)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message %s was not acked", code)
+		}
+	}
+
+	require.NoError(t, send("0200", TestCaseReply))
+	host := <-hostConns
+
+	t.Run("sign-off drains pending requests", func(t *testing.T) {
+		pending := make(chan error, 1)
+		go func() {
+			pending <- send("0200", TestCaseDelayedResponse)
+		}()
+		require.Eventually(t, func() bool {
+			return c.Stats().PendingRequests == 1
+		}, time.Second, 10*time.Millisecond)
+
+		push(host, "002", "")
+		requireAck(t, "002")
+		requireEvent(t, connection.HostEvent{Type: connection.HostSignOff})
+		require.Equal(t, connection.SignedOff, c.SignOnState())
+
+		// new financial messages are rejected while network management
+		// messages are sent
+		require.ErrorIs(t, send("0200", TestCaseReply), connection.ErrNotSignedOn)
+		require.NoError(t, send("0800", TestCaseReply))
+
+		// pending request gets its response
+		require.NoError(t, <-pending)
+		requireEvent(t, connection.HostEvent{Type: connection.HostDrained})
+
+		c.MarkSignedOn()
+		require.NoError(t, send("0200", TestCaseReply))
+	})
+
+	t.Run("cutover updates business date", func(t *testing.T) {
+		require.Empty(t, c.CurrentBusinessDate())
+
+		push(host, "070", "1017")
+		requireAck(t, "070")
+		requireEvent(t, connection.HostEvent{Type: connection.HostCutover, BusinessDate: "1017"})
+		require.Equal(t, "1017", c.CurrentBusinessDate())
+
+		// traffic is not affected
+		require.Equal(t, connection.SignedOn, c.SignOnState())
+		require.NoError(t, send("0200", TestCaseReply))
+	})
+
+	t.Run("blocked HostEventHandler doesn't hold up messages", func(t *testing.T) {
+		// host of the previous connection may be left in the channel
+		select {
+		case <-hostConns:
+		default:
+		}
+
+		release := make(chan struct{})
+		blocked := make(chan connection.HostEvent, 10)
+		c, err := connectiontest.NewPipeConnection(spec, readMessageLength, writeMessageLength, serverHandler,
+			connection.InboundWorkers(1, 10),
+			connection.SendTimeout(time.Second),
+			connection.HostSignOffBehavior(true, false),
+			connection.HostEventHandler(func(c *connection.Connection, event connection.HostEvent) {
+				blocked <- event
+				<-release
+			}),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+		defer close(release)
+
+		message := iso8583.NewMessage(spec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(2, TestCaseReply))
+		require.NoError(t, message.Field(11, getSTAN()))
+		_, err = c.Send(message)
+		require.NoError(t, err)
+		host := <-hostConns
+
+		push(host, "070", "1018")
+		select {
+		case event := <-blocked:
+			require.Equal(t, connection.HostCutover, event.Type)
+		case <-time.After(time.Second):
+			t.Fatal("event was not emitted")
+		}
+
+		// response is handled while the handler is blocked
+		message = iso8583.NewMessage(spec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(2, TestCaseReply))
+		require.NoError(t, message.Field(11, getSTAN()))
+		_, err = c.Send(message)
+		require.NoError(t, err)
+		require.Equal(t, "1018", c.CurrentBusinessDate())
+	})
+}
+
+func TestClient_MaxEncodableLength(t *testing.T) {
+	spec := specWithFields(map[int]field.Field{
+		48: field.NewString(&field.Spec{
+			Length:      9999,
+			Description: "Additional Data",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.LLLL,
+		}),
+	})
+
+	// writer of custom length header, which doesn't check the length
+	writeASCIILength := func(w io.Writer, length int) (int, error) {
+		return fmt.Fprintf(w, "%04d", length)
+	}
+
+	var received int32
+	srv := server.New(spec, connection.ReadASCII4BytesLength, connection.WriteASCII4BytesLength, connection.InboundMessageHandler(
+		func(c *connection.Connection, message *iso8583.Message) {
+			atomic.AddInt32(&received, 1)
+
+			response, err := iso8583util.NewResponseFrom(message, []int{11})
+			require.NoError(t, err)
+			c.Reply(response)
+		},
+	))
+	require.NoError(t, srv.Start("127.0.0.1:"))
+	defer srv.Close()
+
+	newMessage := func(dataLength int) *iso8583.Message {
+		message := iso8583.NewMessage(spec)
+		message.MTI("0100")
+		require.NoError(t, message.Field(11, getSTAN()))
+		require.NoError(t, message.Field(48, strings.Repeat("A", dataLength)))
+
+		return message
+	}
+
+	tests := []struct {
+		name   string
+		writer connection.MessageLengthWriter
+		opts   []connection.Option
+	}{
+		{
+			name:   "length helper",
+			writer: connection.WriteASCII4BytesLength,
+		},
+		{
+			name:   "custom writer with MaxEncodableLength",
+			writer: writeASCIILength,
+			opts:   []connection.Option{connection.MaxEncodableLength(connection.ASCII4BytesMaxLength)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&received, 0)
+
+			c, err := connection.New(srv.Addr, spec, connection.ReadASCII4BytesLength, tt.writer, tt.opts...)
+			require.NoError(t, err)
+			require.NoError(t, c.Connect())
+			defer c.Close()
+
+			_, err = c.Send(newMessage(9990))
+			require.ErrorIs(t, err, connection.ErrMessageTooLong)
+
+			var tooLongErr *connection.MessageTooLongError
+			require.True(t, errors.As(err, &tooLongErr))
+			require.Greater(t, tooLongErr.Length, connection.ASCII4BytesMaxLength)
+			require.Equal(t, connection.ASCII4BytesMaxLength, tooLongErr.Max)
+
+			// connection is not affected by the message that was not
+			// written
+			response, err := c.Send(newMessage(100))
+			require.NoError(t, err)
+
+			mti, err := response.GetMTI()
+			require.NoError(t, err)
+			require.Equal(t, "0110", mti)
+			require.Equal(t, int32(1), atomic.LoadInt32(&received))
+		})
+	}
+
+	t.Run("negative max", func(t *testing.T) {
+		_, err := connection.New(srv.Addr, spec, connection.ReadASCII4BytesLength, writeASCIILength, connection.MaxEncodableLength(-1))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "max encodable length should not be negative, got -1")
+	})
+}
+
+// writeRecordingConn records data of each Write call
+type writeRecordingConn struct {
+	net.Conn
+
+	mu     sync.Mutex
+	writes [][]byte
+}
+
+func (c *writeRecordingConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.writes = append(c.writes, append([]byte(nil), p...))
+	c.mu.Unlock()
+
+	return c.Conn.Write(p)
+}
+
+func (c *writeRecordingConn) recordedWrites() [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([][]byte(nil), c.writes...)
+}
+
+func TestClient_AtomicFrameWrites(t *testing.T) {
+	clientPipe, hostPipe := net.Pipe()
+	clientConn := &writeRecordingConn{Conn: clientPipe}
+	hostConn := &writeRecordingConn{Conn: hostPipe}
+
+	tpdu := connection.TPDU([2]byte{0x00, 0x01}, [2]byte{0x00, 0x02})
+
+	var pings int32
+	host, err := connection.NewFrom(hostConn, testSpec, readMessageLength, writeMessageLength, tpdu,
+		connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+			response, err := iso8583util.NewResponseFrom(message, []int{11})
+			require.NoError(t, err)
+			c.Reply(response)
+		}),
+	)
+	require.NoError(t, err)
+	defer host.Close()
+
+	c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength, tpdu,
+		connection.IdleTime(50*time.Millisecond),
+		connection.PingHandler(func(c *connection.Connection) {
+			ping := iso8583.NewMessage(testSpec)
+			ping.MTI("0800")
+			ping.Field(11, getSTAN())
+
+			if _, err := c.Send(ping); err == nil {
+				atomic.AddInt32(&pings, 1)
+			}
+		}),
+	)
+	require.NoError(t, err)
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			message := iso8583.NewMessage(testSpec)
+			message.MTI("0100")
+			require.NoError(t, message.Field(2, "CAR"))
+			require.NoError(t, message.Field(11, getSTAN()))
+
+			_, err := c.Send(message)
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&pings) > 0
+	}, time.Second, 10*time.Millisecond)
+
+	// each Write call has exactly one frame: its length header, TPDU and
+	// the message
+	requireFramePerWrite := func(writes [][]byte) {
+		for _, write := range writes {
+			length, err := readMessageLength(bytes.NewReader(write))
+			require.NoError(t, err)
+			require.Equal(t, len(write)-2, length)
+		}
+	}
+
+	clientWrites := clientConn.recordedWrites()
+	require.GreaterOrEqual(t, len(clientWrites), 101)
+	requireFramePerWrite(clientWrites)
+
+	hostWrites := hostConn.recordedWrites()
+	require.GreaterOrEqual(t, len(hostWrites), 101)
+	requireFramePerWrite(hostWrites)
+}
+
+func TestServer_AutoRespondEcho(t *testing.T) {
+	spec := specWithFields(map[int]field.Field{
+		39: field.NewString(&field.Spec{
+			Length:      2,
+			Description: "Response Code",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+		70: field.NewString(&field.Spec{
+			Length:      3,
+			Description: "Network Management Information Code",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+	})
+
+	// handler replies with response code 96, so its responses differ from
+	// the ones of the echo responder
+	var handled int32
+	handler := func(c *connection.Connection, message *iso8583.Message) {
+		atomic.AddInt32(&handled, 1)
+
+		response, err := iso8583util.NewResponseFrom(message, []int{11, 70})
+		require.NoError(t, err)
+		require.NoError(t, response.Field(39, "96"))
+		c.Reply(response)
+	}
+
+	startServer := func(t *testing.T, opts ...connection.Option) (*connection.Connection, *int32) {
+		t.Helper()
+
+		var counted int32
+		srv := server.New(spec, readMessageLength, writeMessageLength, opts...)
+		srv.AutoRespondEcho(true)
+		srv.Use(func(next server.ResponderFunc) server.ResponderFunc {
+			return func(c *connection.Connection, message *iso8583.Message) (*iso8583.Message, error) {
+				if server.IsEchoRequest(message) {
+					atomic.AddInt32(&counted, 1)
+				}
+				return next(c, message)
+			}
+		})
+		require.NoError(t, srv.Start("127.0.0.1:"))
+		t.Cleanup(srv.Close)
+
+		c, err := connection.New(srv.Addr, spec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		t.Cleanup(func() { c.Close() })
+
+		return c, &counted
+	}
+
+	send := func(t *testing.T, c *connection.Connection, code string) *iso8583.Message {
+		t.Helper()
+
+		message := iso8583.NewMessage(spec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+		require.NoError(t, message.Field(70, code))
+
+		response, err := c.Send(message)
+		require.NoError(t, err)
+
+		mti, err := response.GetMTI()
+		require.NoError(t, err)
+		require.Equal(t, "0810", mti)
+
+		return response
+	}
+
+	responseCode := func(t *testing.T, response *iso8583.Message) string {
+		t.Helper()
+
+		code, err := response.GetString(39)
+		require.NoError(t, err)
+
+		return code
+	}
+
+	t.Run("echo test is answered before the handlers and seen by middlewares", func(t *testing.T) {
+		atomic.StoreInt32(&handled, 0)
+		c, counted := startServer(t, connection.InboundMessageHandler(handler))
+
+		response := send(t, c, "301")
+		require.Equal(t, "00", responseCode(t, response))
+		require.Equal(t, int32(0), atomic.LoadInt32(&handled))
+
+		code, err := response.GetString(70)
+		require.NoError(t, err)
+		require.Equal(t, "301", code)
+		require.Equal(t, int32(1), atomic.LoadInt32(counted))
+
+		// other network management messages are handled by the handler
+		response = send(t, c, "001")
+		require.Equal(t, "96", responseCode(t, response))
+		require.Equal(t, int32(1), atomic.LoadInt32(&handled))
+		require.Equal(t, int32(1), atomic.LoadInt32(counted))
+	})
+
+	t.Run("echo test is answered without handlers", func(t *testing.T) {
+		c, counted := startServer(t)
+
+		response := send(t, c, "301")
+		require.Equal(t, "00", responseCode(t, response))
+		require.Equal(t, int32(1), atomic.LoadInt32(counted))
+
+		// unregistered messages are still responded with invalid
+		// transaction code
+		response = send(t, c, "001")
+		require.Equal(t, server.DefaultInvalidTransactionCode, responseCode(t, response))
+	})
+
+	t.Run("registered 0800 handler overrides the echo responder", func(t *testing.T) {
+		atomic.StoreInt32(&handled, 0)
+		c, counted := startServer(t, connection.InboundMessageHandlerFor("0800", handler))
+
+		response := send(t, c, "301")
+		require.Equal(t, "96", responseCode(t, response))
+		require.Equal(t, int32(1), atomic.LoadInt32(&handled))
+		require.Equal(t, int32(1), atomic.LoadInt32(counted))
+	})
+}
+
+func TestServer_FramingSelector(t *testing.T) {
+	srv := server.New(testSpec, readMessageLength, writeMessageLength, connection.InboundMessageHandler(
+		func(c *connection.Connection, message *iso8583.Message) {
+			response, err := iso8583util.NewResponseFrom(message, []int{2, 11})
+			require.NoError(t, err)
+			c.Reply(response)
+		},
+	))
+
+	// ASCII length header starts with a digit, while binary header of the
+	// short message starts with zero byte
+	srv.FramingSelector(func(conn net.Conn) (connection.MessageLengthReader, connection.MessageLengthWriter, error) {
+		first := make([]byte, 1)
+		if _, err := io.ReadFull(conn, first); err != nil {
+			return nil, nil, err
+		}
+
+		if first[0] >= '0' && first[0] <= '9' {
+			return connection.ReadASCII4BytesLength, connection.WriteASCII4BytesLength, nil
+		}
+
+		return readMessageLength, writeMessageLength, nil
+	})
+
+	errs := make(chan error, 10)
+	srv.ErrorHandler = func(err error) {
+		errs <- err
+	}
+
+	require.NoError(t, srv.Start("127.0.0.1:"))
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		mlReader connection.MessageLengthReader
+		mlWriter connection.MessageLengthWriter
+	}{
+		{
+			name:     "binary length header",
+			mlReader: readMessageLength,
+			mlWriter: writeMessageLength,
+		},
+		{
+			name:     "ASCII length header",
+			mlReader: connection.ReadASCII4BytesLength,
+			mlWriter: connection.WriteASCII4BytesLength,
+		},
+	}
+
+	var clients []*connection.Connection
+	for _, tt := range tests {
+		c, err := connection.New(srv.Addr, testSpec, tt.mlReader, tt.mlWriter)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		clients = append(clients, c)
+	}
+
+	// both clients are connected to the same server at the same time
+	for i, tt := range tests {
+		c := clients[i]
+
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 3; i++ {
+				message := iso8583.NewMessage(testSpec)
+				err := message.Marshal(baseFields{
+					MTI:          field.NewStringValue("0800"),
+					TestCaseCode: field.NewStringValue(TestCaseReply),
+					STAN:         field.NewStringValue(getSTAN()),
+				})
+				require.NoError(t, err)
+
+				response, err := c.Send(message)
+				require.NoError(t, err)
+
+				mti, err := response.GetMTI()
+				require.NoError(t, err)
+				require.Equal(t, "0810", mti)
+			}
+		})
+	}
+
+	require.Len(t, srv.Connections(), 2)
+
+	t.Run("connection is closed when selector fails", func(t *testing.T) {
+		conn, err := net.Dial("tcp", srv.Addr)
+		require.NoError(t, err)
+		conn.Close()
+
+		select {
+		case err := <-errs:
+			require.Contains(t, err.Error(), "selecting framing")
+		case <-time.After(time.Second):
+			t.Fatal("selector error was not reported")
+		}
+	})
+}
+
+func TestServer_HandlerErrors(t *testing.T) {
+	spec := specWithFields(map[int]field.Field{
+		39: field.NewString(&field.Spec{
+			Length:      2,
+			Description: "Response Code",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+	})
+
+	errPlain := errors.New("card not found")
+
+	// field 2 defines what handler returns
+	handler := func(c *connection.Connection, message *iso8583.Message) error {
+		code, err := message.GetString(2)
+		if err != nil {
+			return err
+		}
+
+		switch code {
+		case "ERR":
+			return errPlain
+		case "FTL":
+			return fmt.Errorf("invalid MAC: %w", server.ErrFatal)
+		}
+
+		response, err := iso8583util.NewResponseFrom(message, []int{2, 11})
+		if err != nil {
+			return err
+		}
+		if err := response.Field(39, "00"); err != nil {
+			return err
+		}
+
+		return c.Reply(response)
+	}
+
+	startServer := func(t *testing.T, configure func(srv *server.Server)) (*server.Server, chan error) {
+		t.Helper()
+
+		srv := server.New(spec, readMessageLength, writeMessageLength)
+		srv.Handle(handler)
+
+		errs := make(chan error, 10)
+		srv.ErrorHandler = func(err error) {
+			errs <- err
+		}
+
+		if configure != nil {
+			configure(srv)
+		}
+
+		require.NoError(t, srv.Start("127.0.0.1:"))
+		t.Cleanup(srv.Close)
+
+		return srv, errs
+	}
+
+	connect := func(t *testing.T, srv *server.Server) (*connection.Connection, chan struct{}) {
+		t.Helper()
+
+		closed := make(chan struct{}, 1)
+		c, err := connection.New(srv.Addr, spec, readMessageLength, writeMessageLength,
+			connection.ConnectionClosedHandler(func(c *connection.Connection) {
+				closed <- struct{}{}
+			}),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		t.Cleanup(func() { c.Close() })
+
+		return c, closed
+	}
+
+	send := func(t *testing.T, c *connection.Connection, mti, code string) string {
+		t.Helper()
+
+		message := iso8583.NewMessage(spec)
+		message.MTI(mti)
+		require.NoError(t, message.Field(2, code))
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		response, err := c.Send(message)
+		require.NoError(t, err)
+
+		responseCode, err := response.GetString(39)
+		require.NoError(t, err)
+
+		return responseCode
+	}
+
+	t.Run("handler error is responded with 96 and reported", func(t *testing.T) {
+		srv, errs := startServer(t, nil)
+		c, closed := connect(t, srv)
+
+		require.Equal(t, server.DefaultErrorResponseCode, send(t, c, "0100", "ERR"))
+
+		select {
+		case err := <-errs:
+			require.ErrorIs(t, err, errPlain)
+		case <-time.After(time.Second):
+			t.Fatal("handler error was not reported")
+		}
+
+		// connection is not closed
+		require.Equal(t, "00", send(t, c, "0100", "000"))
+		select {
+		case <-closed:
+			t.Fatal("connection was closed")
+		default:
+		}
+	})
+
+	t.Run("fatal handler error closes the connection after the response", func(t *testing.T) {
+		srv, errs := startServer(t, nil)
+
+		// client may fail pending request when connection is closed
+		// before it matched the response, so raw connection is used
+		conn, err := net.Dial("tcp", srv.Addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoError(t, conn.SetDeadline(time.Now().Add(time.Second)))
+
+		message := iso8583.NewMessage(spec)
+		message.MTI("0100")
+		require.NoError(t, message.Field(2, "FTL"))
+		require.NoError(t, message.Field(11, getSTAN()))
+		packed, err := message.Pack()
+		require.NoError(t, err)
+
+		_, err = writeMessageLength(conn, len(packed))
+		require.NoError(t, err)
+		_, err = conn.Write(packed)
+		require.NoError(t, err)
+
+		length, err := readMessageLength(conn)
+		require.NoError(t, err)
+		raw := make([]byte, length)
+		_, err = io.ReadFull(conn, raw)
+		require.NoError(t, err)
+
+		response := iso8583.NewMessage(spec)
+		require.NoError(t, response.Unpack(raw))
+		responseCode, err := response.GetString(39)
+		require.NoError(t, err)
+		require.Equal(t, server.DefaultErrorResponseCode, responseCode)
+
+		// connection is closed after the response
+		_, err = conn.Read(make([]byte, 1))
+		require.ErrorIs(t, err, io.EOF)
+
+		select {
+		case err := <-errs:
+			require.ErrorIs(t, err, server.ErrFatal)
+		case <-time.After(time.Second):
+			t.Fatal("handler error was not reported")
+		}
+	})
+
+	t.Run("error response policy", func(t *testing.T) {
+		srv, _ := startServer(t, func(srv *server.Server) {
+			srv.ErrorResponsePolicy(func(req *iso8583.Message, err error) *iso8583.Message {
+				response := server.DefaultErrorResponse(req, err)
+				if errors.Is(err, errPlain) {
+					response.Field(39, "14")
+				}
+				return response
+			})
+		})
+		c, _ := connect(t, srv)
+
+		require.Equal(t, "14", send(t, c, "0100", "ERR"))
+	})
+
+	t.Run("handler without errors", func(t *testing.T) {
+		srv, _ := startServer(t, func(srv *server.Server) {
+			srv.HandleFor("02", server.FromInboundHandler(func(c *connection.Connection, message *iso8583.Message) {
+				response, err := iso8583util.NewResponseFrom(message, []int{11})
+				require.NoError(t, err)
+				require.NoError(t, response.Field(39, "01"))
+				c.Reply(response)
+			}))
+		})
+		c, _ := connect(t, srv)
+
+		require.Equal(t, "01", send(t, c, "0200", "ERR"))
+		require.Equal(t, server.DefaultErrorResponseCode, send(t, c, "0100", "ERR"))
+	})
+}
+
+func TestServer_Stats(t *testing.T) {
+	srv := server.New(testSpec, readMessageLength, writeMessageLength, connection.SendTimeout(time.Second))
+	srv.Handle(func(c *connection.Connection, message *iso8583.Message) error {
+		code, err := message.GetString(2)
+		if err != nil {
+			return err
+		}
+		if code == "ERR" {
+			return errors.New("handler failed")
+		}
+
+		response, err := iso8583util.NewResponseFrom(message, []int{2, 11})
+		if err != nil {
+			return err
+		}
+
+		return c.Reply(response)
+	})
+	srv.ErrorHandler = func(err error) {}
+
+	accepted := make(chan *connection.Connection, 2)
+	srv.OnConnect = func(id string, c *connection.Connection) {
+		accepted <- c
+	}
+
+	require.NoError(t, srv.Start("127.0.0.1:"))
+	defer srv.Close()
+
+	newMessage := func(code string) *iso8583.Message {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0100")
+		require.NoError(t, message.Field(2, code))
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		return message
+	}
+
+	// first client sends 3 requests and 1 request failing in handler
+	c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength)
+	require.NoError(t, err)
+	require.NoError(t, c.Connect())
+	defer c.Close()
+	serverConn := <-accepted
+
+	for i := 0; i < 3; i++ {
+		_, err := c.Send(newMessage(TestCaseReply))
+		require.NoError(t, err)
+	}
+	_, err = c.Send(newMessage("ERR"))
+	require.NoError(t, err)
+
+	// second client sends 2 requests and the message that can't be
+	// unpacked, so server closes its connection
+	conn, err := net.Dial("tcp", srv.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	<-accepted
+
+	for i := 0; i < 2; i++ {
+		packed, err := newMessage(TestCaseReply).Pack()
+		require.NoError(t, err)
+		_, err = writeMessageLength(conn, len(packed))
+		require.NoError(t, err)
+		_, err = conn.Write(packed)
+		require.NoError(t, err)
+
+		length, err := readMessageLength(conn)
+		require.NoError(t, err)
+		_, err = io.ReadFull(conn, make([]byte, length))
+		require.NoError(t, err)
+	}
+
+	_, err = writeMessageLength(conn, 5)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("01xxx"))
+	require.NoError(t, err)
+
+	expected := server.Stats{
+		ConnectionsAccepted: 2,
+		OpenConnections:     1,
+		MessagesReceived:    6,
+		MessagesSent:        6,
+		HandlerErrors:       1,
+		UnpackErrors:        1,
+	}
+	require.Eventually(t, func() bool {
+		return srv.Stats() == expected
+	}, time.Second, 10*time.Millisecond, "stats: %+v", srv.Stats())
+
+	infos := srv.Connections()
+	require.Len(t, infos, 1)
+	require.Equal(t, uint64(4), infos[0].MessagesHandled)
+	require.Equal(t, uint64(4), infos[0].MessagesSent)
+	require.Equal(t, 0, infos[0].PendingRequests)
+
+	// request sent by the server to the first client, which doesn't reply
+	pushErr := make(chan error, 1)
+	go func() {
+		push := iso8583.NewMessage(testSpec)
+		push.MTI("0800")
+		push.Field(11, getSTAN())
+
+		_, err := serverConn.Send(push)
+		pushErr <- err
+	}()
+
+	require.Eventually(t, func() bool {
+		infos := srv.Connections()
+		return len(infos) == 1 && infos[0].PendingRequests == 1 && infos[0].MessagesSent == 5
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, uint64(7), srv.Stats().MessagesSent)
+
+	t.Run("ResetStats", func(t *testing.T) {
+		srv.ResetStats()
+
+		require.Equal(t, server.Stats{OpenConnections: 1}, srv.Stats())
+
+		infos := srv.Connections()
+		require.Len(t, infos, 1)
+		require.Equal(t, uint64(0), infos[0].MessagesHandled)
+		require.Equal(t, uint64(0), infos[0].MessagesSent)
+		require.Equal(t, 1, infos[0].PendingRequests)
+
+		// counting continues after reset
+		_, err := c.Send(newMessage(TestCaseReply))
+		require.NoError(t, err)
+
+		require.Eventually(t, func() bool {
+			stats := srv.Stats()
+			return stats.MessagesReceived == 1 && stats.MessagesSent == 1
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	require.ErrorIs(t, <-pushErr, connection.ErrSendTimeout)
+}
+
+func TestTestServer_RecordedMessages(t *testing.T) {
+	server, err := NewTestServer()
+	require.NoError(t, err)
+	defer server.Close()
+
+	c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength)
+	require.NoError(t, err)
+	require.NoError(t, c.Connect())
+	defer c.Close()
+
+	send := func(testCase string) string {
+		stan := getSTAN()
+		message := iso8583.NewMessage(testSpec)
+		err := message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(testCase),
+			STAN:         field.NewStringValue(stan),
+		})
+		require.NoError(t, err)
+
+		_, err = c.Send(message)
+		require.NoError(t, err)
+
+		return stan
+	}
+
+	// advice of the original request, which server doesn't reply to
+	advise := func(originalSTAN string) {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0420")
+		require.NoError(t, message.Field(11, originalSTAN))
+		require.NoError(t, c.Reply(message))
+	}
+
+	// mixed traffic: pings, requests and advices
+	var stans []string
+	for i := 0; i < 2; i++ {
+		stans = append(stans, send(TestCasePingCounter))
+		stans = append(stans, send(TestCaseReply))
+	}
+	advise(stans[1])
+	advise(stans[3])
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, server.WaitForMessages(ctx, 2, hasMTI("0420")))
+
+	require.Len(t, server.ReceivedMessages(), 6)
+	require.Equal(t, 4, server.CountByMTI("0800"))
+	require.Equal(t, 2, server.CountByMTI("0420"))
+	require.Equal(t, 0, server.CountByMTI("0100"))
+
+	last := server.LastByMTI("0800")
+	require.NotNil(t, last)
+	stan, err := last.GetString(11)
+	require.NoError(t, err)
+	require.Equal(t, stans[3], stan)
+	require.Nil(t, server.LastByMTI("0100"))
+
+	// exactly one advice echoes STAN of the first request
+	advices := server.Find(func(message *iso8583.Message) bool {
+		stan, _ := message.GetString(11)
+		return hasMTI("0420")(message) && stan == stans[1]
+	})
+	require.Len(t, advices, 1)
+
+	pings := server.Find(isPingMessage)
+	require.Len(t, pings, 2)
+
+	// returned messages are copies
+	require.NoError(t, pings[0].Field(11, "000000"))
+	require.Len(t, server.Find(isPingMessage), 2)
+	stan, err = server.Find(isPingMessage)[0].GetString(11)
+	require.NoError(t, err)
+	require.Equal(t, stans[0], stan)
+
+	t.Run("record limit keeps the last messages", func(t *testing.T) {
+		server.SetRecordLimit(3)
+		defer server.SetRecordLimit(0)
+
+		require.Len(t, server.ReceivedMessages(), 3)
+		require.Equal(t, 1, server.CountByMTI("0800"))
+		require.Equal(t, 2, server.CountByMTI("0420"))
+	})
+
+	t.Run("ResetReceived", func(t *testing.T) {
+		server.ResetReceived()
+		require.Empty(t, server.ReceivedMessages())
+
+		send(TestCaseReply)
+		require.Equal(t, 1, server.CountByMTI("0800"))
+	})
+}
+
+func TestServer_InboundChannelMode(t *testing.T) {
+	srv := server.New(testSpec, readMessageLength, writeMessageLength)
+	require.NoError(t, srv.InboundChannelMode())
+	require.NoError(t, srv.Start("127.0.0.1:"))
+	defer srv.Close()
+
+	// scripted host: sign-on is approved, then authorization is declined
+	script := []struct {
+		mti          string
+		responseCode string
+	}{
+		{mti: "0800", responseCode: "000"},
+		{mti: "0100", responseCode: "005"},
+	}
+
+	hostErr := make(chan error, 1)
+	go func() {
+		for _, step := range script {
+			inbound := <-srv.Inbound()
+
+			mti, err := inbound.Message.GetMTI()
+			if err != nil {
+				hostErr <- err
+				return
+			}
+			if mti != step.mti {
+				hostErr <- fmt.Errorf("expected %s, got %s", step.mti, mti)
+				return
+			}
+
+			packed, err := inbound.Message.Pack()
+			if err != nil {
+				hostErr <- err
+				return
+			}
+			if !bytes.Equal(packed, inbound.Raw) {
+				hostErr <- fmt.Errorf("raw message %x doesn't match the message %x", inbound.Raw, packed)
+				return
+			}
+
+			response, err := iso8583util.NewResponseFrom(inbound.Message, []int{11})
+			if err == nil {
+				err = response.Field(2, step.responseCode)
+			}
+			if err == nil {
+				err = inbound.Respond(response)
+			}
+			if err != nil {
+				hostErr <- err
+				return
+			}
+		}
+		hostErr <- nil
+	}()
+
+	c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength)
+	require.NoError(t, err)
+	require.NoError(t, c.Connect())
+	defer c.Close()
+
+	for _, step := range script {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI(step.mti)
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		response, err := c.Send(message)
+		require.NoError(t, err)
+
+		code, err := response.GetString(2)
+		require.NoError(t, err)
+		require.Equal(t, step.responseCode, code)
+	}
+
+	require.NoError(t, <-hostErr)
+
+	t.Run("handlers can't be used with inbound channel", func(t *testing.T) {
+		srv := server.New(testSpec, readMessageLength, writeMessageLength, connection.InboundMessageHandler(
+			func(c *connection.Connection, message *iso8583.Message) {},
+		))
+		require.ErrorIs(t, srv.InboundChannelMode(), server.ErrInboundModeConflict)
+
+		srv = server.New(testSpec, readMessageLength, writeMessageLength)
+		srv.HandleFor("08", func(c *connection.Connection, message *iso8583.Message) error {
+			return nil
+		})
+		require.ErrorIs(t, srv.InboundChannelMode(), server.ErrInboundModeConflict)
+	})
+
+	t.Run("connection fails when handler is set after inbound channel", func(t *testing.T) {
+		srv := server.New(testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, srv.InboundChannelMode())
+		srv.Handle(func(c *connection.Connection, message *iso8583.Message) error {
+			return nil
+		})
+
+		errs := make(chan error, 1)
+		srv.ErrorHandler = func(err error) {
+			errs <- err
+		}
+
+		require.NoError(t, srv.Start("127.0.0.1:"))
+		defer srv.Close()
+
+		conn, err := net.Dial("tcp", srv.Addr)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		select {
+		case err := <-errs:
+			require.ErrorIs(t, err, server.ErrInboundModeConflict)
+		case <-time.After(time.Second):
+			t.Fatal("conflict was not reported")
+		}
+
+		// connection is closed
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		_, err = conn.Read(make([]byte, 1))
+		require.ErrorIs(t, err, io.EOF)
+	})
+}
+
+// lrc returns the longitudinal redundancy check of body
+func lrc(body []byte) []byte {
+	var sum byte
+	for _, b := range body {
+		sum ^= b
+	}
+
+	return []byte{sum}
+}
+
+func verifyLRC(body, received []byte) error {
+	if expected := lrc(body); !bytes.Equal(expected, received) {
+		return fmt.Errorf("LRC %x doesn't match %x", received, expected)
+	}
+
+	return nil
+}
+
+// corruptingListener accepts connections which corrupt the last byte of
+// the packed message of the first frame they write
+type corruptingListener struct {
+	net.Listener
+}
+
+func (l *corruptingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &corruptingConn{Conn: conn}, nil
+}
+
+type corruptingConn struct {
+	net.Conn
+	corrupted int32
+}
+
+func (c *corruptingConn) Write(p []byte) (int, error) {
+	if atomic.CompareAndSwapInt32(&c.corrupted, 0, 1) {
+		p = append([]byte(nil), p...)
+		// the last byte is LRC
+		p[len(p)-2] ^= 0xFF
+	}
+
+	return c.Conn.Write(p)
+}
+
+func TestClient_FrameIntegrity(t *testing.T) {
+	startServer := func(t *testing.T, naks chan *iso8583.Message) string {
+		t.Helper()
+
+		srv := server.New(testSpec, readMessageLength, writeMessageLength,
+			connection.FrameIntegrity(lrc, verifyLRC),
+			connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+				mti, _ := message.GetMTI()
+				if mti == "0644" {
+					naks <- message
+					return
+				}
+
+				message.MTI("0810")
+				c.Reply(message)
+			}),
+		)
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		srv.Serve(&corruptingListener{Listener: ln})
+		t.Cleanup(srv.Close)
+
+		return srv.Addr
+	}
+
+	newRequest := func(t *testing.T) *iso8583.Message {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		return message
+	}
+
+	t.Run("rejects corrupted frame and sends NAK", func(t *testing.T) {
+		naks := make(chan *iso8583.Message, 1)
+		addr := startServer(t, naks)
+
+		handledErrs := make(chan error, 1)
+		c, err := connection.New(addr, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(200*time.Millisecond),
+			connection.FrameIntegrity(lrc, verifyLRC),
+			connection.FrameIntegrityNAK(func(body []byte) *iso8583.Message {
+				nak := iso8583.NewMessage(testSpec)
+				nak.MTI("0644")
+				return nak
+			}),
+			connection.ErrorHandler(func(c *connection.Connection, err error) {
+				handledErrs <- err
+			}),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		// response to the first request is corrupted
+		_, err = c.Send(newRequest(t))
+		require.ErrorIs(t, err, connection.ErrSendTimeout)
+
+		select {
+		case err := <-handledErrs:
+			require.ErrorIs(t, err, connection.ErrFrameIntegrity)
+
+			var integrityErr *connection.FrameIntegrityError
+			require.True(t, errors.As(err, &integrityErr))
+			require.Len(t, integrityErr.Received, 1)
+		case <-time.After(time.Second):
+			t.Fatal("frame integrity error was not handled")
+		}
+
+		select {
+		case <-naks:
+		case <-time.After(time.Second):
+			t.Fatal("NAK was not received by the server")
+		}
+
+		// connection keeps working
+		response, err := c.Send(newRequest(t))
+		require.NoError(t, err)
+
+		mti, err := response.GetMTI()
+		require.NoError(t, err)
+		require.Equal(t, "0810", mti)
+
+		require.Equal(t, connection.StatusOnline, c.Status())
+		require.Equal(t, uint64(1), c.Stats().FrameIntegrityFailures)
+	})
+
+	t.Run("closes connection without NAK", func(t *testing.T) {
+		addr := startServer(t, make(chan *iso8583.Message, 1))
+
+		c, err := connection.New(addr, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(time.Second),
+			connection.FrameIntegrity(lrc, verifyLRC),
+			connection.ErrorHandler(func(c *connection.Connection, err error) {}),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		_, err = c.Send(newRequest(t))
+		require.ErrorIs(t, err, connection.ErrConnectionClosed)
+
+		require.Eventually(t, func() bool {
+			return c.Status() == connection.StatusOffline
+		}, time.Second, 10*time.Millisecond)
+		require.ErrorIs(t, c.Err(), connection.ErrFrameIntegrity)
+	})
+
+	t.Run("checksum is required", func(t *testing.T) {
+		_, err := connection.New("", testSpec, readMessageLength, writeMessageLength,
+			connection.FrameIntegrity(nil, verifyLRC),
+		)
+		require.Error(t, err)
+	})
+}
+
+func TestClient_WireEncoding(t *testing.T) {
+	spec := &iso8583.MessageSpec{
+		Name: "EBCDIC host",
+		Fields: map[int]field.Field{
+			0: field.NewString(&field.Spec{
+				Length:      4,
+				Description: "Message Type Indicator",
+				Enc:         encoding.ASCII,
+				Pref:        prefix.ASCII.Fixed,
+			}),
+			1: field.NewBitmap(&field.Spec{
+				Length:      8,
+				Description: "Bitmap",
+				Enc:         encoding.Binary,
+				Pref:        prefix.Binary.Fixed,
+			}),
+			2: field.NewString(&field.Spec{
+				Length:      19,
+				Description: "Primary Account Number",
+				Enc:         encoding.ASCII,
+				Pref:        prefix.ASCII.LL,
+			}),
+			11: field.NewString(&field.Spec{
+				Length:      6,
+				Description: "Systems Trace Audit Number (STAN)",
+				Enc:         encoding.ASCII,
+				Pref:        prefix.ASCII.Fixed,
+			}),
+			43: field.NewString(&field.Spec{
+				Length:      40,
+				Description: "Card Acceptor Name/Location",
+				Enc:         encoding.ASCII,
+				Pref:        prefix.ASCII.Fixed,
+				Pad:         padding.Right(' '),
+			}),
+			52: field.NewBinary(&field.Spec{
+				Length:      8,
+				Description: "PIN Data",
+				Enc:         encoding.Binary,
+				Pref:        prefix.Binary.Fixed,
+			}),
+		},
+	}
+
+	// PIN block with bytes that are translated by EBCDIC
+	pinBlock := []byte{0x00, 0x25, 0x40, 0x7F, 0x80, 0xC1, 0xF0, 0xFF}
+	const acceptorName = "ACME STORE [NYC]"
+
+	newRequest := func(t *testing.T) *iso8583.Message {
+		message := iso8583.NewMessage(spec)
+		message.MTI("0200")
+		require.NoError(t, message.Field(2, "4242424242424242"))
+		require.NoError(t, message.Field(11, getSTAN()))
+		require.NoError(t, message.Field(43, acceptorName))
+		require.NoError(t, message.BinaryField(52, pinBlock))
+
+		return message
+	}
+
+	t.Run("EBCDIC1047 translates all bytes both ways", func(t *testing.T) {
+		all := make([]byte, 256)
+		for i := range all {
+			all[i] = byte(i)
+		}
+
+		encoded := connection.EBCDIC1047.Encode(all)
+		require.Equal(t, all, connection.EBCDIC1047.Decode(encoded))
+		require.Equal(t, all, connection.EBCDIC1047.Encode(connection.EBCDIC1047.Decode(all)))
+
+		require.Equal(t, []byte{0xF0, 0xF2, 0xF0, 0xF0}, connection.EBCDIC1047.Encode([]byte("0200")))
+		require.Equal(t, []byte{0xC1, 0xAD, 0xBD, 0x40}, connection.EBCDIC1047.Encode([]byte("A[] ")))
+	})
+
+	for _, tc := range []struct {
+		name   string
+		fields []int
+	}{
+		{name: "whole message"},
+		{name: "alphanumeric fields", fields: []int{0, 2, 11, 43}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Run("writes EBCDIC on the wire", func(t *testing.T) {
+				clientConn, hostConn := net.Pipe()
+				defer hostConn.Close()
+
+				c, err := connection.NewFrom(clientConn, spec, connection.ReadEBCDIC4BytesLength, connection.WriteEBCDIC4BytesLength,
+					connection.WireEncoding(connection.EBCDIC1047, tc.fields...),
+					connection.SendTimeout(500*time.Millisecond),
+				)
+				require.NoError(t, err)
+				defer c.Close()
+
+				go c.Send(newRequest(t))
+
+				length, err := connection.ReadEBCDIC4BytesLength(hostConn)
+				require.NoError(t, err)
+				wire := make([]byte, length)
+				_, err = io.ReadFull(hostConn, wire)
+				require.NoError(t, err)
+
+				require.Equal(t, connection.EBCDIC1047.Encode([]byte("0200")), wire[:4])
+				require.Contains(t, string(wire), string(connection.EBCDIC1047.Encode([]byte(acceptorName))))
+				require.NotContains(t, string(wire), acceptorName)
+
+				// binary fields are not translated when only
+				// alphanumeric fields are
+				if len(tc.fields) > 0 {
+					require.Equal(t, pinBlock, wire[len(wire)-len(pinBlock):])
+				} else {
+					require.Equal(t, connection.EBCDIC1047.Encode(pinBlock), wire[len(wire)-len(pinBlock):])
+				}
+			})
+
+			t.Run("round trip with the server", func(t *testing.T) {
+				srv := server.New(spec, connection.ReadEBCDIC4BytesLength, connection.WriteEBCDIC4BytesLength,
+					connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+						message.MTI("0210")
+						c.Reply(message)
+					}),
+				)
+				srv.WireEncoding(connection.EBCDIC1047, tc.fields...)
+				require.NoError(t, srv.Start("127.0.0.1:"))
+				defer srv.Close()
+
+				c, err := connection.New(srv.Addr, spec, connection.ReadEBCDIC4BytesLength, connection.WriteEBCDIC4BytesLength,
+					connection.WireEncoding(connection.EBCDIC1047, tc.fields...),
+				)
+				require.NoError(t, err)
+				require.NoError(t, c.Connect())
+				defer c.Close()
+
+				request := newRequest(t)
+				response, err := c.Send(request)
+				require.NoError(t, err)
+
+				mti, err := response.GetMTI()
+				require.NoError(t, err)
+				require.Equal(t, "0210", mti)
+
+				// all fields are byte-exact
+				for _, id := range []int{2, 11, 43, 52} {
+					expected, err := request.GetBytes(id)
+					require.NoError(t, err)
+
+					actual, err := response.GetBytes(id)
+					require.NoError(t, err)
+					require.Equal(t, expected, actual, "field %d", id)
+				}
+			})
+		})
+	}
+}
+
+func TestSTXETXFramer(t *testing.T) {
+	framer := connection.STXETXFramer{MaxFrameLength: 16}
+
+	t.Run("escapes control bytes of the payload", func(t *testing.T) {
+		payload := []byte{0x01, connection.STX, 'a', connection.ETX, connection.DLE, 'b'}
+
+		var buf bytes.Buffer
+		require.NoError(t, framer.WriteFrame(&buf, payload))
+		require.Equal(t, []byte{
+			connection.STX,
+			0x01, connection.DLE, connection.STX, 'a', connection.DLE, connection.ETX, connection.DLE, connection.DLE, 'b',
+			connection.ETX,
+		}, buf.Bytes())
+
+		read, err := framer.ReadFrame(&buf)
+		require.NoError(t, err)
+		require.Equal(t, payload, read)
+	})
+
+	t.Run("skips bytes before STX and incomplete frames", func(t *testing.T) {
+		r := bytes.NewReader([]byte{'x', 'y', connection.STX, 'b', 'r', 'o', connection.STX, 'o', 'k', connection.ETX})
+
+		read, err := framer.ReadFrame(r)
+		require.NoError(t, err)
+		require.Equal(t, []byte("ok"), read)
+	})
+
+	t.Run("rejects frames longer than max length", func(t *testing.T) {
+		var buf bytes.Buffer
+		buf.WriteByte(connection.STX)
+		buf.Write(bytes.Repeat([]byte{'x'}, 17))
+		buf.WriteByte(connection.ETX)
+		require.NoError(t, framer.WriteFrame(&buf, []byte("next")))
+
+		_, err := framer.ReadFrame(&buf)
+		require.ErrorIs(t, err, connection.ErrInvalidMessageLength)
+
+		var framingErr *connection.FramingError
+		require.True(t, errors.As(err, &framingErr))
+
+		// reading continues with the next frame
+		read, err := framer.ReadFrame(&buf)
+		require.NoError(t, err)
+		require.Equal(t, []byte("next"), read)
+
+		err = framer.WriteFrame(&buf, bytes.Repeat([]byte{'x'}, 17))
+		require.ErrorIs(t, err, connection.ErrMessageTooLong)
+	})
+}
+
+func TestClient_Framer(t *testing.T) {
+	newMessage := func(t *testing.T) *iso8583.Message {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		// first byte of the bitmap with field 7 is STX
+		require.NoError(t, message.Field(7, "0102150405"))
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		return message
+	}
+
+	echo := connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+		message.MTI("0810")
+		c.Reply(message)
+	})
+
+	t.Run("client and server with STX/ETX framing", func(t *testing.T) {
+		framer := connection.STXETXFramer{MaxFrameLength: 1024}
+
+		srv := server.New(testSpec, nil, nil, connection.WithFramer(framer), echo)
+		require.NoError(t, srv.Start("127.0.0.1:"))
+		defer srv.Close()
+
+		c, err := connection.New(srv.Addr, testSpec, nil, nil, connection.WithFramer(framer))
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				request := newMessage(t)
+				response, err := c.Send(request)
+				require.NoError(t, err)
+
+				mti, err := response.GetMTI()
+				require.NoError(t, err)
+				require.Equal(t, "0810", mti)
+
+				stan, err := request.GetString(11)
+				require.NoError(t, err)
+				responseSTAN, err := response.GetString(11)
+				require.NoError(t, err)
+				require.Equal(t, stan, responseSTAN)
+			}()
+		}
+		wg.Wait()
+	})
+
+	t.Run("length framer works with length-based server", func(t *testing.T) {
+		srv := server.New(testSpec, readMessageLength, writeMessageLength, echo)
+		require.NoError(t, srv.Start("127.0.0.1:"))
+		defer srv.Close()
+
+		c, err := connection.New(srv.Addr, testSpec, nil, nil,
+			connection.WithFramer(connection.LengthFramer{
+				ReadLength:  readMessageLength,
+				WriteLength: writeMessageLength,
+			}),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		_, err = c.Send(newMessage(t))
+		require.NoError(t, err)
+	})
+}
+
+func TestFixedLengthFramer(t *testing.T) {
+	framer := connection.FixedLength(8, 0x00)
+
+	var buf bytes.Buffer
+	require.NoError(t, framer.WriteFrame(&buf, []byte("abc")))
+	require.NoError(t, framer.WriteFrame(&buf, []byte("12345678")))
+	require.Equal(t, []byte("abc\x00\x00\x00\x00\x0012345678"), buf.Bytes())
+
+	read, err := framer.ReadFrame(&buf)
+	require.NoError(t, err)
+	require.Equal(t, []byte("abc"), read)
+
+	read, err = framer.ReadFrame(&buf)
+	require.NoError(t, err)
+	require.Equal(t, []byte("12345678"), read)
+
+	err = framer.WriteFrame(&buf, []byte("123456789"))
+	require.ErrorIs(t, err, connection.ErrMessageTooLong)
+	require.Zero(t, buf.Len())
+
+	// trailing pad byte of the payload would be stripped by ReadFrame
+	err = framer.WriteFrame(&buf, []byte("abc\x00"))
+	require.EqualError(t, err, "payload ends with pad byte 0x00 and can't be read back")
+	require.Zero(t, buf.Len())
+}
+
+func TestClient_FixedLengthFraming(t *testing.T) {
+	var received int32
+	echo := connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+		atomic.AddInt32(&received, 1)
+		message.MTI("0810")
+		c.Reply(message)
+	})
+
+	newMessage := func(t *testing.T) *iso8583.Message {
+		message := iso8583.NewMessage(testSpec)
+		message.MTI("0800")
+		require.NoError(t, message.Field(11, getSTAN()))
+
+		return message
+	}
+
+	t.Run("messages shorter than frame length are padded", func(t *testing.T) {
+		framer := connection.FixedLength(512, 0x00)
+
+		srv := server.New(testSpec, nil, nil, connection.WithFramer(framer), echo)
+		require.NoError(t, srv.Start("127.0.0.1:"))
+		defer srv.Close()
+
+		c, err := connection.New(srv.Addr, testSpec, nil, nil, connection.WithFramer(framer))
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		for i := 0; i < 3; i++ {
+			request := newMessage(t)
+			response, err := c.Send(request)
+			require.NoError(t, err)
+
+			mti, err := response.GetMTI()
+			require.NoError(t, err)
+			require.Equal(t, "0810", mti)
+
+			stan, err := request.GetString(11)
+			require.NoError(t, err)
+			responseSTAN, err := response.GetString(11)
+			require.NoError(t, err)
+			require.Equal(t, stan, responseSTAN)
+		}
+	})
+
+	t.Run("message longer than frame length is not sent", func(t *testing.T) {
+		atomic.StoreInt32(&received, 0)
+		framer := connection.FixedLength(16, 0x00)
+
+		srv := server.New(testSpec, nil, nil, connection.WithFramer(framer), echo)
+		require.NoError(t, srv.Start("127.0.0.1:"))
+		defer srv.Close()
+
+		c, err := connection.New(srv.Addr, testSpec, nil, nil,
+			connection.WithFramer(framer),
+			connection.SendTimeout(200*time.Millisecond),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		_, err = c.Send(newMessage(t))
+		require.ErrorIs(t, err, connection.ErrMessageTooLong)
+
+		require.Equal(t, uint64(0), c.Stats().MessagesSent)
+		require.Equal(t, connection.StatusOnline, c.Status())
+
+		time.Sleep(50 * time.Millisecond)
+		require.Zero(t, atomic.LoadInt32(&received))
+	})
+}
+
+func TestClient_WrapConn(t *testing.T) {
+	echo := connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+		message.MTI("0810")
+		c.Reply(message)
+	})
+
+	t.Run("client and server compress the stream", func(t *testing.T) {
+		srv := server.New(testSpec, readMessageLength, writeMessageLength, echo)
+		srv.WrapConn(wrapZlib)
+		require.NoError(t, srv.Start("127.0.0.1:"))
+		defer srv.Close()
+
+		var wrapped int32
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.WrapConn(func(conn net.Conn) (net.Conn, error) {
+				atomic.AddInt32(&wrapped, 1)
+				return wrapZlib(conn)
+			}),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		require.Equal(t, int32(1), atomic.LoadInt32(&wrapped))
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				message := iso8583.NewMessage(testSpec)
+				message.MTI("0800")
+				require.NoError(t, message.Field(11, getSTAN()))
+
+				response, err := c.Send(message)
+				require.NoError(t, err)
+
+				mti, err := response.GetMTI()
+				require.NoError(t, err)
+				require.Equal(t, "0810", mti)
+			}()
+		}
+		wg.Wait()
+	})
+
+	t.Run("wrapping error fails Connect", func(t *testing.T) {
+		srv := server.New(testSpec, readMessageLength, writeMessageLength, echo)
+		require.NoError(t, srv.Start("127.0.0.1:"))
+		defer srv.Close()
+
+		errWrap := errors.New("key exchange failed")
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.WrapConn(func(conn net.Conn) (net.Conn, error) {
+				return nil, errWrap
+			}),
+		)
+		require.NoError(t, err)
+
+		err = c.Connect()
+		require.ErrorIs(t, err, errWrap)
+		require.Equal(t, connection.StatusOffline, c.Status())
+	})
+
+	t.Run("server closes connection it failed to wrap", func(t *testing.T) {
+		errWrap := errors.New("key exchange failed")
+		serverErrs := make(chan error, 1)
+
+		srv := server.New(testSpec, readMessageLength, writeMessageLength, echo)
+		srv.WrapConn(func(conn net.Conn) (net.Conn, error) {
+			return nil, errWrap
+		})
+		srv.ErrorHandler = func(err error) {
+			serverErrs <- err
+		}
+		require.NoError(t, srv.Start("127.0.0.1:"))
+		defer srv.Close()
+
+		c, err := connection.New(srv.Addr, testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		select {
+		case err := <-serverErrs:
+			require.ErrorIs(t, err, errWrap)
+		case <-time.After(time.Second):
+			t.Fatal("server error was not reported")
+		}
+
+		select {
+		case <-c.Done():
+		case <-time.After(time.Second):
+			t.Fatal("connection was not closed by the server")
+		}
+	})
+}
+
+func TestClient_SendBatch(t *testing.T) {
+	server, err := NewTestServer()
+	require.NoError(t, err)
+	defer server.Close()
+
+	newMessage := func(t *testing.T, testCase string) *iso8583.Message {
+		message := iso8583.NewMessage(testSpec)
+		err := message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(testCase),
+			STAN:         field.NewStringValue(getSTAN()),
+		})
+		require.NoError(t, err)
+
+		return message
+	}
+
+	t.Run("results follow the order of messages", func(t *testing.T) {
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(300*time.Millisecond),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		// every 100th message times out
+		messages := make([]*iso8583.Message, 500)
+		for i := range messages {
+			testCase := TestCaseReply
+			if i%100 == 42 {
+				testCase = TestCaseNoResponse
+			}
+			messages[i] = newMessage(t, testCase)
+		}
+
+		results := c.SendBatch(context.Background(), messages, 20)
+		require.Len(t, results, len(messages))
+
+		for i, result := range results {
+			require.Equal(t, i, result.Index)
+
+			if i%100 == 42 {
+				require.ErrorIs(t, result.Err, connection.ErrSendTimeout)
+				require.Nil(t, result.Response)
+				require.Positive(t, result.Duration)
+				continue
+			}
+
+			require.NoError(t, result.Err)
+			require.True(t, result.Info.Written)
+			require.Positive(t, result.Duration)
+
+			stan, err := messages[i].GetString(11)
+			require.NoError(t, err)
+			responseSTAN, err := result.Response.GetString(11)
+			require.NoError(t, err)
+			require.Equal(t, stan, responseSTAN)
+		}
+
+		require.Equal(t, uint64(5), c.Stats().SendTimeouts)
+	})
+
+	t.Run("it stops when context is cancelled", func(t *testing.T) {
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(10*time.Second),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		messages := make([]*iso8583.Message, 10)
+		for i := range messages {
+			messages[i] = newMessage(t, TestCaseNoResponse)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			require.Eventually(t, func() bool {
+				return c.PendingRequests() == 2
+			}, time.Second, 10*time.Millisecond)
+			cancel()
+		}()
+
+		started := time.Now()
+		results := c.SendBatch(ctx, messages, 2)
+		require.Less(t, time.Since(started), time.Second)
+
+		require.Len(t, results, len(messages))
+		for i, result := range results {
+			require.Equal(t, i, result.Index)
+			require.ErrorIs(t, result.Err, context.Canceled)
+		}
+
+		// only the first messages were sent
+		require.Equal(t, uint64(2), c.Stats().MessagesSent)
+	})
+}
+
+func TestClient_AutoSTAN(t *testing.T) {
+	server, err := NewTestServer()
+	require.NoError(t, err)
+	defer server.Close()
+
+	// messageWithoutSTAN returns network management message without STAN
+	messageWithoutSTAN := func(t *testing.T) *iso8583.Message {
+		message := iso8583.NewMessage(testSpec)
+		err := message.Marshal(baseFields{
+			MTI: field.NewStringValue("0800"),
+		})
+		require.NoError(t, err)
+
+		return message
+	}
+
+	t.Run("it sets STANs from the provider", func(t *testing.T) {
+		provider := &sequenceSTANProvider{stans: []string{"000101", "000102"}}
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.WithSTANProvider(provider),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		for _, expected := range []string{"000101", "000102"} {
+			response, err := c.Send(messageWithoutSTAN(t))
+			require.NoError(t, err)
+
+			stan, err := response.GetString(11)
+			require.NoError(t, err)
+			require.Equal(t, expected, stan)
+		}
+	})
+
+	t.Run("it keeps STAN set by the caller", func(t *testing.T) {
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.WithSTANProvider(failingSTANProvider{}),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		message := messageWithoutSTAN(t)
+		expected := getSTAN()
+		require.NoError(t, message.Field(11, expected))
+
+		response, err := c.Send(message)
+		require.NoError(t, err)
+
+		stan, err := response.GetString(11)
+		require.NoError(t, err)
+		require.Equal(t, expected, stan)
+	})
+
+	t.Run("it fails Send before writing message when provider fails", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		// nothing reads from serverConn, so any write would block
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.WithSTANProvider(failingSTANProvider{}),
+			connection.SendTimeout(time.Second),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		_, err = c.Send(messageWithoutSTAN(t))
+		require.ErrorIs(t, err, errSTANStorage)
+		require.Equal(t, connection.Stats{}, c.Stats())
 	})
 
-	t.Run("it returns ErrConnectionClosed when connection was closed by server", func(t *testing.T) {
-		server, err := NewTestServer()
+	t.Run("AutoSTAN uses in-memory counter", func(t *testing.T) {
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.AutoSTAN(),
+		)
 		require.NoError(t, err)
-		defer server.Close()
+		require.NoError(t, c.Connect())
+		defer c.Close()
 
-		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength, connection.SendTimeout(2*time.Second))
-		require.NoError(t, err)
+		for _, expected := range []string{"000001", "000002"} {
+			response, err := c.Send(messageWithoutSTAN(t))
+			require.NoError(t, err)
 
-		err = c.Connect()
+			stan, err := response.GetString(11)
+			require.NoError(t, err)
+			require.Equal(t, expected, stan)
+		}
+	})
+
+	t.Run("it skips STANs of pending requests after rollover", func(t *testing.T) {
+		// pending requests don't time out until the clock is advanced
+		clock := connectiontest.NewFakeClock(time.Now())
+
+		c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength,
+			connection.AutoSTANWithMax(3),
+			connection.WithClock(clock),
+		)
 		require.NoError(t, err)
-		defer func() {
-			c.Close()
-		}()
+		require.NoError(t, c.Connect())
+		defer c.Close()
 
-		// trigger server to close connection
+		// sendNoResponse sends message server doesn't reply to, so its
+		// STAN stays in flight until it times out
+		var wg sync.WaitGroup
+		sendNoResponse := func(pending int) {
+			message := iso8583.NewMessage(testSpec)
+			err := message.Marshal(baseFields{
+				MTI:          field.NewStringValue("0800"),
+				TestCaseCode: field.NewStringValue(TestCaseNoResponse),
+			})
+			require.NoError(t, err)
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := c.Send(message)
+				require.Equal(t, connection.ErrSendTimeout, err)
+			}()
+
+			require.Eventually(t, func() bool {
+				return c.PendingRequests() == pending
+			}, time.Second, 10*time.Millisecond)
+		}
+
+		// 000001 is in flight
+		sendNoResponse(1)
+
+		// 000001 is skipped when counter rolls over
+		for _, expected := range []string{"000002", "000003", "000002"} {
+			response, err := c.Send(messageWithoutSTAN(t))
+			require.NoError(t, err)
+
+			stan, err := response.GetString(11)
+			require.NoError(t, err)
+			require.Equal(t, expected, stan)
+		}
+		require.Equal(t, uint64(1), c.Stats().STANSkips)
+
+		// 000003 and 000002 are in flight
+		sendNoResponse(2)
+		sendNoResponse(3)
+
+		_, err = c.Send(messageWithoutSTAN(t))
+		require.Equal(t, connection.ErrSTANExhausted, err)
+
+		expirePendingRequests(t, c, clock)
+		wg.Wait()
+	})
+}
+
+func TestClient_OutgoingQueue(t *testing.T) {
+	newMessage := func(t *testing.T) *iso8583.Message {
 		message := iso8583.NewMessage(testSpec)
-		err = message.Marshal(baseFields{
-			MTI:          field.NewStringValue("0800"),
-			TestCaseCode: field.NewStringValue(TestCaseCloseConnection),
-			STAN:         field.NewStringValue(getSTAN()),
+		err := message.Marshal(baseFields{
+			MTI:  field.NewStringValue("0800"),
+			STAN: field.NewStringValue(getSTAN()),
 		})
 		require.NoError(t, err)
 
-		_, err = c.Send(message)
+		return message
+	}
+
+	// wedge makes writer block on the first message and fills the queue
+	// with the second one. Nobody reads from the server side of the pipe,
+	// so writes block.
+	wedge := func(t *testing.T, c *connection.Connection) {
+		go c.Reply(newMessage(t))
+
+		// let writer take the first message
+		time.Sleep(50 * time.Millisecond)
+
+		go c.Reply(newMessage(t))
+
+		require.Eventually(t, func() bool {
+			return c.Stats().OutgoingQueueDepth == 1
+		}, 500*time.Millisecond, 10*time.Millisecond)
+	}
+
+	t.Run("Send waits for the space in the queue until SendTimeout", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.OutgoingQueueSize(1),
+			connection.SendTimeout(200*time.Millisecond),
+		)
 		require.NoError(t, err)
+		defer c.Close()
 
-		// let's wait for connection to be close
-		time.Sleep(100 * time.Millisecond)
+		wedge(t, c)
 
-		// because connection was closed (by server) we should receive
-		// ErrConnectionClosed error
-		message = iso8583.NewMessage(testSpec)
-		err = message.Marshal(baseFields{
-			MTI:          field.NewStringValue("0800"),
-			TestCaseCode: field.NewStringValue(TestCaseReply),
-			STAN:         field.NewStringValue(getSTAN()),
-		})
+		start := time.Now()
+		_, err = c.Send(newMessage(t))
+		require.Equal(t, connection.ErrSendTimeout, err)
+		require.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+
+		err = c.Reply(newMessage(t))
+		require.Equal(t, connection.ErrSendTimeout, err)
+	})
+
+	t.Run("Send fails with ErrOutgoingQueueFull when DropWhenFull is set", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.OutgoingQueueSize(1),
+			connection.SendTimeout(200*time.Millisecond),
+			connection.DropWhenFull(),
+		)
 		require.NoError(t, err)
+		defer c.Close()
 
-		_, err = c.Send(message)
-		require.Equal(t, connection.ErrConnectionClosed, err)
+		wedge(t, c)
+
+		start := time.Now()
+		_, err = c.Send(newMessage(t))
+		require.Equal(t, connection.ErrOutgoingQueueFull, err)
+		require.Less(t, time.Since(start), 200*time.Millisecond)
+
+		err = c.Reply(newMessage(t))
+		require.Equal(t, connection.ErrOutgoingQueueFull, err)
+
+		require.Equal(t, 0, c.Stats().PendingRequests)
+	})
+
+	t.Run("OutgoingQueueHighWatermarkHandler is called when watermark is reached", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		depths := make(chan int, 10)
+		c, err := connection.NewFrom(clientConn, testSpec, readMessageLength, writeMessageLength,
+			connection.OutgoingQueueSize(10),
+			connection.SendTimeout(200*time.Millisecond),
+			connection.OutgoingQueueHighWatermarkHandler(3, func(c *connection.Connection, depth int) {
+				depths <- depth
+			}),
+		)
+		require.NoError(t, err)
+		defer c.Close()
+
+		// one message is taken by the writer, the rest wait in queue
+		wedge(t, c)
+		for i := 0; i < 3; i++ {
+			go c.Reply(newMessage(t))
+		}
+
+		require.Eventually(t, func() bool {
+			return c.Stats().OutgoingQueueDepth == 4
+		}, 500*time.Millisecond, 10*time.Millisecond)
+
+		require.Equal(t, 3, <-depths)
+
+		// handler is called only once while queue is above watermark
+		require.Len(t, depths, 0)
 	})
 }
 
@@ -644,6 +9529,37 @@ func (m *TrackingRWCloser) Close() error {
 // interface guard
 var _ io.ReadWriteCloser = (*TrackingRWCloser)(nil)
 
+var errWriteFailed = errors.New("write failed")
+
+// FailingWriteRWCloser fails all writes and blocks reads until it's closed
+type FailingWriteRWCloser struct {
+	once   sync.Once
+	closed chan struct{}
+}
+
+func NewFailingWriteRWCloser() *FailingWriteRWCloser {
+	return &FailingWriteRWCloser{
+		closed: make(chan struct{}),
+	}
+}
+
+func (m *FailingWriteRWCloser) Write(p []byte) (n int, err error) {
+	return 0, errWriteFailed
+}
+func (m *FailingWriteRWCloser) Read(p []byte) (n int, err error) {
+	<-m.closed
+	return 0, io.EOF
+}
+func (m *FailingWriteRWCloser) Close() error {
+	m.once.Do(func() {
+		close(m.closed)
+	})
+	return nil
+}
+
+// interface guard
+var _ io.ReadWriteCloser = (*FailingWriteRWCloser)(nil)
+
 func TestClient_SetOptions(t *testing.T) {
 	c, err := connection.New("", testSpec, readMessageLength, writeMessageLength)
 	require.NoError(t, err)
@@ -658,9 +9574,33 @@ func TestClient_SetOptions(t *testing.T) {
 
 	require.NoError(t, c.SetOptions(connection.PingHandler(func(c *connection.Connection) {})))
 	require.NotNil(t, c.Opts.PingHandler)
+	require.NotNil(t, c.Options().PingHandler)
 
 	require.NoError(t, c.SetOptions(connection.RootCAs("./testdata/ca.crt")))
 	require.NotNil(t, c.Opts.TLSConfig)
+
+	require.Error(t, c.SetOptions(connection.PendingRequestsShards(0)))
+
+	t.Run("TLS options don't change the config in use", func(t *testing.T) {
+		inUse := c.Opts.TLSConfig
+		rootCAs := inUse.RootCAs
+
+		require.NoError(t, c.SetOptions(
+			connection.SetTLSConfig(func(config *tls.Config) {
+				config.ServerName = "gateway.example.com"
+			}),
+			connection.RootCAs("./testdata/ca.crt"),
+			connection.ClientCert("./testdata/client.crt", "./testdata/client.key"),
+		))
+
+		require.Empty(t, inUse.ServerName)
+		require.Same(t, rootCAs, inUse.RootCAs)
+		require.Empty(t, inUse.Certificates)
+
+		require.Equal(t, "gateway.example.com", c.Opts.TLSConfig.ServerName)
+		require.NotSame(t, rootCAs, c.Opts.TLSConfig.RootCAs)
+		require.Len(t, c.Opts.TLSConfig.Certificates, 1)
+	})
 }
 
 func BenchmarkSend100(b *testing.B) { benchmarkSend(100, b) }
@@ -672,9 +9612,7 @@ func BenchmarkSend10000(b *testing.B) { benchmarkSend(10000, b) }
 func BenchmarkSend100000(b *testing.B) { benchmarkSend(100000, b) }
 
 func benchmarkSend(m int, b *testing.B) {
-	server := server.New(testSpec, readMessageLength, writeMessageLength)
-	// start on random port
-	err := server.Start("127.0.0.1:")
+	server, err := NewTestServer()
 	if err != nil {
 		b.Fatal("starting server: ", err)
 	}
@@ -702,6 +9640,249 @@ func benchmarkSend(m int, b *testing.B) {
 	server.Close()
 }
 
+// BenchmarkSendLatency reports latency percentiles of Send calls made by
+// 1000 concurrent senders
+func BenchmarkSendLatency(b *testing.B) {
+	server, err := NewTestServer()
+	if err != nil {
+		b.Fatal("starting server: ", err)
+	}
+	defer server.Close()
+
+	c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength)
+	if err != nil {
+		b.Fatal("creating client: ", err)
+	}
+
+	err = c.Connect()
+	if err != nil {
+		b.Fatal("connecting to the server: ", err)
+	}
+	defer c.Close()
+
+	const senders = 1000
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		latencies []time.Duration
+	)
+
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		for i := 0; i < senders; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				message := iso8583.NewMessage(testSpec)
+				message.MTI("0800")
+				message.Field(11, getSTAN())
+
+				start := time.Now()
+				_, err := c.Send(message)
+				latency := time.Since(start)
+				if err != nil {
+					b.Error("sending message: ", err)
+					return
+				}
+
+				mu.Lock()
+				latencies = append(latencies, latency)
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+	}
+
+	b.StopTimer()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) float64 {
+		return float64(latencies[int(float64(len(latencies)-1)*p)].Nanoseconds())
+	}
+	b.ReportMetric(percentile(0.50), "p50-ns")
+	b.ReportMetric(percentile(0.99), "p99-ns")
+}
+
+func BenchmarkSendTimeout(b *testing.B) {
+	server, err := NewTestServer()
+	if err != nil {
+		b.Fatal("starting server: ", err)
+	}
+	defer server.Close()
+
+	c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength, connection.SendTimeout(time.Millisecond))
+	if err != nil {
+		b.Fatal("creating client: ", err)
+	}
+
+	err = c.Connect()
+	if err != nil {
+		b.Fatal("connecting to the server: ", err)
+	}
+	defer c.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		message := iso8583.NewMessage(testSpec)
+		err := message.Marshal(baseFields{
+			MTI:          field.NewStringValue("0800"),
+			TestCaseCode: field.NewStringValue(TestCaseNoResponse),
+			STAN:         field.NewStringValue(getSTAN()),
+		})
+		if err != nil {
+			b.Fatal("marshaling message: ", err)
+		}
+
+		_, err = c.Send(message)
+		if err != connection.ErrSendTimeout {
+			b.Fatal("expected send timeout, got: ", err)
+		}
+	}
+
+	b.StopTimer()
+
+	if pending := c.PendingRequests(); pending != 0 {
+		b.Fatal("expected no pending requests, got: ", pending)
+	}
+}
+
+// BenchmarkSendTimeoutConcurrent times out 50k concurrently pending requests
+func BenchmarkSendTimeoutConcurrent(b *testing.B) {
+	server, err := NewTestServer()
+	if err != nil {
+		b.Fatal("starting server: ", err)
+	}
+	defer server.Close()
+
+	c, err := connection.New(server.Addr, testSpec, readMessageLength, writeMessageLength, connection.SendTimeout(500*time.Millisecond))
+	if err != nil {
+		b.Fatal("creating client: ", err)
+	}
+
+	err = c.Connect()
+	if err != nil {
+		b.Fatal("connecting to the server: ", err)
+	}
+	defer c.Close()
+
+	const pending = 50000
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		var wg sync.WaitGroup
+		for i := 0; i < pending; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				message := iso8583.NewMessage(testSpec)
+				message.MTI("0800")
+				message.Field(2, TestCaseNoResponse)
+				message.Field(11, getSTAN())
+
+				_, err := c.Send(message)
+				if err != connection.ErrSendTimeout {
+					b.Error("expected send timeout, got: ", err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+// BenchmarkReceive reports how many reads from the connection it takes to
+// receive a message when messages arrive in batches of 100
+func BenchmarkReceive(b *testing.B) {
+	b.Run("new messages", func(b *testing.B) {
+		benchmarkReceive(b)
+	})
+
+	b.Run("message pool", func(b *testing.B) {
+		benchmarkReceive(b, connection.MessagePool(true))
+	})
+}
+
+func benchmarkReceive(b *testing.B, options ...connection.Option) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+
+	conn := &CountingReadsConn{Conn: clientConn}
+	received := make(chan struct{}, 100)
+
+	options = append(options,
+		connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+			received <- struct{}{}
+		}),
+	)
+
+	c, err := connection.NewFrom(conn, testSpec, readMessageLength, writeMessageLength, options...)
+	if err != nil {
+		b.Fatal("creating client: ", err)
+	}
+	defer c.Close()
+
+	message := iso8583.NewMessage(testSpec)
+	message.MTI("0800")
+	message.Field(11, getSTAN())
+
+	packed, err := message.Pack()
+	if err != nil {
+		b.Fatal("packing message: ", err)
+	}
+
+	var batch bytes.Buffer
+	for i := 0; i < 100; i++ {
+		writeMessageLength(&batch, len(packed))
+		batch.Write(packed)
+	}
+
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		if _, err := serverConn.Write(batch.Bytes()); err != nil {
+			b.Fatal("writing messages: ", err)
+		}
+
+		for i := 0; i < 100; i++ {
+			<-received
+		}
+	}
+
+	b.StopTimer()
+
+	b.ReportMetric(float64(conn.Reads())/float64(b.N*100), "reads/msg")
+}
+
+// CountingReadsConn counts reads from the wrapped connection
+type CountingReadsConn struct {
+	net.Conn
+
+	mu    sync.Mutex
+	reads int
+}
+
+func (c *CountingReadsConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	c.reads++
+	c.mu.Unlock()
+
+	return c.Conn.Read(p)
+}
+
+func (c *CountingReadsConn) Reads() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.reads
+}
+
 // send/receive m messages
 func processMessages(b *testing.B, m int, c *connection.Connection) {
 	var wg sync.WaitGroup
@@ -716,6 +9897,7 @@ func processMessages(b *testing.B, m int, c *connection.Connection) {
 
 			message := iso8583.NewMessage(testSpec)
 			message.MTI("0800")
+			message.Field(11, getSTAN())
 
 			_, err := c.Send(message)
 			if err != nil {
@@ -0,0 +1,108 @@
+// Package connectiontest provides utilities for testing code that uses
+// connection package.
+package connectiontest
+
+import (
+	"sync"
+	"time"
+
+	connection "github.com/moov-io/iso8583-connection"
+)
+
+// FakeClock is connection.Clock which time moves only when Advance is
+// called. It lets tests check timeouts without waiting for them.
+type FakeClock struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers map[*fakeTimer]struct{}
+}
+
+var _ connection.Clock = (*FakeClock)(nil)
+
+// NewFakeClock returns FakeClock set to now
+func NewFakeClock(now time.Time) *FakeClock {
+	c := &FakeClock{
+		now:    now,
+		timers: make(map[*fakeTimer]struct{}),
+	}
+	c.cond = sync.NewCond(&c.mu)
+
+	return c
+}
+
+// Now returns the current time of the clock
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// NewTimer returns timer that fires when the clock is advanced by d
+func (c *FakeClock) NewTimer(d time.Duration) connection.Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &fakeTimer{
+		clock: c,
+		when:  c.now.Add(d),
+		ch:    make(chan time.Time, 1),
+	}
+
+	if d <= 0 {
+		t.ch <- c.now
+		return t
+	}
+
+	c.timers[t] = struct{}{}
+	c.cond.Broadcast()
+
+	return t
+}
+
+// Advance moves the clock forward by d and fires timers that expire
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+
+	for t := range c.timers {
+		if t.when.After(c.now) {
+			continue
+		}
+		delete(c.timers, t)
+		t.ch <- c.now
+	}
+}
+
+// BlockUntil blocks until there are at least n active timers
+func (c *FakeClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	when  time.Time
+	ch    chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	_, active := t.clock.timers[t]
+	delete(t.clock.timers, t)
+
+	return active
+}
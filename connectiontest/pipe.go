@@ -0,0 +1,40 @@
+package connectiontest
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+)
+
+// NewPipeConnection returns the connection wired to the in-process server
+// over net.Pipe, so no sockets are used. Messages received by the server
+// are handled by serverHandler, which can reply, delay the reply or count
+// messages as the handler of a real server does. opts are applied to the
+// returned connection. Server side is closed when the returned connection
+// is closed.
+func NewPipeConnection(spec *iso8583.MessageSpec, mlReader connection.MessageLengthReader, mlWriter connection.MessageLengthWriter, serverHandler connection.InboundMessageHandlerFunc, opts ...connection.Option) (*connection.Connection, error) {
+	clientConn, serverConn := net.Pipe()
+
+	var serverOpts []connection.Option
+	if serverHandler != nil {
+		serverOpts = append(serverOpts, connection.InboundMessageHandler(serverHandler))
+	}
+
+	_, err := connection.NewFrom(serverConn, spec, mlReader, mlWriter, serverOpts...)
+	if err != nil {
+		clientConn.Close()
+		serverConn.Close()
+		return nil, fmt.Errorf("creating server side of the pipe: %w", err)
+	}
+
+	c, err := connection.NewFrom(clientConn, spec, mlReader, mlWriter, opts...)
+	if err != nil {
+		// server side is closed when it reads EOF
+		clientConn.Close()
+		return nil, fmt.Errorf("creating client side of the pipe: %w", err)
+	}
+
+	return c, nil
+}
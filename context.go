@@ -0,0 +1,90 @@
+package connection
+
+import (
+	"context"
+	"sync"
+
+	"github.com/moov-io/iso8583"
+)
+
+// requestContexts keeps contexts of SendCtx calls by the request and
+// response messages while handlers may ask for them
+type requestContexts struct {
+	mu       sync.Mutex
+	contexts map[*iso8583.Message]*requestContext
+}
+
+type requestContext struct {
+	ctx context.Context
+
+	// number of holders of the message context
+	refs int
+}
+
+func newRequestContexts() *requestContexts {
+	return &requestContexts{
+		contexts: make(map[*iso8583.Message]*requestContext),
+	}
+}
+
+// acquire makes ctx the context of message until the returned function is
+// called. Nothing is kept for messages sent without the context.
+func (r *requestContexts) acquire(ctx context.Context, message *iso8583.Message) func() {
+	if ctx == nil || ctx == context.Background() || message == nil {
+		return func() {}
+	}
+
+	r.mu.Lock()
+	rc, found := r.contexts[message]
+	if !found {
+		rc = &requestContext{ctx: ctx}
+		r.contexts[message] = rc
+	}
+	rc.refs++
+	r.mu.Unlock()
+
+	return func() {
+		r.mu.Lock()
+		rc.refs--
+		if rc.refs == 0 {
+			delete(r.contexts, message)
+		}
+		r.mu.Unlock()
+	}
+}
+
+func (r *requestContexts) get(message *iso8583.Message) (context.Context, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rc, found := r.contexts[message]
+	if !found {
+		return nil, false
+	}
+
+	return rc.ctx, true
+}
+
+// SendCtx sends message and waits for the response like Send. It returns
+// ctx.Err() when ctx is done before the response was received. Request is
+// not pending after that, so its response is handled as unmatched, and
+// message is not written if it's still in the outgoing queue. Handlers can
+// get ctx with RequestContext.
+func (c *Connection) SendCtx(ctx context.Context, message *iso8583.Message, opts ...SendOption) (*iso8583.Message, error) {
+	resp, _, err := c.send(ctx, message, opts...)
+
+	return resp, c.wrapError(err)
+}
+
+// RequestContext returns the context of the SendCtx call message is the
+// request or the response of. It's available to MACGenerator,
+// ResponseValidator, TimeoutReversalHandler, DeadLetterHandler and
+// LateResponseHandler while they handle the message. For other messages it
+// returns context.Background().
+func (c *Connection) RequestContext(message *iso8583.Message) context.Context {
+	if ctx, found := c.requestContexts.get(message); found {
+		return ctx
+	}
+
+	return context.Background()
+}
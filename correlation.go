@@ -0,0 +1,40 @@
+package connection
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/moov-io/iso8583"
+)
+
+// setCorrelationID sets CorrelationIDField of the message to the value
+// generated for ctx unless it's set
+func (c *Connection) setCorrelationID(ctx context.Context, message *iso8583.Message) error {
+	field := c.options().CorrelationIDField
+	if isFieldSet(message, field) {
+		return nil
+	}
+
+	if err := message.Field(field, c.options().CorrelationIDGenerator(ctx)); err != nil {
+		return fmt.Errorf("setting correlation ID field %d: %w", field, err)
+	}
+
+	return nil
+}
+
+// checkCorrelationID counts the response which correlation ID differs from
+// the one of the request. Response without the field is not counted, as
+// not every host echoes it.
+func (c *Connection) checkCorrelationID(request, response *iso8583.Message) {
+	field := c.options().CorrelationIDField
+	if !isFieldSet(request, field) || !isFieldSet(response, field) {
+		return
+	}
+
+	requestID, _ := request.GetString(field)
+	responseID, _ := response.GetString(field)
+	if requestID != responseID {
+		atomic.AddUint64(&c.correlationIDMismatches, 1)
+	}
+}
@@ -0,0 +1,50 @@
+package connection
+
+import (
+	"fmt"
+
+	"github.com/moov-io/iso8583"
+)
+
+// DeadLetterHandlerFunc is called with the message connection gave up on
+// after it was accepted into the outgoing queue and the reason why it was
+// not delivered
+type DeadLetterHandlerFunc func(message *iso8583.Message, reason error)
+
+// deadLetter passes message of the request that will never be written to
+// DeadLetterHandler. It must be called once for the request received from
+// the outgoing queue.
+func (c *Connection) deadLetter(req request, reason error) {
+	if c.options().DeadLetterHandler == nil || req.message == nil {
+		return
+	}
+
+	release := c.requestContexts.acquire(req.ctx, req.message)
+	go func() {
+		defer release()
+		c.options().DeadLetterHandler(req.message, c.wrapError(reason))
+	}()
+}
+
+// dropRequest releases request received from the outgoing queue that
+// won't be written because connection was closed
+func (c *Connection) dropRequest(req request) {
+	c.deadLetter(req, fmt.Errorf("message dropped from outgoing queue: %w", ErrConnectionClosed))
+
+	if req.rawMessage != nil {
+		c.releaseBuffer(req.rawMessage)
+	}
+}
+
+// dropQueued drops requests left in the outgoing queue when connection is
+// closed. Senders of the requests have returned already.
+func (c *Connection) dropQueued(requestsCh chan request) {
+	for {
+		select {
+		case req := <-requestsCh:
+			c.dropRequest(req)
+		default:
+			return
+		}
+	}
+}
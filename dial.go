@@ -0,0 +1,194 @@
+package connection
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Resolver resolves host name into IP addresses. *net.Resolver implements
+// it.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// SRVResolver looks up DNS SRV records. *net.Resolver implements it.
+type SRVResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// DialFunc establishes network connection with addr
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// SRVService is the service which SRV records point to the server targets
+type SRVService struct {
+	Service string
+	Proto   string
+	Name    string
+}
+
+func (s *SRVService) String() string {
+	return fmt.Sprintf("_%s._%s.%s", s.Service, s.Proto, s.Name)
+}
+
+// dialResolved establishes network connection with the server. It returns
+// the connection and the host name of the server.
+func (c *Connection) dialResolved(addr string) (net.Conn, string, error) {
+	if c.options().SRV != nil {
+		return c.dialSRV()
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, "", err
+	}
+
+	conn, err := c.dialHost(host, port)
+
+	return conn, host, err
+}
+
+// dialSRV looks up SRV targets of the server and dials them in order of
+// their priority and weight until connection is established
+func (c *Connection) dialSRV() (net.Conn, string, error) {
+	srv := c.options().SRV
+
+	ctx, cancel := c.resolveContext()
+	defer cancel()
+
+	_, targets, err := c.options().SRVResolver.LookupSRV(ctx, srv.Service, srv.Proto, srv.Name)
+	if err != nil {
+		return nil, "", fmt.Errorf("looking up SRV records of %s: %w", srv, err)
+	}
+
+	if len(targets) == 0 {
+		return nil, "", fmt.Errorf("looking up SRV records of %s: no targets found", srv)
+	}
+
+	var conn net.Conn
+	for _, target := range orderSRV(targets) {
+		host := strings.TrimSuffix(target.Target, ".")
+
+		conn, err = c.dialHost(host, strconv.Itoa(int(target.Port)))
+		if err == nil {
+			return conn, host, nil
+		}
+	}
+
+	return nil, "", err
+}
+
+// dialHost resolves the host and dials the resolved addresses in order
+// until connection is established. Only the first address is dialed when
+// DialAllAddresses is not set.
+func (c *Connection) dialHost(host, port string) (net.Conn, error) {
+	addrs, err := c.resolve(host)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	for _, addr := range addrs {
+		ctx, cancel := c.dialContext()
+		conn, err = c.options().DialFunc(ctx, "tcp", net.JoinHostPort(addr, port))
+		cancel()
+		if err == nil || !c.options().DialAllAddresses {
+			break
+		}
+	}
+
+	return conn, err
+}
+
+// resolve returns IP addresses of the host. IP addresses and empty host
+// (local system) are returned as is.
+func (c *Connection) resolve(host string) ([]string, error) {
+	if host == "" || net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+
+	ctx, cancel := c.resolveContext()
+	defer cancel()
+
+	addrs, err := c.options().Resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("resolving %s: %w", host, err)
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("resolving %s: no addresses found", host)
+	}
+
+	return addrs, nil
+}
+
+// resolveContext returns context for DNS lookups limited by ResolveTimeout
+func (c *Connection) resolveContext() (context.Context, context.CancelFunc) {
+	if c.options().ResolveTimeout > 0 {
+		return context.WithTimeout(context.Background(), c.options().ResolveTimeout)
+	}
+
+	return context.WithCancel(context.Background())
+}
+
+// dialContext returns context for dialing limited by DialTimeout
+func (c *Connection) dialContext() (context.Context, context.CancelFunc) {
+	if c.options().DialTimeout > 0 {
+		return context.WithTimeout(context.Background(), c.options().DialTimeout)
+	}
+
+	return context.WithCancel(context.Background())
+}
+
+// orderSRV returns SRV targets ordered by priority (lowest first). Targets
+// with the same priority are randomly ordered by their weight as RFC 2782
+// describes.
+func orderSRV(targets []*net.SRV) []*net.SRV {
+	sorted := append([]*net.SRV(nil), targets...)
+
+	// targets with zero weight go first within the priority
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Priority != sorted[j].Priority {
+			return sorted[i].Priority < sorted[j].Priority
+		}
+		return sorted[i].Weight < sorted[j].Weight
+	})
+
+	ordered := make([]*net.SRV, 0, len(sorted))
+	for start := 0; start < len(sorted); {
+		end := start
+		for end < len(sorted) && sorted[end].Priority == sorted[start].Priority {
+			end++
+		}
+
+		group := sorted[start:end]
+		for len(group) > 0 {
+			total := 0
+			for _, target := range group {
+				total += int(target.Weight)
+			}
+
+			// #nosec G404 -- target selection doesn't need secure random numbers
+			r := rand.Intn(total + 1)
+
+			i, sum := 0, 0
+			for ; i < len(group)-1; i++ {
+				sum += int(group[i].Weight)
+				if sum >= r {
+					break
+				}
+			}
+
+			ordered = append(ordered, group[i])
+			group = append(group[:i:i], group[i+1:]...)
+		}
+
+		start = end
+	}
+
+	return ordered
+}
@@ -0,0 +1,20 @@
+package connection
+
+import (
+	"github.com/moov-io/iso8583"
+)
+
+// AutoSTANWithMax enables auto-STAN with the in-memory counter rolling over
+// from max to 000001, so tests can wrap it quickly
+func AutoSTANWithMax(max uint32) Option {
+	return func(o *Options) error {
+		o.STANProvider = newSTANCounter(max)
+		return nil
+	}
+}
+
+// ReleaseInbound releases inbound message as it's done when
+// InboundMessageHandler returns
+func (c *Connection) ReleaseInbound(message *iso8583.Message) {
+	c.releaseInbound(message)
+}
@@ -0,0 +1,99 @@
+package connection
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// expvarMu serializes publishing, so the map is published once for
+	// the prefix
+	expvarMu sync.Mutex
+
+	// expvarOwners are the connections which counters are published by
+	// the prefix
+	expvarOwners = make(map[string]*Connection)
+)
+
+// publishExpvar publishes counters of the connection as expvar.Map named
+// ExpvarPrefix. It returns ErrExpvarPrefixTaken when counters of another
+// connection are published with the prefix. Map published by the
+// connection which was closed is reused.
+func (c *Connection) publishExpvar() error {
+	prefix := c.options().ExpvarPrefix
+
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+
+	if c.expvarPrefix == prefix {
+		return nil
+	}
+
+	if owner, found := expvarOwners[prefix]; found && owner != c {
+		return fmt.Errorf("publishing expvar %s: %w", prefix, ErrExpvarPrefixTaken)
+	}
+
+	var vars *expvar.Map
+	switch v := expvar.Get(prefix).(type) {
+	case nil:
+		vars = expvar.NewMap(prefix)
+	case *expvar.Map:
+		vars = v
+	default:
+		return fmt.Errorf("publishing expvar %s: name is used by %T", prefix, v)
+	}
+
+	// counters published under the previous prefix set by SetOptions
+	c.clearExpvar()
+
+	counters := map[string]*uint64{
+		"sent":          &c.messagesSent,
+		"received":      &c.messagesReceived,
+		"timeouts":      &c.sendTimeouts,
+		"unmatched":     &c.unmatchedResponses,
+		"reconnects":    &c.reconnects,
+		"unpack_errors": &c.unpackErrors,
+	}
+	for name, counter := range counters {
+		counter := counter
+		vars.Set(name, expvar.Func(func() interface{} {
+			return atomic.LoadUint64(counter)
+		}))
+	}
+
+	vars.Set("pending", expvar.Func(func() interface{} {
+		return c.pendingRequests.len()
+	}))
+
+	expvarOwners[prefix] = c
+	c.expvarPrefix = prefix
+
+	return nil
+}
+
+// unpublishExpvar removes counters of the connection from the map, so it
+// doesn't keep the closed connection reachable and the prefix can be used
+// by another connection. As expvar can't remove published vars, the empty
+// map stays published.
+func (c *Connection) unpublishExpvar() {
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+
+	c.clearExpvar()
+}
+
+// clearExpvar removes counters of the connection from the map they are
+// published to. It should be called with expvarMu held.
+func (c *Connection) clearExpvar() {
+	if c.expvarPrefix == "" {
+		return
+	}
+
+	if vars, ok := expvar.Get(c.expvarPrefix).(*expvar.Map); ok {
+		vars.Init()
+	}
+	delete(expvarOwners, c.expvarPrefix)
+	c.expvarPrefix = ""
+}
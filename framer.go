@@ -0,0 +1,227 @@
+package connection
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Framer reads and writes frames of the connection instead of
+// MessageLengthReader and MessageLengthWriter. Payload of the frame is the
+// packed message with TPDU and FrameIntegrity checksum, if they are set.
+// Errors returned by ReadFrame as FramingError are handled according to
+// FramingRecovery, others close the connection.
+type Framer interface {
+	// ReadFrame reads the next frame from r and returns its payload
+	ReadFrame(r io.Reader) ([]byte, error)
+
+	// WriteFrame writes the frame with payload into w
+	WriteFrame(w io.Writer, payload []byte) error
+}
+
+// LengthFramer is Framer of frames with the length header read and
+// written by the length functions, like the ones passed to New
+type LengthFramer struct {
+	ReadLength  MessageLengthReader
+	WriteLength MessageLengthWriter
+}
+
+// ReadFrame reads the length header and the payload
+func (f LengthFramer) ReadFrame(r io.Reader) ([]byte, error) {
+	length, err := f.ReadLength(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if length < 0 {
+		return nil, &FramingError{Err: fmt.Errorf("%w: %d", ErrInvalidMessageLength, length)}
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	return payload, nil
+}
+
+// WriteFrame writes the length header and the payload
+func (f LengthFramer) WriteFrame(w io.Writer, payload []byte) error {
+	if _, err := f.WriteLength(w, len(payload)); err != nil {
+		return fmt.Errorf("writing message header: %w", err)
+	}
+
+	_, err := w.Write(payload)
+
+	return err
+}
+
+// control bytes of STXETXFramer
+const (
+	STX byte = 0x02
+	ETX byte = 0x03
+	DLE byte = 0x10
+)
+
+// STXETXFramer is Framer of frames delimited by STX and ETX bytes without
+// length header. STX, ETX and DLE bytes of the payload are escaped with
+// DLE. Bytes before STX and incomplete frames followed by STX are skipped.
+type STXETXFramer struct {
+	// MaxFrameLength is the maximum length of the payload. Longer frames
+	// are skipped up to their ETX and reported as FramingError with
+	// ErrInvalidMessageLength. Zero means no limit.
+	MaxFrameLength int
+}
+
+// ReadFrame reads the frame and returns its unescaped payload
+func (f STXETXFramer) ReadFrame(r io.Reader) ([]byte, error) {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = &byteReader{r: r}
+	}
+
+	// skip bytes until the frame starts
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == STX {
+			break
+		}
+	}
+
+	var payload []byte
+	length := 0
+	escaped := false
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		if !escaped {
+			switch b {
+			case DLE:
+				escaped = true
+				continue
+			case ETX:
+				if f.MaxFrameLength > 0 && length > f.MaxFrameLength {
+					return nil, &FramingError{Err: fmt.Errorf("%w: %d", ErrInvalidMessageLength, length)}
+				}
+				return payload, nil
+			case STX:
+				// the broken frame is dropped, as the next
+				// one starts here
+				payload, length = nil, 0
+				continue
+			}
+		}
+		escaped = false
+
+		// payload of too long frame is skipped up to ETX
+		length++
+		if f.MaxFrameLength == 0 || length <= f.MaxFrameLength {
+			payload = append(payload, b)
+		}
+	}
+}
+
+// WriteFrame writes STX, escaped payload and ETX
+func (f STXETXFramer) WriteFrame(w io.Writer, payload []byte) error {
+	if f.MaxFrameLength > 0 && len(payload) > f.MaxFrameLength {
+		return &MessageTooLongError{Length: len(payload), Max: f.MaxFrameLength}
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(payload) + 2)
+
+	buf.WriteByte(STX)
+	for _, b := range payload {
+		if b == STX || b == ETX || b == DLE {
+			buf.WriteByte(DLE)
+		}
+		buf.WriteByte(b)
+	}
+	buf.WriteByte(ETX)
+
+	_, err := buf.WriteTo(w)
+
+	return err
+}
+
+// FixedLengthFramer is Framer of frames of fixed length without header.
+// Payload is padded to the length with PadByte, so the trailing PadByte
+// bytes are stripped from the read frames. Payload can't end with PadByte
+// then, as it would be stripped with the padding, and WriteFrame rejects
+// such payloads. Choose PadByte which the last field of the messages
+// doesn't end with, e.g. 0x00 for ASCII fields.
+type FixedLengthFramer struct {
+	Length  int
+	PadByte byte
+}
+
+// FixedLength returns FixedLengthFramer of frames of n bytes padded with
+// padByte
+func FixedLength(n int, padByte byte) FixedLengthFramer {
+	return FixedLengthFramer{Length: n, PadByte: padByte}
+}
+
+// ReadFrame reads the frame and returns it without padding
+func (f FixedLengthFramer) ReadFrame(r io.Reader) ([]byte, error) {
+	frame := make([]byte, f.Length)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimRight(frame, string([]byte{f.PadByte})), nil
+}
+
+// WriteFrame writes the payload padded to the frame length. It returns the
+// error if payload ends with PadByte.
+func (f FixedLengthFramer) WriteFrame(w io.Writer, payload []byte) error {
+	if len(payload) > f.Length {
+		return &MessageTooLongError{Length: len(payload), Max: f.Length}
+	}
+
+	if len(payload) > 0 && payload[len(payload)-1] == f.PadByte {
+		return fmt.Errorf("payload ends with pad byte 0x%02x and can't be read back", f.PadByte)
+	}
+
+	frame := make([]byte, f.Length)
+	copy(frame, payload)
+	for i := len(payload); i < len(frame); i++ {
+		frame[i] = f.PadByte
+	}
+
+	_, err := w.Write(frame)
+
+	return err
+}
+
+// byteReader reads bytes one by one from the reader without buffering,
+// so no bytes of the next frame are consumed
+type byteReader struct {
+	r io.Reader
+	b [1]byte
+}
+
+func (br *byteReader) ReadByte() (byte, error) {
+	if _, err := io.ReadFull(br.r, br.b[:]); err != nil {
+		return 0, err
+	}
+
+	return br.b[0], nil
+}
+
+// readFramerFrame reads the frame with Framer. Frame is the payload, so
+// there is no header.
+func (c *Connection) readFramerFrame(r *bufio.Reader) (*[]byte, int, error) {
+	payload, err := c.options().Framer.ReadFrame(r)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return &payload, 0, nil
+}
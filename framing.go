@@ -0,0 +1,282 @@
+package connection
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+)
+
+// ErrInvalidMessageLength is returned when message length read from the
+// length header is out of range
+var ErrInvalidMessageLength = errors.New("invalid message length")
+
+// FramingRecovery defines what to do when inbound message has implausible
+// length or can't be unpacked
+type FramingRecovery int
+
+const (
+	// FramingRecoveryClose closes the connection, so no more messages
+	// are read with broken message boundaries
+	FramingRecoveryClose FramingRecovery = iota
+
+	// FramingRecoveryResync skips bytes until the position where the
+	// next message may start and continues reading from it
+	FramingRecoveryResync
+)
+
+func (r FramingRecovery) String() string {
+	switch r {
+	case FramingRecoveryClose:
+		return "close"
+	case FramingRecoveryResync:
+		return "resync"
+	default:
+		return fmt.Sprintf("FramingRecovery(%d)", int(r))
+	}
+}
+
+// FramingError is reported to ErrorHandler when inbound message has
+// implausible length or can't be unpacked
+type FramingError struct {
+	Err error
+
+	// Recovery is the action taken after the error
+	Recovery FramingRecovery
+
+	// Discarded is the number of bytes dropped, including the bytes of
+	// the broken message
+	Discarded int
+}
+
+func (e *FramingError) Error() string {
+	return fmt.Sprintf("framing error (%s, %d bytes discarded): %v", e.Recovery, e.Discarded, e.Err)
+}
+
+func (e *FramingError) Unwrap() error {
+	return e.Err
+}
+
+// UnpackError is returned when inbound message can't be unpacked. It keeps
+// the raw frame for debugging.
+type UnpackError struct {
+	Err error
+
+	// Header is the length header of the message
+	Header []byte
+
+	// RawMessage is the packed message without the header
+	RawMessage []byte
+}
+
+func (e *UnpackError) Error() string {
+	return fmt.Sprintf("unpacking message: %v", e.Err)
+}
+
+func (e *UnpackError) Unwrap() error {
+	return e.Err
+}
+
+// Dump returns hex dump of the header and the packed message
+func (e *UnpackError) Dump() string {
+	var buf bytes.Buffer
+	e.writeDump(&buf)
+
+	return buf.String()
+}
+
+// writeDump writes the error with hex and ASCII dump of the header and the
+// packed message to w
+func (e *UnpackError) writeDump(w io.Writer) {
+	fmt.Fprintf(w, "%v\nheader (%d bytes):\n%smessage (%d bytes):\n%s",
+		e, len(e.Header), hex.Dump(e.Header), len(e.RawMessage), hex.Dump(e.RawMessage))
+}
+
+// UnpackErrorAction defines what to do with the inbound message that was
+// read, but can't be unpacked
+type UnpackErrorAction int
+
+const (
+	// UnpackErrorClose closes the connection
+	UnpackErrorClose UnpackErrorAction = iota
+
+	// UnpackErrorSkip drops the message and continues reading from the
+	// next one, as the length header of the message was valid
+	UnpackErrorSkip
+)
+
+func (a UnpackErrorAction) String() string {
+	switch a {
+	case UnpackErrorClose:
+		return "close"
+	case UnpackErrorSkip:
+		return "skip"
+	default:
+		return fmt.Sprintf("UnpackErrorAction(%d)", int(a))
+	}
+}
+
+// UnpackErrorPolicy returns the action for the packed inbound message
+// (without the length header) that can't be unpacked because of err
+type UnpackErrorPolicy func(raw []byte, err error) UnpackErrorAction
+
+// SkipOnUnpackError is the UnpackErrorPolicy which skips messages that
+// can't be unpacked
+func SkipOnUnpackError(raw []byte, err error) UnpackErrorAction {
+	return UnpackErrorSkip
+}
+
+// CloseOnUnpackError is the UnpackErrorPolicy which closes the connection
+// when message can't be unpacked
+func CloseOnUnpackError(raw []byte, err error) UnpackErrorAction {
+	return UnpackErrorClose
+}
+
+// handleUnpackError reports the error to ErrorHandler and returns it if
+// reading can't be continued according to UnpackErrorPolicy
+func (c *Connection) handleUnpackError(unpackErr *UnpackError) error {
+	action := c.options().UnpackErrorPolicy(unpackErr.RawMessage, unpackErr.Err)
+	c.handleError(fmt.Errorf("%w (%s)", unpackErr, action))
+
+	if action == UnpackErrorSkip {
+		return nil
+	}
+
+	return unpackErr
+}
+
+// peekReader reads from bufio.Reader without consuming the data, so the
+// length header can be checked before it's read
+type peekReader struct {
+	r   *bufio.Reader
+	off int
+	err error
+}
+
+func (p *peekReader) Read(b []byte) (int, error) {
+	buf, err := p.r.Peek(p.off + len(b))
+
+	var n int
+	if len(buf) > p.off {
+		n = copy(b, buf[p.off:])
+	}
+	p.off += n
+
+	if err != nil {
+		p.err = err
+		return n, err
+	}
+
+	return n, nil
+}
+
+// retryReader retries reads of the connection that return neither data
+// nor error until the connection is closed. bufio.Reader fails Peek with
+// io.ErrNoProgress after a few such reads, while connections passed to
+// NewFrom may return them while waiting for data.
+type retryReader struct {
+	r    io.Reader
+	done <-chan struct{}
+}
+
+func (r *retryReader) Read(b []byte) (int, error) {
+	for {
+		n, err := r.r.Read(b)
+		if n > 0 || err != nil || len(b) == 0 {
+			return n, err
+		}
+
+		select {
+		case <-r.done:
+			return 0, ErrConnectionClosed
+		default:
+			runtime.Gosched()
+		}
+	}
+}
+
+// validLength reports whether message length is in the allowed range
+func (c *Connection) validLength(length int) bool {
+	if length < 0 {
+		return false
+	}
+
+	return c.options().MaxMessageLength == 0 || length <= c.options().MaxMessageLength
+}
+
+// recoverFraming applies FramingRecovery after the framing error and
+// reports it to ErrorHandler. read is the number of bytes of the broken
+// message that were read. It returns error if reading can't be continued.
+func (c *Connection) recoverFraming(r *bufio.Reader, framingErr *FramingError, read int) error {
+	framingErr.Recovery = c.options().FramingRecovery
+	framingErr.Discarded = read
+
+	if framingErr.Recovery != FramingRecoveryResync {
+		c.handleError(framingErr)
+		return framingErr
+	}
+
+	// Framer has read the broken frame, so the next one is read as is
+	if c.options().Framer != nil {
+		c.handleError(framingErr)
+		return nil
+	}
+
+	// when nothing was read, we are still at the position of the
+	// broken message and have to skip it
+	skipped, err := c.resync(r, read == 0)
+	framingErr.Discarded += skipped
+	c.handleError(framingErr)
+
+	return err
+}
+
+// resync skips bytes until the position where the next message may start
+// and returns the number of skipped bytes. Message may start at the
+// position of SyncMarker or, when it's not set, at the position of the
+// length header with valid length.
+func (c *Connection) resync(r *bufio.Reader, skip bool) (int, error) {
+	var skipped int
+
+	for {
+		if skip {
+			if _, err := r.Discard(1); err != nil {
+				return skipped, err
+			}
+			skipped++
+		}
+		skip = true
+
+		found, err := c.messageStarts(r)
+		if err != nil {
+			return skipped, err
+		}
+
+		if found {
+			return skipped, nil
+		}
+	}
+}
+
+// messageStarts reports whether message may start at the current position
+func (c *Connection) messageStarts(r *bufio.Reader) (bool, error) {
+	if len(c.options().SyncMarker) > 0 {
+		b, err := r.Peek(len(c.options().SyncMarker))
+		if err != nil {
+			return false, err
+		}
+
+		return bytes.Equal(b, c.options().SyncMarker), nil
+	}
+
+	header := &peekReader{r: r}
+	length, err := c.readMessageLength(header)
+	if header.err != nil {
+		return false, header.err
+	}
+
+	return err == nil && c.validLength(length), nil
+}
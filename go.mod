@@ -8,5 +8,6 @@ require (
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/testify v1.7.1
 	github.com/yerden/go-util v1.1.4 // indirect
+	go.uber.org/goleak v1.1.12
 	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
 )
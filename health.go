@@ -0,0 +1,41 @@
+package connection
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ErrUnhealthy is returned by Healthy when connection should not be used
+var ErrUnhealthy = errors.New("connection is unhealthy")
+
+// Healthy returns nil when connection status is StatusOnline, it received a message
+// within PingWindow (if PingHandler is set) and the number of pending
+// requests is below SaturationThreshold (if it's set). Otherwise, it
+// returns ErrUnhealthy with the reason. It's suitable for readiness probes.
+func (c *Connection) Healthy() error {
+	if status := c.Status(); status != StatusOnline {
+		return fmt.Errorf("%w: connection is %s", ErrUnhealthy, status)
+	}
+
+	if c.options().PingHandler != nil {
+		window := c.options().PingWindow
+		if window == 0 {
+			window = c.options().IdleTime + c.options().SendTimeout
+		}
+
+		lastReceived := time.Unix(0, atomic.LoadInt64(&c.lastReceived))
+		if idle := c.options().Clock.Now().Sub(lastReceived); idle > window {
+			return fmt.Errorf("%w: ping is stale: no message received for %s", ErrUnhealthy, idle)
+		}
+	}
+
+	if c.options().SaturationThreshold > 0 {
+		if pending := c.pendingRequests.len(); pending >= c.options().SaturationThreshold {
+			return fmt.Errorf("%w: %d pending requests reached saturation threshold %d", ErrUnhealthy, pending, c.options().SaturationThreshold)
+		}
+	}
+
+	return nil
+}
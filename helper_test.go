@@ -1,21 +1,36 @@
 package connection_test
 
 import (
+	"bytes"
+	"compress/zlib"
+	"context"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"sync"
+	"testing"
 	"time"
 
 	"github.com/moov-io/iso8583"
 	connection "github.com/moov-io/iso8583-connection"
+	"github.com/moov-io/iso8583-connection/connectiontest"
+	"github.com/moov-io/iso8583-connection/iso8583util"
 	"github.com/moov-io/iso8583-connection/server"
 	"github.com/moov-io/iso8583/encoding"
 	"github.com/moov-io/iso8583/field"
 	"github.com/moov-io/iso8583/network"
 	"github.com/moov-io/iso8583/prefix"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
 )
 
+// TestMain checks that goroutines started by the tests exit by the time
+// they are done
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m)
+}
+
 // here are the implementation of the provider protocol:
 // * header reader and writer
 // * spec
@@ -86,8 +101,19 @@ type testServer struct {
 	// to protect following
 	mutex         sync.Mutex
 	receivedPings int
+
+	// copies of the received messages, the channel closed when the next
+	// message is received and the max number of kept messages, or
+	// defaultRecordLimit if it's zero
+	receivedMessages []*iso8583.Message
+	nextReceived     chan struct{}
+	recordLimit      int
 }
 
+// defaultRecordLimit is the number of the last received messages kept by
+// the test server by default
+const defaultRecordLimit = 1000
+
 func (t *testServer) Ping() {
 	t.mutex.Lock()
 	t.receivedPings++
@@ -101,6 +127,175 @@ func (t *testServer) ReceivedPings() int {
 	return t.receivedPings
 }
 
+// CountPings is the middleware counting ping messages
+func (t *testServer) CountPings(next server.ResponderFunc) server.ResponderFunc {
+	return func(c *connection.Connection, message *iso8583.Message) (*iso8583.Message, error) {
+		if isPingMessage(message) {
+			t.Ping()
+		}
+
+		return next(c, message)
+	}
+}
+
+// Record is the middleware keeping copies of the received messages
+func (t *testServer) Record(next server.ResponderFunc) server.ResponderFunc {
+	return func(c *connection.Connection, message *iso8583.Message) (*iso8583.Message, error) {
+		t.record(message)
+
+		return next(c, message)
+	}
+}
+
+// record keeps the copy of the received message, as handler may reply
+// with the message
+func (t *testServer) record(message *iso8583.Message) {
+	received, err := message.Clone()
+	if err != nil {
+		log.Printf("cloning received message: %s", err.Error())
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.receivedMessages = append(t.receivedMessages, received)
+	t.trimReceived()
+	if t.nextReceived != nil {
+		close(t.nextReceived)
+		t.nextReceived = nil
+	}
+}
+
+// trimReceived drops the oldest received messages over the record limit.
+// It should be called with mutex held.
+func (t *testServer) trimReceived() {
+	limit := t.recordLimit
+	if limit == 0 {
+		limit = defaultRecordLimit
+	}
+
+	if extra := len(t.receivedMessages) - limit; extra > 0 {
+		t.receivedMessages = append([]*iso8583.Message(nil), t.receivedMessages[extra:]...)
+	}
+}
+
+// SetRecordLimit sets the number of the last received messages kept by the
+// server
+func (t *testServer) SetRecordLimit(n int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.recordLimit = n
+	t.trimReceived()
+}
+
+// ResetReceived forgets the received messages, e.g. between test cases
+func (t *testServer) ResetReceived() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.receivedMessages = nil
+}
+
+// ReceivedMessages returns copies of the messages received by the server
+// in the order they were received
+func (t *testServer) ReceivedMessages() []*iso8583.Message {
+	return t.Find(func(message *iso8583.Message) bool {
+		return true
+	})
+}
+
+// Find returns copies of the received messages matching match in the order
+// they were received
+func (t *testServer) Find(match func(message *iso8583.Message) bool) []*iso8583.Message {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var messages []*iso8583.Message
+	for _, message := range t.receivedMessages {
+		// match gets the copy, as it may set fields, e.g. with
+		// GetString of unset field
+		clone, err := message.Clone()
+		if err != nil {
+			log.Printf("cloning received message: %s", err.Error())
+			continue
+		}
+
+		if match(clone) {
+			messages = append(messages, clone)
+		}
+	}
+
+	return messages
+}
+
+// CountByMTI returns the number of the received messages with the MTI
+func (t *testServer) CountByMTI(mti string) int {
+	return len(t.Find(hasMTI(mti)))
+}
+
+// LastByMTI returns copy of the last received message with the MTI or nil
+// if there is none
+func (t *testServer) LastByMTI(mti string) *iso8583.Message {
+	messages := t.Find(hasMTI(mti))
+	if len(messages) == 0 {
+		return nil
+	}
+
+	return messages[len(messages)-1]
+}
+
+func hasMTI(mti string) func(message *iso8583.Message) bool {
+	return func(message *iso8583.Message) bool {
+		messageMTI, _ := message.GetMTI()
+		return messageMTI == mti
+	}
+}
+
+// WaitForMessages waits until server received n messages matching match,
+// including the ones received before the call
+func (t *testServer) WaitForMessages(ctx context.Context, n int, match func(message *iso8583.Message) bool) error {
+	for {
+		// channel is taken before messages are matched, so the
+		// message received meanwhile is not missed
+		t.mutex.Lock()
+		if t.nextReceived == nil {
+			t.nextReceived = make(chan struct{})
+		}
+		next := t.nextReceived
+		t.mutex.Unlock()
+
+		matched := len(t.Find(match))
+		if matched >= n {
+			return nil
+		}
+
+		select {
+		case <-next:
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for %d messages, received %d: %w", n, matched, ctx.Err())
+		}
+	}
+}
+
+// isPingMessage reports whether message is 0800 with TestCasePingCounter
+// code
+func isPingMessage(message *iso8583.Message) bool {
+	mti, _ := message.GetMTI()
+	if mti != "0800" {
+		return false
+	}
+
+	// GetString would set the field if it's not set
+	if _, set := message.GetFields()[2]; !set {
+		return false
+	}
+	code, _ := message.GetString(2)
+
+	return code == TestCasePingCounter
+}
+
 const (
 	TestCaseReply           string = "000"
 	TestCaseDelayedResponse string = "001"
@@ -109,90 +304,193 @@ const (
 	// received message
 	TestCaseSameSTANRequest string = "003"
 	TestCaseCloseConnection string = "004"
+	TestCaseNoResponse      string = "005"
 )
 
 func NewTestServer() (*testServer, error) {
-	var srv *testServer
+	srv := &testServer{}
 
-	// define logic for our test server
-	testServerLogic := func(c *connection.Connection, message *iso8583.Message) {
-		mti, err := message.GetMTI()
-		if err != nil {
-			log.Printf("getting MTI: %s", err.Error())
-			return
-		}
+	server := server.New(testSpec, readMessageLength, writeMessageLength, connection.InboundMessageHandler(srv.Handle))
+	// pings are answered by the echo responder and counted by the
+	// middleware wrapping it
+	server.AutoRespondEcho(true)
+	server.EchoDetector = isPingMessage
+	server.Use(srv.Record, srv.CountPings)
+	// start on random port
+	err := server.Start("127.0.0.1:")
+	if err != nil {
+		return nil, err
+	}
+
+	srv.server = server
+	srv.Addr = server.Addr
+
+	return srv, nil
+}
 
-		// we handle only 0800 messages
-		if mti != "0800" {
+// Handle is the logic of our test server. It can be used as the server
+// handler of connectiontest.NewPipeConnection.
+func (t *testServer) Handle(c *connection.Connection, message *iso8583.Message) {
+	mti, err := message.GetMTI()
+	if err != nil {
+		log.Printf("getting MTI: %s", err.Error())
+		return
+	}
+
+	// we handle only 0800 messages
+	if mti != "0800" {
+		return
+	}
+
+	// build the response message
+	response, err := iso8583util.NewResponseFrom(message, []int{2, 7, 11})
+	if err != nil {
+		log.Printf("building response: %s", err.Error())
+		return
+	}
+
+	// check if PAN was set to specific test case value
+	f2 := message.GetField(2)
+	if f2 != nil {
+		code, err := f2.String()
+		if err != nil {
+			log.Printf("getting field 2: %s", err.Error())
 			return
 		}
 
-		// update MTI for the response message
-		newMTI := "0810"
-		message.MTI(newMTI)
+		switch code {
+		case TestCaseDelayedResponse:
+			// testing value to "sleep" for a 3 seconds
+			time.Sleep(500 * time.Millisecond)
+			c.Reply(response)
+		case TestCaseSameSTANRequest:
+			// here we will send message to the client with
+			// the same STAN
+			stan, _ := message.GetString(11)
+			incomingMessage := iso8583.NewMessage(testSpec)
+			incomingMessage.MTI("0800")
+			incomingMessage.Field(11, stan)
 
-		// check if PAN was set to specific test case value
-		f2 := message.GetField(2)
-		if f2 != nil {
-			code, err := f2.String()
+			_, err := c.Send(incomingMessage)
 			if err != nil {
-				log.Printf("getting field 2: %s", err.Error())
-				return
-			}
-
-			switch code {
-			case TestCaseDelayedResponse:
-				// testing value to "sleep" for a 3 seconds
-				time.Sleep(500 * time.Millisecond)
-				c.Reply(message)
-			case TestCaseSameSTANRequest:
-				// here we will send message to the client with
-				// the same STAN
-				stan, _ := message.GetString(11)
-				incomingMessage := iso8583.NewMessage(testSpec)
-				incomingMessage.MTI("0800")
-				incomingMessage.Field(11, stan)
-
-				_, err := c.Send(incomingMessage)
-				if err != nil {
-					log.Printf("sending message to client: %s", err.Error())
-				}
-				// and then delay the reply
-				time.Sleep(200 * time.Millisecond)
-				c.Reply(message)
-			case TestCasePingCounter:
-				// ping request received
-				srv.Ping()
-				c.Reply(message)
-			case TestCaseCloseConnection:
-				// reply
-				c.Reply(message)
-				// let client receive reply
-				time.Sleep(50 * time.Millisecond)
-				c.Close()
-			case TestCaseReply:
-				c.Reply(message)
-			default:
-				c.Reply(message)
+				log.Printf("sending message to client: %s", err.Error())
 			}
+			// and then delay the reply
+			time.Sleep(200 * time.Millisecond)
+			c.Reply(response)
+		case TestCaseCloseConnection:
+			// reply
+			c.Reply(response)
+			// let client receive reply
+			time.Sleep(50 * time.Millisecond)
+			c.Close()
+		case TestCaseNoResponse:
+			// we never reply
+		case TestCaseReply:
+			c.Reply(response)
+		default:
+			c.Reply(response)
 		}
 	}
+}
 
-	server := server.New(testSpec, readMessageLength, writeMessageLength, connection.InboundMessageHandler(testServerLogic))
-	// start on random port
-	err := server.Start("127.0.0.1:")
-	if err != nil {
-		return nil, err
+func (t *testServer) Close() {
+	t.server.Close()
+}
+
+// packedFrame returns packed network management message with length header
+func packedFrame(t *testing.T, stan string) []byte {
+	t.Helper()
+
+	message := iso8583.NewMessage(testSpec)
+	err := message.Marshal(baseFields{
+		MTI:  field.NewStringValue("0800"),
+		STAN: field.NewStringValue(stan),
+	})
+	require.NoError(t, err)
+
+	packed, err := message.Pack()
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	_, err = writeMessageLength(&buf, len(packed))
+	require.NoError(t, err)
+	buf.Write(packed)
+
+	return buf.Bytes()
+}
+
+// specWithFields returns copy of testSpec with additional fields
+func specWithFields(fields map[int]field.Field) *iso8583.MessageSpec {
+	spec := &iso8583.MessageSpec{
+		Name:   testSpec.Name,
+		Fields: map[int]field.Field{},
 	}
 
-	srv = &testServer{
-		server: server,
-		Addr:   server.Addr,
+	for id, f := range testSpec.Fields {
+		spec.Fields[id] = f
 	}
 
-	return srv, nil
+	for id, f := range fields {
+		spec.Fields[id] = f
+	}
+
+	return spec
 }
 
-func (t *testServer) Close() {
-	t.server.Close()
+// expirePendingRequests advances clock until pending requests of c time out.
+// The clock is advanced more than once because timer wheel may arm its next
+// tick only after the clock was moved.
+func expirePendingRequests(t *testing.T, c *connection.Connection, clock *connectiontest.FakeClock) {
+	t.Helper()
+
+	require.Eventually(t, func() bool {
+		clock.Advance(c.Opts.SendTimeout)
+		return c.PendingRequests() == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+// zlibConn is the example of ConnWrapper which compresses the stream of
+// the connection with zlib. Each write is flushed, so the peer can
+// decompress the frame without waiting for the next one.
+type zlibConn struct {
+	net.Conn
+
+	writeMu sync.Mutex
+	zw      *zlib.Writer
+
+	// zr is created on the first read, as zlib header is read when it's
+	// created
+	zr io.ReadCloser
+}
+
+func wrapZlib(conn net.Conn) (net.Conn, error) {
+	return &zlibConn{
+		Conn: conn,
+		zw:   zlib.NewWriter(conn),
+	}, nil
+}
+
+func (c *zlibConn) Read(p []byte) (int, error) {
+	if c.zr == nil {
+		zr, err := zlib.NewReader(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		c.zr = zr
+	}
+
+	return c.zr.Read(p)
+}
+
+func (c *zlibConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	n, err := c.zw.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	return n, c.zw.Flush()
 }
@@ -0,0 +1,185 @@
+package connection
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/moov-io/iso8583"
+)
+
+// network management information codes (field 70) of the messages from the
+// host handled with HostSignOffBehavior
+const (
+	networkManagementSignOff = "002"
+	networkManagementCutover = "070"
+)
+
+// drainPollInterval is how often Drain checks pending requests
+const drainPollInterval = 10 * time.Millisecond
+
+// HostEventType is the type of HostEvent
+type HostEventType int
+
+const (
+	// HostSignOff is emitted when the host signed the connection off
+	HostSignOff HostEventType = iota + 1
+
+	// HostDrained is emitted when pending requests got their responses
+	// or failed after HostSignOff
+	HostDrained
+
+	// HostCutover is emitted when the host switched the business date
+	HostCutover
+)
+
+func (t HostEventType) String() string {
+	switch t {
+	case HostSignOff:
+		return "sign-off"
+	case HostDrained:
+		return "drained"
+	case HostCutover:
+		return "cutover"
+	}
+
+	return fmt.Sprintf("HostEventType(%d)", int(t))
+}
+
+// HostEvent is the lifecycle event caused by the network management
+// message from the host
+type HostEvent struct {
+	Type HostEventType
+
+	// BusinessDate is the business date after HostCutover, as set in
+	// field 15 (settlement date) of the cutover message
+	BusinessDate string
+}
+
+// CurrentBusinessDate returns the business date set by the last cutover
+// message from the host handled with HostSignOffBehavior, or an empty
+// string if there was none
+func (c *Connection) CurrentBusinessDate() string {
+	date, _ := c.businessDate.Load().(string)
+
+	return date
+}
+
+// Drain signs the connection off, so Sends of financial messages fail with
+// ErrNotSignedOn like with RequireSignOn, and waits until pending requests
+// got their responses or failed. Connection accepts financial messages
+// again when it's signed on or reconnected.
+func (c *Connection) Drain(ctx context.Context) error {
+	atomic.StoreInt32(&c.draining, 1)
+	c.setSignOnState(SignedOff)
+
+	for c.pendingRequests.len() > 0 {
+		timer := c.options().Clock.NewTimer(drainPollInterval)
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// handleHostNetworkManagement handles sign-off and cutover messages from
+// the host when HostSignOffBehavior is set and reports whether message was
+// handled. The connection is signed off right away, while the ack is sent
+// and HostEventHandler is called in the separate goroutine, as the message
+// may be handled by the read loop.
+func (c *Connection) handleHostNetworkManagement(message *iso8583.Message) bool {
+	if !c.options().HostSignOffHandling {
+		return false
+	}
+
+	mti, _ := message.GetMTI()
+	if !c.options().MTIVersion.IsNetworkManagement(mti) {
+		return false
+	}
+
+	code, err := matchFieldValue(message, "70")
+	if err != nil {
+		return false
+	}
+
+	switch code {
+	case networkManagementSignOff:
+		ack := c.hostAck(message)
+		drain := c.options().HostSignOffDrain
+		if drain {
+			atomic.StoreInt32(&c.draining, 1)
+		}
+		c.setSignOnState(SignedOff)
+
+		go func() {
+			c.sendHostAck(ack)
+			c.emitHostEvent(HostEvent{Type: HostSignOff})
+
+			if drain {
+				if err := c.Drain(context.Background()); err == nil {
+					c.emitHostEvent(HostEvent{Type: HostDrained})
+				}
+			}
+		}()
+	case networkManagementCutover:
+		ack := c.hostAck(message)
+		date, _ := matchFieldValue(message, "15")
+		if date != "" {
+			c.businessDate.Store(date)
+		}
+
+		go func() {
+			c.sendHostAck(ack)
+			c.emitHostEvent(HostEvent{Type: HostCutover, BusinessDate: date})
+		}()
+	default:
+		return false
+	}
+
+	return true
+}
+
+// hostAck builds the ack of the network management message of the host
+// when HostSignOffAck is set. It's built before the message is released.
+func (c *Connection) hostAck(message *iso8583.Message) *iso8583.Message {
+	if !c.options().HostSignOffAck {
+		return nil
+	}
+
+	ack, err := c.options().MTIVersion.NewResponseFrom(message, []int{7, 11, 15, 70})
+	if err == nil {
+		if _, found := message.GetSpec().Fields[39]; found {
+			err = ack.Field(39, "00")
+		}
+	}
+	if err != nil {
+		c.handleError(fmt.Errorf("building ack of network management message: %w", err))
+		return nil
+	}
+
+	return ack
+}
+
+// sendHostAck sends the ack built by hostAck, if any
+func (c *Connection) sendHostAck(ack *iso8583.Message) {
+	if ack == nil {
+		return
+	}
+
+	if err := c.reply(ack); err != nil {
+		c.handleError(fmt.Errorf("sending ack of network management message: %w", err))
+	}
+}
+
+// emitHostEvent calls HostEventHandler. Events of the message are emitted
+// from the same goroutine, so HostDrained follows HostSignOff.
+func (c *Connection) emitHostEvent(event HostEvent) {
+	if c.options().HostEventHandler != nil {
+		c.options().HostEventHandler(c, event)
+	}
+}
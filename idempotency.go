@@ -0,0 +1,163 @@
+package connection
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/moov-io/iso8583"
+)
+
+// SendOption configures a single Send
+type SendOption func(o *sendOptions)
+
+type sendOptions struct {
+	idempotencyKey string
+}
+
+// WithIdempotencyKey makes Send deduplicate the message by key. Send of
+// the message with the key which was sent within IdempotencyTTL returns
+// the response of the first Send or, if it's still waiting for the
+// response, waits for it instead of writing the message again. Response is
+// shared by the deduplicated Sends, so they should not modify or release
+// it. Key of the failed Send may be used again.
+func WithIdempotencyKey(key string) SendOption {
+	return func(o *sendOptions) {
+		o.idempotencyKey = key
+	}
+}
+
+// idempotentSend is the Send of the message with idempotency key
+type idempotentSend struct {
+	key string
+
+	// closed when Send returns and following fields are set
+	done     chan struct{}
+	response *iso8583.Message
+	info     SendInfo
+	err      error
+
+	// time after which completed Send is evicted, zero while Send is
+	// waiting for the response
+	expiresAt time.Time
+}
+
+// idempotencyCache keeps Sends with idempotency keys which are waiting
+// for the response or completed within TTL. Sends are ordered by the time
+// they were started or, after they complete, by the time they completed,
+// so expired Sends are at the front. Only completed Sends count toward the
+// size of the cache.
+type idempotencyCache struct {
+	mu        sync.Mutex
+	entries   map[string]*list.Element
+	order     *list.List
+	completed int
+}
+
+func newIdempotencyCache() *idempotencyCache {
+	return &idempotencyCache{
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// start returns the Send of the key which is pending or completed within
+// TTL and true, or registers a new Send of the key which the caller should
+// perform and complete
+func (c *idempotencyCache) start(key string, now time.Time, size int) (*idempotentSend, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.evict(now, size)
+
+	if e, found := c.entries[key]; found {
+		return e.Value.(*idempotentSend), true
+	}
+
+	send := &idempotentSend{
+		key:  key,
+		done: make(chan struct{}),
+	}
+	c.entries[key] = c.order.PushBack(send)
+
+	return send, false
+}
+
+// complete keeps successful Send until expiresAt, evicting the oldest
+// completed Sends when there are more than size of them, and removes the
+// failed one, so it may be retried
+func (c *idempotencyCache) complete(send *idempotentSend, now, expiresAt time.Time, size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, found := c.entries[send.key]
+	if !found || e.Value != send {
+		// evicted already
+		return
+	}
+
+	if send.err != nil {
+		c.remove(e)
+		return
+	}
+
+	send.expiresAt = expiresAt
+	c.completed++
+	c.order.MoveToBack(e)
+
+	c.evict(now, size)
+}
+
+// evict removes completed Sends which expired and, while there are more
+// than size completed Sends, the oldest of them. Pending Sends are not
+// evicted.
+func (c *idempotencyCache) evict(now time.Time, size int) {
+	for e := c.order.Front(); e != nil; {
+		next := e.Next()
+
+		send := e.Value.(*idempotentSend)
+		if !send.expiresAt.IsZero() {
+			if !now.After(send.expiresAt) && c.completed <= size {
+				return
+			}
+			c.remove(e)
+		}
+
+		e = next
+	}
+}
+
+func (c *idempotencyCache) remove(e *list.Element) {
+	send := c.order.Remove(e).(*idempotentSend)
+	delete(c.entries, send.key)
+
+	if !send.expiresAt.IsZero() {
+		c.completed--
+	}
+}
+
+// sendIdempotent sends the message unless the message with the key was
+// sent within IdempotencyTTL
+func (c *Connection) sendIdempotent(ctx context.Context, message *iso8583.Message, key string) (*iso8583.Message, SendInfo, error) {
+	send, found := c.idempotentSends.start(key, c.options().Clock.Now(), c.options().IdempotencyCacheSize)
+	if found {
+		atomic.AddUint64(&c.deduplicatedSends, 1)
+
+		select {
+		case <-send.done:
+		case <-ctx.Done():
+			return nil, SendInfo{}, ctx.Err()
+		}
+		return send.response, send.info, send.err
+	}
+
+	send.response, send.info, send.err = c.sendWithInfo(ctx, message)
+
+	now := c.options().Clock.Now()
+	c.idempotentSends.complete(send, now, now.Add(c.options().IdempotencyTTL), c.options().IdempotencyCacheSize)
+	close(send.done)
+
+	return send.response, send.info, send.err
+}
@@ -0,0 +1,75 @@
+package connection
+
+import (
+	"sync/atomic"
+
+	"github.com/moov-io/iso8583"
+)
+
+// inboundJob is the invocation of the inbound handler
+type inboundJob func()
+
+// inboundWorkers returns the number of goroutines that run inbound
+// handlers or zero if each handler runs in its own goroutine. Handlers are
+// processed serially by a single worker.
+func (c *Connection) inboundWorkers() int {
+	if c.options().SerialInboundProcessing {
+		return 1
+	}
+
+	return c.options().InboundWorkers
+}
+
+// startInboundWorkers starts goroutines that run jobs from the returned
+// queue. Workers exit when queue is closed and all queued jobs are done.
+func (c *Connection) startInboundWorkers(workers int) chan inboundJob {
+	jobs := make(chan inboundJob, c.options().InboundQueueSize)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range jobs {
+				atomic.AddInt64(&c.inboundQueueDepth, -1)
+				job()
+			}
+		}()
+	}
+
+	return jobs
+}
+
+// runInbound runs the job in its own goroutine or, when InboundWorkers are
+// set, queues it for the workers. When the queue is full, it waits for
+// the space in it unless DropInboundWhenFull is set, in which case message
+// is dropped.
+func (c *Connection) runInbound(jobs chan inboundJob, message *iso8583.Message, job inboundJob) {
+	c.readers.Add(1)
+	tracked := func() {
+		defer c.readers.Done()
+		job()
+	}
+
+	if jobs == nil {
+		go tracked()
+		return
+	}
+
+	atomic.AddInt64(&c.inboundQueueDepth, 1)
+
+	if !c.options().DropInboundWhenFull {
+		jobs <- tracked
+		return
+	}
+
+	select {
+	case jobs <- tracked:
+	default:
+		c.readers.Done()
+		atomic.AddInt64(&c.inboundQueueDepth, -1)
+		atomic.AddUint64(&c.inboundDropped, 1)
+
+		if c.options().InboundDropHandler != nil {
+			c.options().InboundDropHandler(c, message)
+		}
+		c.releaseInbound(message)
+	}
+}
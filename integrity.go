@@ -0,0 +1,109 @@
+package connection
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/moov-io/iso8583"
+)
+
+// FrameIntegrityError is reported to ErrorHandler when checksum of the
+// inbound frame doesn't match its body. It matches ErrFrameIntegrity.
+type FrameIntegrityError struct {
+	// Err is the error returned by the verify function
+	Err error
+
+	// Body is the packed message
+	Body []byte
+
+	// Received is the checksum received with the body
+	Received []byte
+}
+
+func (e *FrameIntegrityError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrFrameIntegrity, e.Err)
+}
+
+func (e *FrameIntegrityError) Unwrap() error {
+	return e.Err
+}
+
+func (e *FrameIntegrityError) Is(target error) bool {
+	return target == ErrFrameIntegrity
+}
+
+// FrameIntegrityNAKFunc returns the message sent to the peer when the
+// frame with body failed verification. If it returns nil, nothing is
+// sent.
+type FrameIntegrityNAKFunc func(body []byte) *iso8583.Message
+
+// writeChecksum writes the checksum of the packed message after it when
+// FrameIntegrity is set
+func (c *Connection) writeChecksum(buf *bytes.Buffer, packed []byte) {
+	if c.options().FrameIntegrityCompute == nil {
+		return
+	}
+
+	buf.Write(c.options().FrameIntegrityCompute(packed))
+}
+
+// checksumLength returns the length of the checksum appended to frames
+func (c *Connection) checksumLength() int {
+	if c.options().FrameIntegrityCompute == nil {
+		return 0
+	}
+
+	return c.options().FrameIntegritySize
+}
+
+// verifyFrameIntegrity splits the body of the inbound frame into the
+// packed message and the checksum and verifies them. It returns the packed
+// message.
+func (c *Connection) verifyFrameIntegrity(body []byte) ([]byte, *FrameIntegrityError) {
+	if c.options().FrameIntegrityVerify == nil {
+		return body, nil
+	}
+
+	size := c.options().FrameIntegritySize
+	if len(body) < size {
+		return nil, &FrameIntegrityError{
+			Err:  fmt.Errorf("frame is shorter than checksum: %d bytes", len(body)),
+			Body: body,
+		}
+	}
+
+	packed, received := body[:len(body)-size], body[len(body)-size:]
+	if err := c.options().FrameIntegrityVerify(packed, received); err != nil {
+		return nil, &FrameIntegrityError{
+			Err:      err,
+			Body:     packed,
+			Received: received,
+		}
+	}
+
+	return packed, nil
+}
+
+// rejectFrame reports the frame that failed verification to ErrorHandler
+// and sends the NAK message when FrameIntegrityNAK is set. It returns the
+// error if connection should be closed.
+func (c *Connection) rejectFrame(integrityErr *FrameIntegrityError) error {
+	atomic.AddUint64(&c.frameIntegrityFailures, 1)
+	c.handleError(integrityErr)
+
+	nak := c.options().FrameIntegrityNAK
+	if nak == nil {
+		return integrityErr
+	}
+
+	if message := nak(integrityErr.Body); message != nil {
+		go func() {
+			if err := c.reply(message); err != nil {
+				c.handleError(fmt.Errorf("sending frame integrity NAK: %w", err))
+			}
+		}()
+	}
+
+	return nil
+}
@@ -0,0 +1,200 @@
+package iso8583util
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrUnknownVersion is returned when version of ISO 8583 can't be detected
+// from the MTI
+var ErrUnknownVersion = errors.New("unknown ISO 8583 version")
+
+// Version is the version of ISO 8583 which conventions MTIs follow
+type Version int
+
+const (
+	// VersionAuto detects the version from the first digit of each MTI
+	VersionAuto Version = iota
+
+	// Version1987 is ISO 8583:1987 with MTIs like 0800
+	Version1987
+
+	// Version1993 is ISO 8583:1993 with MTIs like 1804
+	Version1993
+
+	// Version2003 is ISO 8583:2003 with MTIs like 2804. It adds
+	// instruction (xx6x) and instruction acknowledgement (xx7x) messages.
+	Version2003
+)
+
+// position of the digits in MTI
+const (
+	versionIndex  = 0
+	classIndex    = 1
+	functionIndex = 2
+	originIndex   = 3
+)
+
+// message class of the network management messages
+const classNetworkManagement = '8'
+
+func (v Version) String() string {
+	switch v {
+	case VersionAuto:
+		return "auto"
+	case Version1987:
+		return "1987"
+	case Version1993:
+		return "1993"
+	case Version2003:
+		return "2003"
+	}
+
+	return fmt.Sprintf("Version(%d)", int(v))
+}
+
+// DetectVersion returns the version of ISO 8583 by the first digit of the
+// MTI: 0 for 1987, 1 for 1993 and 2 for 2003. Other digits are reserved or
+// used privately, so their version is unknown.
+func DetectVersion(mti string) (Version, error) {
+	if err := validateMTI(mti); err != nil {
+		return VersionAuto, err
+	}
+
+	switch mti[versionIndex] {
+	case '0':
+		return Version1987, nil
+	case '1':
+		return Version1993, nil
+	case '2':
+		return Version2003, nil
+	}
+
+	return VersionAuto, fmt.Errorf("MTI %q: %w", mti, ErrUnknownVersion)
+}
+
+// resolve returns the version of the MTI, detected unless v is set. MTIs
+// of reserved and private versions (3xxx to 9xxx) follow conventions of
+// 2003 as they are the most permissive.
+func (v Version) resolve(mti string) (Version, error) {
+	if err := validateMTI(mti); err != nil {
+		return VersionAuto, err
+	}
+
+	if v != VersionAuto {
+		return v, nil
+	}
+
+	version, err := DetectVersion(mti)
+	if errors.Is(err, ErrUnknownVersion) {
+		return Version2003, nil
+	}
+
+	return version, err
+}
+
+// maxFunction returns the largest message function digit of the version
+// requests and responses are defined for
+func (v Version) maxFunction() byte {
+	if v == Version2003 {
+		// instruction and its acknowledgement
+		return 7
+	}
+
+	// notification acknowledgement
+	return 5
+}
+
+// IsRequest reports whether the MTI is request (xx0x), advice (xx2x),
+// notification (xx4x) or, for 2003, instruction (xx6x)
+func (v Version) IsRequest(mti string) bool {
+	version, err := v.resolve(mti)
+	if err != nil {
+		return false
+	}
+
+	function := mti[functionIndex] - '0'
+
+	return function%2 == 0 && function <= version.maxFunction()
+}
+
+// IsResponse reports whether the MTI is request response (xx1x), advice
+// response (xx3x), notification acknowledgement (xx5x) or, for 2003,
+// instruction acknowledgement (xx7x)
+func (v Version) IsResponse(mti string) bool {
+	version, err := v.resolve(mti)
+	if err != nil {
+		return false
+	}
+
+	function := mti[functionIndex] - '0'
+
+	return function%2 == 1 && function <= version.maxFunction()
+}
+
+// IsNetworkManagement reports whether the MTI is network management
+// message (x8xx), e.g. 0800 echo or 1804 sign-on
+func (v Version) IsNetworkManagement(mti string) bool {
+	if _, err := v.resolve(mti); err != nil {
+		return false
+	}
+
+	return mti[classIndex] == classNetworkManagement
+}
+
+// ResponseMTI returns the response MTI of the request MTI following the
+// conventions of the version. See ResponseMTI function.
+func (v Version) ResponseMTI(mti string) (string, error) {
+	version, err := v.resolve(mti)
+	if err != nil {
+		return "", fmt.Errorf("%v: %w", err, ErrUnderivableMTI)
+	}
+
+	if !version.IsRequest(mti) {
+		return "", fmt.Errorf("MTI %q is not a request of ISO 8583:%s: %w", mti, version, ErrUnderivableMTI)
+	}
+
+	function := mti[functionIndex] - '0'
+
+	origin := mti[originIndex] - '0'
+	if origin > 5 {
+		return "", fmt.Errorf("MTI %q has unknown origin: %w", mti, ErrUnderivableMTI)
+	}
+
+	// responses are sent for the original message, not for its repeat
+	origin -= origin % 2
+
+	return string([]byte{mti[versionIndex], mti[classIndex], '0' + function + 1, '0' + origin}), nil
+}
+
+// IsRequest reports whether the MTI is a request of the version detected
+// from its first digit
+func IsRequest(mti string) bool {
+	return VersionAuto.IsRequest(mti)
+}
+
+// IsResponse reports whether the MTI is a response of the version
+// detected from its first digit
+func IsResponse(mti string) bool {
+	return VersionAuto.IsResponse(mti)
+}
+
+// IsNetworkManagement reports whether the MTI is network management
+// message (x8xx)
+func IsNetworkManagement(mti string) bool {
+	return VersionAuto.IsNetworkManagement(mti)
+}
+
+func validateMTI(mti string) error {
+	if len(mti) != 4 {
+		return fmt.Errorf("MTI %q should have 4 digits", mti)
+	}
+
+	for _, d := range mti {
+		if d < '0' || d > '9' {
+			return fmt.Errorf("MTI %q should have only digits", mti)
+		}
+	}
+
+	return nil
+}
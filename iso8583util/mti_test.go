@@ -0,0 +1,139 @@
+package iso8583util_test
+
+import (
+	"testing"
+
+	"github.com/moov-io/iso8583-connection/iso8583util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectVersion(t *testing.T) {
+	tests := []struct {
+		mti      string
+		expected iso8583util.Version
+		err      error
+	}{
+		{mti: "0800", expected: iso8583util.Version1987},
+		{mti: "1804", expected: iso8583util.Version1993},
+		{mti: "2100", expected: iso8583util.Version2003},
+		{mti: "9100", err: iso8583util.ErrUnknownVersion},
+		{mti: "080"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mti, func(t *testing.T) {
+			version, err := iso8583util.DetectVersion(tt.mti)
+			if tt.expected == iso8583util.VersionAuto {
+				require.Error(t, err)
+				if tt.err != nil {
+					require.ErrorIs(t, err, tt.err)
+				}
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, version)
+		})
+	}
+}
+
+func TestVersion_Classification(t *testing.T) {
+	tests := []struct {
+		version           iso8583util.Version
+		mti               string
+		request           bool
+		response          bool
+		networkManagement bool
+	}{
+		// 1987
+		{mti: "0100", request: true},
+		{mti: "0110", response: true},
+		{mti: "0221", request: true},
+		{mti: "0430", response: true},
+		{mti: "0640", request: true},
+		{mti: "0650", response: true},
+		{mti: "0800", request: true, networkManagement: true},
+		{mti: "0810", response: true, networkManagement: true},
+		{mti: "0160"},
+		{mti: "0170"},
+		{mti: "0180"},
+
+		// 1993
+		{mti: "1100", request: true},
+		{mti: "1110", response: true},
+		{mti: "1420", request: true},
+		{mti: "1430", response: true},
+		{mti: "1804", request: true, networkManagement: true},
+		{mti: "1814", response: true, networkManagement: true},
+		{mti: "1160"},
+		{mti: "1870", networkManagement: true},
+
+		// 2003
+		{mti: "2100", request: true},
+		{mti: "2110", response: true},
+		{mti: "2160", request: true},
+		{mti: "2170", response: true},
+		{mti: "2804", request: true, networkManagement: true},
+		{mti: "2814", response: true, networkManagement: true},
+		{mti: "2190"},
+
+		// private MTIs follow 2003
+		{mti: "9160", request: true},
+		{mti: "9170", response: true},
+
+		// version set for the nonconforming host
+		{version: iso8583util.Version2003, mti: "0160", request: true},
+		{version: iso8583util.Version2003, mti: "0170", response: true},
+		{version: iso8583util.Version1987, mti: "2160"},
+
+		{mti: "08a0"},
+		{mti: "081"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.version.String()+"/"+tt.mti, func(t *testing.T) {
+			require.Equal(t, tt.request, tt.version.IsRequest(tt.mti))
+			require.Equal(t, tt.response, tt.version.IsResponse(tt.mti))
+			require.Equal(t, tt.networkManagement, tt.version.IsNetworkManagement(tt.mti))
+
+			if tt.version == iso8583util.VersionAuto {
+				require.Equal(t, tt.request, iso8583util.IsRequest(tt.mti))
+				require.Equal(t, tt.response, iso8583util.IsResponse(tt.mti))
+				require.Equal(t, tt.networkManagement, iso8583util.IsNetworkManagement(tt.mti))
+			}
+		})
+	}
+}
+
+func TestVersion_ResponseMTI(t *testing.T) {
+	tests := []struct {
+		version  iso8583util.Version
+		mti      string
+		expected string
+	}{
+		{mti: "0800", expected: "0810"},
+		{mti: "0640", expected: "0650"},
+		{mti: "0160"},
+		{mti: "1804", expected: "1814"},
+		{mti: "1421", expected: "1430"},
+		{mti: "1160"},
+		{mti: "2804", expected: "2814"},
+		{mti: "2162", expected: "2172"},
+		{mti: "2170"},
+		{version: iso8583util.Version2003, mti: "0160", expected: "0170"},
+		{version: iso8583util.Version1993, mti: "2160"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.version.String()+"/"+tt.mti, func(t *testing.T) {
+			mti, err := tt.version.ResponseMTI(tt.mti)
+			if tt.expected == "" {
+				require.ErrorIs(t, err, iso8583util.ErrUnderivableMTI)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, mti)
+		})
+	}
+}
@@ -0,0 +1,72 @@
+// Package iso8583util provides helpers for building ISO 8583 messages
+// handled by connection package.
+package iso8583util
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/moov-io/iso8583"
+)
+
+// ErrUnderivableMTI is returned when response MTI can't be derived from
+// the request MTI, e.g. when the request is a response itself
+var ErrUnderivableMTI = errors.New("response MTI can't be derived")
+
+// NewResponseFrom returns the response to req packed with the spec of req.
+// Its MTI is derived with ResponseMTI and fields copyFields that are set in
+// req are copied into it as is. Fields that are not set in req are
+// skipped.
+func NewResponseFrom(req *iso8583.Message, copyFields []int) (*iso8583.Message, error) {
+	return VersionAuto.NewResponseFrom(req, copyFields)
+}
+
+// NewResponseFrom is NewResponseFrom function with the response MTI
+// derived following the conventions of the version
+func (v Version) NewResponseFrom(req *iso8583.Message, copyFields []int) (*iso8583.Message, error) {
+	mti, err := req.GetMTI()
+	if err != nil {
+		return nil, fmt.Errorf("getting MTI: %w", err)
+	}
+
+	responseMTI, err := v.ResponseMTI(mti)
+	if err != nil {
+		return nil, err
+	}
+
+	response := iso8583.NewMessage(req.GetSpec())
+	response.MTI(responseMTI)
+
+	set := req.GetFields()
+	for _, id := range copyFields {
+		// MTI and bitmap are not copied
+		if id < 2 {
+			continue
+		}
+
+		if _, found := set[id]; !found {
+			continue
+		}
+
+		value, err := req.GetBytes(id)
+		if err != nil {
+			return nil, fmt.Errorf("getting field %d: %w", id, err)
+		}
+
+		if err := response.BinaryField(id, value); err != nil {
+			return nil, fmt.Errorf("setting field %d: %w", id, err)
+		}
+	}
+
+	return response, nil
+}
+
+// ResponseMTI returns the response MTI of the request MTI: request (xx0x),
+// advice (xx2x), notification (xx4x) and instruction (xx6x) messages are
+// responded with xx1x, xx3x, xx5x and xx7x messages. Instructions are
+// defined by ISO 8583:2003 only, and the version is detected from the first
+// digit of the MTI. Repeat origin of the request, e.g. 0221, is not kept,
+// so both 0220 and 0221 are responded with 0230.
+func ResponseMTI(mti string) (string, error) {
+	return VersionAuto.ResponseMTI(mti)
+}
@@ -0,0 +1,98 @@
+package iso8583util_test
+
+import (
+	"testing"
+
+	"github.com/moov-io/iso8583"
+	"github.com/moov-io/iso8583-connection/iso8583util"
+	"github.com/moov-io/iso8583/specs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseMTI(t *testing.T) {
+	tests := []struct {
+		mti      string
+		expected string
+		err      bool
+	}{
+		{mti: "0100", expected: "0110"},
+		{mti: "0200", expected: "0210"},
+		{mti: "0201", expected: "0210"},
+		{mti: "0220", expected: "0230"},
+		{mti: "0221", expected: "0230"},
+		{mti: "0420", expected: "0430"},
+		{mti: "0421", expected: "0430"},
+		{mti: "0800", expected: "0810"},
+		{mti: "0820", expected: "0830"},
+		{mti: "1604", expected: "1614"},
+		{mti: "1804", expected: "1814"},
+		{mti: "1420", expected: "1430"},
+		{mti: "2100", expected: "2110"},
+		{mti: "2160", expected: "2170"},
+		{mti: "0160", err: true},
+		{mti: "1814", err: true},
+		{mti: "2170", err: true},
+		{mti: "0110", err: true},
+		{mti: "0810", err: true},
+		{mti: "0280", err: true},
+		{mti: "0206", err: true},
+		{mti: "080", err: true},
+		{mti: "08a0", err: true},
+		{mti: "", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mti, func(t *testing.T) {
+			mti, err := iso8583util.ResponseMTI(tt.mti)
+			if tt.err {
+				require.ErrorIs(t, err, iso8583util.ErrUnderivableMTI)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, mti)
+		})
+	}
+}
+
+func TestNewResponseFrom(t *testing.T) {
+	t.Run("copies set fields", func(t *testing.T) {
+		req := iso8583.NewMessage(specs.Spec87ASCII)
+		req.MTI("0200")
+		require.NoError(t, req.Field(2, "4242424242424242"))
+		require.NoError(t, req.Field(4, "100"))
+		require.NoError(t, req.Field(11, "123456"))
+
+		response, err := iso8583util.NewResponseFrom(req, []int{0, 1, 2, 11, 37})
+		require.NoError(t, err)
+
+		mti, err := response.GetMTI()
+		require.NoError(t, err)
+		require.Equal(t, "0210", mti)
+
+		fields := response.GetFields()
+		require.Len(t, fields, 3)
+		require.Contains(t, fields, 2)
+		require.Contains(t, fields, 11)
+
+		pan, err := response.GetString(2)
+		require.NoError(t, err)
+		require.Equal(t, "4242424242424242", pan)
+
+		stan, err := response.GetString(11)
+		require.NoError(t, err)
+		require.Equal(t, "123456", stan)
+
+		// response can be packed with the spec of the request
+		_, err = response.Pack()
+		require.NoError(t, err)
+	})
+
+	t.Run("returns error for response MTI", func(t *testing.T) {
+		req := iso8583.NewMessage(specs.Spec87ASCII)
+		req.MTI("0210")
+
+		_, err := iso8583util.NewResponseFrom(req, []int{11})
+		require.ErrorIs(t, err, iso8583util.ErrUnderivableMTI)
+	})
+}
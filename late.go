@@ -0,0 +1,112 @@
+package connection
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/moov-io/iso8583"
+)
+
+// lateRequest is the timed out request which response may still be
+// delivered to LateResponseHandler during LateResponseGrace
+type lateRequest struct {
+	original *iso8583.Message
+
+	// context of the SendCtx call of the request
+	ctx context.Context
+
+	// reversal of the request sent when grace period passes without
+	// the response
+	reversal *iso8583.Message
+}
+
+// lateRequests keeps timed out requests during LateResponseGrace
+type lateRequests struct {
+	mu       sync.Mutex
+	requests map[string]*lateRequest
+}
+
+func newLateRequests() *lateRequests {
+	return &lateRequests{
+		requests: make(map[string]*lateRequest),
+	}
+}
+
+// add registers timed out request
+func (l *lateRequests) add(reqID string, req *lateRequest) {
+	l.mu.Lock()
+	l.requests[reqID] = req
+	l.mu.Unlock()
+}
+
+// remove removes request with reqID and returns it if it was registered
+func (l *lateRequests) remove(reqID string) (*lateRequest, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	req, found := l.requests[reqID]
+	delete(l.requests, reqID)
+
+	return req, found
+}
+
+// removeRequest removes request only if it's still registered with reqID
+// and reports whether it was removed
+func (l *lateRequests) removeRequest(reqID string, req *lateRequest) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.requests[reqID] != req {
+		return false
+	}
+	delete(l.requests, reqID)
+
+	return true
+}
+
+// handleTimeout reverses the timed out request. When LateResponseGrace is
+// set, the request waits for the late response first and it's reversed
+// only if response was not received during the grace period.
+func (c *Connection) handleTimeout(ctx context.Context, original *iso8583.Message, reqID string) {
+	reversal := c.buildReversal(original)
+
+	if c.options().LateResponseGrace <= 0 || c.options().LateResponseHandler == nil {
+		if reversal != nil {
+			c.reverse(original, reqID, reversal)
+		}
+		return
+	}
+
+	late := &lateRequest{
+		original: original,
+		ctx:      ctx,
+		reversal: reversal,
+	}
+	c.lateRequests.add(reqID, late)
+
+	c.timeouts.afterFunc(c.options().LateResponseGrace, func() {
+		if c.lateRequests.removeRequest(reqID, late) && late.reversal != nil {
+			c.reverse(late.original, reqID, late.reversal)
+		}
+	})
+}
+
+// deliverLate passes response received during LateResponseGrace to
+// LateResponseHandler and reports whether it was delivered
+func (c *Connection) deliverLate(reqID string, message *iso8583.Message, inbound chan inboundJob) bool {
+	late, found := c.lateRequests.remove(reqID)
+	if !found {
+		return false
+	}
+
+	atomic.AddUint64(&c.lateResponses, 1)
+
+	c.runInbound(inbound, message, func() {
+		defer c.requestContexts.acquire(late.ctx, message)()
+		c.options().LateResponseHandler(reqID, message)
+		c.releaseInbound(message)
+	})
+
+	return true
+}
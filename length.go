@@ -0,0 +1,125 @@
+package connection
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/moov-io/iso8583/network"
+)
+
+// maximum lengths the headers of the length helpers can encode
+const (
+	ASCII4BytesMaxLength  = 9999
+	Binary2BytesMaxLength = math.MaxUint16
+)
+
+// MessageTooLongError is returned by Send and Reply when the packed
+// message is longer than the length header can encode. Message is not
+// written to the connection.
+type MessageTooLongError struct {
+	// Length is the length of the packed message with TPDU
+	Length int
+
+	// Max is the maximum length the header can encode
+	Max int
+}
+
+func (e *MessageTooLongError) Error() string {
+	return fmt.Sprintf("%v: length %d exceeds max length %d", ErrMessageTooLong, e.Length, e.Max)
+}
+
+func (e *MessageTooLongError) Unwrap() error {
+	return ErrMessageTooLong
+}
+
+// ReadASCII4BytesLength is MessageLengthReader of 4 digits ASCII length
+// header, e.g. "0123"
+func ReadASCII4BytesLength(r io.Reader) (int, error) {
+	header := network.NewASCII4BytesHeader()
+	if _, err := header.ReadFrom(r); err != nil {
+		return 0, err
+	}
+
+	return header.Length(), nil
+}
+
+// WriteASCII4BytesLength is MessageLengthWriter of 4 digits ASCII length
+// header. It fails with MessageTooLongError when length exceeds
+// ASCII4BytesMaxLength.
+func WriteASCII4BytesLength(w io.Writer, length int) (int, error) {
+	if length > ASCII4BytesMaxLength {
+		return 0, &MessageTooLongError{Length: length, Max: ASCII4BytesMaxLength}
+	}
+
+	header := network.NewASCII4BytesHeader()
+	header.SetLength(length)
+
+	return header.WriteTo(w)
+}
+
+// ReadBinary2BytesLength is MessageLengthReader of 2 bytes big-endian
+// length header
+func ReadBinary2BytesLength(r io.Reader) (int, error) {
+	header := network.NewBinary2BytesHeader()
+	if _, err := header.ReadFrom(r); err != nil {
+		return 0, err
+	}
+
+	return header.Length(), nil
+}
+
+// WriteBinary2BytesLength is MessageLengthWriter of 2 bytes big-endian
+// length header. It fails with MessageTooLongError when length exceeds
+// Binary2BytesMaxLength.
+func WriteBinary2BytesLength(w io.Writer, length int) (int, error) {
+	if length > Binary2BytesMaxLength {
+		return 0, &MessageTooLongError{Length: length, Max: Binary2BytesMaxLength}
+	}
+
+	header := network.NewBinary2BytesHeader()
+	if err := header.SetLength(length); err != nil {
+		return 0, err
+	}
+
+	return header.WriteTo(w)
+}
+
+// ReadEBCDIC4BytesLength is MessageLengthReader of 4 digits length header
+// in EBCDIC, e.g. F0F1F2F3 for 123
+func ReadEBCDIC4BytesLength(r io.Reader) (int, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, err
+	}
+
+	length, err := strconv.Atoi(string(EBCDIC1047.Decode(header)))
+	if err != nil || length < 0 {
+		return 0, fmt.Errorf("invalid EBCDIC length header %X", header)
+	}
+
+	return length, nil
+}
+
+// WriteEBCDIC4BytesLength is MessageLengthWriter of 4 digits length header
+// in EBCDIC. It fails with MessageTooLongError when length exceeds
+// ASCII4BytesMaxLength.
+func WriteEBCDIC4BytesLength(w io.Writer, length int) (int, error) {
+	if length > ASCII4BytesMaxLength {
+		return 0, &MessageTooLongError{Length: length, Max: ASCII4BytesMaxLength}
+	}
+
+	return w.Write(EBCDIC1047.Encode([]byte(fmt.Sprintf("%04d", length))))
+}
+
+// checkEncodableLength returns MessageTooLongError when length exceeds
+// MaxEncodableLength
+func (c *Connection) checkEncodableLength(length int) error {
+	max := c.options().MaxEncodableLength
+	if max > 0 && length > max {
+		return &MessageTooLongError{Length: length, Max: max}
+	}
+
+	return nil
+}
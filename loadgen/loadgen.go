@@ -0,0 +1,174 @@
+// Package loadgen sends messages with the connection or the pool at the
+// target rate and reports latency, timeouts and errors, e.g. to check
+// whether the link sustains the required TPS.
+package loadgen
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+)
+
+// Generator sends the load with the Target
+type Generator struct {
+	Target Target
+	Opts   Options
+}
+
+// New creates Generator which sends messages with target. TPS, Duration
+// and Template options are required.
+func New(target Target, options ...Option) (*Generator, error) {
+	opts := GetDefaultOptions()
+	for _, opt := range options {
+		if err := opt(&opts); err != nil {
+			return nil, fmt.Errorf("setting load generator option: %w", err)
+		}
+	}
+
+	if target.Send == nil {
+		return nil, fmt.Errorf("target send should not be nil")
+	}
+
+	if opts.TPS == 0 || opts.Duration == 0 || opts.Template == nil {
+		return nil, fmt.Errorf("tps, duration and template should be set")
+	}
+
+	if opts.MaxInFlight == 0 {
+		opts.MaxInFlight = opts.TPS
+	}
+
+	return &Generator{
+		Target: target,
+		Opts:   opts,
+	}, nil
+}
+
+// Run sends messages at TPS rate for Duration and returns the report when
+// responses of all sent messages are received or failed. When ctx is
+// done, no more messages are sent and the report of the messages sent so
+// far is returned. It returns error if message can't be built from the
+// template.
+func (g *Generator) Run(ctx context.Context) (*Report, error) {
+	clock := g.Opts.Clock
+	interval := time.Second / time.Duration(g.Opts.TPS)
+	recorder := newRecorder(g.Opts.LatencyBuckets)
+
+	var before connection.Stats
+	if g.Target.Stats != nil {
+		before = g.Target.Stats()
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, g.Opts.MaxInFlight)
+
+	started := clock.Now()
+	var err error
+	for seq := 0; ; seq++ {
+		// messages are paced by their schedule, so slow sends don't
+		// lower the rate
+		offset := time.Duration(seq) * interval
+		if offset >= g.Opts.Duration || !g.waitUntil(ctx, started.Add(offset)) {
+			break
+		}
+
+		var message *iso8583.Message
+		message, err = g.message(seq)
+		if err != nil {
+			break
+		}
+
+		select {
+		case slots <- struct{}{}:
+		default:
+			recorder.skip()
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			sent := clock.Now()
+			_, err := g.Target.Send(ctx, message)
+			recorder.record(clock.Now().Sub(sent), err)
+		}()
+	}
+
+	wg.Wait()
+
+	if err != nil {
+		return nil, err
+	}
+
+	report := recorder.report()
+	report.TargetTPS = g.Opts.TPS
+	report.Elapsed = clock.Now().Sub(started)
+
+	if g.Target.Stats != nil {
+		report.Stats = statsDiff(before, g.Target.Stats())
+	}
+
+	return report, nil
+}
+
+// waitUntil waits for the time at. It returns false if ctx is done
+// before.
+func (g *Generator) waitUntil(ctx context.Context, at time.Time) bool {
+	wait := at.Sub(g.Opts.Clock.Now())
+	if wait <= 0 {
+		return ctx.Err() == nil
+	}
+
+	timer := g.Opts.Clock.NewTimer(wait)
+	select {
+	case <-timer.C():
+		return true
+	case <-ctx.Done():
+		timer.Stop()
+		return false
+	}
+}
+
+// message builds the message with sequence number seq from the template
+func (g *Generator) message(seq int) (*iso8583.Message, error) {
+	message, err := g.Opts.Template.Clone()
+	if err != nil {
+		return nil, fmt.Errorf("cloning template: %w", err)
+	}
+
+	for _, mutate := range g.Opts.Mutators {
+		if err := mutate(message, seq); err != nil {
+			return nil, fmt.Errorf("mutating message %d: %w", seq, err)
+		}
+	}
+
+	return message, nil
+}
+
+// statsDiff returns counters of after increased since before and gauges
+// of after
+func statsDiff(before, after connection.Stats) connection.Stats {
+	return connection.Stats{
+		PendingRequests:         after.PendingRequests,
+		OutgoingQueueDepth:      after.OutgoingQueueDepth,
+		InboundQueueDepth:       after.InboundQueueDepth,
+		STANSkips:               after.STANSkips - before.STANSkips,
+		MACVerificationFailures: after.MACVerificationFailures - before.MACVerificationFailures,
+		LateResponses:           after.LateResponses - before.LateResponses,
+		UnmatchedResponses:      after.UnmatchedResponses - before.UnmatchedResponses,
+		InboundDropped:          after.InboundDropped - before.InboundDropped,
+		MessagesReceived:        after.MessagesReceived - before.MessagesReceived,
+		MessagesSent:            after.MessagesSent - before.MessagesSent,
+		SendTimeouts:            after.SendTimeouts - before.SendTimeouts,
+		Reconnects:              after.Reconnects - before.Reconnects,
+		DeduplicatedSends:       after.DeduplicatedSends - before.DeduplicatedSends,
+		CorrelationIDMismatches: after.CorrelationIDMismatches - before.CorrelationIDMismatches,
+		UnpackErrors:            after.UnpackErrors - before.UnpackErrors,
+		FrameIntegrityFailures:  after.FrameIntegrityFailures - before.FrameIntegrityFailures,
+	}
+}
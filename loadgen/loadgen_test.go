@@ -0,0 +1,175 @@
+package loadgen_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/moov-io/iso8583-connection/iso8583util"
+	"github.com/moov-io/iso8583-connection/loadgen"
+	"github.com/moov-io/iso8583-connection/pool"
+	"github.com/moov-io/iso8583-connection/server"
+	"github.com/moov-io/iso8583/network"
+	"github.com/moov-io/iso8583/specs"
+	"github.com/stretchr/testify/require"
+)
+
+var testSpec = specs.Spec87ASCII
+
+func readMessageLength(r io.Reader) (int, error) {
+	header := network.NewBinary2BytesHeader()
+	n, err := header.ReadFrom(r)
+	if err != nil {
+		return n, err
+	}
+
+	return header.Length(), nil
+}
+
+func writeMessageLength(w io.Writer, length int) (int, error) {
+	header := network.NewBinary2BytesHeader()
+	header.SetLength(length)
+
+	n, err := header.WriteTo(w)
+	if err != nil {
+		return n, fmt.Errorf("writing message header: %w", err)
+	}
+
+	return n, nil
+}
+
+// startServer starts the server which doesn't reply to messages with STAN
+// divisible by noReplyEvery. Server is closed when the test finishes.
+func startServer(t *testing.T, noReplyEvery int) string {
+	t.Helper()
+
+	srv := server.New(testSpec, readMessageLength, writeMessageLength,
+		connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+			stan, err := message.GetString(11)
+			if err != nil {
+				return
+			}
+
+			n, err := strconv.Atoi(stan)
+			if err != nil || n%noReplyEvery == 0 {
+				return
+			}
+
+			response, err := iso8583util.NewResponseFrom(message, []int{11})
+			if err != nil {
+				return
+			}
+			c.Reply(response)
+		}),
+	)
+	require.NoError(t, srv.Start("127.0.0.1:"))
+	t.Cleanup(srv.Close)
+
+	return srv.Addr
+}
+
+func template() *iso8583.Message {
+	message := iso8583.NewMessage(testSpec)
+	message.MTI("0800")
+
+	return message
+}
+
+func TestGenerator_Run(t *testing.T) {
+	t.Run("reports latency and timeouts of the connection", func(t *testing.T) {
+		addr := startServer(t, 10)
+
+		c, err := connection.New(addr, testSpec, readMessageLength, writeMessageLength,
+			connection.SendTimeout(200*time.Millisecond),
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.Connect())
+		defer c.Close()
+
+		g, err := loadgen.New(loadgen.Connection(c),
+			loadgen.TPS(50),
+			loadgen.Duration(400*time.Millisecond),
+			loadgen.Template(template(), loadgen.RotateSTAN()),
+		)
+		require.NoError(t, err)
+
+		report, err := g.Run(context.Background())
+		require.NoError(t, err)
+
+		// STANs 000001-000020, 000010 and 000020 get no response
+		require.Equal(t, 20, report.Sent)
+		require.Equal(t, 18, report.Succeeded)
+		require.Equal(t, 2, report.TimedOut)
+		require.Zero(t, report.Failed)
+		require.Zero(t, report.Skipped)
+		require.Empty(t, report.Errors)
+
+		require.Positive(t, report.Latency.Min)
+		require.LessOrEqual(t, report.Latency.Min, report.Latency.P50)
+		require.LessOrEqual(t, report.Latency.P50, report.Latency.P99)
+		require.LessOrEqual(t, report.Latency.P99, report.Latency.Max)
+		require.Less(t, report.Latency.Max, 200*time.Millisecond)
+		require.Equal(t, report.Latency.P99, report.Percentile(99))
+
+		var counted int
+		for _, bucket := range report.Histogram {
+			counted += bucket.Count
+		}
+		require.Equal(t, report.Succeeded, counted)
+
+		// last messages are sent after 380ms and timed out one waits
+		// for 200ms more
+		require.GreaterOrEqual(t, report.Elapsed, 500*time.Millisecond)
+		require.Greater(t, report.Throughput(), 0.0)
+
+		require.Equal(t, uint64(20), report.Stats.MessagesSent)
+		require.Equal(t, uint64(18), report.Stats.MessagesReceived)
+		require.Equal(t, uint64(2), report.Stats.SendTimeouts)
+
+		summary := report.String()
+		require.Contains(t, summary, "20 sent, 18 succeeded, 2 timed out, 0 failed, 0 skipped")
+		require.Contains(t, summary, "target 50")
+		require.Contains(t, summary, "p99")
+	})
+
+	t.Run("skips messages when too many are in flight", func(t *testing.T) {
+		addr := startServer(t, 1)
+
+		p, err := pool.New(func(addr string) (*connection.Connection, error) {
+			return connection.New(addr, testSpec, readMessageLength, writeMessageLength,
+				connection.SendTimeout(300*time.Millisecond),
+			)
+		}, []string{addr})
+		require.NoError(t, err)
+		require.NoError(t, p.Connect())
+		defer p.Close()
+
+		g, err := loadgen.New(loadgen.Pool(p),
+			loadgen.TPS(20),
+			loadgen.Duration(200*time.Millisecond),
+			loadgen.Template(template(), loadgen.RotateSTAN()),
+			loadgen.MaxInFlight(2),
+		)
+		require.NoError(t, err)
+
+		report, err := g.Run(context.Background())
+		require.NoError(t, err)
+
+		require.Equal(t, 2, report.Sent)
+		require.Equal(t, 2, report.TimedOut)
+		require.Equal(t, 2, report.Skipped)
+		require.Equal(t, uint64(2), report.Stats.SendTimeouts)
+	})
+
+	t.Run("requires TPS, duration and template", func(t *testing.T) {
+		_, err := loadgen.New(loadgen.Target{Send: func(ctx context.Context, message *iso8583.Message) (*iso8583.Message, error) {
+			return message, nil
+		}}, loadgen.TPS(10))
+		require.Error(t, err)
+	})
+}
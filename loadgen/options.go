@@ -0,0 +1,149 @@
+package loadgen
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+)
+
+// Mutator changes the message built from the template before it's sent,
+// e.g. sets unique STAN. seq is the sequence number of the message
+// starting from 0.
+type Mutator func(message *iso8583.Message, seq int) error
+
+// DefaultLatencyBuckets are the upper bounds of the latency histogram
+var DefaultLatencyBuckets = []time.Duration{
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2 * time.Second,
+	5 * time.Second,
+}
+
+type Options struct {
+	// TPS is the number of messages sent per second
+	TPS int
+
+	// Duration is the time messages are sent for. Run waits for the
+	// responses of the messages sent before it returns.
+	Duration time.Duration
+
+	// Template is the message cloned for each sent message
+	Template *iso8583.Message
+
+	// Mutators are applied to each clone of the Template in order
+	Mutators []Mutator
+
+	// MaxInFlight is the number of messages waiting for the response
+	// after which the following messages are skipped instead of sent, so
+	// the target that can't sustain TPS is visible in the report. Default
+	// is TPS.
+	MaxInFlight int
+
+	// LatencyBuckets are the upper bounds of the latency histogram in
+	// increasing order. Default is DefaultLatencyBuckets.
+	LatencyBuckets []time.Duration
+
+	// Clock is used to pace the messages and to measure latency. Default
+	// is the clock of connection.GetDefaultOptions.
+	Clock connection.Clock
+}
+
+type Option func(*Options) error
+
+// GetDefaultOptions returns default options
+func GetDefaultOptions() Options {
+	return Options{
+		LatencyBuckets: DefaultLatencyBuckets,
+		Clock:          connection.GetDefaultOptions().Clock,
+	}
+}
+
+// TPS sets a TPS option
+func TPS(n int) Option {
+	return func(o *Options) error {
+		if n <= 0 {
+			return fmt.Errorf("tps should be positive, got %d", n)
+		}
+		o.TPS = n
+		return nil
+	}
+}
+
+// Duration sets a Duration option
+func Duration(d time.Duration) Option {
+	return func(o *Options) error {
+		if d <= 0 {
+			return fmt.Errorf("duration should be positive, got %v", d)
+		}
+		o.Duration = d
+		return nil
+	}
+}
+
+// Template sets Template and Mutators options
+func Template(message *iso8583.Message, mutators ...Mutator) Option {
+	return func(o *Options) error {
+		if message == nil {
+			return fmt.Errorf("template should not be nil")
+		}
+		o.Template = message
+		o.Mutators = mutators
+		return nil
+	}
+}
+
+// MaxInFlight sets a MaxInFlight option
+func MaxInFlight(n int) Option {
+	return func(o *Options) error {
+		if n <= 0 {
+			return fmt.Errorf("max in flight should be positive, got %d", n)
+		}
+		o.MaxInFlight = n
+		return nil
+	}
+}
+
+// LatencyBuckets sets a LatencyBuckets option
+func LatencyBuckets(buckets ...time.Duration) Option {
+	return func(o *Options) error {
+		if len(buckets) == 0 {
+			return fmt.Errorf("latency buckets should not be empty")
+		}
+		for i := 1; i < len(buckets); i++ {
+			if buckets[i] <= buckets[i-1] {
+				return fmt.Errorf("latency buckets should be increasing, got %v after %v", buckets[i], buckets[i-1])
+			}
+		}
+		o.LatencyBuckets = buckets
+		return nil
+	}
+}
+
+// WithClock sets a Clock option
+func WithClock(clock connection.Clock) Option {
+	return func(o *Options) error {
+		if clock == nil {
+			return fmt.Errorf("clock should not be nil")
+		}
+		o.Clock = clock
+		return nil
+	}
+}
+
+// RotateSTAN returns Mutator which sets field 11 to the STAN from 000001
+// to 999999 and then again from 000001
+func RotateSTAN() Mutator {
+	return func(message *iso8583.Message, seq int) error {
+		return message.Field(11, fmt.Sprintf("%06d", seq%999999+1))
+	}
+}
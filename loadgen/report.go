@@ -0,0 +1,230 @@
+package loadgen
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	connection "github.com/moov-io/iso8583-connection"
+)
+
+// Report contains results of the run
+type Report struct {
+	// TargetTPS is the rate messages were sent at
+	TargetTPS int
+
+	// Elapsed is the time from the first message till the last response
+	Elapsed time.Duration
+
+	// Sent is the number of messages sent
+	Sent int
+
+	// Succeeded is the number of messages that got the response
+	Succeeded int
+
+	// TimedOut is the number of messages that failed with
+	// connection.ErrSendTimeout
+	TimedOut int
+
+	// Failed is the number of messages that failed with other errors
+	Failed int
+
+	// Skipped is the number of messages not sent because MaxInFlight
+	// messages were waiting for the response
+	Skipped int
+
+	// Errors are the numbers of Failed messages by the error text
+	Errors map[string]int
+
+	// Latency summarizes the time messages that succeeded waited for the
+	// response
+	Latency Latency
+
+	// Histogram is the latency histogram of the messages that succeeded
+	Histogram []Bucket
+
+	// Stats are the counters of the target increased during the run,
+	// e.g. UnmatchedResponses, and its gauges at the end of the run
+	Stats connection.Stats
+
+	// latencies of the messages that succeeded in increasing order
+	latencies []time.Duration
+}
+
+// Latency summarizes latency of the messages
+type Latency struct {
+	Min  time.Duration
+	Mean time.Duration
+	P50  time.Duration
+	P90  time.Duration
+	P99  time.Duration
+	Max  time.Duration
+}
+
+// Bucket is the bucket of the latency histogram
+type Bucket struct {
+	// UpperBound is the maximum latency counted in the bucket. It's
+	// math.MaxInt64 for the last bucket.
+	UpperBound time.Duration
+
+	// Count is the number of messages with latency above the bound of
+	// the previous bucket and up to UpperBound
+	Count int
+}
+
+// Throughput returns the number of messages that succeeded per second
+func (r *Report) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+
+	return float64(r.Succeeded) / r.Elapsed.Seconds()
+}
+
+// Percentile returns latency p percent of succeeded messages didn't
+// exceed, e.g. Percentile(99) is the p99 latency
+func (r *Report) Percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+
+	// nearest rank
+	rank := int(math.Ceil(p / 100 * float64(len(r.latencies))))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(r.latencies) {
+		rank = len(r.latencies)
+	}
+
+	return r.latencies[rank-1]
+}
+
+// String returns the text summary of the report
+func (r *Report) String() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "requests:   %d sent, %d succeeded, %d timed out, %d failed, %d skipped\n",
+		r.Sent, r.Succeeded, r.TimedOut, r.Failed, r.Skipped)
+	fmt.Fprintf(&b, "throughput: %.1f TPS (target %d) in %v\n", r.Throughput(), r.TargetTPS, r.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(&b, "latency:    min %v, mean %v, p50 %v, p90 %v, p99 %v, max %v\n",
+		r.Latency.Min, r.Latency.Mean, r.Latency.P50, r.Latency.P90, r.Latency.P99, r.Latency.Max)
+
+	b.WriteString("histogram:\n")
+	for i, bucket := range r.Histogram {
+		if bucket.UpperBound == math.MaxInt64 {
+			fmt.Fprintf(&b, "  > %-9v %d\n", r.Histogram[i-1].UpperBound, bucket.Count)
+			continue
+		}
+		fmt.Fprintf(&b, "  <= %-8v %d\n", bucket.UpperBound, bucket.Count)
+	}
+
+	if len(r.Errors) > 0 {
+		texts := make([]string, 0, len(r.Errors))
+		for text := range r.Errors {
+			texts = append(texts, text)
+		}
+		sort.Strings(texts)
+
+		b.WriteString("errors:\n")
+		for _, text := range texts {
+			fmt.Fprintf(&b, "  %d  %s\n", r.Errors[text], text)
+		}
+	}
+
+	return b.String()
+}
+
+// recorder collects results of the sent messages
+type recorder struct {
+	mu        sync.Mutex
+	buckets   []time.Duration
+	skipped   int
+	timedOut  int
+	errors    map[string]int
+	latencies []time.Duration
+}
+
+func newRecorder(buckets []time.Duration) *recorder {
+	return &recorder{
+		buckets: buckets,
+		errors:  make(map[string]int),
+	}
+}
+
+func (r *recorder) skip() {
+	r.mu.Lock()
+	r.skipped++
+	r.mu.Unlock()
+}
+
+func (r *recorder) record(latency time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch {
+	case err == nil:
+		r.latencies = append(r.latencies, latency)
+	case errors.Is(err, connection.ErrSendTimeout):
+		r.timedOut++
+	default:
+		r.errors[err.Error()]++
+	}
+}
+
+func (r *recorder) report() *Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	latencies := append([]time.Duration(nil), r.latencies...)
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+
+	report := &Report{
+		Succeeded: len(latencies),
+		TimedOut:  r.timedOut,
+		Skipped:   r.skipped,
+		Errors:    make(map[string]int, len(r.errors)),
+		latencies: latencies,
+	}
+
+	for text, n := range r.errors {
+		report.Errors[text] = n
+		report.Failed += n
+	}
+	report.Sent = report.Succeeded + report.TimedOut + report.Failed
+
+	report.Histogram = make([]Bucket, len(r.buckets)+1)
+	for i, bound := range r.buckets {
+		report.Histogram[i].UpperBound = bound
+	}
+	report.Histogram[len(r.buckets)].UpperBound = math.MaxInt64
+
+	var total time.Duration
+	for _, latency := range latencies {
+		total += latency
+
+		i := sort.Search(len(r.buckets), func(i int) bool {
+			return latency <= r.buckets[i]
+		})
+		report.Histogram[i].Count++
+	}
+
+	if len(latencies) > 0 {
+		report.Latency = Latency{
+			Min:  latencies[0],
+			Mean: total / time.Duration(len(latencies)),
+			P50:  report.Percentile(50),
+			P90:  report.Percentile(90),
+			P99:  report.Percentile(99),
+			Max:  latencies[len(latencies)-1],
+		}
+	}
+
+	return report
+}
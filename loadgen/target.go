@@ -0,0 +1,43 @@
+package loadgen
+
+import (
+	"context"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/moov-io/iso8583-connection/pool"
+)
+
+// Target is the client the load is sent with
+type Target struct {
+	// Send sends the message and waits for the response
+	Send func(ctx context.Context, message *iso8583.Message) (*iso8583.Message, error)
+
+	// Stats returns stats of the client. Counters of the run are
+	// included in the report when it's set.
+	Stats func() connection.Stats
+}
+
+// Connection returns Target which sends messages with c
+func Connection(c *connection.Connection) Target {
+	return Target{
+		Send: func(ctx context.Context, message *iso8583.Message) (*iso8583.Message, error) {
+			return c.SendCtx(ctx, message)
+		},
+		Stats: c.Stats,
+	}
+}
+
+// Pool returns Target which sends messages with p. Messages sent by the
+// pool can't be cancelled, so Run waits for them up to SendTimeout of the
+// connections when its context is done.
+func Pool(p *pool.Pool) Target {
+	return Target{
+		Send: func(ctx context.Context, message *iso8583.Message) (*iso8583.Message, error) {
+			return p.Send(message)
+		},
+		Stats: func() connection.Stats {
+			return p.Stats().Stats
+		},
+	}
+}
@@ -0,0 +1,126 @@
+package connection
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/moov-io/iso8583"
+)
+
+var (
+	// ErrMACGeneration is returned when MACGenerator fails
+	ErrMACGeneration = errors.New("generating MAC")
+
+	// ErrMACVerification is returned by Send when MACVerifier rejects
+	// the response
+	ErrMACVerification = errors.New("verifying MAC")
+)
+
+// MACGeneratorFunc returns MAC computed over the packed message without
+// the MAC field
+type MACGeneratorFunc func(packedWithoutMAC []byte, message *iso8583.Message) ([]byte, error)
+
+// MACVerifierFunc verifies MAC of the inbound message
+type MACVerifierFunc func(packed []byte, message *iso8583.Message) error
+
+// MACVerificationError is returned by Send and reported to ErrorHandler
+// when MACVerifier rejects inbound message
+type MACVerificationError struct {
+	Err error
+
+	// RawMessage is the packed message
+	RawMessage []byte
+}
+
+func (e *MACVerificationError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrMACVerification, e.Err)
+}
+
+func (e *MACVerificationError) Unwrap() error {
+	return e.Err
+}
+
+func (e *MACVerificationError) Is(target error) bool {
+	return target == ErrMACVerification
+}
+
+// verifyMAC runs MACVerifier for the inbound message. When MAC is invalid,
+// the pending request the message replies to fails with the error, which
+// is also reported to ErrorHandler.
+func (c *Connection) verifyMAC(packed []byte, message *iso8583.Message) error {
+	err := c.options().MACVerifier(packed, message)
+	if err == nil {
+		return nil
+	}
+
+	atomic.AddUint64(&c.macVerificationFailures, 1)
+
+	// packed message is in the frame returned to the pool after the
+	// verification
+	macErr := &MACVerificationError{
+		Err:        err,
+		RawMessage: append([]byte(nil), packed...),
+	}
+
+	if c.isResponse(message) {
+		if reqID, err := c.requestID(message); err == nil || c.options().Matcher != nil {
+			if resp, found := c.matchResponse(reqID, message); found {
+				resp.errCh <- macErr
+			}
+		}
+	}
+
+	c.handleError(macErr)
+
+	return macErr
+}
+
+// packWithMAC packs the message with the MAC field set to the value
+// returned by MACGenerator. MAC field is the last field of the message, so
+// MAC is computed over the packed message without the bytes of the field.
+func (c *Connection) packWithMAC(message *iso8583.Message) ([]byte, error) {
+	id := c.options().MACField
+
+	f, found := message.GetSpec().Fields[id]
+	if !found {
+		return nil, fmt.Errorf("%w: field %d is not defined in the spec", ErrMACGeneration, id)
+	}
+
+	// placeholder sets the bit of the MAC field in the bitmap and lets us
+	// know the length of the packed field
+	err := message.BinaryField(id, make([]byte, f.Spec().Length))
+	if err != nil {
+		return nil, fmt.Errorf("%w: setting placeholder of field %d: %v", ErrMACGeneration, id, err)
+	}
+
+	packed, err := message.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("packing message: %w", err)
+	}
+
+	packedField, err := message.GetField(id).Pack()
+	if err != nil {
+		return nil, fmt.Errorf("%w: packing field %d: %v", ErrMACGeneration, id, err)
+	}
+
+	mac, err := c.options().MACGenerator(packed[:len(packed)-len(packedField)], message)
+	if len(c.options().ScrubFields) > 0 {
+		zeroBytes(packed)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMACGeneration, err)
+	}
+
+	err = message.BinaryField(id, mac)
+	if err != nil {
+		return nil, fmt.Errorf("%w: setting field %d: %v", ErrMACGeneration, id, err)
+	}
+
+	packed, err = message.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("packing message: %w", err)
+	}
+
+	return packed, nil
+}
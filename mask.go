@@ -0,0 +1,47 @@
+package connection
+
+import (
+	"strings"
+
+	"github.com/moov-io/iso8583"
+)
+
+// MaskValue masks the sensitive value, e.g. PAN, so it can be logged. The
+// first 6 and the last 4 characters of values longer than 10 characters
+// are kept, shorter values are masked entirely.
+func MaskValue(value string) string {
+	if len(value) <= 10 {
+		return strings.Repeat("*", len(value))
+	}
+
+	return value[:6] + strings.Repeat("*", len(value)-10) + value[len(value)-4:]
+}
+
+// MaskedFields returns string values of the fields set in the message
+// by their IDs with values of maskFields masked by MaskValue
+func MaskedFields(message *iso8583.Message, maskFields []int) map[int]string {
+	masked := make(map[int]bool, len(maskFields))
+	for _, id := range maskFields {
+		masked[id] = true
+	}
+
+	values := make(map[int]string)
+	for id, f := range message.GetFields() {
+		// MTI and bitmap are logged separately
+		if id < 2 {
+			continue
+		}
+
+		value, err := f.String()
+		if err != nil {
+			continue
+		}
+
+		if masked[id] {
+			value = MaskValue(value)
+		}
+		values[id] = value
+	}
+
+	return values
+}
@@ -0,0 +1,165 @@
+package connection
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/moov-io/iso8583"
+)
+
+// matchKeySeparator joins values of the match fields into the request ID
+const matchKeySeparator = "|"
+
+// requestID is a unique identifier for a request.  responses from the server
+// are not guaranteed to return in order so we must have an id to reference the
+// original req. built from STAN or from the fields set by MatchByField and
+// scoped by the Session the message belongs to
+func (c *Connection) requestID(message Message) (string, error) {
+	if message == nil {
+		return "", fmt.Errorf("message required")
+	}
+
+	paths := c.options().MatchFields
+	if len(paths) == 0 {
+		stan, err := message.GetString(11)
+		if err != nil {
+			return "", fmt.Errorf("getting STAN (field 11) of the message: %w", err)
+		}
+
+		if stan == "" {
+			return "", errors.New("STAN is missing")
+		}
+
+		return c.sessionRequestID(message, stan), nil
+	}
+
+	values := make([]string, len(paths))
+	for i, path := range paths {
+		value, err := matchFieldValue(message, path)
+		if err != nil {
+			return "", fmt.Errorf("getting match field %s of the message: %w", path, err)
+		}
+
+		if value == "" {
+			return "", fmt.Errorf("match field %s is missing", path)
+		}
+
+		values[i] = value
+	}
+
+	return c.sessionRequestID(message, strings.Join(values, matchKeySeparator)), nil
+}
+
+// parseFieldPath parses the field path such as 11 or 63.2 into the field
+// ID and the tags of the subfields
+func parseFieldPath(path string) (int, []string, error) {
+	parts := strings.Split(path, ".")
+
+	id, err := strconv.Atoi(parts[0])
+	if err != nil || id < 2 {
+		return 0, nil, fmt.Errorf("field path should start with a data field, got %q", path)
+	}
+
+	for _, tag := range parts[1:] {
+		if tag == "" {
+			return 0, nil, fmt.Errorf("field path should not have empty subfield tags, got %q", path)
+		}
+	}
+
+	return id, parts[1:], nil
+}
+
+// matchFieldValue returns the value of the field or subfield at path. It
+// returns an empty string when field is not set.
+func matchFieldValue(message Message, path string) (string, error) {
+	id, tags, err := parseFieldPath(path)
+	if err != nil {
+		return "", err
+	}
+
+	msg, isMessage := message.(*iso8583.Message)
+	if !isMessage {
+		if len(tags) > 0 {
+			return "", fmt.Errorf("subfields can be matched only in *iso8583.Message, got %T", message)
+		}
+
+		return message.GetString(id)
+	}
+
+	// GetFields is used as GetString would mark the field as set
+	f, set := msg.GetFields()[id]
+	if !set {
+		return "", nil
+	}
+
+	if len(tags) == 0 {
+		return f.String()
+	}
+
+	// subfields of the composite field are reached through its JSON
+	// representation as the field package doesn't export them
+	raw, err := json.Marshal(f)
+	if err != nil {
+		return "", fmt.Errorf("marshaling field %d: %w", id, err)
+	}
+
+	for _, tag := range tags {
+		var subfields map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &subfields); err != nil {
+			return "", fmt.Errorf("field %s is not a composite field", path)
+		}
+
+		raw = subfields[tag]
+		if raw == nil {
+			return "", nil
+		}
+	}
+
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		// numeric subfields are JSON numbers
+		return string(raw), nil
+	}
+
+	return value, nil
+}
+
+// setMatchFieldValue sets the field or subfield at path to value
+func setMatchFieldValue(message *iso8583.Message, path string, value string) error {
+	id, tags, err := parseFieldPath(path)
+	if err != nil {
+		return err
+	}
+
+	if len(tags) == 0 {
+		return message.Field(id, value)
+	}
+
+	// subfield is set through JSON so other subfields of the composite
+	// field are kept, e.g. {"63":{"2":"000001"}}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	err = message.UnmarshalJSON(nestFieldPath(id, tags, raw))
+	if n, convErr := strconv.Atoi(value); err != nil && convErr == nil {
+		// numeric subfields are unmarshaled from JSON numbers
+		err = message.UnmarshalJSON(nestFieldPath(id, tags, []byte(strconv.Itoa(n))))
+	}
+	if err != nil {
+		return fmt.Errorf("setting field %s: %w", path, err)
+	}
+
+	return nil
+}
+
+func nestFieldPath(id int, tags []string, raw []byte) []byte {
+	for i := len(tags) - 1; i >= 0; i-- {
+		raw = []byte(fmt.Sprintf("{%q:%s}", tags[i], raw))
+	}
+
+	return []byte(fmt.Sprintf(`{"%d":%s}`, id, raw))
+}
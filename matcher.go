@@ -0,0 +1,38 @@
+package connection
+
+import "github.com/moov-io/iso8583"
+
+// PendingRequest describes the request waiting for the response passed to
+// Matcher
+type PendingRequest struct {
+	// ID is the request ID the request is registered with
+	ID string
+
+	// Message is the request. It's nil when message sent with SendMessage
+	// is not *iso8583.Message. Matcher must not modify it.
+	Message *iso8583.Message
+
+	resp response
+}
+
+// matchResponse removes the pending request the response is the reply to.
+// Request is found by reqID unless Matcher is set.
+func (c *Connection) matchResponse(reqID string, message *iso8583.Message) (response, bool) {
+	matcher := c.options().Matcher
+	if matcher == nil {
+		return c.pendingRequests.remove(reqID)
+	}
+
+	pending := c.pendingRequests.list()
+	if len(pending) == 0 {
+		return response{}, false
+	}
+
+	matched, found := matcher(pending, message)
+	if !found || matched == nil {
+		return response{}, false
+	}
+
+	// request may have timed out or been canceled while matcher ran
+	return c.pendingRequests.take(matched.ID, matched.resp.errCh, matched.resp.gen)
+}
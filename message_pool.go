@@ -0,0 +1,93 @@
+package connection
+
+import (
+	"fmt"
+
+	"github.com/moov-io/iso8583"
+)
+
+// newMessage returns message to unpack inbound frame into. It's created
+// by MessageFactory when it's set. Otherwise, when MessagePool option is
+// set, message is taken from the pool.
+func (c *Connection) newMessage() *iso8583.Message {
+	if c.options().MessageFactory != nil {
+		return c.options().MessageFactory()
+	}
+
+	spec := c.inboundSpec()
+
+	if c.options().MessagePool {
+		if message, ok := c.messages.Get().(*iso8583.Message); ok && message.GetSpec() == spec {
+			return message
+		}
+	}
+
+	return iso8583.NewMessage(spec)
+}
+
+// unpackMessage unpacks inbound message. Fields preset by MessageFactory
+// that are not in the packed message stay set.
+func (c *Connection) unpackMessage(message *iso8583.Message, packed []byte) error {
+	if c.options().MessageFactory == nil {
+		return message.Unpack(packed)
+	}
+
+	preset := message.GetFields()
+
+	if err := message.Unpack(packed); err != nil {
+		return err
+	}
+
+	unpacked := message.GetFields()
+	for id, f := range preset {
+		if _, found := unpacked[id]; found || id < 2 {
+			continue
+		}
+
+		// Unpack doesn't change values of the fields it doesn't read
+		value, err := f.Bytes()
+		if err != nil {
+			return fmt.Errorf("getting preset field %d: %w", id, err)
+		}
+
+		if err := message.BinaryField(id, value); err != nil {
+			return fmt.Errorf("setting preset field %d: %w", id, err)
+		}
+	}
+
+	return nil
+}
+
+// ReleaseMessage returns the message received by Send to the pool when
+// MessagePool option is set, so it can be reused for the next inbound
+// message. The message must not be used after it's released. It does
+// nothing when MessagePool option is not set.
+func (c *Connection) ReleaseMessage(message *iso8583.Message) {
+	if !c.options().MessagePool || c.options().MessageFactory != nil || message == nil || message.GetSpec() != c.inboundSpec() {
+		return
+	}
+
+	// values of fields that are not set in the next message must not
+	// leak into it. Messages with fields that can't be reset are left to
+	// the garbage collector.
+	for id, f := range message.GetFields() {
+		if id == 0 || id == 1 {
+			continue
+		}
+
+		if err := f.SetBytes(nil); err != nil {
+			return
+		}
+	}
+
+	c.messages.Put(message)
+}
+
+// inboundSpec returns spec used to unpack inbound messages
+func (c *Connection) inboundSpec() *iso8583.MessageSpec {
+	if c.options().InboundSpec != nil {
+		return c.options().InboundSpec
+	}
+
+	return c.spec
+}
@@ -0,0 +1,324 @@
+package connection
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/moov-io/iso8583"
+)
+
+// MultiOption configures SendMulti
+type MultiOption func(o *multiOptions)
+
+type multiOptions struct {
+	finalMTIs    []string
+	maxResponses int
+	timeout      time.Duration
+}
+
+// FinalMTIs makes SendMulti stop waiting for responses after the response
+// with one of the MTIs, e.g. 0230 completion following 0210
+// acknowledgement
+func FinalMTIs(mtis ...string) MultiOption {
+	return func(o *multiOptions) {
+		o.finalMTIs = append([]string(nil), mtis...)
+	}
+}
+
+// MaxResponses makes SendMulti stop waiting for responses after n
+// responses
+func MaxResponses(n int) MultiOption {
+	return func(o *multiOptions) {
+		o.maxResponses = n
+	}
+}
+
+// MultiTimeout sets the time SendMulti waits for responses. By default,
+// it's SendTimeout.
+func MultiTimeout(d time.Duration) MultiOption {
+	return func(o *multiOptions) {
+		o.timeout = d
+	}
+}
+
+// SendMulti sends message and returns the channel its responses are
+// delivered to in the order they were received. Request stays registered
+// until the response with one of FinalMTIs, MaxResponses responses or
+// MultiTimeout, whichever comes first, and then the channel is closed.
+// Message is validated and its STAN, correlation ID and time fields are
+// set like for Send.
+// Channel is closed without responses when connection is closed. It
+// returns an error if message was not written. Channel should be drained,
+// as responses are kept until they are received from it.
+func (c *Connection) SendMulti(message *iso8583.Message, opts ...MultiOption) (<-chan *iso8583.Message, error) {
+	o := multiOptions{
+		timeout: c.options().SendTimeout,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	// message is prepared like the request of Send, so it's written
+	// with reply only because its responses are delivered differently
+	if err := c.checkRequest(message); err != nil {
+		return nil, c.wrapError(err)
+	}
+
+	if err := c.setRequestFields(context.Background(), message); err != nil {
+		return nil, c.wrapError(err)
+	}
+
+	reqID, err := c.requestID(message)
+	if err != nil {
+		return nil, c.wrapError(fmt.Errorf("creating request ID: %w", err))
+	}
+
+	m := newMultiRequest(o)
+
+	// request is registered before it's written so responses can't
+	// arrive before it, and before its timer is started so it can't
+	// expire before it's registered
+	if !c.multiRequests.add(reqID, m) {
+		c.multiRequests.finish(reqID, m)
+		return nil, c.wrapError(ErrMultiRequestPending)
+	}
+	c.multiRequests.startTimer(reqID, m, o.timeout)
+
+	if err := c.reply(message); err != nil {
+		c.multiRequests.finish(reqID, m)
+		return nil, c.wrapError(err)
+	}
+
+	return m.out, nil
+}
+
+// multiRequest is the request of SendMulti waiting for its responses
+type multiRequest struct {
+	opts multiOptions
+	out  chan *iso8583.Message
+
+	// to protect following: timer, queue, received, finished
+	mu sync.Mutex
+
+	// timer to finish the request after MultiTimeout, nil until it's
+	// started
+	timer *wheelTimer
+
+	queue    []*iso8583.Message
+	received int
+	finished bool
+
+	// signals forward about queued response or finish
+	ready chan struct{}
+}
+
+func newMultiRequest(opts multiOptions) *multiRequest {
+	m := &multiRequest{
+		opts:  opts,
+		out:   make(chan *iso8583.Message),
+		ready: make(chan struct{}, 1),
+	}
+
+	go m.forward()
+
+	return m
+}
+
+// push queues the response and reports whether it's the last one. It
+// returns false for queued when request was finished already.
+func (m *multiRequest) push(message *iso8583.Message) (queued, last bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.finished {
+		return false, false
+	}
+
+	m.queue = append(m.queue, message)
+	m.received++
+	m.signal()
+
+	if m.opts.maxResponses > 0 && m.received >= m.opts.maxResponses {
+		return true, true
+	}
+
+	mti, _ := message.GetMTI()
+	for _, final := range m.opts.finalMTIs {
+		if mti == final {
+			return true, true
+		}
+	}
+
+	return true, false
+}
+
+// stopTimer stops the timer of the request if it was started
+func (m *multiRequest) stopTimer(timeouts *timerWheel) {
+	m.mu.Lock()
+	timer := m.timer
+	m.mu.Unlock()
+
+	if timer != nil {
+		timeouts.stop(timer)
+	}
+}
+
+// finish makes forward close the channel once queued responses are
+// received from it
+func (m *multiRequest) finish() {
+	m.mu.Lock()
+	m.finished = true
+	m.signal()
+	m.mu.Unlock()
+}
+
+func (m *multiRequest) signal() {
+	select {
+	case m.ready <- struct{}{}:
+	default:
+	}
+}
+
+// forward sends queued responses to the channel, so the read loop isn't
+// blocked by the receiver
+func (m *multiRequest) forward() {
+	defer close(m.out)
+
+	for {
+		m.mu.Lock()
+		if len(m.queue) == 0 {
+			finished := m.finished
+			m.mu.Unlock()
+
+			if finished {
+				return
+			}
+
+			<-m.ready
+			continue
+		}
+
+		message := m.queue[0]
+		m.queue[0] = nil
+		m.queue = m.queue[1:]
+		m.mu.Unlock()
+
+		m.out <- message
+	}
+}
+
+// multiRequests keeps requests of SendMulti by the request ID
+type multiRequests struct {
+	timeouts *timerWheel
+
+	// number of requests to skip the lookup when there are none,
+	// accessed atomically
+	n int32
+
+	mu       sync.Mutex
+	requests map[string]*multiRequest
+}
+
+func newMultiRequests(timeouts *timerWheel) *multiRequests {
+	return &multiRequests{
+		timeouts: timeouts,
+		requests: make(map[string]*multiRequest),
+	}
+}
+
+// add registers the request unless request with reqID is registered
+func (r *multiRequests) add(reqID string, m *multiRequest) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, found := r.requests[reqID]; found {
+		return false
+	}
+
+	r.requests[reqID] = m
+	atomic.AddInt32(&r.n, 1)
+
+	return true
+}
+
+// startTimer finishes the request after timeout unless it's finished
+// already
+func (r *multiRequests) startTimer(reqID string, m *multiRequest, timeout time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.finished {
+		return
+	}
+
+	m.timer = r.timeouts.afterFunc(timeout, func() {
+		r.finish(reqID, m)
+	})
+}
+
+// deliver queues the response of the request with reqID and finishes the
+// request if it's the last response. It reports whether response was
+// queued.
+func (r *multiRequests) deliver(reqID string, message *iso8583.Message) bool {
+	r.mu.Lock()
+	m, found := r.requests[reqID]
+	r.mu.Unlock()
+
+	if !found {
+		return false
+	}
+
+	queued, last := m.push(message)
+	if last {
+		r.finish(reqID, m)
+	}
+
+	return queued
+}
+
+// finish removes the request if it's still registered with reqID and
+// finishes it
+func (r *multiRequests) finish(reqID string, m *multiRequest) {
+	r.mu.Lock()
+	if r.requests[reqID] == m {
+		delete(r.requests, reqID)
+		atomic.AddInt32(&r.n, -1)
+	}
+	r.mu.Unlock()
+
+	m.stopTimer(r.timeouts)
+	m.finish()
+}
+
+// finishAll finishes all requests, e.g. when connection is closed
+func (r *multiRequests) finishAll() {
+	r.mu.Lock()
+	requests := r.requests
+	r.requests = make(map[string]*multiRequest)
+	atomic.StoreInt32(&r.n, 0)
+	r.mu.Unlock()
+
+	for _, m := range requests {
+		m.stopTimer(r.timeouts)
+		m.finish()
+	}
+}
+
+// deliverMulti delivers the response to the request of SendMulti and
+// reports whether it was delivered. It's called by the read loop, so
+// responses are delivered in the order they were received.
+func (c *Connection) deliverMulti(message *iso8583.Message) bool {
+	if atomic.LoadInt32(&c.multiRequests.n) == 0 || !c.isResponse(message) {
+		return false
+	}
+
+	reqID, err := c.requestID(message)
+	if err != nil {
+		return false
+	}
+
+	return c.multiRequests.deliver(reqID, message)
+}
@@ -0,0 +1,43 @@
+package connection
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// wrapError adds Name of the connection to err, so errors of different
+// connections can be told apart. Wrapped error still matches the sentinel
+// errors with errors.Is.
+func (c *Connection) wrapError(err error) error {
+	if err == nil || c.options().Name == "" {
+		return err
+	}
+
+	return fmt.Errorf("connection %s: %w", c.options().Name, err)
+}
+
+// logPrefix returns Name and Tags of the connection formatted as
+// "[name key=value] " to prefix the log lines
+func (c *Connection) logPrefix() string {
+	if c.options().Name == "" && len(c.options().Tags) == 0 {
+		return ""
+	}
+
+	parts := make([]string, 0, len(c.options().Tags)+1)
+	if c.options().Name != "" {
+		parts = append(parts, c.options().Name)
+	}
+
+	keys := make([]string, 0, len(c.options().Tags))
+	for k := range c.options().Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		parts = append(parts, k+"="+c.options().Tags[k])
+	}
+
+	return "[" + strings.Join(parts, " ") + "] "
+}
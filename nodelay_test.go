@@ -0,0 +1,69 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package connection_test
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient_TCPNoDelay(t *testing.T) {
+	// noDelay returns TCP_NODELAY value of the socket
+	noDelay := func(t *testing.T, conn *net.TCPConn) bool {
+		rawConn, err := conn.SyscallConn()
+		require.NoError(t, err)
+
+		var value int
+		var sockErr error
+		err = rawConn.Control(func(fd uintptr) {
+			value, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+		})
+		require.NoError(t, err)
+		require.NoError(t, sockErr)
+
+		return value != 0
+	}
+
+	dial := func(t *testing.T) *net.TCPConn {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() { ln.Close() })
+
+		go func() {
+			conn, err := ln.Accept()
+			if err == nil {
+				t.Cleanup(func() { conn.Close() })
+			}
+		}()
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+
+		return conn.(*net.TCPConn)
+	}
+
+	t.Run("TCP_NODELAY is set by default", func(t *testing.T) {
+		conn := dial(t)
+
+		c, err := connection.NewFrom(conn, testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, err)
+		defer c.Close()
+
+		require.True(t, noDelay(t, conn))
+	})
+
+	t.Run("TCP_NODELAY is not set when option is false", func(t *testing.T) {
+		conn := dial(t)
+
+		c, err := connection.NewFrom(conn, testSpec, readMessageLength, writeMessageLength, connection.TCPNoDelay(false))
+		require.NoError(t, err)
+		defer c.Close()
+
+		require.False(t, noDelay(t, conn))
+	})
+}
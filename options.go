@@ -1,19 +1,49 @@
 package connection
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"time"
 
 	"github.com/moov-io/iso8583"
+	"github.com/moov-io/iso8583-connection/iso8583util"
 )
 
 type Options struct {
-	// SendTimeout sets the timeout for a Send operation
+	// SendTimeout sets the timeout for a Send operation. Timeouts of
+	// pending requests are checked every 10ms, so Send may return
+	// ErrSendTimeout up to 10ms later than SendTimeout.
 	SendTimeout time.Duration
 
+	// WriteTimeout sets the timeout for writing a message into the
+	// connection. When it's exceeded, the message fails with
+	// ErrWriteTimeout and the connection is closed. Zero means no timeout.
+	WriteTimeout time.Duration
+
+	// TCPNoDelay controls whether the operating system should delay
+	// writes to combine them into fewer packets (Nagle's algorithm). It's
+	// true by default, so each message is sent as soon as it's written,
+	// which is what latency sensitive traffic needs. As each message is
+	// written with a single write, setting it to false only lets
+	// consecutive small messages be coalesced into one packet. It's
+	// applied only to TCP connections.
+	TCPNoDelay bool
+
+	// Name identifies the connection when many of them are used. It's
+	// added to the errors returned by Connect, Send, Reply and Close and
+	// passed to ErrorHandler, and to the log lines. Handlers may read it
+	// from the Opts of the connection they are called with.
+	Name string
+
+	// Tags are key/value pairs added to the log lines together with Name,
+	// e.g. endpoint or currency of the connection
+	Tags map[string]string
+
 	// IdleTime is the period at which the client will be sending ping
 	// message to the server
 	IdleTime time.Duration
@@ -22,29 +52,574 @@ type Options struct {
 	// it should be safe for concurrent use
 	PingHandler func(c *Connection)
 
+	// PingWindow is the time since the last inbound message after which
+	// Healthy reports that ping is stale. It's used only when PingHandler
+	// is set, as responses to pings keep idle connection receiving
+	// messages. By default, it's IdleTime plus SendTimeout.
+	PingWindow time.Duration
+
+	// SaturationThreshold is the number of pending requests at which
+	// Healthy reports that connection is saturated. Zero disables the
+	// check.
+	SaturationThreshold int
+
 	// InboundMessageHandler is called when a message from the server is
 	// received and no matching request for it was found.
 	// InboundMessageHandler should be safe for concurrent use. Use it
 	// for the following use cases:
 	// * to log timed out responses
 	// * to handle network management messages (echo, heartbeat, etc.)
-	InboundMessageHandler func(c *Connection, message *iso8583.Message)
+	InboundMessageHandler InboundMessageHandlerFunc
+
+	// InboundMessageHandlers are handlers registered with
+	// InboundMessageHandlerFor by MTI prefix. Message is passed to the
+	// handler with the longest prefix of its MTI, or to
+	// InboundMessageHandler if no prefix matches. Handlers run in their
+	// own goroutines, not in the read loop.
+	InboundMessageHandlers map[string]InboundMessageHandlerFunc
+
+	// NetworkManagementHandler handles inbound network management
+	// messages (x8xx, e.g. 0800 echo or 1804 sign-on) which are not
+	// responses, following MTI conventions of MTIVersion. Handlers
+	// registered with InboundMessageHandlerFor take precedence over it,
+	// and InboundMessageHandler handles the rest of the messages.
+	NetworkManagementHandler InboundMessageHandlerFunc
 
 	// ConnectionClosedHandler is called when connection is closed by server or there
 	// were network errors during network read/write
 	ConnectionClosedHandler func(c *Connection)
 
+	// ConnectionEstablishedHandler is called when connection is
+	// established by Connect or reconnected, after TLS upgrade if it's
+	// set
+	ConnectionEstablishedHandler func(c *Connection)
+
+	// Resolver resolves host of the server address on each Connect and
+	// reconnect attempt. By default, it's net.DefaultResolver.
+	Resolver Resolver
+
+	// ResolveTimeout limits the time host resolution may take. Zero means
+	// no limit.
+	ResolveTimeout time.Duration
+
+	// DialTimeout limits the time establishing connection with each
+	// address and TLS handshake may take, so Connect and reconnect
+	// attempts to unreachable hosts fail before the OS timeout. Zero
+	// means no limit. Default is 10 seconds.
+	DialTimeout time.Duration
+
+	// SRV is the service which DNS SRV records are looked up on each
+	// Connect and reconnect attempt to discover the server targets. When
+	// it's set, address of the connection is not used. Targets are dialed
+	// in order of their priority and weight until connection is
+	// established.
+	SRV *SRVService
+
+	// SRVResolver looks up SRV records. By default, it's
+	// net.DefaultResolver.
+	SRVResolver SRVResolver
+
+	// DialAllAddresses makes Connect dial all resolved addresses of the
+	// host in order until connection is established. When it's not set,
+	// only the first address is dialed. It's set by default.
+	DialAllAddresses bool
+
+	// DialFunc establishes network connection with the resolved address.
+	// By default, it's DialContext of net.Dialer.
+	DialFunc DialFunc
+
+	// AddrChangedHandler is called when the address of the server is
+	// changed with SetAddr. When connection is migrated to the new
+	// address, it's called after the new connection is established.
+	AddrChangedHandler func(c *Connection, oldAddr, newAddr string)
+
+	// AutoReconnect makes connection established with Connect reconnect
+	// when it's lost because of the network or protocol error. Close
+	// stops reconnecting.
+	AutoReconnect bool
+
+	// BackoffPolicy defines delays between reconnect attempts. By
+	// default, it's exponential backoff from 1 second to 1 minute with
+	// jitter.
+	BackoffPolicy BackoffPolicy
+
+	// ReconnectStablePeriod is the time connection should stay up for
+	// the reconnect attempts counter to be reset when it's lost
+	ReconnectStablePeriod time.Duration
+
+	// MaxReconnectAttempts is the number of consecutive failed reconnect
+	// attempts after which connection stops reconnecting. Send and Reply
+	// fail with ErrReconnectExhausted until Connect is called. Zero means
+	// unlimited attempts.
+	MaxReconnectAttempts int
+
+	// ReconnectsExhaustedHandler is called with the error of the last
+	// attempt when MaxReconnectAttempts are exhausted
+	ReconnectsExhaustedHandler func(lastErr error)
+
+	// ErrorHandler is called for errors that can't be returned to the
+	// caller, like framing errors or responses without matching
+	// requests. When it's not set, errors are logged. It should be safe
+	// for concurrent use.
+	ErrorHandler func(c *Connection, err error)
+
+	// DeadLetterHandler is called once for each message accepted into
+	// the outgoing queue that connection gave up on: the message
+	// couldn't be packed or written, or it was dropped from the queue
+	// when connection was closed. Reason wraps the underlying error. It's
+	// useful for messages sent with Reply, which caller may not wait
+	// for. It should be safe for concurrent use.
+	DeadLetterHandler DeadLetterHandlerFunc
+
+	// QueuedMessageTTL is the maximum time message may wait in the
+	// outgoing queue. Expired messages are not written, Send and Reply
+	// return ErrMessageExpired and message is passed to
+	// DeadLetterHandler. It can be overridden for the message with
+	// SetMessageTTL. Zero means messages don't expire.
+	QueuedMessageTTL time.Duration
+
+	// LateResponseGrace is the time after SendTimeout during which the
+	// response to the timed out request is still passed to
+	// LateResponseHandler instead of InboundMessageHandler. Reversal of
+	// the request is sent only if response was not received during the
+	// grace period. It has effect only when LateResponseHandler is set.
+	LateResponseGrace time.Duration
+
+	// LateResponseHandler is called with the ID of the timed out request
+	// and its response received during LateResponseGrace. Response is
+	// released when handler returns, so it should not keep it.
+	LateResponseHandler func(requestID string, response *iso8583.Message)
+
+	// TimeoutReversalHandler builds the reversal of the request which
+	// MTI is one of ReversalMTIs when Send returns ErrSendTimeout for it.
+	// Reversal is sent in the background and Send still returns
+	// ErrSendTimeout. Returning nil skips the reversal.
+	TimeoutReversalHandler func(original *iso8583.Message) *iso8583.Message
+
+	// ReversalMTIs are MTIs of the requests reversed by
+	// TimeoutReversalHandler. Default is 0100 and 0200 and their 1993 and
+	// 2003 counterparts 1100, 1200, 2100 and 2200.
+	ReversalMTIs []string
+
+	// ReversalResultHandler is called with the response or error of the
+	// reversal sent by TimeoutReversalHandler. When it's not set, reversal
+	// errors are passed to ErrorHandler.
+	ReversalResultHandler func(c *Connection, reversal, response *iso8583.Message, err error)
+
+	// LateResponseAfterReversalHandler is called when the response to the
+	// reversed request is received within SendTimeout after reversal was sent,
+	// e.g. the late approval. Response is passed to InboundMessageHandler
+	// after the handler returns, so it should not keep it.
+	LateResponseAfterReversalHandler func(c *Connection, original, response *iso8583.Message)
+
+	// ResponseValidator is called by Send with the request and its
+	// response. When it returns an error, Send returns the response and
+	// the error wrapped in ResponseError. Request is nil when message
+	// sent with SendMessage is not *iso8583.Message.
+	ResponseValidator func(request, response *iso8583.Message) error
+
+	// Matcher finds the pending request the response is the reply to
+	// when responses can't be matched by the request ID, e.g. when
+	// several fields should be compared with tolerance. It's called for
+	// every response with all pending requests, so matching takes
+	// O(pending) time and allocations instead of the map lookup by the
+	// request ID, and it should be fast as responses are not read while
+	// it runs. Response is unmatched when it returns false. Requests are
+	// still registered by the request ID, so STAN or MatchFields should
+	// be set and unique.
+	Matcher func(pending []*PendingRequest, response *iso8583.Message) (*PendingRequest, bool)
+
+	// RequiredFields are the fields Send requires by MTI prefix. Fields
+	// of the longest prefix of the message MTI are checked before STAN
+	// is set, and Send fails with ValidationError listing the fields
+	// which are not set or empty. SkipValidation skips the check for
+	// the message.
+	RequiredFields map[string][]int
+
+	// IdempotencyCacheSize is the maximum number of completed Sends with
+	// idempotency key kept to deduplicate Sends with the same key. Sends
+	// waiting for the response are kept regardless of the size.
+	IdempotencyCacheSize int
+
+	// IdempotencyTTL is the time after Send with idempotency key completed
+	// during which Sends with the same key return its response
+	IdempotencyTTL time.Duration
+
+	// CorrelationIDField is the field Send sets to the value returned by
+	// CorrelationIDGenerator when it's not set. Response with another
+	// value of the field is counted in Stats.CorrelationIDMismatches.
+	CorrelationIDField int
+
+	// CorrelationIDGenerator returns the correlation ID for the context of
+	// SendCtx, or context.Background() for other Sends
+	CorrelationIDGenerator func(ctx context.Context) string
+
+	// AdviceAckMTIs maps MTIs of inbound advices to MTIs of their acks,
+	// e.g. 0620 to 0630. Ack is sent as soon as the advice is read,
+	// before the advice is passed to its handler, unless DeferAdviceAcks
+	// is set.
+	AdviceAckMTIs map[string]string
+
+	// AdviceAckBuilder builds the ack of the advice. When it's nil, ack
+	// is the response to the advice with its MTI from AdviceAckMTIs and
+	// fields such as STAN, RRN and terminal ID copied from the advice.
+	AdviceAckBuilder func(advice *iso8583.Message) *iso8583.Message
+
+	// DeferAdviceAcks makes handlers of the advices send their acks, e.g.
+	// when the ack should include the result of the processing. Handler
+	// may build the ack with AdviceAck.
+	DeferAdviceAcks bool
+
 	TLSConfig *tls.Config
+
+	// ExpvarPrefix is the name of expvar.Map the counters of the
+	// connection are published under. Counters are not published when
+	// it's empty.
+	ExpvarPrefix string
+
+	// TLSUpgrade is called by Connect and reconnect on the plaintext
+	// connection, e.g. to exchange the hello message. When it returns
+	// nil, connection is upgraded to TLS with TLSConfig. Connection is
+	// closed if it returns error or TLS handshake fails.
+	TLSUpgrade func(c *Connection) error
+
+	// AcceptTLSUpgradeConfig is the TLS config of the connection created
+	// with NewFrom which is upgraded to TLS with ReplyAndUpgradeTLS
+	AcceptTLSUpgradeConfig *tls.Config
+
+	// ReadBufferSize is the size of the buffer used to read messages from
+	// the connection
+	ReadBufferSize int
+
+	// MaxMessageLength is the maximum length of the inbound message. Length
+	// header out of range is handled according to FramingRecovery. Zero
+	// means no limit.
+	MaxMessageLength int
+
+	// MaxEncodableLength is the maximum length of the outgoing message
+	// the length header can encode. Send and Reply of the longer message
+	// fail with MessageTooLongError before it's written. Length helpers
+	// like WriteASCII4BytesLength check their maximum themselves. Zero
+	// means no limit.
+	MaxEncodableLength int
+
+	// Framer reads and writes frames instead of the length functions
+	// passed to New, e.g. STXETXFramer for frames delimited by STX and
+	// ETX. MaxMessageLength and SyncMarker are not used with it.
+	Framer Framer
+
+	// WrapConn wraps the connection after it's established (and TLS
+	// handshake is done) and before messages are read and written, e.g.
+	// to compress or encrypt the stream. It can't be used with TLS
+	// upgrade.
+	WrapConn ConnWrapper
+
+	// FrameIntegrityCompute computes the checksum, e.g. LRC, appended to
+	// the packed message of each outbound frame. The length header
+	// includes it.
+	FrameIntegrityCompute func(body []byte) []byte
+
+	// FrameIntegrityVerify verifies the checksum received after the
+	// packed message of each inbound frame before it's unpacked
+	FrameIntegrityVerify func(body, received []byte) error
+
+	// FrameIntegritySize is the length of the checksum
+	FrameIntegritySize int
+
+	// FrameIntegrityNAK makes connection send the returned message
+	// instead of closing when the inbound frame failed verification
+	FrameIntegrityNAK FrameIntegrityNAKFunc
+
+	// WireEncoding translates the packed message between the character
+	// set of the spec and the one used on the wire, e.g. EBCDIC1047. The
+	// length header, TPDU and FrameIntegrity checksum are not
+	// translated; the checksum is computed over the wire bytes.
+	WireEncoding Encoding
+
+	// WireEncodingFields are the fields translated with WireEncoding. 0
+	// is MTI and 1 is bitmap. All bytes of the message are translated
+	// when it's empty.
+	WireEncodingFields map[int]bool
+
+	// FramingRecovery defines what to do when inbound message has
+	// invalid length or can't be unpacked. By default, connection is
+	// closed.
+	FramingRecovery FramingRecovery
+
+	// UnpackErrorPolicy defines what to do when inbound message was read,
+	// but can't be unpacked, e.g. it doesn't match the spec. The error is
+	// reported to ErrorHandler as UnpackError. When it's nil, such
+	// messages are handled according to FramingRecovery.
+	UnpackErrorPolicy UnpackErrorPolicy
+
+	// SyncMarker are the bytes each inbound message (with its length
+	// header) starts with. When FramingRecovery is FramingRecoveryResync,
+	// reading continues from the next SyncMarker. If it's not set, reading
+	// continues from the next position with valid length header, so
+	// MaxMessageLength should be set.
+	SyncMarker []byte
+
+	// InboundSpec is the spec used to unpack inbound messages when
+	// they use a different dialect than outgoing messages. By default,
+	// the spec of the connection is used.
+	InboundSpec *iso8583.MessageSpec
+
+	// TPDU is the TPDU header written between the length header and
+	// the message. When it's set, TPDU is also read from inbound messages.
+	TPDU *TPDUHeader
+
+	// ValidateTPDU makes Send fail with ErrTPDUMismatch when TPDU of the
+	// response doesn't have the swapped addresses of TPDU
+	ValidateTPDU bool
+
+	// MACGenerator is called when message is packed to compute MAC
+	// which is set into MACField. MAC field must be the last field of the
+	// message, and MAC is computed over the packed message without it.
+	MACGenerator MACGeneratorFunc
+
+	// MACField is the field with the MAC, 64 by default
+	MACField int
+
+	// MACVerifier is called for each inbound message after it's
+	// unpacked. Message with invalid MAC is not delivered: request it
+	// replies to fails with ErrMACVerification, and the error with the
+	// raw message is reported to ErrorHandler. Packed message is reused
+	// once the verifier returned, so it must not be retained.
+	MACVerifier MACVerifierFunc
+
+	// MACVerificationFatal makes connection close when MACVerifier
+	// rejects inbound message
+	MACVerificationFatal bool
+
+	// MessagePool makes inbound messages be reused. Messages passed to
+	// InboundMessageHandler are reused after the handler returns, so
+	// handler must not keep references to them. Responses returned by
+	// Send may be returned for reuse with ReleaseMessage.
+	MessagePool bool
+
+	// AutoSetFields are the fields Send and Reply set to the current
+	// time if message doesn't have them. Fields are set when message is
+	// written into the connection, so messages waiting in the outgoing
+	// queue don't get stale time. Message must not be modified until
+	// Send or Reply returns.
+	AutoSetFields map[int]TimeFieldKind
+
+	// TimeLocation is the location of the local time fields. By default,
+	// it's time.Local.
+	TimeLocation *time.Location
+
+	// STANProvider enables auto-STAN: Send sets STAN (field 11) of the
+	// message received from the provider if message doesn't have it.
+	// With MatchFields, it sets the last of the match fields instead.
+	// Auto-STAN is disabled when it's nil.
+	STANProvider STANProvider
+
+	// MatchFields are the paths of the fields responses are matched to
+	// requests by, such as "11", or "63.2" for subfield 2 of composite
+	// field 63. Request ID is built from the values of all of them. When
+	// it's empty, responses are matched by STAN (field 11).
+	MatchFields []string
+
+	// MTIVersion is the version of ISO 8583 which conventions MTIs
+	// follow, e.g. to tell responses from requests. By default, it's
+	// detected from the first digit of each MTI, and it can be set for
+	// hosts which don't follow the conventions of their version.
+	MTIVersion iso8583util.Version
+
+	// SignOnRequired makes Send fail with ErrNotSignedOn while connection
+	// is SignedOff unless MTI of the message starts with one of
+	// SignOnAllowedMTIs or, when they are empty, it's network management
+	// message (x8xx). Connection is SignedOff after Connect and reconnect.
+	SignOnRequired bool
+
+	// SignOnAllowedMTIs are prefixes of MTIs Send accepts before
+	// sign-on
+	SignOnAllowedMTIs []string
+
+	// SignOnDetector is called by Send while connection is SignedOff
+	// with the request and its response. When it returns true,
+	// connection moves to SignedOn state, e.g. on 0810 with approved
+	// sign-on.
+	SignOnDetector func(request, response *iso8583.Message) bool
+
+	// SignOffDetector is called with inbound messages which are not
+	// responses while connection is SignedOn. When it returns true,
+	// connection moves to SignedOff state, e.g. on 0800 sign-off request
+	// from the host. Message is handled by its handler as usual.
+	SignOffDetector func(message *iso8583.Message) bool
+
+	// SignOnStateHandler is called in its own goroutine when sign-on
+	// state of the connection changes
+	SignOnStateHandler func(c *Connection, state SignOnState)
+
+	// HostSignOffHandling makes connection handle network management
+	// messages from the host with field 70 set to 002 (sign-off) and 070
+	// (cutover) instead of passing them to handlers. Connection is
+	// signed off by the sign-off, and CurrentBusinessDate is set to
+	// field 15 of the cutover message. Both are reported to
+	// HostEventHandler.
+	HostSignOffHandling bool
+
+	// HostSignOffAck makes connection reply to sign-off and cutover
+	// messages with fields 7, 11, 15, 70 copied and field 39 set to 00
+	// if the spec has it
+	HostSignOffAck bool
+
+	// HostSignOffDrain makes connection Drain after the sign-off, so
+	// financial messages are rejected until it's signed on or
+	// reconnected, and report HostDrained when pending requests are
+	// done
+	HostSignOffDrain bool
+
+	// HostEventHandler is called with lifecycle events caused by the
+	// messages from the host, e.g. to pause upstream traffic. It's
+	// called in the separate goroutine, so it doesn't hold up reading of
+	// the following messages.
+	HostEventHandler func(c *Connection, event HostEvent)
+
+	// SessionField is the field Session sets to its ID. Request IDs of
+	// the messages with the ID of the open session in the field are
+	// scoped by the session. By default, it's field 41 (card acceptor
+	// terminal identification).
+	SessionField int
+
+	// ScrubFields are the fields with sensitive data (PAN, track 2, PIN
+	// block, etc.). Their values are overwritten with zeros and left
+	// empty when Send or Reply returns, and the packed message buffers
+	// owned by the connection are zeroed. References to the values held
+	// by the caller can't be scrubbed, and string values can only be
+	// dropped as Go strings are immutable.
+	ScrubFields []int
+
+	// ScrubInbound makes ScrubFields be scrubbed also in inbound messages
+	// when InboundMessageHandler returns. Responses returned by Send are
+	// held by the caller and are not scrubbed.
+	ScrubInbound bool
+
+	// DumpOnError is the writer the hex dump of inbound message is
+	// written to when message can't be unpacked
+	DumpOnError io.Writer
+
+	// MessageFactory creates the message each inbound frame is unpacked
+	// into instead of iso8583.NewMessage with the inbound spec. It's
+	// called once per frame and may preset fields, which stay set if the
+	// frame doesn't include them. MessagePool is not used when it's set.
+	MessageFactory func() *iso8583.Message
+
+	// TraceWriter is the writer each sent and received message is
+	// rendered to with its fields described by the spec. Messages are
+	// rendered in the background, in the order they were written and
+	// read. Nothing is rendered when it's nil.
+	TraceWriter io.Writer
+
+	// TraceMaskFields are the fields masked by MaskValue in the trace,
+	// e.g. PAN
+	TraceMaskFields []int
+
+	// OutgoingQueueSize is the number of messages that can wait to be
+	// written into the connection. When queue is full, Send and Reply
+	// wait for the space in the queue until SendTimeout passes, or fail
+	// with ErrOutgoingQueueFull if DropWhenFull is set. It's used only
+	// when connection is established.
+	OutgoingQueueSize int
+
+	// DropWhenFull makes Send and Reply fail immediately with
+	// ErrOutgoingQueueFull when outgoing queue is full
+	DropWhenFull bool
+
+	// InboundWorkers is the number of goroutines that run inbound
+	// handlers. When it's set, handlers are queued into the inbound queue
+	// of InboundQueueSize instead of running each of them in its own
+	// goroutine. When the queue is full, reading from the connection
+	// waits for the space in it unless DropInboundWhenFull is set.
+	InboundWorkers int
+
+	// InboundQueueSize is the number of inbound messages that can wait
+	// for InboundWorkers
+	InboundQueueSize int
+
+	// SerialInboundProcessing makes inbound handlers (including
+	// LateResponseHandler) run one at a time in the order messages were
+	// read from the connection. Responses to Send are not affected. It
+	// overrides InboundWorkers with a single worker, so a slow handler
+	// delays all the following ones and, once inbound queue is full,
+	// reading from the connection.
+	SerialInboundProcessing bool
+
+	// DropInboundWhenFull makes connection drop inbound messages when
+	// inbound queue is full. Dropped messages are counted in Stats and
+	// passed to InboundDropHandler.
+	DropInboundWhenFull bool
+
+	// InboundDropHandler is called with the inbound message dropped
+	// because inbound queue was full. It's called by the read loop and
+	// message is released when it returns, so it should not block or
+	// keep the message.
+	InboundDropHandler func(c *Connection, message *iso8583.Message)
+
+	// OutgoingQueueHighWatermarkHandler is called when the number of
+	// messages in the outgoing queue reaches OutgoingQueueHighWatermark.
+	// It's called again only after the queue depth goes below the
+	// watermark and reaches it again.
+	OutgoingQueueHighWatermarkHandler func(c *Connection, depth int)
+	OutgoingQueueHighWatermark        int
+
+	// PendingRequestsShards is the number of shards the requests waiting
+	// for the reply are spread across. More shards reduce lock contention
+	// between concurrent Send calls. It's used only when connection is
+	// created.
+	PendingRequestsShards int
+
+	// Clock is used for send timeouts, idle time and request timing
+	// details. Write deadlines always use the real time. It's used only
+	// when connection is created.
+	Clock Clock
 }
 
 type Option func(*Options) error
 
 func GetDefaultOptions() Options {
 	return Options{
-		SendTimeout: 30 * time.Second,
-		IdleTime:    5 * time.Second,
-		PingHandler: nil,
-		TLSConfig:   nil,
+		SendTimeout:           30 * time.Second,
+		IdleTime:              5 * time.Second,
+		PingHandler:           nil,
+		TLSConfig:             nil,
+		TCPNoDelay:            true,
+		ReadBufferSize:        8 * 1024,
+		OutgoingQueueSize:     1024,
+		PendingRequestsShards: 32,
+		Clock:                 realClock{},
+		Resolver:              net.DefaultResolver,
+		SRVResolver:           net.DefaultResolver,
+		DialAllAddresses:      true,
+		DialFunc:              (&net.Dialer{}).DialContext,
+		DialTimeout:           10 * time.Second,
+		BackoffPolicy:         defaultBackoffPolicy(),
+		ReconnectStablePeriod: time.Minute,
+		MACField:              64,
+		ReversalMTIs:          []string{"0100", "0200", "1100", "1200", "2100", "2200"},
+		IdempotencyCacheSize:  1024,
+		IdempotencyTTL:        time.Minute,
+		SessionField:          41,
+	}
+}
+
+// Name sets a Name option
+func Name(name string) Option {
+	return func(o *Options) error {
+		o.Name = name
+		return nil
+	}
+}
+
+// Tags sets a Tags option
+func Tags(tags map[string]string) Option {
+	return func(o *Options) error {
+		o.Tags = make(map[string]string, len(tags))
+		for k, v := range tags {
+			o.Tags[k] = v
+		}
+		return nil
 	}
 }
 
@@ -64,86 +639,1003 @@ func SendTimeout(d time.Duration) Option {
 	}
 }
 
-// PingHandler sets a PingHandler option
-func PingHandler(handler func(c *Connection)) Option {
+// ReadBufferSize sets a ReadBufferSize option
+func ReadBufferSize(n int) Option {
 	return func(o *Options) error {
-		o.PingHandler = handler
+		if n < 1 {
+			return fmt.Errorf("read buffer size should be positive, got %d", n)
+		}
+		o.ReadBufferSize = n
 		return nil
 	}
 }
 
-// ConnectionClosedHandler sets a ConnectionClosedHandler option
-func ConnectionClosedHandler(handler func(c *Connection)) Option {
+// MaxMessageLength sets a MaxMessageLength option
+func MaxMessageLength(n int) Option {
 	return func(o *Options) error {
-		o.ConnectionClosedHandler = handler
+		if n < 0 {
+			return fmt.Errorf("max message length should not be negative, got %d", n)
+		}
+		o.MaxMessageLength = n
 		return nil
 	}
 }
 
-// InboundMessageHandler sets an InboundMessageHandler option
-func InboundMessageHandler(handler func(c *Connection, message *iso8583.Message)) Option {
+// MaxEncodableLength sets a MaxEncodableLength option
+func MaxEncodableLength(n int) Option {
 	return func(o *Options) error {
-		o.InboundMessageHandler = handler
+		if n < 0 {
+			return fmt.Errorf("max encodable length should not be negative, got %d", n)
+		}
+		o.MaxEncodableLength = n
 		return nil
 	}
 }
 
-func defaultTLSConfig() *tls.Config {
-	return &tls.Config{
-		MinVersion: tls.VersionTLS12,
+// WithFramer sets a Framer option. Length functions passed to New may be
+// nil when it's set.
+func WithFramer(framer Framer) Option {
+	return func(o *Options) error {
+		if framer == nil {
+			return fmt.Errorf("framer should not be nil")
+		}
+		o.Framer = framer
+		return nil
 	}
 }
 
-func ClientCert(cert, key string) Option {
+// WrapConn sets a WrapConn option. Connect fails if wrap returns error.
+func WrapConn(wrap ConnWrapper) Option {
+	return func(o *Options) error {
+		o.WrapConn = wrap
+		return nil
+	}
+}
+
+// FrameIntegrity sets FrameIntegrityCompute, FrameIntegrityVerify and
+// FrameIntegritySize options. compute should return checksums of the same
+// length for all bodies, so the checksum can be split from the inbound
+// frame. Frames which failed verification are reported to ErrorHandler as
+// FrameIntegrityError and connection is closed unless FrameIntegrityNAK
+// is set.
+func FrameIntegrity(compute func(body []byte) []byte, verify func(body, received []byte) error) Option {
 	return func(o *Options) error {
-		if o.TLSConfig == nil {
-			o.TLSConfig = defaultTLSConfig()
+		if compute == nil || verify == nil {
+			return fmt.Errorf("frame integrity compute and verify should not be nil")
 		}
+		o.FrameIntegrityCompute = compute
+		o.FrameIntegrityVerify = verify
+		o.FrameIntegritySize = len(compute(nil))
+		return nil
+	}
+}
 
-		certificate, err := tls.LoadX509KeyPair(cert, key)
-		if err != nil {
-			return fmt.Errorf("loading certificate: %w", err)
+// FrameIntegrityNAK sets a FrameIntegrityNAK option
+func FrameIntegrityNAK(nak FrameIntegrityNAKFunc) Option {
+	return func(o *Options) error {
+		o.FrameIntegrityNAK = nak
+		return nil
+	}
+}
+
+// WireEncoding sets WireEncoding and WireEncodingFields options. When
+// fields are given, only they are translated, e.g. the alphanumeric fields
+// the host sends in EBCDIC, while the rest of the message is sent as
+// packed with the spec.
+func WireEncoding(enc Encoding, fields ...int) Option {
+	return func(o *Options) error {
+		if enc == nil {
+			return fmt.Errorf("wire encoding should not be nil")
 		}
 
-		o.TLSConfig.Certificates = []tls.Certificate{certificate}
+		var translated map[int]bool
+		if len(fields) > 0 {
+			translated = make(map[int]bool, len(fields))
+			for _, id := range fields {
+				if id < 0 {
+					return fmt.Errorf("wire encoding field should not be negative, got %d", id)
+				}
+				translated[id] = true
+			}
+		}
 
+		o.WireEncoding = enc
+		o.WireEncodingFields = translated
 		return nil
 	}
 }
 
-// RootCAs creates pool of Root CAs
-func RootCAs(file ...string) Option {
+// OnUnpackError sets an UnpackErrorPolicy option, e.g. SkipOnUnpackError
+func OnUnpackError(policy UnpackErrorPolicy) Option {
+	return func(o *Options) error {
+		o.UnpackErrorPolicy = policy
+		return nil
+	}
+}
+
+// ResyncOnFramingError makes connection skip broken inbound messages and
+// continue reading from the next message that starts with marker (or has
+// valid length header if marker is empty) instead of closing the
+// connection
+func ResyncOnFramingError(marker []byte) Option {
+	return func(o *Options) error {
+		o.FramingRecovery = FramingRecoveryResync
+		o.SyncMarker = marker
+		return nil
+	}
+}
+
+// DumpOnError sets a DumpOnError option
+func DumpOnError(w io.Writer) Option {
+	return func(o *Options) error {
+		o.DumpOnError = w
+		return nil
+	}
+}
+
+// MessageFactory sets a MessageFactory option
+func MessageFactory(factory func() *iso8583.Message) Option {
+	return func(o *Options) error {
+		o.MessageFactory = factory
+		return nil
+	}
+}
+
+// TraceWriter sets TraceWriter and TraceMaskFields options
+func TraceWriter(w io.Writer, maskFields []int) Option {
+	return func(o *Options) error {
+		o.TraceWriter = w
+		o.TraceMaskFields = maskFields
+		return nil
+	}
+}
+
+// MessagePool sets a MessagePool option
+func MessagePool(enabled bool) Option {
+	return func(o *Options) error {
+		o.MessagePool = enabled
+		return nil
+	}
+}
+
+// ScrubFields sets a ScrubFields option
+func ScrubFields(fields []int) Option {
+	return func(o *Options) error {
+		o.ScrubFields = append([]int(nil), fields...)
+		return nil
+	}
+}
+
+// ScrubInbound sets a ScrubInbound option
+func ScrubInbound(enabled bool) Option {
+	return func(o *Options) error {
+		o.ScrubInbound = enabled
+		return nil
+	}
+}
+
+// InboundSpec sets an InboundSpec option
+func InboundSpec(spec *iso8583.MessageSpec) Option {
+	return func(o *Options) error {
+		o.InboundSpec = spec
+		return nil
+	}
+}
+
+// MACGenerator sets a MACGenerator option
+func MACGenerator(generator MACGeneratorFunc) Option {
+	return func(o *Options) error {
+		o.MACGenerator = generator
+		return nil
+	}
+}
+
+// MACField sets a MACField option
+func MACField(id int) Option {
 	return func(o *Options) error {
-		if o.TLSConfig == nil {
-			o.TLSConfig = defaultTLSConfig()
+		if id != 64 && id != 128 {
+			return fmt.Errorf("MAC field should be 64 or 128, got %d", id)
 		}
+		o.MACField = id
+		return nil
+	}
+}
 
-		certPool := x509.NewCertPool()
+// MACVerifier sets a MACVerifier option. If fatal is true, connection is
+// closed when MAC of inbound message is invalid.
+func MACVerifier(verifier MACVerifierFunc, fatal bool) Option {
+	return func(o *Options) error {
+		o.MACVerifier = verifier
+		o.MACVerificationFatal = fatal
+		return nil
+	}
+}
 
-		for _, f := range file {
-			cert, err := ioutil.ReadFile(f)
-			if err != nil {
-				return fmt.Errorf("loading root certificate %s: %w", file, err)
-			}
+// TPDU sets a TPDU option with dest and src addresses
+func TPDU(dest, src [2]byte) Option {
+	return func(o *Options) error {
+		tpdu := NewTPDUHeader(dest, src)
+		o.TPDU = &tpdu
+		return nil
+	}
+}
 
-			ok := certPool.AppendCertsFromPEM(cert)
-			if !ok {
-				return fmt.Errorf("parsing root certificate %s: %w", file, err)
+// ValidateTPDU sets a ValidateTPDU option
+func ValidateTPDU() Option {
+	return func(o *Options) error {
+		o.ValidateTPDU = true
+		return nil
+	}
+}
+
+// AutoSetTransmissionTime makes Send and Reply set field 7 (transmission
+// date and time) to the current GMT time when it's enabled
+func AutoSetTransmissionTime(enabled bool) Option {
+	return func(o *Options) error {
+		fields := make(map[int]TimeFieldKind, len(o.AutoSetFields)+1)
+		for id, kind := range o.AutoSetFields {
+			fields[id] = kind
+		}
+
+		if enabled {
+			fields[7] = TimeFieldTransmissionDateTime
+		} else {
+			delete(fields, 7)
+		}
+
+		o.AutoSetFields = fields
+		return nil
+	}
+}
+
+// AutoSetFields makes Send and Reply set fields to the current time. It
+// replaces fields set by AutoSetTransmissionTime.
+func AutoSetFields(fields map[int]TimeFieldKind) Option {
+	return func(o *Options) error {
+		o.AutoSetFields = make(map[int]TimeFieldKind, len(fields))
+		for id, kind := range fields {
+			if kind < TimeFieldTransmissionDateTime || kind > TimeFieldLocalDate {
+				return fmt.Errorf("unknown kind of time field %d: %d", id, kind)
 			}
+			o.AutoSetFields[id] = kind
 		}
+		return nil
+	}
+}
+
+// TimeLocation sets a TimeLocation option
+func TimeLocation(location *time.Location) Option {
+	return func(o *Options) error {
+		o.TimeLocation = location
+		return nil
+	}
+}
 
-		o.TLSConfig.RootCAs = certPool
+// AutoSTAN enables auto-STAN with the in-memory counter rolling over from
+// 999999 to 000001
+func AutoSTAN() Option {
+	return func(o *Options) error {
+		o.STANProvider = newSTANCounter(maxSTAN)
+		return nil
+	}
+}
 
+// WithSTANProvider enables auto-STAN with the provider
+func WithSTANProvider(provider STANProvider) Option {
+	return func(o *Options) error {
+		o.STANProvider = provider
 		return nil
 	}
 }
 
-func SetTLSConfig(cfg func(*tls.Config)) Option {
+// MatchByField sets a MatchFields option. Paths of subfields of composite
+// fields are joined with dots, e.g. "63.2".
+func MatchByField(paths ...string) Option {
 	return func(o *Options) error {
-		if o.TLSConfig == nil {
-			o.TLSConfig = defaultTLSConfig()
+		if len(paths) == 0 {
+			return fmt.Errorf("match fields should not be empty")
+		}
+
+		for _, path := range paths {
+			if _, _, err := parseFieldPath(path); err != nil {
+				return err
+			}
 		}
-		cfg(o.TLSConfig)
+
+		o.MatchFields = append([]string(nil), paths...)
+		return nil
+	}
+}
+
+// MTIVersion sets a MTIVersion option
+func MTIVersion(version iso8583util.Version) Option {
+	return func(o *Options) error {
+		if version < iso8583util.VersionAuto || version > iso8583util.Version2003 {
+			return fmt.Errorf("unknown MTI version %d", version)
+		}
+		o.MTIVersion = version
+		return nil
+	}
+}
+
+// RequireSignOn sets SignOnRequired and SignOnAllowedMTIs options
+func RequireSignOn(allowedMTIs ...string) Option {
+	return func(o *Options) error {
+		o.SignOnRequired = true
+		o.SignOnAllowedMTIs = append([]string(nil), allowedMTIs...)
+		return nil
+	}
+}
+
+// SignOnDetector sets a SignOnDetector option
+func SignOnDetector(detector func(request, response *iso8583.Message) bool) Option {
+	return func(o *Options) error {
+		o.SignOnDetector = detector
+		return nil
+	}
+}
+
+// SignOffDetector sets a SignOffDetector option
+func SignOffDetector(detector func(message *iso8583.Message) bool) Option {
+	return func(o *Options) error {
+		o.SignOffDetector = detector
+		return nil
+	}
+}
+
+// SignOnStateHandler sets a SignOnStateHandler option
+func SignOnStateHandler(handler func(c *Connection, state SignOnState)) Option {
+	return func(o *Options) error {
+		o.SignOnStateHandler = handler
+		return nil
+	}
+}
+
+// HostSignOffBehavior sets HostSignOffHandling, HostSignOffAck and
+// HostSignOffDrain options
+func HostSignOffBehavior(ack bool, drain bool) Option {
+	return func(o *Options) error {
+		o.HostSignOffHandling = true
+		o.HostSignOffAck = ack
+		o.HostSignOffDrain = drain
+		return nil
+	}
+}
+
+// HostEventHandler sets a HostEventHandler option
+func HostEventHandler(handler func(c *Connection, event HostEvent)) Option {
+	return func(o *Options) error {
+		o.HostEventHandler = handler
+		return nil
+	}
+}
+
+// SessionField sets a SessionField option
+func SessionField(field int) Option {
+	return func(o *Options) error {
+		if field < 2 {
+			return fmt.Errorf("session field should be a data field, got %d", field)
+		}
+		o.SessionField = field
+		return nil
+	}
+}
+
+// OutgoingQueueSize sets an OutgoingQueueSize option
+func OutgoingQueueSize(n int) Option {
+	return func(o *Options) error {
+		if n < 0 {
+			return fmt.Errorf("outgoing queue size should not be negative, got %d", n)
+		}
+		o.OutgoingQueueSize = n
+		return nil
+	}
+}
+
+// DropWhenFull sets a DropWhenFull option
+func DropWhenFull() Option {
+	return func(o *Options) error {
+		o.DropWhenFull = true
+		return nil
+	}
+}
+
+// InboundWorkers sets InboundWorkers and InboundQueueSize options
+func InboundWorkers(n int, queueSize int) Option {
+	return func(o *Options) error {
+		if n < 0 {
+			return fmt.Errorf("number of inbound workers should not be negative, got %d", n)
+		}
+		if queueSize < 0 {
+			return fmt.Errorf("inbound queue size should not be negative, got %d", queueSize)
+		}
+		o.InboundWorkers = n
+		o.InboundQueueSize = queueSize
+		return nil
+	}
+}
+
+// SerialInboundProcessing sets a SerialInboundProcessing option
+func SerialInboundProcessing(enabled bool) Option {
+	return func(o *Options) error {
+		o.SerialInboundProcessing = enabled
+		return nil
+	}
+}
+
+// DropInboundWhenFull sets a DropInboundWhenFull option
+func DropInboundWhenFull() Option {
+	return func(o *Options) error {
+		o.DropInboundWhenFull = true
+		return nil
+	}
+}
+
+// InboundDropHandler sets an InboundDropHandler option
+func InboundDropHandler(handler func(c *Connection, message *iso8583.Message)) Option {
+	return func(o *Options) error {
+		o.InboundDropHandler = handler
+		return nil
+	}
+}
+
+// OutgoingQueueHighWatermarkHandler sets an OutgoingQueueHighWatermarkHandler
+// option that is called when depth of the outgoing queue reaches watermark
+func OutgoingQueueHighWatermarkHandler(watermark int, handler func(c *Connection, depth int)) Option {
+	return func(o *Options) error {
+		if watermark < 1 {
+			return fmt.Errorf("outgoing queue high watermark should be positive, got %d", watermark)
+		}
+		o.OutgoingQueueHighWatermark = watermark
+		o.OutgoingQueueHighWatermarkHandler = handler
+		return nil
+	}
+}
+
+// PendingRequestsShards sets a PendingRequestsShards option
+func PendingRequestsShards(n int) Option {
+	return func(o *Options) error {
+		if n < 1 {
+			return fmt.Errorf("number of pending requests shards should be positive, got %d", n)
+		}
+		o.PendingRequestsShards = n
+		return nil
+	}
+}
+
+// WithClock sets a Clock option. It's meant to be used in tests to control
+// timeouts without waiting for them.
+func WithClock(clock Clock) Option {
+	return func(o *Options) error {
+		o.Clock = clock
+		return nil
+	}
+}
+
+// WriteTimeout sets a WriteTimeout option
+func WriteTimeout(d time.Duration) Option {
+	return func(o *Options) error {
+		o.WriteTimeout = d
+		return nil
+	}
+}
+
+// TCPNoDelay sets a TCPNoDelay option
+func TCPNoDelay(enabled bool) Option {
+	return func(o *Options) error {
+		o.TCPNoDelay = enabled
+		return nil
+	}
+}
+
+// PingHandler sets a PingHandler option
+func PingHandler(handler func(c *Connection)) Option {
+	return func(o *Options) error {
+		o.PingHandler = handler
+		return nil
+	}
+}
+
+// PingWindow sets a PingWindow option
+func PingWindow(d time.Duration) Option {
+	return func(o *Options) error {
+		o.PingWindow = d
+		return nil
+	}
+}
+
+// SaturationThreshold sets a SaturationThreshold option
+func SaturationThreshold(n int) Option {
+	return func(o *Options) error {
+		if n < 0 {
+			return fmt.Errorf("saturation threshold should not be negative, got %d", n)
+		}
+		o.SaturationThreshold = n
+		return nil
+	}
+}
+
+// WithResolver sets a Resolver option
+func WithResolver(resolver Resolver) Option {
+	return func(o *Options) error {
+		if resolver == nil {
+			return fmt.Errorf("resolver should not be nil")
+		}
+		o.Resolver = resolver
+		return nil
+	}
+}
+
+// SRVDiscovery makes connection discover the server targets from DNS SRV
+// records of the service, e.g. SRVDiscovery("iso", "tcp",
+// "payments.internal") looks up _iso._tcp.payments.internal.
+func SRVDiscovery(service, proto, name string) Option {
+	return func(o *Options) error {
+		o.SRV = &SRVService{
+			Service: service,
+			Proto:   proto,
+			Name:    name,
+		}
+		return nil
+	}
+}
+
+// WithSRVResolver sets an SRVResolver option
+func WithSRVResolver(resolver SRVResolver) Option {
+	return func(o *Options) error {
+		if resolver == nil {
+			return fmt.Errorf("SRV resolver should not be nil")
+		}
+		o.SRVResolver = resolver
+		return nil
+	}
+}
+
+// DialTimeout sets a DialTimeout option
+func DialTimeout(d time.Duration) Option {
+	return func(o *Options) error {
+		if d < 0 {
+			return fmt.Errorf("dial timeout should not be negative, got %v", d)
+		}
+		o.DialTimeout = d
+		return nil
+	}
+}
+
+// ResolveTimeout sets a ResolveTimeout option
+func ResolveTimeout(d time.Duration) Option {
+	return func(o *Options) error {
+		o.ResolveTimeout = d
+		return nil
+	}
+}
+
+// DialAllAddresses sets a DialAllAddresses option
+func DialAllAddresses(enabled bool) Option {
+	return func(o *Options) error {
+		o.DialAllAddresses = enabled
+		return nil
+	}
+}
+
+// WithDialFunc sets a DialFunc option
+func WithDialFunc(dial DialFunc) Option {
+	return func(o *Options) error {
+		if dial == nil {
+			return fmt.Errorf("dial function should not be nil")
+		}
+		o.DialFunc = dial
+		return nil
+	}
+}
+
+// AddrChangedHandler sets an AddrChangedHandler option
+func AddrChangedHandler(handler func(c *Connection, oldAddr, newAddr string)) Option {
+	return func(o *Options) error {
+		o.AddrChangedHandler = handler
+		return nil
+	}
+}
+
+// AutoReconnect sets an AutoReconnect option
+func AutoReconnect(enabled bool) Option {
+	return func(o *Options) error {
+		o.AutoReconnect = enabled
+		return nil
+	}
+}
+
+// ReconnectBackoff sets a BackoffPolicy option
+func ReconnectBackoff(policy BackoffPolicy) Option {
+	return func(o *Options) error {
+		if policy == nil {
+			return fmt.Errorf("backoff policy should not be nil")
+		}
+		o.BackoffPolicy = policy
+		return nil
+	}
+}
+
+// ReconnectStablePeriod sets a ReconnectStablePeriod option
+func ReconnectStablePeriod(d time.Duration) Option {
+	return func(o *Options) error {
+		o.ReconnectStablePeriod = d
+		return nil
+	}
+}
+
+// MaxReconnectAttempts sets a MaxReconnectAttempts option
+func MaxReconnectAttempts(n int) Option {
+	return func(o *Options) error {
+		if n < 0 {
+			return fmt.Errorf("max reconnect attempts should not be negative, got %d", n)
+		}
+		o.MaxReconnectAttempts = n
+		return nil
+	}
+}
+
+// ReconnectsExhaustedHandler sets a ReconnectsExhaustedHandler option
+func ReconnectsExhaustedHandler(handler func(lastErr error)) Option {
+	return func(o *Options) error {
+		o.ReconnectsExhaustedHandler = handler
+		return nil
+	}
+}
+
+// DeadLetterHandler sets a DeadLetterHandler option
+func DeadLetterHandler(handler DeadLetterHandlerFunc) Option {
+	return func(o *Options) error {
+		o.DeadLetterHandler = handler
+		return nil
+	}
+}
+
+// QueuedMessageTTL sets a QueuedMessageTTL option
+func QueuedMessageTTL(d time.Duration) Option {
+	return func(o *Options) error {
+		if d < 0 {
+			return fmt.Errorf("queued message TTL should not be negative, got %s", d)
+		}
+		o.QueuedMessageTTL = d
+		return nil
+	}
+}
+
+// LateResponseGrace sets a LateResponseGrace option
+func LateResponseGrace(d time.Duration) Option {
+	return func(o *Options) error {
+		if d < 0 {
+			return fmt.Errorf("late response grace should not be negative, got %s", d)
+		}
+		o.LateResponseGrace = d
+		return nil
+	}
+}
+
+// LateResponseHandler sets a LateResponseHandler option
+func LateResponseHandler(handler func(requestID string, response *iso8583.Message)) Option {
+	return func(o *Options) error {
+		o.LateResponseHandler = handler
+		return nil
+	}
+}
+
+// TimeoutReversalHandler sets a TimeoutReversalHandler option
+func TimeoutReversalHandler(handler func(original *iso8583.Message) *iso8583.Message) Option {
+	return func(o *Options) error {
+		o.TimeoutReversalHandler = handler
+		return nil
+	}
+}
+
+// ReversalMTIs sets a ReversalMTIs option
+func ReversalMTIs(mtis ...string) Option {
+	return func(o *Options) error {
+		o.ReversalMTIs = append([]string(nil), mtis...)
+		return nil
+	}
+}
+
+// ReversalResultHandler sets a ReversalResultHandler option
+func ReversalResultHandler(handler func(c *Connection, reversal, response *iso8583.Message, err error)) Option {
+	return func(o *Options) error {
+		o.ReversalResultHandler = handler
+		return nil
+	}
+}
+
+// LateResponseAfterReversalHandler sets a LateResponseAfterReversalHandler
+// option
+func LateResponseAfterReversalHandler(handler func(c *Connection, original, response *iso8583.Message)) Option {
+	return func(o *Options) error {
+		o.LateResponseAfterReversalHandler = handler
+		return nil
+	}
+}
+
+// ResponseValidator sets a ResponseValidator option, e.g. ApproveOnDE39
+func ResponseValidator(validator func(request, response *iso8583.Message) error) Option {
+	return func(o *Options) error {
+		o.ResponseValidator = validator
+		return nil
+	}
+}
+
+// Matcher sets a Matcher option
+func Matcher(matcher func(pending []*PendingRequest, response *iso8583.Message) (*PendingRequest, bool)) Option {
+	return func(o *Options) error {
+		o.Matcher = matcher
+		return nil
+	}
+}
+
+// RequiredFields sets a RequiredFields option, e.g. fields 3, 4 and 22 for
+// "02" prefix. It replaces fields previously set for the same prefixes.
+func RequiredFields(fields map[string][]int) Option {
+	return func(o *Options) error {
+		required := make(map[string][]int, len(o.RequiredFields)+len(fields))
+		for prefix, ids := range o.RequiredFields {
+			required[prefix] = ids
+		}
+		for prefix, ids := range fields {
+			if prefix == "" {
+				return fmt.Errorf("MTI prefix of required fields should not be empty")
+			}
+			required[prefix] = append([]int(nil), ids...)
+		}
+		o.RequiredFields = required
+
+		return nil
+	}
+}
+
+// IdempotencyCacheSize sets an IdempotencyCacheSize option
+func IdempotencyCacheSize(size int) Option {
+	return func(o *Options) error {
+		if size <= 0 {
+			return fmt.Errorf("idempotency cache size should be positive, got %d", size)
+		}
+		o.IdempotencyCacheSize = size
+		return nil
+	}
+}
+
+// IdempotencyTTL sets an IdempotencyTTL option
+func IdempotencyTTL(ttl time.Duration) Option {
+	return func(o *Options) error {
+		if ttl < 0 {
+			return fmt.Errorf("idempotency TTL should not be negative, got %v", ttl)
+		}
+		o.IdempotencyTTL = ttl
+		return nil
+	}
+}
+
+// CorrelationID sets CorrelationIDField and CorrelationIDGenerator options
+func CorrelationID(field int, gen func(ctx context.Context) string) Option {
+	return func(o *Options) error {
+		if field < 2 {
+			return fmt.Errorf("correlation ID field should be a data field, got %d", field)
+		}
+		if gen == nil {
+			return fmt.Errorf("correlation ID generator should not be nil")
+		}
+		o.CorrelationIDField = field
+		o.CorrelationIDGenerator = gen
+		return nil
+	}
+}
+
+// AutoAckAdvices sets AdviceAckMTIs and AdviceAckBuilder options. Builder
+// may be nil to use the default ack.
+func AutoAckAdvices(ackMTIs map[string]string, ackBuilder func(advice *iso8583.Message) *iso8583.Message) Option {
+	return func(o *Options) error {
+		mtis := make(map[string]string, len(ackMTIs))
+		for mti, ackMTI := range ackMTIs {
+			mtis[mti] = ackMTI
+		}
+		o.AdviceAckMTIs = mtis
+		o.AdviceAckBuilder = ackBuilder
+
+		return nil
+	}
+}
+
+// DeferAdviceAcks sets a DeferAdviceAcks option
+func DeferAdviceAcks() Option {
+	return func(o *Options) error {
+		o.DeferAdviceAcks = true
+		return nil
+	}
+}
+
+// ConnectionClosedHandler sets a ConnectionClosedHandler option
+func ConnectionClosedHandler(handler func(c *Connection)) Option {
+	return func(o *Options) error {
+		o.ConnectionClosedHandler = handler
+		return nil
+	}
+}
+
+// ConnectionEstablishedHandler sets a ConnectionEstablishedHandler option
+func ConnectionEstablishedHandler(handler func(c *Connection)) Option {
+	return func(o *Options) error {
+		o.ConnectionEstablishedHandler = handler
+		return nil
+	}
+}
+
+// InboundMessageHandlerFunc handles inbound message without matching
+// request
+type InboundMessageHandlerFunc func(c *Connection, message *iso8583.Message)
+
+// InboundMessageHandler sets an InboundMessageHandler option
+func InboundMessageHandler(handler func(c *Connection, message *iso8583.Message)) Option {
+	return func(o *Options) error {
+		o.InboundMessageHandler = handler
+		return nil
+	}
+}
+
+// InboundMessageHandlerFor registers handler for inbound messages which MTI
+// starts with mtiPrefix, e.g. "08" for network management messages. Handler
+// registered for the longer prefix takes precedence, InboundMessageHandler
+// handles the rest of the messages. Registering the same prefix again
+// replaces the handler.
+func InboundMessageHandlerFor(mtiPrefix string, handler func(c *Connection, message *iso8583.Message)) Option {
+	return func(o *Options) error {
+		if mtiPrefix == "" {
+			return fmt.Errorf("MTI prefix is required, use InboundMessageHandler for all messages")
+		}
+
+		handlers := make(map[string]InboundMessageHandlerFunc, len(o.InboundMessageHandlers)+1)
+		for prefix, h := range o.InboundMessageHandlers {
+			handlers[prefix] = h
+		}
+		handlers[mtiPrefix] = handler
+		o.InboundMessageHandlers = handlers
+
+		return nil
+	}
+}
+
+// NetworkManagementHandler sets a NetworkManagementHandler option
+func NetworkManagementHandler(handler func(c *Connection, message *iso8583.Message)) Option {
+	return func(o *Options) error {
+		o.NetworkManagementHandler = handler
+		return nil
+	}
+}
+
+// ErrorHandler sets an ErrorHandler option
+func ErrorHandler(handler func(c *Connection, err error)) Option {
+	return func(o *Options) error {
+		o.ErrorHandler = handler
+		return nil
+	}
+}
+
+func defaultTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
+// cloneTLSConfig replaces TLSConfig with its copy, or with the default
+// config when it's not set, and returns it. Options change the copy, as the
+// config may be used by the connection being dialed or reconnected.
+func cloneTLSConfig(o *Options) *tls.Config {
+	if o.TLSConfig == nil {
+		o.TLSConfig = defaultTLSConfig()
+	} else {
+		o.TLSConfig = o.TLSConfig.Clone()
+	}
+
+	return o.TLSConfig
+}
+
+func ClientCert(cert, key string) Option {
+	return func(o *Options) error {
+		certificate, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return fmt.Errorf("loading certificate: %w", err)
+		}
+
+		cloneTLSConfig(o).Certificates = []tls.Certificate{certificate}
+
+		return nil
+	}
+}
+
+// RootCAs creates pool of Root CAs
+func RootCAs(file ...string) Option {
+	return func(o *Options) error {
+		certPool := x509.NewCertPool()
+
+		for _, f := range file {
+			cert, err := ioutil.ReadFile(f)
+			if err != nil {
+				return fmt.Errorf("loading root certificate %s: %w", file, err)
+			}
+
+			ok := certPool.AppendCertsFromPEM(cert)
+			if !ok {
+				return fmt.Errorf("parsing root certificate %s: %w", file, err)
+			}
+		}
+
+		cloneTLSConfig(o).RootCAs = certPool
+
+		return nil
+	}
+}
+
+// PublishExpvar publishes counters of the connection as expvar.Map named
+// prefix with sent, received, timeouts, unmatched, reconnects and pending
+// values. Values are read from the same counters as Stats. New and Connect
+// return ErrExpvarPrefixTaken when the prefix is used by another
+// connection. Close removes the values from the map, so the prefix can be
+// used by the connection created later, and Connect publishes them again.
+func PublishExpvar(prefix string) Option {
+	return func(o *Options) error {
+		if prefix == "" {
+			return fmt.Errorf("expvar prefix should not be empty")
+		}
+		o.ExpvarPrefix = prefix
+		return nil
+	}
+}
+
+// TLSSessionCache makes TLS sessions be resumed on Connect and reconnect
+// by caching up to capacity sessions (64 if it's zero). The cache is
+// created with the option, so connections created with the same option
+// share it. Whether the last handshake was resumed is reported by
+// DidResume of TLSConnectionState.
+func TLSSessionCache(capacity int) Option {
+	var cache tls.ClientSessionCache
+	if capacity >= 0 {
+		cache = tls.NewLRUClientSessionCache(capacity)
+	}
+
+	return func(o *Options) error {
+		if capacity < 0 {
+			return fmt.Errorf("TLS session cache capacity should not be negative, got %d", capacity)
+		}
+
+		cloneTLSConfig(o).ClientSessionCache = cache
+
+		return nil
+	}
+}
+
+// TLSUpgrade sets a TLSUpgrade option. TLS config is set with ClientCert,
+// RootCAs and SetTLSConfig options as for the TLS connection.
+func TLSUpgrade(hello func(c *Connection) error) Option {
+	return func(o *Options) error {
+		if hello == nil {
+			return fmt.Errorf("TLS upgrade hello should not be nil")
+		}
+		o.TLSUpgrade = hello
+		return nil
+	}
+}
+
+// AcceptTLSUpgrade sets an AcceptTLSUpgradeConfig option
+func AcceptTLSUpgrade(config *tls.Config) Option {
+	return func(o *Options) error {
+		if config == nil {
+			return fmt.Errorf("TLS config should not be nil")
+		}
+		o.AcceptTLSUpgradeConfig = config
+		return nil
+	}
+}
+
+// SetTLSConfig calls cfg with the copy of TLSConfig, which replaces it
+func SetTLSConfig(cfg func(*tls.Config)) Option {
+	return func(o *Options) error {
+		cfg(cloneTLSConfig(o))
 		return nil
 	}
 }
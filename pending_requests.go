@@ -0,0 +1,183 @@
+package connection
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/moov-io/iso8583"
+)
+
+// pendingRequest keeps the channels and timing of the Send waiting for the
+// reply. It's reused by Send calls, so requests and responses keep the
+// generation of its use and are ignored when it was reused.
+type pendingRequest struct {
+	replyCh chan *iso8583.Message
+	errCh   chan error
+	timing  requestTiming
+}
+
+var pendingRequestPool = sync.Pool{
+	New: func() interface{} {
+		return &pendingRequest{
+			replyCh: make(chan *iso8583.Message, 1),
+			errCh:   make(chan error, 1),
+		}
+	},
+}
+
+// getPendingRequest returns pending request from the pool and its new
+// generation
+func getPendingRequest() (*pendingRequest, uint64) {
+	pr := pendingRequestPool.Get().(*pendingRequest)
+
+	return pr, pr.timing.reuse()
+}
+
+// putPendingRequest returns pending request into the pool. It must be
+// called only when the reply or error delivered to it was received, so
+// its channels are empty.
+func putPendingRequest(pr *pendingRequest) {
+	pendingRequestPool.Put(pr)
+}
+
+// pendingRequests keeps requests that are waiting for the reply. Requests
+// are spread across lock-striped shards by the hash of the request ID, so
+// concurrent Send calls don't contend for a single lock.
+type pendingRequests struct {
+	shards []*pendingRequestsShard
+}
+
+type pendingRequestsShard struct {
+	mu       sync.Mutex
+	requests map[string]response
+}
+
+func newPendingRequests(shards int) *pendingRequests {
+	p := &pendingRequests{
+		shards: make([]*pendingRequestsShard, shards),
+	}
+
+	for i := range p.shards {
+		p.shards[i] = &pendingRequestsShard{
+			requests: make(map[string]response),
+		}
+	}
+
+	return p
+}
+
+func (p *pendingRequests) shard(reqID string) *pendingRequestsShard {
+	h := fnv.New32a()
+	h.Write([]byte(reqID))
+
+	return p.shards[h.Sum32()%uint32(len(p.shards))]
+}
+
+// add registers request waiting for the reply
+func (p *pendingRequests) add(reqID string, resp response) {
+	shard := p.shard(reqID)
+
+	shard.mu.Lock()
+	shard.requests[reqID] = resp
+	shard.mu.Unlock()
+}
+
+// remove removes request and reports whether it was pending. Only the caller
+// that removed the request may deliver reply or error to it.
+func (p *pendingRequests) remove(reqID string) (response, bool) {
+	shard := p.shard(reqID)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	resp, found := shard.requests[reqID]
+	delete(shard.requests, reqID)
+
+	return resp, found
+}
+
+// removeRequest removes request only if it's the one identified by errCh
+// and generation (and not another request with the same ID or the reused
+// pending request) and reports whether it was pending
+func (p *pendingRequests) removeRequest(reqID string, errCh chan error, gen uint64) bool {
+	_, found := p.take(reqID, errCh, gen)
+
+	return found
+}
+
+// take is removeRequest which returns the removed request
+func (p *pendingRequests) take(reqID string, errCh chan error, gen uint64) (response, bool) {
+	shard := p.shard(reqID)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	resp, found := shard.requests[reqID]
+	if !found || resp.errCh != errCh || resp.gen != gen {
+		return response{}, false
+	}
+
+	delete(shard.requests, reqID)
+
+	return resp, true
+}
+
+// has reports whether request is pending
+func (p *pendingRequests) has(reqID string) bool {
+	shard := p.shard(reqID)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	_, found := shard.requests[reqID]
+
+	return found
+}
+
+// removeAll removes all pending requests and returns them
+func (p *pendingRequests) removeAll() []response {
+	var removed []response
+
+	for _, shard := range p.shards {
+		shard.mu.Lock()
+		for reqID, resp := range shard.requests {
+			removed = append(removed, resp)
+			delete(shard.requests, reqID)
+		}
+		shard.mu.Unlock()
+	}
+
+	return removed
+}
+
+// list returns descriptors of the pending requests
+func (p *pendingRequests) list() []*PendingRequest {
+	var pending []*PendingRequest
+
+	for _, shard := range p.shards {
+		shard.mu.Lock()
+		for reqID, resp := range shard.requests {
+			pending = append(pending, &PendingRequest{
+				ID:      reqID,
+				Message: resp.message,
+				resp:    resp,
+			})
+		}
+		shard.mu.Unlock()
+	}
+
+	return pending
+}
+
+// len returns the number of pending requests
+func (p *pendingRequests) len() int {
+	var n int
+
+	for _, shard := range p.shards {
+		shard.mu.Lock()
+		n += len(shard.requests)
+		shard.mu.Unlock()
+	}
+
+	return n
+}
@@ -0,0 +1,157 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	connection "github.com/moov-io/iso8583-connection"
+)
+
+// ConnectCtx creates connections to all addresses and connects them
+// concurrently. It returns as soon as readyFraction of connections are
+// online, while the rest are connected in the background every
+// ReconnectWait. Connections that failed to connect are retried until ctx
+// is done. Then ConnectCtx closes all connections and returns the error
+// wrapping ctx.Err(). Addresses that failed to connect are returned by
+// ConnectErrors.
+func (p *Pool) ConnectCtx(ctx context.Context, readyFraction float64) error {
+	if readyFraction <= 0 || readyFraction > 1 {
+		return fmt.Errorf("ready fraction should be in (0, 1], got %v", readyFraction)
+	}
+
+	p.connectMu.Lock()
+	defer p.connectMu.Unlock()
+
+	p.mu.RLock()
+	closed, connected, weights := p.closed, p.connections != nil, p.Opts.Weights
+	p.mu.RUnlock()
+
+	if closed {
+		return ErrClosed
+	}
+
+	if connected {
+		return connection.ErrAlreadyConnected
+	}
+
+	connections, err := p.newConnections(weights)
+	if err != nil {
+		return err
+	}
+
+	// dialing goroutines are waited by Close
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		p.closeConnections(connections, nil)
+		return ErrClosed
+	}
+	p.wg.Add(len(connections))
+	p.mu.Unlock()
+
+	d := &dialing{
+		connected: make(chan struct{}, len(connections)),
+		aborted:   make(chan struct{}),
+	}
+	for _, pc := range connections {
+		p.setState(pc, StateConnecting, nil)
+		go p.dial(pc, d)
+	}
+
+	ready := int(math.Ceil(readyFraction * float64(len(connections))))
+	for n := 0; n < ready; n++ {
+		select {
+		case <-d.connected:
+		case <-ctx.Done():
+			d.abort()
+			p.closeConnections(connections, ctx.Err())
+			return fmt.Errorf("connected %d of %d required connections: %w", n, ready, ctx.Err())
+		case <-p.done:
+			d.abort()
+			p.closeConnections(connections, nil)
+			return ErrClosed
+		}
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		d.abort()
+		p.closeConnections(connections, nil)
+		return ErrClosed
+	}
+	p.start(connections)
+	p.mu.Unlock()
+
+	return nil
+}
+
+// dialing is the state of connections connected by ConnectCtx
+type dialing struct {
+	// connected receives a value when connection is connected
+	connected chan struct{}
+
+	// aborted is closed when ConnectCtx failed. Connections connected
+	// after that are closed.
+	mu        sync.Mutex
+	aborted   chan struct{}
+	isAborted bool
+}
+
+// abort stops connecting
+func (d *dialing) abort() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.isAborted {
+		d.isAborted = true
+		close(d.aborted)
+	}
+}
+
+// dial connects the connection every ReconnectWait until it's connected,
+// ConnectCtx failed or pool is closed
+func (p *Pool) dial(pc *pooledConnection, d *dialing) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.Opts.ReconnectWait)
+	defer ticker.Stop()
+
+	for {
+		err := pc.conn.Connect()
+		if errors.Is(err, connection.ErrAlreadyConnected) {
+			err = nil
+		}
+
+		d.mu.Lock()
+		aborted := d.isAborted
+		d.mu.Unlock()
+
+		if aborted {
+			if err == nil {
+				pc.conn.Close()
+				p.setState(pc, StateClosed, nil)
+			}
+			return
+		}
+
+		if err == nil {
+			d.connected <- struct{}{}
+			return
+		}
+
+		p.setConnectErr(pc, err)
+
+		select {
+		case <-d.aborted:
+			return
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package pool_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/moov-io/iso8583-connection/pool"
+	"github.com/moov-io/iso8583-connection/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPool_ConnectCtx(t *testing.T) {
+	t.Run("returns when ready fraction of connections is online", func(t *testing.T) {
+		reachableAddr := startServer(t)
+		unreachableAddr := freeAddr(t)
+
+		p, err := pool.New(factory(), []string{reachableAddr, unreachableAddr},
+			pool.ReconnectWait(20*time.Millisecond),
+		)
+		require.NoError(t, err)
+		defer p.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		require.NoError(t, p.ConnectCtx(ctx, 0.5))
+
+		conn, err := p.Get()
+		require.NoError(t, err)
+		require.Same(t, p.Connections()[0], conn)
+
+		// unreachable connection may still be dialed
+		require.Eventually(t, func() bool {
+			return p.ConnectErrors()[unreachableAddr] != nil
+		}, time.Second, 10*time.Millisecond)
+		require.Len(t, p.ConnectErrors(), 1)
+
+		// unreachable connection is connected in the background
+		srv := server.New(testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, srv.Start(unreachableAddr))
+		defer srv.Close()
+
+		require.Eventually(t, func() bool {
+			state, _ := p.State(unreachableAddr)
+			return state == pool.StateOnline
+		}, 2*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("returns context error when ready fraction is not met in time", func(t *testing.T) {
+		reachableAddr := startServer(t)
+		unreachableAddr := freeAddr(t)
+
+		p, err := pool.New(factory(), []string{reachableAddr, unreachableAddr},
+			pool.ReconnectWait(20*time.Millisecond),
+		)
+		require.NoError(t, err)
+		defer p.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		err = p.ConnectCtx(ctx, 1)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.Contains(t, p.ConnectErrors(), unreachableAddr)
+
+		// connections were closed
+		for _, addr := range []string{reachableAddr, unreachableAddr} {
+			state, _ := p.State(addr)
+			require.NotEqual(t, pool.StateOnline, state)
+		}
+		require.Empty(t, p.Connections())
+
+		_, err = p.Get()
+		require.ErrorIs(t, err, pool.ErrNoConnections)
+	})
+
+	t.Run("validates ready fraction", func(t *testing.T) {
+		p, err := pool.New(factory(), []string{startServer(t)})
+		require.NoError(t, err)
+		defer p.Close()
+
+		for _, fraction := range []float64{0, -0.5, 1.5} {
+			require.Error(t, p.ConnectCtx(context.Background(), fraction))
+		}
+	})
+
+	t.Run("fails when pool is already connected", func(t *testing.T) {
+		p, err := pool.New(factory(), []string{startServer(t)})
+		require.NoError(t, err)
+		defer p.Close()
+
+		require.NoError(t, p.ConnectCtx(context.Background(), 1))
+
+		err = p.ConnectCtx(context.Background(), 1)
+		require.ErrorIs(t, err, connection.ErrAlreadyConnected)
+	})
+}
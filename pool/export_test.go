@@ -0,0 +1,11 @@
+package pool
+
+import (
+	connection "github.com/moov-io/iso8583-connection"
+)
+
+// SetBeforeSend sets the hook Send calls with the selected connection
+// before the message is sent over it
+func (p *Pool) SetBeforeSend(hook func(c *connection.Connection)) {
+	p.beforeSend = hook
+}
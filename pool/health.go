@@ -0,0 +1,140 @@
+package pool
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	connection "github.com/moov-io/iso8583-connection"
+)
+
+// EventType is the type of the pool event
+type EventType string
+
+const (
+	// EventUnhealthy means connection failed HealthCheckFailures
+	// consecutive health checks, so it was removed from rotation and
+	// closed
+	EventUnhealthy EventType = "unhealthy"
+
+	// EventHealthy means unhealthy connection was connected again and
+	// returned into rotation
+	EventHealthy EventType = "healthy"
+)
+
+// Event is the event of the pool
+type Event struct {
+	Type EventType
+
+	// Addr is the address of the connection
+	Addr string
+
+	// Err is the error of the last health check for EventUnhealthy and
+	// the lookup error for EventSRVLookupFailed
+	Err error
+}
+
+// emit passes the event to EventHandler
+func (p *Pool) emit(event Event) {
+	if p.Opts.EventHandler != nil {
+		go p.Opts.EventHandler(event)
+	}
+}
+
+// checkHealth calls HealthCheck with the connection every
+// HealthCheckInterval until pool is closed or connection is removed.
+// Unhealthy connection is connected again instead.
+func (p *Pool) checkHealth(pc *pooledConnection) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.Opts.HealthCheckInterval)
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-pc.removed:
+			return
+		case <-ticker.C:
+		}
+
+		if atomic.LoadInt32(&pc.unhealthy) == 1 {
+			if err := pc.conn.Connect(); err != nil {
+				continue
+			}
+
+			failures = 0
+			atomic.StoreInt32(&pc.unhealthy, 0)
+			p.setState(pc, StateOnline, nil)
+			p.emit(Event{Type: EventHealthy, Addr: pc.addr})
+			p.notifyWaiters()
+			continue
+		}
+
+		// offline connections are connected by themselves or by
+		// the pool
+		if !pc.online() {
+			continue
+		}
+
+		err := p.Opts.HealthCheck(pc.conn)
+		if err == nil {
+			failures = 0
+			continue
+		}
+
+		failures++
+		if failures < p.Opts.HealthCheckFailures {
+			continue
+		}
+
+		atomic.StoreInt32(&pc.unhealthy, 1)
+		p.emit(Event{Type: EventUnhealthy, Addr: pc.addr, Err: err})
+		p.setState(pc, StateDegraded, err)
+		pc.conn.Close()
+	}
+}
+
+// Healthy returns nil when at least MinHealthy connections of the pool are
+// healthy, i.e. Healthy of the connection returns nil and it didn't fail
+// health checks. Otherwise, it returns connection.ErrUnhealthy with the
+// reasons of the unhealthy connections. It's suitable for readiness
+// probes.
+func (p *Pool) Healthy() error {
+	p.mu.RLock()
+	closed, connections := p.closed, p.connections
+	p.mu.RUnlock()
+
+	if closed {
+		return ErrClosed
+	}
+
+	healthy := 0
+	var reasons []string
+	for _, pc := range connections {
+		err := pc.conn.Healthy()
+		if err == nil && atomic.LoadInt32(&pc.unhealthy) == 1 {
+			err = fmt.Errorf("%w: health checks failed", connection.ErrUnhealthy)
+		}
+
+		if err != nil {
+			reasons = append(reasons, fmt.Sprintf("%s: %v", pc.addr, err))
+			continue
+		}
+		healthy++
+	}
+
+	if healthy >= p.Opts.MinHealthy {
+		return nil
+	}
+
+	err := fmt.Errorf("%w: %d of %d connections are healthy, need %d", connection.ErrUnhealthy, healthy, len(connections), p.Opts.MinHealthy)
+	if len(reasons) > 0 {
+		err = fmt.Errorf("%w (%s)", err, strings.Join(reasons, "; "))
+	}
+
+	return err
+}
@@ -0,0 +1,121 @@
+package pool_test
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/moov-io/iso8583-connection/pool"
+	"github.com/moov-io/iso8583-connection/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPool_HealthCheck(t *testing.T) {
+	healthyAddr := startServer(t, connection.InboundMessageHandler(reply))
+
+	// silentAddr is the server which stopped responding
+	silentAddr := startServer(t, connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {}))
+
+	var stan int32
+	ping := func(c *connection.Connection) error {
+		_, err := c.Send(newMessage(t, fmt.Sprintf("%06d", atomic.AddInt32(&stan, 1))))
+		return err
+	}
+
+	events := make(chan pool.Event, 10)
+	p, err := pool.New(factory(connection.SendTimeout(50*time.Millisecond)), []string{healthyAddr, silentAddr},
+		pool.HealthCheck(100*time.Millisecond, 2, ping),
+		pool.EventHandler(func(event pool.Event) {
+			events <- event
+		}),
+	)
+	require.NoError(t, err)
+	require.NoError(t, p.Connect())
+	defer p.Close()
+
+	select {
+	case event := <-events:
+		require.Equal(t, pool.EventUnhealthy, event.Type)
+		require.Equal(t, silentAddr, event.Addr)
+		require.ErrorIs(t, event.Err, connection.ErrSendTimeout)
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection was not evicted")
+	}
+
+	// only healthy connection is in rotation
+	for i := 0; i < 10; i++ {
+		c, err := p.Get()
+		require.NoError(t, err)
+		require.Same(t, p.Connections()[0], c)
+	}
+
+	// evicted connection is connected again and evicted again as
+	// server still doesn't respond, healthy connection is not evicted
+	deadline := time.After(2 * time.Second)
+	for seen := map[pool.EventType]bool{}; !seen[pool.EventHealthy] || !seen[pool.EventUnhealthy]; {
+		select {
+		case event := <-events:
+			require.Equal(t, silentAddr, event.Addr)
+			seen[event.Type] = true
+		case <-deadline:
+			t.Fatal("connection was not connected and evicted again")
+		}
+	}
+}
+
+func TestPool_Healthy(t *testing.T) {
+	t.Run("returns nil when at least MinHealthy connections are healthy", func(t *testing.T) {
+		addrs := startServers(t, 2)
+		p, err := pool.New(factory(), append(addrs, "127.0.0.1:1"), pool.MinHealthy(2), pool.ReconnectWait(time.Hour))
+		require.NoError(t, err)
+		require.NoError(t, p.Connect())
+		defer p.Close()
+
+		require.NoError(t, p.Healthy())
+	})
+
+	t.Run("returns error when less than MinHealthy connections are healthy", func(t *testing.T) {
+		addr := startServer(t)
+		p, err := pool.New(factory(), []string{addr, "127.0.0.1:1"}, pool.MinHealthy(2), pool.ReconnectWait(time.Hour))
+		require.NoError(t, err)
+		require.NoError(t, p.Connect())
+		defer p.Close()
+
+		err = p.Healthy()
+		require.ErrorIs(t, err, connection.ErrUnhealthy)
+		require.Contains(t, err.Error(), "1 of 2 connections are healthy, need 2")
+		require.Contains(t, err.Error(), "127.0.0.1:1: connection is unhealthy: connection is offline")
+	})
+
+	t.Run("returns error when all connections are down", func(t *testing.T) {
+		servers := make([]*server.Server, 2)
+		addrs := make([]string, 2)
+		for i := range servers {
+			servers[i] = server.New(testSpec, readMessageLength, writeMessageLength)
+			require.NoError(t, servers[i].Start("127.0.0.1:"))
+			addrs[i] = servers[i].Addr
+		}
+
+		p, err := pool.New(factory(), addrs, pool.ReconnectWait(time.Hour))
+		require.NoError(t, err)
+		require.NoError(t, p.Connect())
+		defer p.Close()
+
+		require.NoError(t, p.Healthy())
+
+		for _, srv := range servers {
+			srv.Close()
+		}
+
+		require.Eventually(t, func() bool {
+			return p.Healthy() != nil
+		}, time.Second, 10*time.Millisecond)
+
+		err = p.Healthy()
+		require.ErrorIs(t, err, connection.ErrUnhealthy)
+		require.Contains(t, err.Error(), "0 of 2 connections are healthy, need 1")
+	})
+}
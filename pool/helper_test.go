@@ -0,0 +1,98 @@
+package pool_test
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/moov-io/iso8583-connection/iso8583util"
+	"github.com/moov-io/iso8583-connection/server"
+	"github.com/moov-io/iso8583/network"
+	"github.com/moov-io/iso8583/specs"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+// TestMain checks that goroutines started by the tests exit by the time
+// they are done
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m)
+}
+
+var testSpec = specs.Spec87ASCII
+
+func readMessageLength(r io.Reader) (int, error) {
+	header := network.NewBinary2BytesHeader()
+	n, err := header.ReadFrom(r)
+	if err != nil {
+		return n, err
+	}
+
+	return header.Length(), nil
+}
+
+func writeMessageLength(w io.Writer, length int) (int, error) {
+	header := network.NewBinary2BytesHeader()
+	header.SetLength(length)
+
+	n, err := header.WriteTo(w)
+	if err != nil {
+		return n, fmt.Errorf("writing message header: %w", err)
+	}
+
+	return n, nil
+}
+
+// startServer starts the server with opts and returns its address. Server
+// is closed when the test finishes.
+func startServer(t *testing.T, opts ...connection.Option) string {
+	t.Helper()
+
+	srv := server.New(testSpec, readMessageLength, writeMessageLength, opts...)
+	require.NoError(t, srv.Start("127.0.0.1:"))
+	t.Cleanup(srv.Close)
+
+	return srv.Addr
+}
+
+// startServers starts n servers with opts and returns their addresses
+func startServers(t *testing.T, n int, opts ...connection.Option) []string {
+	t.Helper()
+
+	addrs := make([]string, n)
+	for i := range addrs {
+		addrs[i] = startServer(t, opts...)
+	}
+
+	return addrs
+}
+
+// reply responds to the message with STAN copied from it
+func reply(c *connection.Connection, message *iso8583.Message) {
+	response, err := iso8583util.NewResponseFrom(message, []int{11})
+	if err != nil {
+		return
+	}
+
+	c.Reply(response)
+}
+
+// newMessage returns the network management request with STAN
+func newMessage(t *testing.T, stan string) *iso8583.Message {
+	t.Helper()
+
+	message := iso8583.NewMessage(testSpec)
+	message.MTI("0800")
+	require.NoError(t, message.Field(11, stan))
+
+	return message
+}
+
+// factory creates connections with opts
+func factory(opts ...connection.Option) func(addr string) (*connection.Connection, error) {
+	return func(addr string) (*connection.Connection, error) {
+		return connection.New(addr, testSpec, readMessageLength, writeMessageLength, opts...)
+	}
+}
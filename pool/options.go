@@ -0,0 +1,271 @@
+package pool
+
+import (
+	"fmt"
+	"time"
+
+	connection "github.com/moov-io/iso8583-connection"
+)
+
+// Strategy defines how Get selects the connection among online
+// connections with positive weight
+type Strategy int
+
+const (
+	// RoundRobin selects connections in turn regardless of their
+	// weights
+	RoundRobin Strategy = iota
+
+	// WeightedRandom selects connection randomly with the probability
+	// proportional to its weight
+	WeightedRandom
+
+	// PriorityFailover selects the connection with the highest weight.
+	// Connections with lower weights are used only when connections with
+	// higher weights are offline. Connections with the same weight are
+	// selected in order of their addresses.
+	PriorityFailover
+)
+
+func (s Strategy) String() string {
+	switch s {
+	case RoundRobin:
+		return "round robin"
+	case WeightedRandom:
+		return "weighted random"
+	case PriorityFailover:
+		return "priority failover"
+	}
+
+	return fmt.Sprintf("strategy(%d)", int(s))
+}
+
+// DefaultWeight is the weight of the connection without WithWeight option
+const DefaultWeight = 1
+
+type Options struct {
+	// MinConnections is the number of connections Connect should
+	// establish, otherwise it fails. Default is 1.
+	MinConnections int
+
+	// ReconnectWait is the time between attempts to connect connections
+	// that failed to connect on Connect. Connections lost after they were
+	// established are reconnected by themselves when created with
+	// connection.AutoReconnect option. Default is 5 seconds.
+	ReconnectWait time.Duration
+
+	// Strategy of connection selection. Default is RoundRobin.
+	Strategy Strategy
+
+	// Weights of connections by address. Connections without weight have
+	// DefaultWeight. Weight 0 means no new requests are sent over the
+	// connection.
+	Weights map[string]int
+
+	// SendRetries is the number of times Send retries the message over
+	// another connection when the selected connection was closed or gave
+	// up reconnecting. Default is 1.
+	SendRetries int
+
+	// RetryWritten makes Send retry the message which writing was started
+	// when connection was closed, so the server may receive it twice.
+	// By default, only messages which were not written are retried.
+	RetryWritten bool
+
+	// HealthCheckInterval is the interval HealthCheck is called with
+	// each online connection. Health is not checked when it's zero.
+	HealthCheckInterval time.Duration
+
+	// HealthCheck checks the connection, e.g. sends the echo message
+	HealthCheck func(c *connection.Connection) error
+
+	// HealthCheckFailures is the number of consecutive HealthCheck
+	// failures after which connection is marked unhealthy, removed from
+	// rotation and closed. It's connected again every
+	// HealthCheckInterval. Default is 3.
+	HealthCheckFailures int
+
+	// MinHealthy is the number of healthy connections below which Healthy
+	// returns the error. Default is 1.
+	MinHealthy int
+
+	// EventHandler is called with the events of the pool, e.g. health
+	// state transitions of connections
+	EventHandler func(event Event)
+
+	// StateChangeHandler is called on every state transition of each
+	// connection of the pool. Transitions of the same connection are
+	// passed in order. It's never called while pool locks are held, but
+	// it blocks further transitions of the connection, so it should
+	// return quickly.
+	StateChangeHandler StateChangeHandler
+
+	// SRVRefreshInterval is the interval SRV records of the pool created
+	// by NewFromSRV are looked up again to add connections to new targets
+	// and remove connections to the targets which are gone. Default is 1
+	// minute.
+	SRVRefreshInterval time.Duration
+
+	// ExpvarPrefix is the name of expvar.Map the stats of the pool are
+	// published as. Stats are not published when it's empty.
+	ExpvarPrefix string
+}
+
+type Option func(*Options) error
+
+// GetDefaultOptions returns default options
+func GetDefaultOptions() Options {
+	return Options{
+		MinConnections:      1,
+		ReconnectWait:       5 * time.Second,
+		Strategy:            RoundRobin,
+		SendRetries:         1,
+		HealthCheckFailures: 3,
+		MinHealthy:          1,
+		SRVRefreshInterval:  time.Minute,
+	}
+}
+
+// MinConnections sets a MinConnections option
+func MinConnections(n int) Option {
+	return func(o *Options) error {
+		if n < 0 {
+			return fmt.Errorf("min connections should not be negative, got %d", n)
+		}
+		o.MinConnections = n
+		return nil
+	}
+}
+
+// ReconnectWait sets a ReconnectWait option
+func ReconnectWait(d time.Duration) Option {
+	return func(o *Options) error {
+		if d <= 0 {
+			return fmt.Errorf("reconnect wait should be positive, got %v", d)
+		}
+		o.ReconnectWait = d
+		return nil
+	}
+}
+
+// WithStrategy sets a Strategy option
+func WithStrategy(strategy Strategy) Option {
+	return func(o *Options) error {
+		switch strategy {
+		case RoundRobin, WeightedRandom, PriorityFailover:
+		default:
+			return fmt.Errorf("unknown strategy: %v", strategy)
+		}
+		o.Strategy = strategy
+		return nil
+	}
+}
+
+// WithWeight sets the weight of the connection to addr
+func WithWeight(addr string, weight int) Option {
+	return func(o *Options) error {
+		if weight < 0 {
+			return fmt.Errorf("weight of %s should not be negative, got %d", addr, weight)
+		}
+
+		weights := make(map[string]int, len(o.Weights)+1)
+		for a, w := range o.Weights {
+			weights[a] = w
+		}
+		weights[addr] = weight
+		o.Weights = weights
+
+		return nil
+	}
+}
+
+// SendRetries sets a SendRetries option
+func SendRetries(n int) Option {
+	return func(o *Options) error {
+		if n < 0 {
+			return fmt.Errorf("send retries should not be negative, got %d", n)
+		}
+		o.SendRetries = n
+		return nil
+	}
+}
+
+// RetryWritten sets a RetryWritten option
+func RetryWritten() Option {
+	return func(o *Options) error {
+		o.RetryWritten = true
+		return nil
+	}
+}
+
+// HealthCheck sets HealthCheckInterval, HealthCheckFailures and
+// HealthCheck options
+func HealthCheck(interval time.Duration, failures int, check func(c *connection.Connection) error) Option {
+	return func(o *Options) error {
+		if interval <= 0 {
+			return fmt.Errorf("health check interval should be positive, got %v", interval)
+		}
+		if failures <= 0 {
+			return fmt.Errorf("health check failures should be positive, got %d", failures)
+		}
+		if check == nil {
+			return fmt.Errorf("health check should not be nil")
+		}
+		o.HealthCheckInterval = interval
+		o.HealthCheckFailures = failures
+		o.HealthCheck = check
+		return nil
+	}
+}
+
+// MinHealthy sets a MinHealthy option
+func MinHealthy(n int) Option {
+	return func(o *Options) error {
+		if n <= 0 {
+			return fmt.Errorf("min healthy connections should be positive, got %d", n)
+		}
+		o.MinHealthy = n
+		return nil
+	}
+}
+
+// EventHandler sets an EventHandler option
+func EventHandler(handler func(event Event)) Option {
+	return func(o *Options) error {
+		o.EventHandler = handler
+		return nil
+	}
+}
+
+// NotifyStateChange sets a StateChangeHandler option
+func NotifyStateChange(handler StateChangeHandler) Option {
+	return func(o *Options) error {
+		o.StateChangeHandler = handler
+		return nil
+	}
+}
+
+// SRVRefreshInterval sets a SRVRefreshInterval option
+func SRVRefreshInterval(d time.Duration) Option {
+	return func(o *Options) error {
+		if d <= 0 {
+			return fmt.Errorf("SRV refresh interval should be positive, got %v", d)
+		}
+		o.SRVRefreshInterval = d
+		return nil
+	}
+}
+
+// PublishExpvar publishes stats of the pool as expvar.Map named prefix
+// with the values of each connection by its address and the values summed
+// for all connections as "total". Values have the same names as the ones
+// of connection.PublishExpvar.
+func PublishExpvar(prefix string) Option {
+	return func(o *Options) error {
+		if prefix == "" {
+			return fmt.Errorf("expvar prefix should not be empty")
+		}
+		o.ExpvarPrefix = prefix
+		return nil
+	}
+}
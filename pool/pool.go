@@ -0,0 +1,502 @@
+// Package pool keeps connections to several addresses of the same host,
+// e.g. links to primary and backup datacenters, and selects the
+// connection each request is sent over.
+package pool
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	connection "github.com/moov-io/iso8583-connection"
+)
+
+var (
+	// ErrNoConnections is returned by Get when there is no online
+	// connection with positive weight
+	ErrNoConnections = errors.New("no online connections")
+
+	// ErrClosed is returned when pool is closed
+	ErrClosed = errors.New("pool is closed")
+
+	// ErrUnknownAddr is returned by SetWeight when pool has no
+	// connection to the address
+	ErrUnknownAddr = errors.New("unknown address")
+)
+
+// ConnectionFactoryFunc creates the connection to addr. Connection is
+// connected by the pool. It should be created with
+// connection.AutoReconnect option to be reconnected when it's lost.
+type ConnectionFactoryFunc func(addr string) (*connection.Connection, error)
+
+// Pool is the pool of connections. It may be used by multiple goroutines
+// simultaneously.
+type Pool struct {
+	// counter of Get calls used by RoundRobin. It's updated atomically
+	// and kept first to be 64-bit aligned.
+	next uint64
+
+	Factory ConnectionFactoryFunc
+	Opts    Options
+
+	// Addrs of the pool created by NewFromSRV are updated on SRV refresh
+	// under pool locks, use Connections or State to inspect them
+	Addrs []string
+
+	// connectMu serializes Connect calls
+	connectMu sync.Mutex
+
+	// connections in order of Addrs, created by Connect
+	mu          sync.RWMutex
+	connections []*pooledConnection
+	closed      bool
+
+	// errors of connections that failed to connect on Connect by their
+	// addresses
+	connectErrs map[string]error
+
+	// closed when pool is closed to stop connecting
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	// GetCtx calls waiting for the connection
+	waitersMu sync.Mutex
+	waiters   *list.List
+
+	// srv is the service which SRV records are looked up by srvResolver
+	// to refresh Addrs, set by NewFromSRV
+	srv         *connection.SRVService
+	srvResolver connection.SRVResolver
+
+	// nextID is the id of the next connection created by the pool. It's
+	// protected by connectMu.
+	nextID int
+
+	// beforeSend is called by Send with the selected connection, so tests
+	// can close it before the message is written
+	beforeSend func(c *connection.Connection)
+}
+
+// pooledConnection is the connection with its weight
+type pooledConnection struct {
+	addr string
+	conn *connection.Connection
+
+	// id is the index of addr in Addrs passed to StateChangeHandler.
+	// Connections added by the SRV refresh get the next free ids.
+	id string
+
+	// removed is closed when the address is gone from SRV records, so
+	// connecting and health checks of the connection stop
+	removed chan struct{}
+
+	state connectionState
+
+	// weight is updated atomically by SetWeight
+	weight int32
+
+	// unhealthy is set to 1 when connection failed health checks
+	unhealthy int32
+}
+
+// online reports whether connection is established
+func (pc *pooledConnection) online() bool {
+	return pc.conn.Status() == connection.StatusOnline
+}
+
+// New returns the pool of connections to addrs created by factory
+func New(factory ConnectionFactoryFunc, addrs []string, options ...Option) (*Pool, error) {
+	opts := GetDefaultOptions()
+	for _, opt := range options {
+		if err := opt(&opts); err != nil {
+			return nil, fmt.Errorf("setting pool option: %w", err)
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("pool needs at least one address")
+	}
+
+	if opts.MinConnections > len(addrs) {
+		return nil, fmt.Errorf("min connections %d exceed number of addresses %d", opts.MinConnections, len(addrs))
+	}
+
+	p := &Pool{
+		Factory: factory,
+		Addrs:   append([]string(nil), addrs...),
+		Opts:    opts,
+		done:    make(chan struct{}),
+		waiters: list.New(),
+	}
+
+	if opts.ExpvarPrefix != "" {
+		if err := p.publishExpvar(); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// Connect creates and connects connections to all addresses. It fails if
+// less than MinConnections were connected. Connections that failed to
+// connect are connected in the background every ReconnectWait.
+func (p *Pool) Connect() error {
+	// connections are dialed without pool locks, so state changes are
+	// not reported while they are held
+	p.connectMu.Lock()
+	defer p.connectMu.Unlock()
+
+	p.mu.RLock()
+	closed, connected, weights := p.closed, p.connections != nil, p.Opts.Weights
+	p.mu.RUnlock()
+
+	if closed {
+		return ErrClosed
+	}
+
+	if connected {
+		return connection.ErrAlreadyConnected
+	}
+
+	connections, err := p.newConnections(weights)
+	if err != nil {
+		return err
+	}
+
+	var failed []*pooledConnection
+	var connectErr error
+	for _, pc := range connections {
+		p.setState(pc, StateConnecting, nil)
+		if err := pc.conn.Connect(); err != nil {
+			failed = append(failed, pc)
+			connectErr = err
+			p.setConnectErr(pc, err)
+		}
+	}
+
+	if connected := len(connections) - len(failed); connected < p.Opts.MinConnections {
+		p.closeConnections(connections, connectErr)
+		return fmt.Errorf("connected %d of %d min connections: %w", connected, p.Opts.MinConnections, connectErr)
+	}
+
+	p.mu.Lock()
+
+	// pool was closed while connections were dialed
+	if p.closed {
+		p.mu.Unlock()
+		p.closeConnections(connections, nil)
+		return ErrClosed
+	}
+
+	for _, pc := range failed {
+		p.wg.Add(1)
+		go p.connectInBackground(pc)
+	}
+
+	p.start(connections)
+	p.mu.Unlock()
+
+	return nil
+}
+
+// newConnections creates connections to all addresses with factory
+func (p *Pool) newConnections(weights map[string]int) ([]*pooledConnection, error) {
+	connections := make([]*pooledConnection, 0, len(p.Addrs))
+	for i, addr := range p.Addrs {
+		pc, err := p.newConnection(strconv.Itoa(i), addr, weights)
+		if err != nil {
+			for _, pc := range connections {
+				pc.conn.Close()
+			}
+			return nil, err
+		}
+
+		connections = append(connections, pc)
+	}
+	p.nextID = len(p.Addrs)
+
+	return connections, nil
+}
+
+// newConnection creates the connection to addr with factory
+func (p *Pool) newConnection(id, addr string, weights map[string]int) (*pooledConnection, error) {
+	conn, err := p.Factory(addr)
+	if err != nil {
+		return nil, fmt.Errorf("creating connection to %s: %w", addr, err)
+	}
+
+	pc := &pooledConnection{
+		addr:    addr,
+		conn:    conn,
+		id:      id,
+		removed: make(chan struct{}),
+	}
+
+	// wake up GetCtx calls when connection is established and track
+	// state of the connection
+	opts := conn.Options()
+	established := opts.ConnectionEstablishedHandler
+	closed := opts.ConnectionClosedHandler
+	err = conn.SetOptions(
+		connection.ConnectionEstablishedHandler(func(c *connection.Connection) {
+			if established != nil {
+				established(c)
+			}
+			p.setState(pc, StateOnline, nil)
+			p.notifyWaiters()
+		}),
+		connection.ConnectionClosedHandler(func(c *connection.Connection) {
+			if closed != nil {
+				closed(c)
+			}
+			p.connectionClosed(pc, c)
+		}),
+	)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("setting options of connection to %s: %w", addr, err)
+	}
+
+	weight, found := weights[addr]
+	if !found {
+		weight = DefaultWeight
+	}
+	pc.weight = int32(weight)
+
+	return pc, nil
+}
+
+// closeConnections closes connections that were not added to the pool
+func (p *Pool) closeConnections(connections []*pooledConnection, err error) {
+	for _, pc := range connections {
+		pc.conn.Close()
+		p.setState(pc, StateClosed, err)
+	}
+}
+
+// start adds connections to the pool and starts checking their health
+// and refreshing SRV records. It should be called with mu held.
+func (p *Pool) start(connections []*pooledConnection) {
+	p.connections = connections
+
+	if p.Opts.HealthCheckInterval > 0 {
+		for _, pc := range connections {
+			p.wg.Add(1)
+			go p.checkHealth(pc)
+		}
+	}
+
+	if p.srv != nil {
+		p.wg.Add(1)
+		go p.refreshSRV()
+	}
+}
+
+// setConnectErr records the error connection failed to connect with on
+// Connect
+func (p *Pool) setConnectErr(pc *pooledConnection, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.connectErrs == nil {
+		p.connectErrs = make(map[string]error)
+	}
+	p.connectErrs[pc.addr] = err
+}
+
+// ConnectErrors returns errors of connections which failed to connect on
+// Connect or ConnectCtx by their addresses. Such connections are connected
+// in the background.
+func (p *Pool) ConnectErrors() map[string]error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	errs := make(map[string]error, len(p.connectErrs))
+	for addr, err := range p.connectErrs {
+		errs[addr] = err
+	}
+
+	return errs
+}
+
+// connectInBackground connects the connection every ReconnectWait until
+// it's connected, removed or pool is closed
+func (p *Pool) connectInBackground(pc *pooledConnection) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.Opts.ReconnectWait)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-pc.removed:
+			return
+		case <-ticker.C:
+		}
+
+		err := pc.conn.Connect()
+		if err == nil || errors.Is(err, connection.ErrAlreadyConnected) {
+			return
+		}
+	}
+}
+
+// Connections returns connections of the pool in order of Addrs
+func (p *Pool) Connections() []*connection.Connection {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	conns := make([]*connection.Connection, len(p.connections))
+	for i, pc := range p.connections {
+		conns[i] = pc.conn
+	}
+
+	return conns
+}
+
+// Get returns the online connection with positive weight selected by
+// Strategy or ErrNoConnections if there is none
+func (p *Pool) Get() (*connection.Connection, error) {
+	pc, err := p.get(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return pc.conn, nil
+}
+
+// get selects the connection which is not in exclude
+func (p *Pool) get(exclude map[*pooledConnection]bool) (*pooledConnection, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		return nil, ErrClosed
+	}
+
+	candidates := make([]*pooledConnection, 0, len(p.connections))
+	totalWeight := 0
+	for _, pc := range p.connections {
+		weight := int(atomic.LoadInt32(&pc.weight))
+		if weight == 0 || exclude[pc] || atomic.LoadInt32(&pc.unhealthy) == 1 || !pc.online() {
+			continue
+		}
+
+		candidates = append(candidates, pc)
+		totalWeight += weight
+	}
+
+	if len(candidates) == 0 {
+		return nil, ErrNoConnections
+	}
+
+	return p.selectConnection(candidates, totalWeight), nil
+}
+
+// selectConnection selects one of the candidates by Strategy
+func (p *Pool) selectConnection(candidates []*pooledConnection, totalWeight int) *pooledConnection {
+	switch p.Opts.Strategy {
+	case WeightedRandom:
+		n := rand.Intn(totalWeight)
+		for _, pc := range candidates {
+			n -= int(atomic.LoadInt32(&pc.weight))
+			if n < 0 {
+				return pc
+			}
+		}
+
+		// weight was changed concurrently
+		return candidates[len(candidates)-1]
+
+	case PriorityFailover:
+		selected := candidates[0]
+		for _, pc := range candidates[1:] {
+			if atomic.LoadInt32(&pc.weight) > atomic.LoadInt32(&selected.weight) {
+				selected = pc
+			}
+		}
+
+		return selected
+	}
+
+	n := atomic.AddUint64(&p.next, 1) - 1
+
+	return candidates[n%uint64(len(candidates))]
+}
+
+// SetWeight changes the weight of the connection to addr. Weight 0 drains
+// the connection: requests pending on it get their responses, but Get
+// doesn't return it.
+func (p *Pool) SetWeight(addr string, weight int) error {
+	if weight < 0 {
+		return fmt.Errorf("weight of %s should not be negative, got %d", addr, weight)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, pc := range p.connections {
+		if pc.addr == addr {
+			atomic.StoreInt32(&pc.weight, int32(weight))
+			if weight > 0 {
+				p.notifyWaiters()
+			}
+			return nil
+		}
+	}
+
+	// weight is used by Connect
+	for _, a := range p.Addrs {
+		if a == addr {
+			return WithWeight(addr, weight)(&p.Opts)
+		}
+	}
+
+	return fmt.Errorf("setting weight of %s: %w", addr, ErrUnknownAddr)
+}
+
+// Close stops connecting and closes all connections of the pool without
+// draining them. Use Shutdown to let pending requests complete first.
+func (p *Pool) Close() error {
+	connections, ok := p.stop()
+	if !ok {
+		return nil
+	}
+
+	var closeErr error
+	for _, pc := range connections {
+		if err := pc.conn.Close(); err != nil && closeErr == nil {
+			closeErr = fmt.Errorf("closing connection to %s: %w", pc.addr, err)
+		}
+		p.setState(pc, StateClosed, nil)
+	}
+
+	return closeErr
+}
+
+// stop marks pool closed, so it doesn't hand out connections, and waits
+// for background connecting and health checks to stop. It returns
+// connections of the pool and false if pool was closed already.
+func (p *Pool) stop() ([]*pooledConnection, bool) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, false
+	}
+	p.closed = true
+	close(p.done)
+	connections := p.connections
+	p.mu.Unlock()
+
+	p.wg.Wait()
+
+	return connections, true
+}
@@ -0,0 +1,142 @@
+package pool_test
+
+import (
+	"testing"
+	"time"
+
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/moov-io/iso8583-connection/pool"
+	"github.com/stretchr/testify/require"
+)
+
+// getCounts returns how many of n Gets returned each connection of the
+// pool, in order of addresses
+func getCounts(t *testing.T, p *pool.Pool, n int) []int {
+	t.Helper()
+
+	index := make(map[*connection.Connection]int)
+	for i, c := range p.Connections() {
+		index[c] = i
+	}
+
+	counts := make([]int, len(index))
+	for i := 0; i < n; i++ {
+		c, err := p.Get()
+		require.NoError(t, err)
+		counts[index[c]]++
+	}
+
+	return counts
+}
+
+func TestPool_Connect(t *testing.T) {
+	addrs := startServers(t, 2)
+
+	t.Run("connects all connections", func(t *testing.T) {
+		p, err := pool.New(factory(), addrs)
+		require.NoError(t, err)
+		require.NoError(t, p.Connect())
+		defer p.Close()
+
+		for _, c := range p.Connections() {
+			require.Equal(t, connection.StatusOnline, c.Status())
+		}
+	})
+
+	t.Run("fails when less than MinConnections are connected", func(t *testing.T) {
+		p, err := pool.New(factory(), []string{addrs[0], "127.0.0.1:1"}, pool.MinConnections(2))
+		require.NoError(t, err)
+		require.Error(t, p.Connect())
+		require.Empty(t, p.Connections())
+
+		_, err = p.Get()
+		require.ErrorIs(t, err, pool.ErrNoConnections)
+	})
+
+	t.Run("skips connections which failed to connect", func(t *testing.T) {
+		p, err := pool.New(factory(), []string{addrs[0], "127.0.0.1:1"}, pool.ReconnectWait(time.Hour))
+		require.NoError(t, err)
+		require.NoError(t, p.Connect())
+		defer p.Close()
+
+		require.Equal(t, []int{10, 0}, getCounts(t, p, 10))
+	})
+}
+
+func TestPool_Strategy(t *testing.T) {
+	addrs := startServers(t, 2)
+
+	t.Run("RoundRobin ignores weights", func(t *testing.T) {
+		p, err := pool.New(factory(), addrs, pool.WithWeight(addrs[0], 3))
+		require.NoError(t, err)
+		require.NoError(t, p.Connect())
+		defer p.Close()
+
+		require.Equal(t, []int{50, 50}, getCounts(t, p, 100))
+	})
+
+	t.Run("WeightedRandom distributes by weights", func(t *testing.T) {
+		p, err := pool.New(factory(), addrs,
+			pool.WithStrategy(pool.WeightedRandom),
+			pool.WithWeight(addrs[0], 3),
+			pool.WithWeight(addrs[1], 1),
+		)
+		require.NoError(t, err)
+		require.NoError(t, p.Connect())
+		defer p.Close()
+
+		counts := getCounts(t, p, 1000)
+		require.InDelta(t, 750, counts[0], 60)
+		require.Equal(t, 1000, counts[0]+counts[1])
+	})
+
+	t.Run("PriorityFailover uses connection with the highest weight", func(t *testing.T) {
+		p, err := pool.New(factory(), addrs,
+			pool.WithStrategy(pool.PriorityFailover),
+			pool.WithWeight(addrs[1], 2),
+		)
+		require.NoError(t, err)
+		require.NoError(t, p.Connect())
+		defer p.Close()
+
+		require.Equal(t, []int{0, 10}, getCounts(t, p, 10))
+
+		// fail over when primary is offline
+		require.NoError(t, p.Connections()[1].Close())
+		require.Equal(t, []int{10, 0}, getCounts(t, p, 10))
+	})
+}
+
+func TestPool_SetWeight(t *testing.T) {
+	addrs := startServers(t, 2)
+
+	p, err := pool.New(factory(), addrs, pool.WithStrategy(pool.WeightedRandom))
+	require.NoError(t, err)
+	require.NoError(t, p.Connect())
+	defer p.Close()
+
+	t.Run("zero weight drains the connection", func(t *testing.T) {
+		require.NoError(t, p.SetWeight(addrs[0], 0))
+		require.Equal(t, []int{0, 100}, getCounts(t, p, 100))
+
+		// drained connection stays online for pending requests
+		require.Equal(t, connection.StatusOnline, p.Connections()[0].Status())
+
+		require.NoError(t, p.SetWeight(addrs[1], 0))
+		_, err := p.Get()
+		require.ErrorIs(t, err, pool.ErrNoConnections)
+	})
+
+	t.Run("changes distribution at runtime", func(t *testing.T) {
+		require.NoError(t, p.SetWeight(addrs[0], 1))
+		require.NoError(t, p.SetWeight(addrs[1], 3))
+
+		counts := getCounts(t, p, 1000)
+		require.InDelta(t, 750, counts[1], 60)
+	})
+
+	t.Run("fails for unknown address", func(t *testing.T) {
+		require.ErrorIs(t, p.SetWeight("127.0.0.1:1", 1), pool.ErrUnknownAddr)
+		require.Error(t, p.SetWeight(addrs[0], -1))
+	})
+}
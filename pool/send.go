@@ -0,0 +1,105 @@
+package pool
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+)
+
+// SendError is returned by Send when the message was not sent or its
+// response was not received
+type SendError struct {
+	// Addr is the address of the connection which failed the request
+	// last. It's empty if no connection was selected.
+	Addr string
+
+	// Attempts is the number of connections the message was sent over
+	Attempts int
+
+	Err error
+}
+
+func (e *SendError) Error() string {
+	if e.Addr == "" {
+		return fmt.Sprintf("sending message: %v", e.Err)
+	}
+
+	return fmt.Sprintf("sending message over %s (attempt %d): %v", e.Addr, e.Attempts, e.Err)
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+// Send sends the message over the connection selected as by Get and
+// waits for the response. When the connection is closed before the
+// message is written, e.g. it was lost after it was selected, or it gave
+// up reconnecting, the message is sent over another connection up to
+// SendRetries times. Messages which writing was started are retried only
+// with RetryWritten option. As connection changes the message it sends
+// (sets STAN and time fields, scrubs ScrubFields), retries send the copy
+// of the message made before the first attempt. Errors are returned as
+// SendError with the address of the connection which failed the request
+// last.
+func (p *Pool) Send(message *iso8583.Message) (*iso8583.Message, error) {
+	var pristine *iso8583.Message
+	if p.Opts.SendRetries > 0 {
+		var err error
+		pristine, err = message.Clone()
+		if err != nil {
+			return nil, &SendError{Err: fmt.Errorf("copying message to retry: %w", err)}
+		}
+	}
+
+	tried := make(map[*pooledConnection]bool)
+
+	var sendErr *SendError
+	for attempt := 1; attempt <= p.Opts.SendRetries+1; attempt++ {
+		pc, err := p.get(tried)
+		if err != nil {
+			if sendErr != nil {
+				// error of the last attempt is more relevant
+				return nil, sendErr
+			}
+			return nil, &SendError{Err: err}
+		}
+		tried[pc] = true
+
+		if attempt > 1 {
+			message, err = pristine.Clone()
+			if err != nil {
+				return nil, sendErr
+			}
+		}
+
+		if p.beforeSend != nil {
+			p.beforeSend(pc.conn)
+		}
+
+		response, info, err := pc.conn.SendWithInfo(message)
+		if err == nil {
+			return response, nil
+		}
+
+		sendErr = &SendError{
+			Addr:     pc.addr,
+			Attempts: attempt,
+			Err:      err,
+		}
+
+		if !retriable(err) || (info.Written && !p.Opts.RetryWritten) {
+			break
+		}
+	}
+
+	return nil, sendErr
+}
+
+// retriable returns true when the message may be sent over another
+// connection after it failed with err
+func retriable(err error) bool {
+	return errors.Is(err, connection.ErrConnectionClosed) ||
+		errors.Is(err, connection.ErrReconnectExhausted)
+}
@@ -0,0 +1,149 @@
+package pool_test
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/moov-io/iso8583-connection/pool"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPool_Send(t *testing.T) {
+	var received int32
+	addrs := startServers(t, 2, connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+		atomic.AddInt32(&received, 1)
+		reply(c, message)
+	}))
+
+	// droppingAddr is the server which closes connection when message
+	// is received
+	droppingAddr := startServer(t, connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+		c.Close()
+	}))
+
+	t.Run("sends message over selected connection", func(t *testing.T) {
+		p, err := pool.New(factory(), addrs)
+		require.NoError(t, err)
+		require.NoError(t, p.Connect())
+		defer p.Close()
+
+		response, err := p.Send(newMessage(t, "000001"))
+		require.NoError(t, err)
+
+		stan, err := response.GetString(11)
+		require.NoError(t, err)
+		require.Equal(t, "000001", stan)
+	})
+
+	t.Run("retries over another connection when selected one was closed", func(t *testing.T) {
+		p, err := pool.New(factory(), addrs)
+		require.NoError(t, err)
+		require.NoError(t, p.Connect())
+		defer p.Close()
+
+		var closed *connection.Connection
+		p.SetBeforeSend(func(c *connection.Connection) {
+			if closed == nil {
+				closed = c
+				require.NoError(t, c.Close())
+			}
+		})
+
+		before := atomic.LoadInt32(&received)
+
+		response, err := p.Send(newMessage(t, "000002"))
+		require.NoError(t, err)
+		require.NotNil(t, response)
+		require.Equal(t, before+1, atomic.LoadInt32(&received))
+	})
+
+	t.Run("retries message as it was before the first attempt", func(t *testing.T) {
+		pans := make(chan string, 1)
+		recordingAddr := startServer(t, connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+			pan, _ := message.GetString(2)
+			pans <- pan
+			reply(c, message)
+		}))
+
+		// message is scrubbed after it was written to the dropping
+		// server
+		p, err := pool.New(factory(connection.ScrubFields([]int{2})), []string{droppingAddr, recordingAddr},
+			pool.WithStrategy(pool.PriorityFailover),
+			pool.RetryWritten(),
+		)
+		require.NoError(t, err)
+		require.NoError(t, p.Connect())
+		defer p.Close()
+
+		message := newMessage(t, "000007")
+		require.NoError(t, message.Field(2, "4242424242424242"))
+
+		_, err = p.Send(message)
+		require.NoError(t, err)
+		require.Equal(t, "4242424242424242", <-pans)
+	})
+
+	t.Run("returns SendError when retries are exhausted", func(t *testing.T) {
+		p, err := pool.New(factory(), addrs, pool.SendRetries(0))
+		require.NoError(t, err)
+		require.NoError(t, p.Connect())
+		defer p.Close()
+
+		var closedAddr string
+		p.SetBeforeSend(func(c *connection.Connection) {
+			closedAddr = c.RemoteAddr().String()
+			require.NoError(t, c.Close())
+		})
+
+		_, err = p.Send(newMessage(t, "000003"))
+		require.ErrorIs(t, err, connection.ErrConnectionClosed)
+
+		var sendErr *pool.SendError
+		require.ErrorAs(t, err, &sendErr)
+		require.Equal(t, closedAddr, sendErr.Addr)
+		require.Equal(t, 1, sendErr.Attempts)
+	})
+
+	t.Run("doesn't retry written message", func(t *testing.T) {
+		p, err := pool.New(factory(), []string{droppingAddr, addrs[0]}, pool.WithStrategy(pool.PriorityFailover))
+		require.NoError(t, err)
+		require.NoError(t, p.Connect())
+		defer p.Close()
+
+		before := atomic.LoadInt32(&received)
+
+		_, err = p.Send(newMessage(t, "000004"))
+		require.ErrorIs(t, err, connection.ErrConnectionClosed)
+
+		var sendErr *pool.SendError
+		require.ErrorAs(t, err, &sendErr)
+		require.Equal(t, droppingAddr, sendErr.Addr)
+		require.Equal(t, before, atomic.LoadInt32(&received))
+	})
+
+	t.Run("retries written message with RetryWritten", func(t *testing.T) {
+		p, err := pool.New(factory(), []string{droppingAddr, addrs[0]},
+			pool.WithStrategy(pool.PriorityFailover),
+			pool.RetryWritten(),
+		)
+		require.NoError(t, err)
+		require.NoError(t, p.Connect())
+		defer p.Close()
+
+		before := atomic.LoadInt32(&received)
+
+		_, err = p.Send(newMessage(t, "000005"))
+		require.NoError(t, err)
+		require.Equal(t, before+1, atomic.LoadInt32(&received))
+	})
+
+	t.Run("fails when there are no connections", func(t *testing.T) {
+		p, err := pool.New(factory(), addrs)
+		require.NoError(t, err)
+
+		_, err = p.Send(newMessage(t, "000006"))
+		require.ErrorIs(t, err, pool.ErrNoConnections)
+	})
+}
@@ -0,0 +1,92 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ShutdownError is returned by Shutdown when some connections were not
+// drained or closed cleanly
+type ShutdownError struct {
+	// Errors of connections by their addresses
+	Errors map[string]error
+}
+
+func (e *ShutdownError) Error() string {
+	addrs := make([]string, 0, len(e.Errors))
+	for addr := range e.Errors {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	failures := make([]string, len(addrs))
+	for i, addr := range addrs {
+		failures[i] = fmt.Sprintf("%s: %v", addr, e.Errors[addr])
+	}
+
+	return fmt.Sprintf("shutting down %d connections: %s", len(addrs), strings.Join(failures, "; "))
+}
+
+// Is reports whether error of any connection matches target, e.g.
+// context.DeadlineExceeded when connections were closed before they were
+// drained
+func (e *ShutdownError) Is(target error) bool {
+	for _, err := range e.Errors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Shutdown gracefully closes the pool. It stops handing out connections,
+// drains all connections concurrently, so their pending requests get
+// responses, and closes them. Connections which were not drained when ctx
+// is done are closed right away, while requests being sent over them are
+// waited for up to their SendTimeout. Errors of connections are returned
+// as ShutdownError.
+func (p *Pool) Shutdown(ctx context.Context) error {
+	connections, ok := p.stop()
+	if !ok {
+		return nil
+	}
+
+	var mu sync.Mutex
+	errs := make(map[string]error)
+
+	var wg sync.WaitGroup
+	for _, pc := range connections {
+		wg.Add(1)
+		go func(pc *pooledConnection) {
+			defer wg.Done()
+
+			err := pc.conn.Drain(ctx)
+			if err != nil {
+				err = fmt.Errorf("draining connection: %w", err)
+			}
+
+			if closeErr := pc.conn.Close(); closeErr != nil && err == nil {
+				err = fmt.Errorf("closing connection: %w", closeErr)
+			}
+			p.setState(pc, StateClosed, err)
+
+			if err != nil {
+				mu.Lock()
+				errs[pc.addr] = err
+				mu.Unlock()
+			}
+		}(pc)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return &ShutdownError{Errors: errs}
+	}
+
+	return nil
+}
@@ -0,0 +1,124 @@
+package pool_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/moov-io/iso8583-connection/pool"
+	"github.com/stretchr/testify/require"
+)
+
+// startDelayedServers starts n servers which reply after delay and
+// returns their addresses and the number of received requests
+func startDelayedServers(t *testing.T, n int, delay time.Duration) ([]string, *int32) {
+	t.Helper()
+
+	var received int32
+	addrs := startServers(t, n, connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {
+		atomic.AddInt32(&received, 1)
+		time.Sleep(delay)
+		reply(c, message)
+	}))
+
+	return addrs, &received
+}
+
+func TestPool_Shutdown(t *testing.T) {
+	t.Run("waits for requests in flight on all connections", func(t *testing.T) {
+		addrs, received := startDelayedServers(t, 2, 300*time.Millisecond)
+
+		p, err := pool.New(factory(), addrs, pool.MinConnections(2))
+		require.NoError(t, err)
+		require.NoError(t, p.Connect())
+
+		// round robin sends requests over both connections
+		var wg sync.WaitGroup
+		sendErrs := make([]error, 2)
+		for i, stan := range []string{"000001", "000002"} {
+			wg.Add(1)
+			go func(i int, stan string) {
+				defer wg.Done()
+
+				response, err := p.Send(newMessage(t, stan))
+				if err == nil {
+					_, err = response.GetString(11)
+				}
+				sendErrs[i] = err
+			}(i, stan)
+		}
+
+		require.Eventually(t, func() bool {
+			return atomic.LoadInt32(received) == 2
+		}, time.Second, 10*time.Millisecond)
+
+		for _, c := range p.Connections() {
+			require.Equal(t, 1, c.Stats().PendingRequests)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		require.NoError(t, p.Shutdown(ctx))
+		wg.Wait()
+
+		for _, err := range sendErrs {
+			require.NoError(t, err)
+		}
+
+		for _, c := range p.Connections() {
+			require.Equal(t, connection.StatusOffline, c.Status())
+		}
+
+		_, err = p.Get()
+		require.ErrorIs(t, err, pool.ErrClosed)
+
+		// pool is closed already
+		require.NoError(t, p.Shutdown(ctx))
+		require.NoError(t, p.Close())
+	})
+
+	t.Run("closes connections not drained in time", func(t *testing.T) {
+		addrs, received := startDelayedServers(t, 2, 300*time.Millisecond)
+
+		p, err := pool.New(factory(), addrs, pool.MinConnections(2))
+		require.NoError(t, err)
+		require.NoError(t, p.Connect())
+
+		var wg sync.WaitGroup
+		for _, stan := range []string{"000001", "000002"} {
+			wg.Add(1)
+			go func(stan string) {
+				defer wg.Done()
+				p.Send(newMessage(t, stan))
+			}(stan)
+		}
+		defer wg.Wait()
+
+		require.Eventually(t, func() bool {
+			return atomic.LoadInt32(received) == 2
+		}, time.Second, 10*time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		err = p.Shutdown(ctx)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+
+		var shutdownErr *pool.ShutdownError
+		require.True(t, errors.As(err, &shutdownErr))
+		require.Len(t, shutdownErr.Errors, 2)
+		for _, addr := range addrs {
+			require.ErrorIs(t, shutdownErr.Errors[addr], context.DeadlineExceeded)
+		}
+
+		for _, c := range p.Connections() {
+			require.Equal(t, connection.StatusOffline, c.Status())
+		}
+	})
+}
@@ -0,0 +1,241 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	connection "github.com/moov-io/iso8583-connection"
+)
+
+const (
+	// EventAdded means the connection to the new SRV target was added to
+	// the pool
+	EventAdded EventType = "added"
+
+	// EventRemoved means the SRV target is gone, so its connection was
+	// removed from the pool and closed
+	EventRemoved EventType = "removed"
+
+	// EventSRVLookupFailed means SRV records could not be looked up, so
+	// connections of the pool were kept as they are
+	EventSRVLookupFailed EventType = "srv lookup failed"
+)
+
+// NewFromSRV returns the pool of connections created by factory to the
+// targets of SRV records of the service looked up by resolver
+// (net.DefaultResolver when it's nil). Addrs are the targets in order of
+// their priority and weight. While pool is connected, records are looked
+// up every SRVRefreshInterval: connections to new targets are added to
+// the pool and connected, and connections to the targets which are gone
+// are removed and closed.
+func NewFromSRV(factory ConnectionFactoryFunc, service connection.SRVService, resolver connection.SRVResolver, options ...Option) (*Pool, error) {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	addrs, err := lookupSRV(context.Background(), resolver, &service)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := New(factory, addrs, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	p.srv = &service
+	p.srvResolver = resolver
+
+	return p, nil
+}
+
+// lookupSRV returns addresses of SRV targets of the service ordered by
+// priority and then by weight, the heaviest first
+func lookupSRV(ctx context.Context, resolver connection.SRVResolver, srv *connection.SRVService) ([]string, error) {
+	_, targets, err := resolver.LookupSRV(ctx, srv.Service, srv.Proto, srv.Name)
+	if err != nil {
+		return nil, fmt.Errorf("looking up SRV records of %s: %w", srv, err)
+	}
+
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("looking up SRV records of %s: no targets found", srv)
+	}
+
+	ordered := append([]*net.SRV(nil), targets...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if ordered[i].Priority != ordered[j].Priority {
+			return ordered[i].Priority < ordered[j].Priority
+		}
+		return ordered[i].Weight > ordered[j].Weight
+	})
+
+	addrs := make([]string, 0, len(ordered))
+	seen := make(map[string]bool, len(ordered))
+	for _, target := range ordered {
+		addr := net.JoinHostPort(strings.TrimSuffix(target.Target, "."), strconv.Itoa(int(target.Port)))
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		addrs = append(addrs, addr)
+	}
+
+	return addrs, nil
+}
+
+// refreshSRV looks up SRV records every SRVRefreshInterval and updates
+// connections of the pool until pool is closed
+func (p *Pool) refreshSRV() {
+	defer p.wg.Done()
+
+	// lookup in progress is canceled when pool is closed
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-p.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ticker := time.NewTicker(p.Opts.SRVRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		addrs, err := lookupSRV(ctx, p.srvResolver, p.srv)
+		if err != nil {
+			p.emit(Event{Type: EventSRVLookupFailed, Err: err})
+			continue
+		}
+
+		p.updateAddrs(addrs)
+	}
+}
+
+// updateAddrs adds connections to the addresses the pool has no
+// connections to and removes connections to the addresses which are not
+// in addrs
+func (p *Pool) updateAddrs(addrs []string) {
+	// connections are created and closed without pool locks, so state
+	// changes are not reported while they are held
+	p.connectMu.Lock()
+	defer p.connectMu.Unlock()
+
+	p.mu.RLock()
+	closed, weights := p.closed, p.Opts.Weights
+	current := make(map[string]bool, len(p.connections))
+	for _, pc := range p.connections {
+		current[pc.addr] = true
+	}
+	p.mu.RUnlock()
+
+	if closed {
+		return
+	}
+
+	wanted := make(map[string]bool, len(addrs))
+	var added []*pooledConnection
+	for _, addr := range addrs {
+		wanted[addr] = true
+		if current[addr] {
+			continue
+		}
+
+		// connection which could not be created is created on the
+		// next refresh
+		pc, err := p.newConnection(strconv.Itoa(p.nextID), addr, weights)
+		if err != nil {
+			continue
+		}
+		p.nextID++
+		added = append(added, pc)
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		p.closeConnections(added, nil)
+		return
+	}
+
+	// connections are replaced rather than changed in place, as they are
+	// iterated without locks
+	var removed []*pooledConnection
+	connections := make([]*pooledConnection, 0, len(p.connections)+len(added))
+	for _, pc := range p.connections {
+		if !wanted[pc.addr] {
+			close(pc.removed)
+			delete(p.connectErrs, pc.addr)
+			removed = append(removed, pc)
+			continue
+		}
+		connections = append(connections, pc)
+	}
+	connections = append(connections, added...)
+
+	p.connections = connections
+	p.Addrs = make([]string, len(connections))
+	for i, pc := range connections {
+		p.Addrs[i] = pc.addr
+	}
+
+	for _, pc := range added {
+		p.wg.Add(1)
+		go p.connectAdded(pc)
+
+		if p.Opts.HealthCheckInterval > 0 {
+			p.wg.Add(1)
+			go p.checkHealth(pc)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, pc := range removed {
+		pc.conn.Close()
+		p.setState(pc, StateClosed, nil)
+		p.emit(Event{Type: EventRemoved, Addr: pc.addr})
+	}
+
+	for _, pc := range added {
+		p.emit(Event{Type: EventAdded, Addr: pc.addr})
+	}
+
+	if p.Opts.ExpvarPrefix != "" && (len(added) > 0 || len(removed) > 0) {
+		// prefix was published by New, so it's not used by other vars
+		_ = p.publishExpvar()
+	}
+}
+
+// connectAdded connects the connection added by the SRV refresh. When it
+// fails, connection is connected in the background every ReconnectWait.
+func (p *Pool) connectAdded(pc *pooledConnection) {
+	defer p.wg.Done()
+
+	p.setState(pc, StateConnecting, nil)
+	err := pc.conn.Connect()
+	if err == nil {
+		return
+	}
+	p.setConnectErr(pc, err)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// background connecting is waited by Close
+	if !p.closed {
+		p.wg.Add(1)
+		go p.connectInBackground(pc)
+	}
+}
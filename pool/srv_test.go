@@ -0,0 +1,181 @@
+package pool_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/moov-io/iso8583-connection/pool"
+	"github.com/stretchr/testify/require"
+)
+
+// stubSRVResolver returns targets set by setTargets as SRV records of any
+// service
+type stubSRVResolver struct {
+	mu      sync.Mutex
+	targets []*net.SRV
+	err     error
+}
+
+func (r *stubSRVResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return "", r.targets, r.err
+}
+
+func (r *stubSRVResolver) setTargets(targets []*net.SRV, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.targets, r.err = targets, err
+}
+
+// srvTarget returns SRV record of the server listening on addr
+func srvTarget(t *testing.T, addr string, priority, weight uint16) *net.SRV {
+	t.Helper()
+
+	host, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+
+	n, err := strconv.Atoi(port)
+	require.NoError(t, err)
+
+	return &net.SRV{Target: host + ".", Port: uint16(n), Priority: priority, Weight: weight}
+}
+
+// connectionAddrs returns addresses of connections of the pool
+func connectionAddrs(p *pool.Pool) []string {
+	var addrs []string
+	for addr := range p.ConnectionStats() {
+		addrs = append(addrs, addr)
+	}
+
+	return addrs
+}
+
+func TestNewFromSRV(t *testing.T) {
+	service := connection.SRVService{Service: "iso", Proto: "tcp", Name: "payments.internal"}
+
+	t.Run("creates connections to targets in order of priority and weight", func(t *testing.T) {
+		addrs := startServers(t, 3)
+		resolver := &stubSRVResolver{targets: []*net.SRV{
+			srvTarget(t, addrs[2], 20, 10),
+			srvTarget(t, addrs[1], 10, 10),
+			srvTarget(t, addrs[0], 10, 50),
+		}}
+
+		p, err := pool.NewFromSRV(factory(), service, resolver)
+		require.NoError(t, err)
+		require.Equal(t, addrs, p.Addrs)
+
+		require.NoError(t, p.Connect())
+		defer p.Close()
+
+		for _, addr := range addrs {
+			require.Eventually(t, func() bool {
+				state, _ := p.State(addr)
+				return state == pool.StateOnline
+			}, time.Second, 10*time.Millisecond)
+		}
+	})
+
+	t.Run("fails when there are no targets", func(t *testing.T) {
+		_, err := pool.NewFromSRV(factory(), service, &stubSRVResolver{})
+		require.EqualError(t, err, "looking up SRV records of _iso._tcp.payments.internal: no targets found")
+	})
+
+	t.Run("adds and removes connections when targets change", func(t *testing.T) {
+		addrs := startServers(t, 3)
+		resolver := &stubSRVResolver{targets: []*net.SRV{
+			srvTarget(t, addrs[0], 10, 10),
+			srvTarget(t, addrs[1], 10, 10),
+		}}
+
+		events := make(chan pool.Event, 10)
+		p, err := pool.NewFromSRV(factory(), service, resolver,
+			pool.SRVRefreshInterval(20*time.Millisecond),
+			pool.EventHandler(func(event pool.Event) {
+				select {
+				case events <- event:
+				default:
+				}
+			}),
+		)
+		require.NoError(t, err)
+		require.NoError(t, p.Connect())
+		defer p.Close()
+
+		removed := p.Connections()[0]
+
+		resolver.setTargets([]*net.SRV{
+			srvTarget(t, addrs[1], 10, 10),
+			srvTarget(t, addrs[2], 10, 10),
+		}, nil)
+
+		require.Eventually(t, func() bool {
+			state, _ := p.State(addrs[2])
+			return state == pool.StateOnline
+		}, time.Second, 10*time.Millisecond)
+
+		require.ElementsMatch(t, []string{addrs[1], addrs[2]}, connectionAddrs(p))
+		require.Equal(t, connection.StatusOffline, removed.Status())
+
+		_, found := p.State(addrs[0])
+		require.False(t, found)
+
+		seen := make(map[pool.EventType]string)
+		for len(seen) < 2 {
+			select {
+			case event := <-events:
+				seen[event.Type] = event.Addr
+			case <-time.After(time.Second):
+				t.Fatal("events were not emitted")
+			}
+		}
+		require.Equal(t, map[pool.EventType]string{
+			pool.EventRemoved: addrs[0],
+			pool.EventAdded:   addrs[2],
+		}, seen)
+	})
+
+	t.Run("keeps connections when lookup fails", func(t *testing.T) {
+		addrs := startServers(t, 2)
+		resolver := &stubSRVResolver{targets: []*net.SRV{
+			srvTarget(t, addrs[0], 10, 10),
+			srvTarget(t, addrs[1], 10, 10),
+		}}
+
+		events := make(chan pool.Event, 10)
+		p, err := pool.NewFromSRV(factory(), service, resolver,
+			pool.SRVRefreshInterval(20*time.Millisecond),
+			pool.EventHandler(func(event pool.Event) {
+				select {
+				case events <- event:
+				default:
+				}
+			}),
+		)
+		require.NoError(t, err)
+		require.NoError(t, p.Connect())
+		defer p.Close()
+
+		lookupErr := errors.New("server misbehaving")
+		resolver.setTargets(nil, lookupErr)
+
+		select {
+		case event := <-events:
+			require.Equal(t, pool.EventSRVLookupFailed, event.Type)
+			require.ErrorIs(t, event.Err, lookupErr)
+		case <-time.After(time.Second):
+			t.Fatal("lookup failure was not reported")
+		}
+
+		require.ElementsMatch(t, addrs, connectionAddrs(p))
+	})
+}
@@ -0,0 +1,113 @@
+package pool
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	connection "github.com/moov-io/iso8583-connection"
+)
+
+// State is the state of the connection of the pool
+type State int
+
+const (
+	// StateClosed is the state of the connection before Connect and
+	// after it was closed for good
+	StateClosed State = iota
+
+	// StateConnecting is the state of the connection being connected or
+	// reconnected
+	StateConnecting
+
+	// StateOnline is the state of the established connection
+	StateOnline
+
+	// StateDegraded is the state of the connection that failed health
+	// checks and was removed from rotation
+	StateDegraded
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateConnecting:
+		return "connecting"
+	case StateOnline:
+		return "online"
+	case StateDegraded:
+		return "degraded"
+	}
+
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// StateChangeHandler is called when connection to addr moves from one
+// state to another. err is the error that caused the transition, e.g.
+// the error connection was closed with, if any.
+type StateChangeHandler func(addr string, connID string, from, to State, err error)
+
+// connectionState tracks the state of the pooled connection
+type connectionState struct {
+	// notifyMu serializes transitions, so StateChangeHandler gets them
+	// in order. No pool locks are held while it's held.
+	notifyMu sync.Mutex
+	state    State
+}
+
+// setState moves the connection to the state and calls
+// StateChangeHandler if state was changed
+func (p *Pool) setState(pc *pooledConnection, to State, err error) {
+	pc.state.notifyMu.Lock()
+	defer pc.state.notifyMu.Unlock()
+
+	from := pc.state.state
+	if from == to {
+		return
+	}
+	pc.state.state = to
+
+	if p.Opts.StateChangeHandler != nil {
+		p.Opts.StateChangeHandler(pc.addr, pc.id, from, to, err)
+	}
+}
+
+// State returns the state of the connection to addr and false if pool has
+// no connection to addr
+func (p *Pool) State(addr string) (State, bool) {
+	p.mu.RLock()
+	var found *pooledConnection
+	for _, pc := range p.connections {
+		if pc.addr == addr {
+			found = pc
+			break
+		}
+	}
+	p.mu.RUnlock()
+
+	if found == nil {
+		return StateClosed, false
+	}
+
+	found.state.notifyMu.Lock()
+	defer found.state.notifyMu.Unlock()
+
+	return found.state.state, true
+}
+
+// connectionClosed moves the connection closed because of the error to
+// StateConnecting when it's reconnected by itself or to StateClosed
+// otherwise
+func (p *Pool) connectionClosed(pc *pooledConnection, c *connection.Connection) {
+	if atomic.LoadInt32(&pc.unhealthy) == 1 {
+		return
+	}
+
+	to := StateClosed
+	if c.Options().AutoReconnect {
+		to = StateConnecting
+	}
+
+	p.setState(pc, to, c.Err())
+}
@@ -0,0 +1,170 @@
+package pool_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/moov-io/iso8583-connection/pool"
+	"github.com/moov-io/iso8583-connection/server"
+	"github.com/stretchr/testify/require"
+)
+
+// transition is the state change passed to StateChangeHandler
+type transition struct {
+	connID   string
+	from, to pool.State
+	err      error
+}
+
+// transitionRecorder records transitions of connections by address
+type transitionRecorder struct {
+	mu          sync.Mutex
+	transitions map[string][]transition
+}
+
+func (r *transitionRecorder) handle(addr, connID string, from, to pool.State, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.transitions == nil {
+		r.transitions = make(map[string][]transition)
+	}
+	r.transitions[addr] = append(r.transitions[addr], transition{connID, from, to, err})
+}
+
+// states returns from and to states of the transitions of addr
+func (r *transitionRecorder) states(addr string) [][2]pool.State {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var states [][2]pool.State
+	for _, tr := range r.transitions[addr] {
+		states = append(states, [2]pool.State{tr.from, tr.to})
+	}
+
+	return states
+}
+
+// get returns transitions of addr
+func (r *transitionRecorder) get(addr string) []transition {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]transition(nil), r.transitions[addr]...)
+}
+
+func TestPool_NotifyStateChange(t *testing.T) {
+	killedAddr := freeAddr(t)
+	srv := server.New(testSpec, readMessageLength, writeMessageLength)
+	require.NoError(t, srv.Start(killedAddr))
+
+	aliveAddr := startServer(t)
+
+	recorder := &transitionRecorder{}
+	p, err := pool.New(
+		factory(
+			connection.AutoReconnect(true),
+			connection.ReconnectBackoff(connection.ExponentialBackoff{Initial: 10 * time.Millisecond}),
+		),
+		[]string{killedAddr, aliveAddr},
+		pool.NotifyStateChange(recorder.handle),
+	)
+	require.NoError(t, err)
+	require.NoError(t, p.Connect())
+
+	online := [][2]pool.State{
+		{pool.StateClosed, pool.StateConnecting},
+		{pool.StateConnecting, pool.StateOnline},
+	}
+	require.Eventually(t, func() bool {
+		return len(recorder.states(killedAddr)) == 2 && len(recorder.states(aliveAddr)) == 2
+	}, 2*time.Second, 10*time.Millisecond)
+	require.Equal(t, online, recorder.states(killedAddr))
+	require.Equal(t, online, recorder.states(aliveAddr))
+
+	state, found := p.State(killedAddr)
+	require.True(t, found)
+	require.Equal(t, pool.StateOnline, state)
+
+	// kill the server
+	srv.Close()
+
+	require.Eventually(t, func() bool {
+		return len(recorder.states(killedAddr)) == 3
+	}, 2*time.Second, 10*time.Millisecond)
+
+	lost := recorder.get(killedAddr)[2]
+	require.Equal(t, pool.StateOnline, lost.from)
+	require.Equal(t, pool.StateConnecting, lost.to)
+	require.Error(t, lost.err)
+	require.Equal(t, "0", lost.connID)
+
+	// restore the server on the same address
+	srv = server.New(testSpec, readMessageLength, writeMessageLength)
+	require.NoError(t, srv.Start(killedAddr))
+	defer srv.Close()
+
+	require.Eventually(t, func() bool {
+		return len(recorder.states(killedAddr)) == 4
+	}, 2*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, p.Close())
+
+	require.Equal(t, [][2]pool.State{
+		{pool.StateClosed, pool.StateConnecting},
+		{pool.StateConnecting, pool.StateOnline},
+		{pool.StateOnline, pool.StateConnecting},
+		{pool.StateConnecting, pool.StateOnline},
+		{pool.StateOnline, pool.StateClosed},
+	}, recorder.states(killedAddr))
+
+	// connection to the other server was not affected
+	require.Equal(t, [][2]pool.State{
+		{pool.StateClosed, pool.StateConnecting},
+		{pool.StateConnecting, pool.StateOnline},
+		{pool.StateOnline, pool.StateClosed},
+	}, recorder.states(aliveAddr))
+
+	for _, tr := range recorder.get(aliveAddr) {
+		require.Equal(t, "1", tr.connID)
+	}
+}
+
+func TestPool_StateDegraded(t *testing.T) {
+	errHealthCheck := errors.New("health check failed")
+
+	addr := startServer(t)
+
+	recorder := &transitionRecorder{}
+	healthy := make(chan bool, 1)
+	healthy <- false
+
+	p, err := pool.New(factory(), []string{addr},
+		pool.NotifyStateChange(recorder.handle),
+		pool.HealthCheck(10*time.Millisecond, 1, func(c *connection.Connection) error {
+			select {
+			case ok := <-healthy:
+				if !ok {
+					return errHealthCheck
+				}
+			default:
+			}
+			return nil
+		}),
+	)
+	require.NoError(t, err)
+	require.NoError(t, p.Connect())
+	defer p.Close()
+
+	require.Eventually(t, func() bool {
+		return len(recorder.states(addr)) == 4
+	}, 2*time.Second, 10*time.Millisecond)
+
+	transitions := recorder.get(addr)
+	require.Equal(t, pool.StateDegraded, transitions[2].to)
+	require.ErrorIs(t, transitions[2].err, errHealthCheck)
+	require.Equal(t, [2]pool.State{pool.StateDegraded, pool.StateOnline}, [2]pool.State{transitions[3].from, transitions[3].to})
+}
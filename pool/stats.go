@@ -0,0 +1,131 @@
+package pool
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+
+	connection "github.com/moov-io/iso8583-connection"
+)
+
+// Stats contains pool statistics
+type Stats struct {
+	// Stats of all connections summed
+	connection.Stats
+
+	// Connections is the number of connections of the pool
+	Connections int
+
+	// OnlineConnections is the number of established connections
+	OnlineConnections int
+}
+
+// ConnectionStats returns Stats of connections by their addresses, so the
+// slow connection is not hidden by the others
+func (p *Pool) ConnectionStats() map[string]connection.Stats {
+	p.mu.RLock()
+	connections := p.connections
+	p.mu.RUnlock()
+
+	stats := make(map[string]connection.Stats, len(connections))
+	for _, pc := range connections {
+		stats[pc.addr] = pc.conn.Stats()
+	}
+
+	return stats
+}
+
+// Stats returns Stats of all connections summed
+func (p *Pool) Stats() Stats {
+	p.mu.RLock()
+	connections := p.connections
+	p.mu.RUnlock()
+
+	stats := Stats{Connections: len(connections)}
+	for _, pc := range connections {
+		if pc.online() {
+			stats.OnlineConnections++
+		}
+		addStats(&stats.Stats, pc.conn.Stats())
+	}
+
+	return stats
+}
+
+// addStats adds counters and gauges of s to sum
+func addStats(sum *connection.Stats, s connection.Stats) {
+	sum.PendingRequests += s.PendingRequests
+	sum.OutgoingQueueDepth += s.OutgoingQueueDepth
+	sum.STANSkips += s.STANSkips
+	sum.MACVerificationFailures += s.MACVerificationFailures
+	sum.LateResponses += s.LateResponses
+	sum.UnmatchedResponses += s.UnmatchedResponses
+	sum.InboundQueueDepth += s.InboundQueueDepth
+	sum.InboundDropped += s.InboundDropped
+	sum.MessagesReceived += s.MessagesReceived
+	sum.MessagesSent += s.MessagesSent
+	sum.SendTimeouts += s.SendTimeouts
+	sum.Reconnects += s.Reconnects
+	sum.DeduplicatedSends += s.DeduplicatedSends
+	sum.CorrelationIDMismatches += s.CorrelationIDMismatches
+	sum.UnpackErrors += s.UnpackErrors
+	sum.FrameIntegrityFailures += s.FrameIntegrityFailures
+}
+
+// expvarValues returns stats with the names used by
+// connection.PublishExpvar
+func expvarValues(s connection.Stats) map[string]interface{} {
+	return map[string]interface{}{
+		"sent":          s.MessagesSent,
+		"received":      s.MessagesReceived,
+		"timeouts":      s.SendTimeouts,
+		"unmatched":     s.UnmatchedResponses,
+		"reconnects":    s.Reconnects,
+		"unpack_errors": s.UnpackErrors,
+		"pending":       s.PendingRequests,
+	}
+}
+
+// expvarMu serializes publishing, so the map is published once for the
+// prefix
+var expvarMu sync.Mutex
+
+// publishExpvar publishes stats of the pool as expvar.Map named
+// ExpvarPrefix with the stats of each connection by its address and the
+// summed stats as "total". If the map is published already, its values
+// are switched to this pool.
+func (p *Pool) publishExpvar() error {
+	prefix := p.Opts.ExpvarPrefix
+
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+
+	var vars *expvar.Map
+	switch v := expvar.Get(prefix).(type) {
+	case nil:
+		vars = expvar.NewMap(prefix)
+	case *expvar.Map:
+		vars = v
+	default:
+		return fmt.Errorf("publishing expvar %s: name is used by %T", prefix, v)
+	}
+
+	vars.Init()
+	for _, addr := range p.Addrs {
+		addr := addr
+		vars.Set(addr, expvar.Func(func() interface{} {
+			return expvarValues(p.ConnectionStats()[addr])
+		}))
+	}
+
+	vars.Set("total", expvar.Func(func() interface{} {
+		stats := p.Stats()
+		values := expvarValues(stats.Stats)
+		values["connections"] = stats.Connections
+		values["online"] = stats.OnlineConnections
+
+		return values
+	}))
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package pool_test
+
+import (
+	"encoding/json"
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/moov-io/iso8583-connection/pool"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPool_ConnectionStats(t *testing.T) {
+	healthyAddr := startServer(t, connection.InboundMessageHandler(reply))
+	slowAddr := startServer(t, connection.InboundMessageHandler(func(c *connection.Connection, message *iso8583.Message) {}))
+
+	p, err := pool.New(factory(connection.SendTimeout(100*time.Millisecond)), []string{healthyAddr, slowAddr},
+		pool.MinConnections(2),
+		pool.PublishExpvar("test_pool_connection_stats"),
+	)
+	require.NoError(t, err)
+	require.NoError(t, p.Connect())
+	defer p.Close()
+
+	// round robin sends half of the requests to the slow connection
+	for _, stan := range []string{"000001", "000002", "000003", "000004"} {
+		p.Send(newMessage(t, stan))
+	}
+
+	stats := p.ConnectionStats()
+	require.Len(t, stats, 2)
+
+	require.Equal(t, uint64(0), stats[healthyAddr].SendTimeouts)
+	require.Equal(t, uint64(2), stats[healthyAddr].MessagesSent)
+	require.Equal(t, uint64(2), stats[healthyAddr].MessagesReceived)
+
+	require.Equal(t, uint64(2), stats[slowAddr].SendTimeouts)
+	require.Equal(t, uint64(2), stats[slowAddr].MessagesSent)
+	require.Equal(t, uint64(0), stats[slowAddr].MessagesReceived)
+
+	total := p.Stats()
+	require.Equal(t, 2, total.Connections)
+	require.Equal(t, 2, total.OnlineConnections)
+	require.Equal(t, uint64(2), total.SendTimeouts)
+	require.Equal(t, uint64(4), total.MessagesSent)
+	require.Equal(t, uint64(2), total.MessagesReceived)
+
+	vars, ok := expvar.Get("test_pool_connection_stats").(*expvar.Map)
+	require.True(t, ok)
+
+	expvarValues := func(key string) map[string]int {
+		var values map[string]int
+		require.NoError(t, json.Unmarshal([]byte(vars.Get(key).String()), &values))
+		return values
+	}
+
+	require.Equal(t, 0, expvarValues(healthyAddr)["timeouts"])
+	require.Equal(t, 2, expvarValues(slowAddr)["timeouts"])
+	require.Equal(t, 2, expvarValues("total")["timeouts"])
+	require.Equal(t, 2, expvarValues("total")["online"])
+}
@@ -0,0 +1,81 @@
+package pool
+
+import (
+	"container/list"
+	"context"
+	"errors"
+
+	connection "github.com/moov-io/iso8583-connection"
+)
+
+// GetCtx returns the connection selected as by Get. When there is no
+// online connection with positive weight, it waits until one is
+// established or its weight is set, or until ctx is done. Waiting calls
+// are woken up in the order they started to wait.
+func (p *Pool) GetCtx(ctx context.Context) (*connection.Connection, error) {
+	for {
+		pc, err := p.get(nil)
+		if !errors.Is(err, ErrNoConnections) {
+			if err != nil {
+				return nil, err
+			}
+			return pc.conn, nil
+		}
+
+		// waiter is added before the connection is selected again, so
+		// connection established in between is not missed
+		ready, waiter := p.addWaiter()
+
+		pc, err = p.get(nil)
+		if !errors.Is(err, ErrNoConnections) {
+			p.removeWaiter(waiter)
+			if err != nil {
+				return nil, err
+			}
+			return pc.conn, nil
+		}
+
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			p.removeWaiter(waiter)
+			return nil, ctx.Err()
+		case <-p.done:
+			p.removeWaiter(waiter)
+			return nil, ErrClosed
+		}
+	}
+}
+
+// addWaiter adds the waiter which channel is closed when connection may
+// be available
+func (p *Pool) addWaiter() (chan struct{}, *list.Element) {
+	ready := make(chan struct{})
+
+	p.waitersMu.Lock()
+	defer p.waitersMu.Unlock()
+
+	return ready, p.waiters.PushBack(ready)
+}
+
+func (p *Pool) removeWaiter(waiter *list.Element) {
+	p.waitersMu.Lock()
+	defer p.waitersMu.Unlock()
+
+	// waiter is removed already if it was notified
+	if waiter.Value != nil {
+		p.waiters.Remove(waiter)
+		waiter.Value = nil
+	}
+}
+
+// notifyWaiters wakes up all waiters in the order they were added
+func (p *Pool) notifyWaiters() {
+	p.waitersMu.Lock()
+	defer p.waitersMu.Unlock()
+
+	for e := p.waiters.Front(); e != nil; e = p.waiters.Front() {
+		close(p.waiters.Remove(e).(chan struct{}))
+		e.Value = nil
+	}
+}
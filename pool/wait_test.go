@@ -0,0 +1,119 @@
+package pool_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/moov-io/iso8583-connection/pool"
+	"github.com/moov-io/iso8583-connection/server"
+	"github.com/stretchr/testify/require"
+)
+
+// freeAddr returns the address no server listens on
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	return addr
+}
+
+func TestPool_GetCtx(t *testing.T) {
+	t.Run("waits until connection is established", func(t *testing.T) {
+		addr := freeAddr(t)
+
+		p, err := pool.New(factory(), []string{addr},
+			pool.MinConnections(0),
+			pool.ReconnectWait(20*time.Millisecond),
+		)
+		require.NoError(t, err)
+		require.NoError(t, p.Connect())
+		defer p.Close()
+
+		type result struct {
+			conn *connection.Connection
+			err  error
+		}
+
+		waiting := make(chan result, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			c, err := p.GetCtx(ctx)
+			waiting <- result{c, err}
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err = p.GetCtx(ctx)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+
+		time.Sleep(150 * time.Millisecond)
+
+		srv := server.New(testSpec, readMessageLength, writeMessageLength)
+		require.NoError(t, srv.Start(addr))
+		defer srv.Close()
+
+		select {
+		case res := <-waiting:
+			require.NoError(t, res.err)
+			require.Equal(t, connection.StatusOnline, res.conn.Status())
+		case <-time.After(3 * time.Second):
+			t.Fatal("GetCtx didn't return after connection was established")
+		}
+	})
+
+	t.Run("waits until connection weight is set", func(t *testing.T) {
+		addr := startServer(t)
+
+		p, err := pool.New(factory(), []string{addr}, pool.WithWeight(addr, 0))
+		require.NoError(t, err)
+		require.NoError(t, p.Connect())
+		defer p.Close()
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := p.GetCtx(context.Background())
+			done <- err
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+		require.NoError(t, p.SetWeight(addr, 1))
+
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("GetCtx didn't return after weight was set")
+		}
+	})
+
+	t.Run("returns ErrClosed when pool is closed", func(t *testing.T) {
+		p, err := pool.New(factory(), []string{freeAddr(t)}, pool.MinConnections(0))
+		require.NoError(t, err)
+		require.NoError(t, p.Connect())
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := p.GetCtx(context.Background())
+			done <- err
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+		require.NoError(t, p.Close())
+
+		select {
+		case err := <-done:
+			require.ErrorIs(t, err, pool.ErrClosed)
+		case <-time.After(time.Second):
+			t.Fatal("GetCtx didn't return after pool was closed")
+		}
+	})
+}
@@ -0,0 +1,182 @@
+package connection
+
+import (
+	"sync/atomic"
+)
+
+// Status is the status of the connection
+type Status string
+
+const (
+	// StatusOnline means connection is established
+	StatusOnline Status = "online"
+
+	// StatusOffline means connection is not established and it's not
+	// being reconnected
+	StatusOffline Status = "offline"
+
+	// StatusReconnecting means connection was lost and it's being
+	// reconnected
+	StatusReconnecting Status = "reconnecting"
+)
+
+// Status returns the status of the connection
+func (c *Connection) Status() Status {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	switch {
+	case c.conn != nil && !c.closing:
+		return StatusOnline
+	case c.reconnecting != nil:
+		return StatusReconnecting
+	}
+
+	return StatusOffline
+}
+
+// startReconnecting starts the reconnect loop after connection was lost
+// with err. The first attempt is made after closed is closed. Attempts
+// counter is reset if the lost connection was up for
+// ReconnectStablePeriod. It should be called with mutex held.
+func (c *Connection) startReconnecting(err error, closed <-chan struct{}) {
+	if c.reconnecting != nil {
+		return
+	}
+
+	if c.options().Clock.Now().Sub(c.connectedAt) >= c.options().ReconnectStablePeriod {
+		c.reconnectAttempts = 0
+	}
+
+	stop := make(chan struct{})
+	c.reconnecting = stop
+
+	go c.reconnect(stop, closed, err)
+}
+
+// stopReconnecting stops the reconnect loop if it's running. It should be
+// called with mutex held.
+func (c *Connection) stopReconnecting() {
+	if c.reconnecting == nil {
+		return
+	}
+
+	close(c.reconnecting)
+	c.reconnecting = nil
+}
+
+// reconnect tries to establish connection waiting between attempts as
+// BackoffPolicy tells until it succeeds, policy gives up, attempts are
+// exhausted or stop is closed
+func (c *Connection) reconnect(stop chan struct{}, closed <-chan struct{}, lastErr error) {
+	var failed int
+
+	// the lost connection is closed without the lock, so it's not
+	// replaced before it's closed
+	select {
+	case <-closed:
+	case <-stop:
+		return
+	}
+
+	for {
+		c.mutex.Lock()
+		if c.reconnecting != stop {
+			c.mutex.Unlock()
+			return
+		}
+		c.reconnectAttempts++
+		attempt := c.reconnectAttempts
+		c.mutex.Unlock()
+
+		delay := c.options().BackoffPolicy.Next(attempt, lastErr)
+		if delay < 0 {
+			c.mutex.Lock()
+			if c.reconnecting == stop {
+				c.stopReconnecting()
+			}
+			c.mutex.Unlock()
+			return
+		}
+
+		timer := c.options().Clock.NewTimer(delay)
+		select {
+		case <-timer.C():
+		case <-stop:
+			timer.Stop()
+			return
+		}
+
+		// dial without the lock, so Send, Status and Close don't wait
+		// for it
+		c.mutex.Lock()
+		if c.reconnecting != stop {
+			c.mutex.Unlock()
+			return
+		}
+		addr := c.addr
+		c.mutex.Unlock()
+
+		conn, err := c.dial(addr)
+		if err != nil {
+			err = c.connectError(addr, err)
+		}
+
+		c.mutex.Lock()
+		// connection was closed or connected meanwhile
+		if c.reconnecting != stop || (c.conn != nil && !c.closing) {
+			if c.reconnecting == stop {
+				c.stopReconnecting()
+			}
+			c.mutex.Unlock()
+
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+
+		if err == nil {
+			c.establish(conn)
+			atomic.AddUint64(&c.reconnects, 1)
+			c.stopReconnecting()
+			c.mutex.Unlock()
+
+			// failed upgrade closes the connection and starts
+			// reconnecting again
+			if err := c.helloAndUpgrade(conn); err != nil {
+				c.handleError(err)
+				return
+			}
+
+			c.connectionEstablished()
+			return
+		}
+
+		failed++
+		if c.options().MaxReconnectAttempts > 0 && failed >= c.options().MaxReconnectAttempts {
+			c.reconnectExhausted = true
+			c.stopReconnecting()
+			c.mutex.Unlock()
+
+			if c.options().ReconnectsExhaustedHandler != nil {
+				go c.options().ReconnectsExhaustedHandler(c.wrapError(err))
+			}
+			return
+		}
+		c.mutex.Unlock()
+
+		c.handleError(err)
+		lastErr = err
+	}
+}
+
+// closedError returns the error for Send and Reply called when connection
+// is closed. It should be called with mutex held.
+func (c *Connection) closedError() error {
+	if c.reconnectExhausted {
+		return ErrReconnectExhausted
+	}
+
+	return ErrConnectionClosed
+}
@@ -0,0 +1,85 @@
+package connection
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/moov-io/iso8583"
+)
+
+// ValidationError is returned by Send when the message misses fields
+// required by RequiredFields for its MTI
+type ValidationError struct {
+	MTI string
+
+	// MissingFields are the required fields which are not set or empty
+	MissingFields []int
+}
+
+func (e *ValidationError) Error() string {
+	ids := make([]string, len(e.MissingFields))
+	for i, id := range e.MissingFields {
+		ids[i] = fmt.Sprint(id)
+	}
+
+	return fmt.Sprintf("message %s misses required fields: %s", e.MTI, strings.Join(ids, ", "))
+}
+
+// SkipValidation makes the next Send of the message skip RequiredFields
+// check, e.g. for malformed messages sent during certification
+func (c *Connection) SkipValidation(message Message) {
+	c.skipValidation.Store(message, struct{}{})
+}
+
+// validateRequiredFields checks that the message has fields required by
+// RequiredFields for the longest prefix of its MTI
+func (c *Connection) validateRequiredFields(message Message) error {
+	if _, skip := c.skipValidation.LoadAndDelete(message); skip {
+		return nil
+	}
+
+	if len(c.options().RequiredFields) == 0 {
+		return nil
+	}
+
+	mti, err := message.GetMTI()
+	if err != nil {
+		return fmt.Errorf("getting MTI: %w", err)
+	}
+
+	var required []int
+	for n := len(mti); n > 0; n-- {
+		if ids, found := c.options().RequiredFields[mti[:n]]; found {
+			required = ids
+			break
+		}
+	}
+
+	var missing []int
+	for _, id := range required {
+		if !hasField(message, id) {
+			missing = append(missing, id)
+		}
+	}
+
+	if len(missing) > 0 {
+		return &ValidationError{
+			MTI:           mti,
+			MissingFields: missing,
+		}
+	}
+
+	return nil
+}
+
+// hasField reports whether the message has non empty field
+func hasField(message Message, id int) bool {
+	// GetString of *iso8583.Message marks the field as set
+	if m, ok := message.(*iso8583.Message); ok {
+		return isFieldSet(m, id)
+	}
+
+	value, err := message.GetString(id)
+
+	return err == nil && value != ""
+}
@@ -0,0 +1,60 @@
+package connection
+
+import (
+	"fmt"
+
+	"github.com/moov-io/iso8583"
+)
+
+// ResponseError is returned by Send when ResponseValidator rejects the
+// response. Send returns the response as well.
+type ResponseError struct {
+	Err error
+
+	// Response is the rejected response
+	Response *iso8583.Message
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("invalid response: %v", e.Err)
+}
+
+func (e *ResponseError) Unwrap() error {
+	return e.Err
+}
+
+// validateResponse runs ResponseValidator for the response of the request
+func (c *Connection) validateResponse(request, response *iso8583.Message) error {
+	err := c.options().ResponseValidator(request, response)
+	if err == nil {
+		return nil
+	}
+
+	return &ResponseError{
+		Err:      err,
+		Response: response,
+	}
+}
+
+// ApproveOnDE39 returns ResponseValidator which accepts responses with
+// response code (field 39) equal to one of the codes and fails with
+// ErrResponseDeclined otherwise
+func ApproveOnDE39(codes ...string) func(request, response *iso8583.Message) error {
+	approved := make(map[string]bool, len(codes))
+	for _, code := range codes {
+		approved[code] = true
+	}
+
+	return func(_, response *iso8583.Message) error {
+		code, err := response.GetString(39)
+		if err != nil {
+			return fmt.Errorf("getting response code (field 39): %w", err)
+		}
+
+		if !approved[code] {
+			return fmt.Errorf("%w with code %q", ErrResponseDeclined, code)
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,74 @@
+package connection
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/moov-io/iso8583"
+)
+
+// buildReversal builds the reversal of the timed out request with
+// TimeoutReversalHandler. It returns nil if request should not be
+// reversed.
+func (c *Connection) buildReversal(original *iso8583.Message) *iso8583.Message {
+	if c.options().TimeoutReversalHandler == nil || !c.reversible(original) {
+		return nil
+	}
+
+	return c.options().TimeoutReversalHandler(original)
+}
+
+// reverse sends the reversal in the background. Original request is
+// remembered for SendTimeout, so its late response can be reported to
+// LateResponseAfterReversalHandler.
+func (c *Connection) reverse(original *iso8583.Message, reqID string, reversal *iso8583.Message) {
+	c.reversed.Store(reqID, original)
+	c.timeouts.afterFunc(c.options().SendTimeout, func() {
+		c.reversed.Delete(reqID)
+	})
+
+	go c.sendReversal(reversal)
+}
+
+// reversible returns true if MTI of the message is one of ReversalMTIs
+func (c *Connection) reversible(message *iso8583.Message) bool {
+	mti, err := message.GetMTI()
+	if err != nil {
+		return false
+	}
+
+	for _, m := range c.options().ReversalMTIs {
+		if m == mti {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sendReversal sends reversal and reports the outcome to
+// ReversalResultHandler or to ErrorHandler when reversal failed and no
+// handler is set
+func (c *Connection) sendReversal(reversal *iso8583.Message) {
+	response, _, err := c.sendWithInfo(context.Background(), reversal)
+
+	if c.options().ReversalResultHandler != nil {
+		c.options().ReversalResultHandler(c, reversal, response, c.wrapError(err))
+		return
+	}
+
+	if err != nil {
+		c.handleError(fmt.Errorf("sending reversal: %w", err))
+	}
+}
+
+// checkLateAfterReversal calls LateResponseAfterReversalHandler if message
+// is the late response to the request that was reversed
+func (c *Connection) checkLateAfterReversal(reqID string, message *iso8583.Message) {
+	original, found := c.reversed.LoadAndDelete(reqID)
+	if !found || c.options().LateResponseAfterReversalHandler == nil {
+		return
+	}
+
+	c.options().LateResponseAfterReversalHandler(c, original.(*iso8583.Message), message)
+}
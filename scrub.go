@@ -0,0 +1,57 @@
+package connection
+
+import (
+	"bytes"
+
+	"github.com/moov-io/iso8583"
+)
+
+// scrubFields overwrites values of ScrubFields of the message with zeros
+// and leaves the fields empty
+func (c *Connection) scrubFields(message *iso8583.Message) {
+	if message == nil || len(c.options().ScrubFields) == 0 {
+		return
+	}
+
+	fields := message.GetFields()
+	for _, id := range c.options().ScrubFields {
+		f, set := fields[id]
+		if !set {
+			continue
+		}
+
+		// binary fields return their value, other fields return a
+		// copy which is zeroed for nothing
+		if value, err := f.Bytes(); err == nil {
+			zeroBytes(value)
+		}
+
+		_ = f.SetBytes(nil)
+	}
+}
+
+// releaseBuffer zeroes the packed message in buf when ScrubFields are set
+// and returns buf into the pool
+func (c *Connection) releaseBuffer(buf *bytes.Buffer) {
+	if len(c.options().ScrubFields) > 0 {
+		zeroBytes(buf.Bytes())
+	}
+
+	putBuffer(buf)
+}
+
+// releaseInbound scrubs inbound message when ScrubInbound is set and
+// releases it
+func (c *Connection) releaseInbound(message *iso8583.Message) {
+	if c.options().ScrubInbound {
+		c.scrubFields(message)
+	}
+
+	c.ReleaseMessage(message)
+}
+
+func zeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,53 @@
+package connection
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/moov-io/iso8583"
+)
+
+// Message is the message sent by SendMessage. *iso8583.Message implements
+// it, as well as types that embed it or pack messages on their own.
+type Message interface {
+	// Pack returns the packed message without the length header
+	Pack() ([]byte, error)
+
+	// GetMTI returns the MTI of the message
+	GetMTI() (string, error)
+
+	// GetString returns the value of the field. It's used to get STAN
+	// (field 11) or MatchFields the response is matched with.
+	GetString(id int) (string, error)
+}
+
+// SendMessage sends message and waits for the response. *iso8583.Message
+// is sent as by Send. For other implementations of Message the STAN must
+// be set by the caller, as STANProvider, AutoSetFields, ScrubFields,
+// SetMessageTTL, TimeoutReversalHandler, LateResponseHandler and
+// DeadLetterHandler work with *iso8583.Message only. Sending such a message
+// fails when MACGenerator is set.
+func (c *Connection) SendMessage(message Message) (*iso8583.Message, error) {
+	if message == nil {
+		return nil, c.wrapError(fmt.Errorf("message required"))
+	}
+
+	resp, _, err := c.sendWithInfo(context.Background(), message)
+
+	return resp, c.wrapError(err)
+}
+
+// packInterface packs the message which is not *iso8583.Message
+func (c *Connection) packInterface(message Message) (*bytes.Buffer, error) {
+	if c.options().MACGenerator != nil {
+		return nil, fmt.Errorf("generating MAC of %T: MACGenerator requires *iso8583.Message", message)
+	}
+
+	packed, err := message.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("packing message: %w", err)
+	}
+
+	return c.frameMessage(packed)
+}
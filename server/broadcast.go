@@ -0,0 +1,119 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+)
+
+// BroadcastResult is the outcome of the broadcast to one connection
+type BroadcastResult struct {
+	// ConnectionID is the ID of the connection the message was sent to
+	ConnectionID string
+
+	RemoteAddr net.Addr
+
+	// Response is the response of the client when broadcast waits for
+	// the responses
+	Response *iso8583.Message
+
+	// Err is the error of sending the message or waiting for the
+	// response
+	Err error
+}
+
+// BroadcastOption configures Broadcast
+type BroadcastOption func(*broadcastOptions)
+
+type broadcastOptions struct {
+	waitForResponses bool
+	responseTimeout  time.Duration
+}
+
+// WaitForResponses makes Broadcast send the message as a request and wait
+// for the response of each client up to timeout. When timeout is zero,
+// SendTimeout of the connection is used.
+func WaitForResponses(timeout time.Duration) BroadcastOption {
+	return func(o *broadcastOptions) {
+		o.waitForResponses = true
+		o.responseTimeout = timeout
+	}
+}
+
+// Broadcast sends a clone of the message to each active connection
+// concurrently and returns the outcomes in the order connections were
+// accepted. Failure of one connection doesn't affect the others. By
+// default, Broadcast returns when message is written into each connection.
+func (s *Server) Broadcast(message *iso8583.Message, opts ...BroadcastOption) []BroadcastResult {
+	options := &broadcastOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	active := s.activeConnections()
+	results := make([]BroadcastResult, len(active))
+
+	var wg sync.WaitGroup
+	for i, ac := range active {
+		results[i] = BroadcastResult{
+			ConnectionID: strconv.FormatUint(ac.seq, 10),
+			RemoteAddr:   ac.conn.RemoteAddr(),
+		}
+
+		clone, err := message.Clone()
+		if err != nil {
+			results[i].Err = fmt.Errorf("cloning message: %w", err)
+			continue
+		}
+
+		wg.Add(1)
+		go func(result *BroadcastResult, c *connection.Connection) {
+			defer wg.Done()
+
+			if !options.waitForResponses {
+				result.Err = c.Reply(clone)
+				return
+			}
+
+			result.Response, result.Err = sendWithTimeout(c, clone, options.responseTimeout)
+		}(&results[i], ac.conn)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// sendWithTimeout sends the message and waits for the response up to
+// timeout or SendTimeout of the connection if timeout is zero
+func sendWithTimeout(c *connection.Connection, message *iso8583.Message, timeout time.Duration) (*iso8583.Message, error) {
+	if timeout <= 0 {
+		return c.Send(message)
+	}
+
+	type sendResult struct {
+		response *iso8583.Message
+		err      error
+	}
+
+	// buffered, so Send doesn't block when we stop waiting for it
+	done := make(chan sendResult, 1)
+	go func() {
+		response, err := c.Send(message)
+		done <- sendResult{response: response, err: err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-done:
+		return r.response, r.err
+	case <-timer.C:
+		return nil, connection.ErrSendTimeout
+	}
+}
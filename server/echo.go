@@ -0,0 +1,124 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/moov-io/iso8583-connection/iso8583util"
+)
+
+// echoMTI is the MTI of the echo test requests answered by the server
+// with AutoRespondEcho
+const echoMTI = "0800"
+
+// echoNetworkManagementCode is the network management information code
+// (field 70) of the echo test
+const echoNetworkManagementCode = "301"
+
+// echoResponseFields are the fields of the echo test request copied into
+// its response
+var echoResponseFields = []int{7, 11, 37, 41, 70}
+
+// IsEchoRequest reports whether message is the echo test request: 0800
+// message with network management information code (field 70) 301. 0800
+// message without field 70 is the echo test as well.
+func IsEchoRequest(message *iso8583.Message) bool {
+	mti, _ := message.GetMTI()
+	if mti != echoMTI {
+		return false
+	}
+
+	if _, set := message.GetFields()[70]; !set {
+		return true
+	}
+
+	code, err := message.GetString(70)
+
+	return err == nil && code == echoNetworkManagementCode
+}
+
+// AutoRespondEcho makes the server answer echo test requests of the
+// clients detected with EchoDetector. Echo tests are answered before the
+// handlers of the server, unless handler for 0800 is registered with
+// connection.InboundMessageHandlerFor. Middlewares see echo tests as
+// other messages. It should be called before Start.
+func (s *Server) AutoRespondEcho(enabled bool) {
+	s.autoRespondEcho = enabled
+}
+
+// RespondEcho replies to the echo test request with the response built by
+// iso8583util.NewResponseFrom with field 39 set to "00" if it's defined in
+// the spec
+func (s *Server) RespondEcho(c *connection.Connection, message *iso8583.Message) {
+	response, err := echoResponse(message)
+	if err != nil {
+		s.handleError(err)
+		return
+	}
+
+	if err := c.Reply(response); err != nil {
+		s.handleError(fmt.Errorf("replying to echo test: %w", err))
+	}
+}
+
+// echoResponse builds the response to the echo test request
+func echoResponse(message *iso8583.Message) (*iso8583.Message, error) {
+	response, err := iso8583util.NewResponseFrom(message, echoResponseFields)
+	if err == nil {
+		if _, found := message.GetSpec().Fields[39]; found {
+			err = response.Field(39, "00")
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("building response to echo test: %w", err)
+	}
+
+	return response, nil
+}
+
+// isEcho reports whether message is the echo test according to
+// EchoDetector
+func (s *Server) isEcho(message *iso8583.Message) bool {
+	if s.EchoDetector != nil {
+		return s.EchoDetector(message)
+	}
+
+	return IsEchoRequest(message)
+}
+
+// respondEcho returns the responder of 0800 messages answering echo tests
+// when AutoRespondEcho is set. Other 0800 messages are passed to next,
+// the responder which would handle them otherwise.
+func (s *Server) respondEcho(next ResponderFunc) ResponderFunc {
+	return func(c *connection.Connection, message *iso8583.Message) (*iso8583.Message, error) {
+		if !s.isEcho(message) {
+			return next(c, message)
+		}
+
+		response, err := echoResponse(message)
+		if err != nil {
+			s.handleError(err)
+			return nil, nil
+		}
+
+		return response, nil
+	}
+}
+
+// fallbackResponder returns the responder of 0800 messages when there is
+// no responder for 0800: the responder of the longest MTI prefix, handler
+// of network management messages or fallback
+func fallbackResponder(responders map[string]ResponderFunc, networkManagement connection.InboundMessageHandlerFunc, fallback ResponderFunc) ResponderFunc {
+	for n := len(echoMTI) - 1; n > 0; n-- {
+		if responder, found := responders[echoMTI[:n]]; found {
+			return responder
+		}
+	}
+
+	if networkManagement != nil {
+		return fromInboundHandler(networkManagement)
+	}
+
+	return fallback
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"fmt"
+	"net"
+
+	connection "github.com/moov-io/iso8583-connection"
+)
+
+// FramingSelectorFunc returns the message length reader and writer of the
+// accepted connection
+type FramingSelectorFunc func(conn net.Conn) (connection.MessageLengthReader, connection.MessageLengthWriter, error)
+
+// FramingSelector sets the function that selects the framing (message
+// length reader and writer) of each accepted connection, so clients with
+// different length headers can be served on the same listener. The
+// selector may read the first bytes from conn to detect the framing: they
+// are read again by the connection. To configure the framing per
+// listener, select it by conn.LocalAddr(). When selector returns error,
+// connection is closed. By default, reader and writer passed to New are
+// used. It should be called before Start.
+func (s *Server) FramingSelector(selector FramingSelectorFunc) {
+	s.framingSelector = selector
+}
+
+// selectFraming returns the conn to use after the framing was selected and
+// the message length reader and writer of the connection
+func (s *Server) selectFraming(conn net.Conn) (net.Conn, connection.MessageLengthReader, connection.MessageLengthWriter, error) {
+	if s.framingSelector == nil {
+		return conn, s.readMessageLength, s.writeMessageLength, nil
+	}
+
+	// selector may wait for the first bytes, so connection is closed
+	// when server is closed meanwhile
+	selected := make(chan struct{})
+	defer close(selected)
+	go func() {
+		select {
+		case <-s.closeCh:
+			conn.Close()
+		case <-selected:
+		}
+	}()
+
+	peeked := &peekedConn{Conn: conn}
+	mlReader, mlWriter, err := s.framingSelector(peeked)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("selecting framing: %w", err)
+	}
+
+	// keep conn as is, e.g. *tls.Conn, when nothing was peeked
+	if len(peeked.peeked) == 0 {
+		return conn, mlReader, mlWriter, nil
+	}
+	peeked.replay = true
+
+	return peeked, mlReader, mlWriter, nil
+}
+
+// peekedConn keeps bytes read from the conn by the framing selector and
+// returns them again once replay is set
+type peekedConn struct {
+	net.Conn
+
+	peeked []byte
+	replay bool
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	if !c.replay {
+		n, err := c.Conn.Read(p)
+		c.peeked = append(c.peeked, p[:n]...)
+		return n, err
+	}
+
+	if len(c.peeked) > 0 {
+		n := copy(p, c.peeked)
+		c.peeked = c.peeked[n:]
+		return n, nil
+	}
+
+	return c.Conn.Read(p)
+}
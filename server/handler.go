@@ -0,0 +1,172 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/moov-io/iso8583-connection/iso8583util"
+)
+
+// ErrFatal marks handler errors after which the connection is closed. The
+// error response is sent first. Wrap it, e.g.
+// fmt.Errorf("invalid MAC: %w", server.ErrFatal).
+var ErrFatal = errors.New("fatal handler error")
+
+// DefaultErrorResponseCode is the response code (field 39) of the default
+// response to the message which handler returned error
+const DefaultErrorResponseCode = "96"
+
+// HandlerFunc handles inbound message like
+// connection.InboundMessageHandlerFunc, but returns error when message
+// can't be handled. The error is responded according to
+// ErrorResponsePolicy.
+type HandlerFunc func(c *connection.Connection, message *iso8583.Message) error
+
+// ErrorResponsePolicyFunc returns the response to the request which
+// handler returned err. No response is sent when it returns nil.
+type ErrorResponsePolicyFunc func(req *iso8583.Message, err error) *iso8583.Message
+
+// ResponderFunc handles inbound message and returns the response the
+// server replies with, if it's not nil, and the error handled like the
+// error of HandlerFunc. Unlike the responses sent with Reply, returned
+// responses are seen by middlewares.
+type ResponderFunc func(c *connection.Connection, message *iso8583.Message) (*iso8583.Message, error)
+
+// FromInboundHandler adapts handler which doesn't return errors to
+// HandlerFunc
+func FromInboundHandler(handler connection.InboundMessageHandlerFunc) HandlerFunc {
+	return func(c *connection.Connection, message *iso8583.Message) error {
+		handler(c, message)
+		return nil
+	}
+}
+
+// fromInboundHandler adapts handler which replies by itself to
+// ResponderFunc
+func fromInboundHandler(handler connection.InboundMessageHandlerFunc) ResponderFunc {
+	return func(c *connection.Connection, message *iso8583.Message) (*iso8583.Message, error) {
+		handler(c, message)
+		return nil, nil
+	}
+}
+
+// responderRegistration is the responder set by Handle, HandleFor, Respond
+// or RespondFor
+type responderRegistration struct {
+	// mtiPrefix is the prefix of MTIs of the handled messages. All
+	// messages are handled when it's empty.
+	mtiPrefix string
+	responder ResponderFunc
+}
+
+// Handle sets the handler of all messages of the accepted connections like
+// connection.InboundMessageHandler. It replaces InboundMessageHandler
+// passed to New. It should be called before Start.
+func (s *Server) Handle(handler HandlerFunc) {
+	s.Respond(fromHandler(handler))
+}
+
+// HandleFor sets the handler of messages which MTI starts with mtiPrefix
+// like connection.InboundMessageHandlerFor. It should be called before
+// Start.
+func (s *Server) HandleFor(mtiPrefix string, handler HandlerFunc) {
+	s.RespondFor(mtiPrefix, fromHandler(handler))
+}
+
+// Respond sets the responder of all messages of the accepted connections
+// like Handle. It should be called before Start.
+func (s *Server) Respond(responder ResponderFunc) {
+	s.responders = append(s.responders, responderRegistration{responder: responder})
+}
+
+// RespondFor sets the responder of messages which MTI starts with
+// mtiPrefix like HandleFor. It should be called before Start.
+func (s *Server) RespondFor(mtiPrefix string, responder ResponderFunc) {
+	s.responders = append(s.responders, responderRegistration{mtiPrefix: mtiPrefix, responder: responder})
+}
+
+// fromHandler adapts handler which replies by itself to ResponderFunc
+func fromHandler(handler HandlerFunc) ResponderFunc {
+	return func(c *connection.Connection, message *iso8583.Message) (*iso8583.Message, error) {
+		return nil, handler(c, message)
+	}
+}
+
+// ErrorResponsePolicy sets the function that builds the response to the
+// message which handler returned error. By default, it's
+// DefaultErrorResponse. It should be called before Start.
+func (s *Server) ErrorResponsePolicy(policy ErrorResponsePolicyFunc) {
+	s.errorResponsePolicy = policy
+}
+
+// DefaultErrorResponse returns the response built by
+// iso8583util.NewResponseFrom with field 39 set to
+// DefaultErrorResponseCode if it's defined in the spec. It returns nil when
+// response can't be built, e.g. req is not a request.
+func DefaultErrorResponse(req *iso8583.Message, err error) *iso8583.Message {
+	response, buildErr := iso8583util.NewResponseFrom(req, unregisteredResponseFields)
+	if buildErr != nil {
+		return nil
+	}
+
+	if _, found := req.GetSpec().Fields[39]; !found {
+		return response
+	}
+
+	if buildErr := response.Field(39, DefaultErrorResponseCode); buildErr != nil {
+		return nil
+	}
+
+	return response
+}
+
+// respondErrors returns the response built by ErrorResponsePolicy when
+// responder returned error without the response, so middlewares see it
+func (s *Server) respondErrors(responder ResponderFunc) ResponderFunc {
+	return func(c *connection.Connection, message *iso8583.Message) (*iso8583.Message, error) {
+		response, err := responder(c, message)
+		if err == nil || response != nil {
+			return response, err
+		}
+
+		policy := s.errorResponsePolicy
+		if policy == nil {
+			policy = DefaultErrorResponse
+		}
+
+		return policy(message, err), err
+	}
+}
+
+// serve adapts responder wrapped with the middlewares to
+// connection.InboundMessageHandlerFunc. It replies with the response
+// responder returned. Errors are passed to ErrorHandler and connection is
+// closed after the response when error is ErrFatal.
+func (s *Server) serve(responder ResponderFunc) connection.InboundMessageHandlerFunc {
+	for i := len(s.middlewares) - 1; i >= 0; i-- {
+		responder = s.middlewares[i](responder)
+	}
+
+	return func(c *connection.Connection, message *iso8583.Message) {
+		mti, _ := message.GetMTI()
+
+		response, err := responder(c, message)
+		if err != nil {
+			atomic.AddUint64(&s.handlerErrors, 1)
+			s.handleError(fmt.Errorf("handling message %s from %s: %w", mti, c.RemoteAddr(), err))
+		}
+
+		if response != nil {
+			if replyErr := c.Reply(response); replyErr != nil {
+				s.handleError(fmt.Errorf("replying to message %s: %w", mti, replyErr))
+			}
+		}
+
+		if errors.Is(err, ErrFatal) {
+			c.Close()
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+)
+
+// ErrInboundModeConflict is returned when inbound channel mode is used
+// together with inbound message handlers
+var ErrInboundModeConflict = errors.New("inbound channel mode and inbound message handlers are mutually exclusive")
+
+// InboundMessage is the message received by the server in inbound channel
+// mode
+type InboundMessage struct {
+	// Message is the copy of the received message
+	Message *iso8583.Message
+
+	// Raw is the received message packed again, without the length
+	// header
+	Raw []byte
+
+	conn *connection.Connection
+}
+
+// Respond replies to the message on the connection it was received from
+func (m InboundMessage) Respond(response *iso8583.Message) error {
+	return m.conn.Reply(response)
+}
+
+// Connection returns the connection the message was received from
+func (m InboundMessage) Connection() *connection.Connection {
+	return m.conn
+}
+
+// InboundChannelMode makes the server deliver received messages to the
+// channel returned by Inbound instead of calling inbound message handlers,
+// so tests can drive the protocol manually. It returns
+// ErrInboundModeConflict when handlers are set with New, Handle, HandleFor
+// or HandleUnregistered. Connections fail to be created when handlers are
+// set after it. It should be called before Start.
+func (s *Server) InboundChannelMode() error {
+	if s.hasHandlers() {
+		return ErrInboundModeConflict
+	}
+
+	s.inbound = make(chan InboundMessage)
+
+	return nil
+}
+
+// Inbound returns the channel of the messages received in inbound channel
+// mode. Handling of each message waits until it's received from the
+// channel or server is closed. It returns nil when inbound channel mode is
+// not set.
+func (s *Server) Inbound() <-chan InboundMessage {
+	return s.inbound
+}
+
+// hasHandlers reports whether any inbound message handler is set
+func (s *Server) hasHandlers() bool {
+	if len(s.responders) > 0 || s.unregisteredHandler != nil {
+		return true
+	}
+
+	o := &connection.Options{}
+	for _, opt := range s.connectionOpts {
+		if err := opt(o); err != nil {
+			continue
+		}
+	}
+
+	return hasInboundHandlers(o)
+}
+
+func hasInboundHandlers(o *connection.Options) bool {
+	return o.InboundMessageHandler != nil || len(o.InboundMessageHandlers) > 0 || o.NetworkManagementHandler != nil
+}
+
+// deliverInbound returns the responder delivering messages to the inbound
+// channel
+func (s *Server) deliverInbound() ResponderFunc {
+	return func(c *connection.Connection, message *iso8583.Message) (*iso8583.Message, error) {
+		// message is released when handler returns
+		clone, err := message.Clone()
+		if err != nil {
+			s.handleError(fmt.Errorf("copying inbound message: %w", err))
+			return nil, nil
+		}
+
+		raw, err := message.Pack()
+		if err != nil {
+			s.handleError(fmt.Errorf("packing inbound message: %w", err))
+			return nil, nil
+		}
+
+		select {
+		case s.inbound <- InboundMessage{Message: clone, Raw: raw, conn: c}:
+		case <-s.closeCh:
+		case <-c.Done():
+		}
+
+		return nil, nil
+	}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+)
+
+// Middleware wraps the responders of the inbound messages of the accepted
+// connections, e.g. to log or count messages. Handlers which reply by
+// themselves, e.g. the ones set with connection.InboundMessageHandler, are
+// adapted to responders which return no response.
+type Middleware func(next ResponderFunc) ResponderFunc
+
+// Use adds middlewares to the inbound message handlers of the accepted
+// connections. The first middleware is the outermost one. They wrap
+// handlers passed to New, handlers set with Handle, HandleFor, Respond and
+// RespondFor, the handler of unregistered messages and the echo test
+// responder, so they see all messages received by the server. It should be
+// called before Start.
+func (s *Server) Use(middlewares ...Middleware) {
+	s.middlewares = append(s.middlewares, middlewares...)
+}
+
+// handlers returns the option that sets inbound message handlers of the
+// accepted connection: handlers passed to New, responders set with
+// Handle, HandleFor, Respond and RespondFor, the handler of unregistered
+// messages and the echo test responder, each wrapped with the middlewares.
+// It's applied after the options of the server.
+func (s *Server) handlers() connection.Option {
+	return func(o *connection.Options) error {
+		var fallback ResponderFunc
+		if o.InboundMessageHandler != nil {
+			fallback = fromInboundHandler(o.InboundMessageHandler)
+		}
+
+		responders := make(map[string]ResponderFunc, len(o.InboundMessageHandlers)+len(s.responders)+1)
+		for prefix, handler := range o.InboundMessageHandlers {
+			responders[prefix] = fromInboundHandler(handler)
+		}
+
+		for _, reg := range s.responders {
+			if reg.mtiPrefix == "" {
+				fallback = s.respondErrors(reg.responder)
+				continue
+			}
+			responders[reg.mtiPrefix] = s.respondErrors(reg.responder)
+		}
+
+		if s.inbound != nil {
+			if fallback != nil || len(responders) > 0 || o.NetworkManagementHandler != nil || s.unregisteredHandler != nil {
+				return ErrInboundModeConflict
+			}
+			fallback = s.deliverInbound()
+		}
+
+		if fallback == nil {
+			fallback = s.respondUnregistered(o.MTIVersion)
+		}
+
+		if s.autoRespondEcho {
+			// explicitly registered handler overrides the responder
+			if _, found := responders[echoMTI]; !found {
+				responders[echoMTI] = s.respondEcho(fallbackResponder(responders, o.NetworkManagementHandler, fallback))
+			}
+		}
+
+		o.InboundMessageHandler = s.serve(fallback)
+
+		if len(responders) > 0 {
+			handlers := make(map[string]connection.InboundMessageHandlerFunc, len(responders))
+			for prefix, responder := range responders {
+				handlers[prefix] = s.serve(responder)
+			}
+			o.InboundMessageHandlers = handlers
+		}
+
+		return nil
+	}
+}
+
+// Logger logs lines of LoggingMiddleware. *log.Logger implements it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// LoggingMiddleware logs one line for each received message with its MTI,
+// STAN, fields, remote address of the client and handler duration. Values
+// of maskFields, e.g. PAN, are masked with connection.MaskValue. MTI and
+// response code (field 39) of the response returned by the responder, or
+// of the received message when handler replied with it, are logged too, as
+// well as the returned error.
+func LoggingMiddleware(logger Logger, maskFields []int) Middleware {
+	return func(next ResponderFunc) ResponderFunc {
+		return func(c *connection.Connection, message *iso8583.Message) (*iso8583.Message, error) {
+			mti, _ := message.GetMTI()
+			stan, _ := message.GetString(11)
+			fields := formatFields(connection.MaskedFields(message, maskFields))
+
+			started := time.Now()
+			response, err := next(c, message)
+			duration := time.Since(started)
+
+			line := fmt.Sprintf("mti=%s stan=%s remote_addr=%s duration=%s fields=%q", mti, stan, c.RemoteAddr(), duration, fields)
+
+			replied := response
+
+			// handler replied with the received message
+			if responseMTI, _ := message.GetMTI(); replied == nil && responseMTI != mti {
+				replied = message
+			}
+
+			if replied != nil {
+				responseMTI, _ := replied.GetMTI()
+				responseCode, _ := replied.GetString(39)
+				line += fmt.Sprintf(" response_mti=%s response_code=%s", responseMTI, responseCode)
+			}
+
+			if err != nil {
+				line += fmt.Sprintf(" error=%q", err.Error())
+			}
+
+			logger.Printf("%s", line)
+
+			return response, err
+		}
+	}
+}
+
+// formatFields formats field values ordered by field IDs
+func formatFields(values map[int]string) string {
+	ids := make([]int, 0, len(values))
+	for id := range values {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	parts := make([]string, 0, len(ids))
+	for _, id := range ids {
+		parts = append(parts, fmt.Sprintf("%d:%s", id, values[id]))
+	}
+
+	return strings.Join(parts, " ")
+}
@@ -1,17 +1,33 @@
 package server
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/moov-io/iso8583"
 	connection "github.com/moov-io/iso8583-connection"
 )
 
+// ErrConnectionNotFound is returned by CloseConnection when there is no
+// active connection with the ID
+var ErrConnectionNotFound = errors.New("connection not found")
+
 // Server is a simple iso8583 server implementation currently used to test
 // iso8583-client and most probably to be used for iso8583-test-harness
 type Server struct {
+	// should be first to be 64-bit aligned for atomic operations
+	unregisteredMessages uint64
+	connectionsAccepted  uint64
+	handlerErrors        uint64
+
 	connectionOpts []connection.Option
 	ln             net.Listener
 	Addr           string
@@ -19,7 +35,8 @@ type Server struct {
 
 	closeCh chan bool
 
-	// spec that will be used to unpack received messages
+	// spec that will be used to pack messages and to unpack received
+	// messages unless connection.InboundSpec option is set
 	spec *iso8583.MessageSpec
 
 	// readMessageLength is the function that reads message length header
@@ -29,16 +46,129 @@ type Server struct {
 	// writeMessageLength is the function that encodes message length and
 	// writes message length header into the connection
 	writeMessageLength connection.MessageLengthWriter
+
+	// OnConnect is called with the ID of each accepted connection. It
+	// should be set before Start.
+	OnConnect func(id string, c *connection.Connection)
+
+	// OnDisconnect is called once for each accepted connection when it's
+	// closed, after its inbound handlers have returned. err is nil when
+	// connection was closed gracefully by the client or by the server,
+	// otherwise it's the error connection was closed because of, e.g.
+	// connection reset. It should be set before Start.
+	OnDisconnect func(id string, c *connection.Connection, err error)
+
+	// AcceptFilter is called with the remote address of each accepted
+	// connection before anything is read from it or TLS handshake is
+	// done. When it returns error, connection is closed and the error is
+	// passed to ErrorHandler. It should be set before Start.
+	AcceptFilter func(remoteAddr net.Addr) error
+
+	// RejectionFrame is written to the connection rejected by
+	// AcceptFilter before it's closed, e.g. packed message with the
+	// length header
+	RejectionFrame []byte
+
+	// ErrorHandler is called with errors of accepting and handling
+	// connections. When it's not set, errors are printed.
+	ErrorHandler func(err error)
+
+	// CloseNotification builds the message sent to the client before its
+	// connection is closed with CloseConnection. No message is sent when
+	// it's not set or returns nil.
+	CloseNotification func(reason string) *iso8583.Message
+
+	// InvalidTransactionCode is the response code (field 39) set by
+	// RespondInvalidTransaction. It's DefaultInvalidTransactionCode by
+	// default.
+	InvalidTransactionCode string
+
+	// EchoDetector reports whether message is the echo test answered by
+	// the server with AutoRespondEcho. It's IsEchoRequest by default.
+	EchoDetector func(message *iso8583.Message) bool
+
+	// autoRespondEcho is set by AutoRespondEcho
+	autoRespondEcho bool
+
+	// framingSelector is set by FramingSelector
+	framingSelector FramingSelectorFunc
+
+	// wrapConn is set by WrapConn
+	wrapConn connection.ConnWrapper
+
+	// responders set by Handle, HandleFor, Respond and RespondFor in
+	// order
+	responders []responderRegistration
+
+	// errorResponsePolicy is set by ErrorResponsePolicy
+	errorResponsePolicy ErrorResponsePolicyFunc
+
+	// inbound is the channel of the received messages set by
+	// InboundChannelMode
+	inbound chan InboundMessage
+
+	// TLS config of the accepted connections set by StartTLS
+	tlsConfig *tls.Config
+
+	// middlewares added with Use
+	middlewares []Middleware
+
+	// handler of messages with no registered handler set by
+	// HandleUnregistered
+	unregisteredHandler connection.InboundMessageHandlerFunc
+
+	// to protect following: lastID, connections, closed
+	mu          sync.Mutex
+	lastID      uint64
+	connections map[string]*activeConnection
+
+	// counters of the closed connections included in Stats
+	closed closedStats
 }
 
+// activeConnection is the connection accepted by the server
+type activeConnection struct {
+	seq         uint64
+	conn        *connection.Connection
+	connectedAt time.Time
+}
+
+// ConnectionInfo describes the active connection of the server
+type ConnectionInfo struct {
+	// ID identifies the connection while it's active
+	ID string
+
+	RemoteAddr  net.Addr
+	ConnectedAt time.Time
+
+	// LastActivity is the time when the last message was received from
+	// the client or, if there was none, when connection was accepted
+	LastActivity time.Time
+
+	// MessagesHandled is the number of messages received from the client
+	MessagesHandled uint64
+
+	// MessagesSent is the number of messages written to the client
+	MessagesSent uint64
+
+	// PendingRequests is the number of messages sent to the client with
+	// Send that wait for the response
+	PendingRequests int
+}
+
+// New creates server which packs messages with spec. connectionOpts are
+// applied to each accepted connection, e.g. use connection.InboundSpec to
+// unpack messages received from clients with a different spec.
 func New(spec *iso8583.MessageSpec, mlReader connection.MessageLengthReader, mlWriter connection.MessageLengthWriter, connectionOpts ...connection.Option) *Server {
 	// automatically choose port
 	return &Server{
-		connectionOpts:     connectionOpts,
-		closeCh:            make(chan bool),
-		spec:               spec,
-		readMessageLength:  mlReader,
-		writeMessageLength: mlWriter,
+		connectionOpts:         connectionOpts,
+		closeCh:                make(chan bool),
+		connections:            make(map[string]*activeConnection),
+		spec:                   spec,
+		readMessageLength:      mlReader,
+		writeMessageLength:     mlWriter,
+		InvalidTransactionCode: DefaultInvalidTransactionCode,
 	}
 }
 
@@ -47,6 +177,33 @@ func (s *Server) Start(addr string) error {
 	if err != nil {
 		return err
 	}
+
+	s.Serve(ln)
+
+	return nil
+}
+
+// StartTLS starts the server which accepts TLS connections configured with
+// config. Set ClientAuth and ClientCAs of the config to require and verify
+// client certificates (mTLS). Handlers can get the client certificate with
+// PeerCertificates of the connection.
+func (s *Server) StartTLS(addr string, config *tls.Config) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	// connections are wrapped with TLS after AcceptFilter
+	s.tlsConfig = config
+	s.Serve(ln)
+
+	return nil
+}
+
+// Serve accepts connections from ln in the background until server is
+// closed. Use it to accept connections of other transports, e.g. the
+// listener of websocket package.
+func (s *Server) Serve(ln net.Listener) {
 	// Store address and listener information for later
 	s.Addr = ln.Addr().String()
 	s.ln = ln
@@ -66,23 +223,71 @@ func (s *Server) Start(addr string) error {
 					return
 				default:
 					// TODO: better handle errors
-					fmt.Printf("Error accepting connection: %s\n", err.Error())
+					s.handleError(fmt.Errorf("accepting connection: %w", err))
 					return
 				}
 			}
 
+			if s.filter(conn) {
+				continue
+			}
+
+			if s.tlsConfig != nil {
+				conn = tls.Server(conn, s.tlsConfig)
+			}
+
 			s.wg.Add(1)
 			go func() {
 				err := s.handleConnection(conn)
 				if err != nil {
-					fmt.Printf("Error handling connection: %s\n", err.Error())
+					s.handleError(fmt.Errorf("handling connection: %w", err))
 				}
 				s.wg.Done()
 			}()
 		}
 	}()
+}
 
-	return nil
+// filter reports whether the connection was rejected by AcceptFilter.
+// Rejected connection is closed in the background, so the accept loop
+// doesn't wait for RejectionFrame to be written into it, and the reason of
+// rejection is passed to ErrorHandler.
+func (s *Server) filter(conn net.Conn) bool {
+	if s.AcceptFilter == nil {
+		return false
+	}
+
+	reason := s.AcceptFilter(conn.RemoteAddr())
+	if reason == nil {
+		return false
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		if len(s.RejectionFrame) > 0 {
+			// don't let the client hold the connection open
+			conn.SetWriteDeadline(time.Now().Add(time.Second))
+			conn.Write(s.RejectionFrame)
+		}
+		conn.Close()
+
+		s.handleError(fmt.Errorf("rejected connection from %s: %w", conn.RemoteAddr(), reason))
+	}()
+
+	return true
+}
+
+// handleError passes err to ErrorHandler or prints it if handler is not
+// set
+func (s *Server) handleError(err error) {
+	if s.ErrorHandler != nil {
+		s.ErrorHandler(err)
+		return
+	}
+
+	fmt.Printf("Error %s\n", err.Error())
 }
 
 func (s *Server) Close() {
@@ -95,12 +300,110 @@ func (s *Server) Close() {
 	s.wg.Wait()
 }
 
+// Connections returns descriptors of the active connections in the order
+// they were accepted
+func (s *Server) Connections() []ConnectionInfo {
+	active := s.activeConnections()
+
+	infos := make([]ConnectionInfo, 0, len(active))
+	for _, ac := range active {
+		stats := ac.conn.Stats()
+		infos = append(infos, ConnectionInfo{
+			ID:              strconv.FormatUint(ac.seq, 10),
+			RemoteAddr:      ac.conn.RemoteAddr(),
+			ConnectedAt:     ac.connectedAt,
+			LastActivity:    ac.conn.LastReceived(),
+			MessagesHandled: stats.MessagesReceived,
+			MessagesSent:    stats.MessagesSent,
+			PendingRequests: stats.PendingRequests,
+		})
+	}
+
+	return infos
+}
+
+// activeConnections returns active connections in the order they were
+// accepted
+func (s *Server) activeConnections() []*activeConnection {
+	s.mu.Lock()
+	active := make([]*activeConnection, 0, len(s.connections))
+	for _, ac := range s.connections {
+		active = append(active, ac)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].seq < active[j].seq
+	})
+
+	return active
+}
+
+// CloseConnection closes the active connection with the ID. If
+// CloseNotification is set, the message it builds for the reason is sent
+// to the client first.
+func (s *Server) CloseConnection(id string, reason string) error {
+	s.mu.Lock()
+	ac, found := s.connections[id]
+	s.mu.Unlock()
+
+	if !found {
+		return fmt.Errorf("closing connection %s: %w", id, ErrConnectionNotFound)
+	}
+
+	if s.CloseNotification != nil {
+		if message := s.CloseNotification(reason); message != nil {
+			if err := ac.conn.Reply(message); err != nil {
+				s.handleError(fmt.Errorf("sending close notification to connection %s: %w", id, err))
+			}
+		}
+	}
+
+	return ac.conn.Close()
+}
+
 func (s *Server) handleConnection(conn net.Conn) error {
-	c, err := connection.NewFrom(conn, s.spec, s.readMessageLength, s.writeMessageLength, s.connectionOpts...)
+	connectedAt := time.Now()
+
+	opts := append(s.connectionOpts[:len(s.connectionOpts):len(s.connectionOpts)], s.handlers())
+
+	if s.wrapConn != nil {
+		wrapped, err := s.wrapConn(conn)
+		if err != nil {
+			conn.Close()
+			return fmt.Errorf("wrapping connection: %w", err)
+		}
+		conn = wrapped
+	}
+
+	framedConn, mlReader, mlWriter, err := s.selectFraming(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	c, err := connection.NewFrom(framedConn, s.spec, mlReader, mlWriter, opts...)
 	if err != nil {
+		conn.Close()
 		return fmt.Errorf("creating connection: %w", err)
 	}
 
+	atomic.AddUint64(&s.connectionsAccepted, 1)
+
+	s.mu.Lock()
+	s.lastID++
+	id := strconv.FormatUint(s.lastID, 10)
+	s.connections[id] = &activeConnection{
+		seq:         s.lastID,
+		conn:        c,
+		connectedAt: connectedAt,
+	}
+	s.mu.Unlock()
+
+	if s.OnConnect != nil {
+		s.OnConnect(id, c)
+	}
+
 	select {
 	case <-s.closeCh:
 		// if server was closed, close the client
@@ -110,5 +413,25 @@ func (s *Server) handleConnection(conn net.Conn) error {
 		// we just return
 	}
 
+	s.mu.Lock()
+	delete(s.connections, id)
+	s.closed.add(c.Stats())
+	s.mu.Unlock()
+
+	if s.OnDisconnect != nil {
+		c.WaitInbound()
+		s.OnDisconnect(id, c, disconnectError(c.Err()))
+	}
+
 	return nil
 }
+
+// disconnectError returns nil if connection was closed by the client
+// gracefully
+func disconnectError(err error) error {
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+
+	return err
+}
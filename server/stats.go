@@ -0,0 +1,90 @@
+package server
+
+import (
+	"sync/atomic"
+
+	connection "github.com/moov-io/iso8583-connection"
+)
+
+// Stats contains statistics of the server. Message counters are the sums
+// of the stats of the connections, including the closed ones.
+type Stats struct {
+	// ConnectionsAccepted is the number of connections accepted by the
+	// server
+	ConnectionsAccepted uint64
+
+	// OpenConnections is the number of active connections
+	OpenConnections int
+
+	// MessagesReceived is the number of messages received from the
+	// clients and unpacked
+	MessagesReceived uint64
+
+	// MessagesSent is the number of messages written to the clients
+	MessagesSent uint64
+
+	// HandlerErrors is the number of errors returned by handlers set
+	// with Handle and HandleFor
+	HandlerErrors uint64
+
+	// UnpackErrors is the number of messages received from the clients
+	// that couldn't be unpacked
+	UnpackErrors uint64
+
+	// UnregisteredMessages is the number of messages received from the
+	// clients that had no registered handler
+	UnregisteredMessages uint64
+}
+
+// closedStats are the message counters of the closed connections
+type closedStats struct {
+	messagesReceived uint64
+	messagesSent     uint64
+	unpackErrors     uint64
+}
+
+// add adds the counters of the closed connection
+func (cs *closedStats) add(stats connection.Stats) {
+	cs.messagesReceived += stats.MessagesReceived
+	cs.messagesSent += stats.MessagesSent
+	cs.unpackErrors += stats.UnpackErrors
+}
+
+// Stats returns statistics of the server
+func (s *Server) Stats() Stats {
+	s.mu.Lock()
+	stats := Stats{
+		OpenConnections:  len(s.connections),
+		MessagesReceived: s.closed.messagesReceived,
+		MessagesSent:     s.closed.messagesSent,
+		UnpackErrors:     s.closed.unpackErrors,
+	}
+	for _, ac := range s.connections {
+		connStats := ac.conn.Stats()
+		stats.MessagesReceived += connStats.MessagesReceived
+		stats.MessagesSent += connStats.MessagesSent
+		stats.UnpackErrors += connStats.UnpackErrors
+	}
+	s.mu.Unlock()
+
+	stats.ConnectionsAccepted = atomic.LoadUint64(&s.connectionsAccepted)
+	stats.HandlerErrors = atomic.LoadUint64(&s.handlerErrors)
+	stats.UnregisteredMessages = atomic.LoadUint64(&s.unregisteredMessages)
+
+	return stats
+}
+
+// ResetStats sets counters of the server and of its active connections to
+// zero
+func (s *Server) ResetStats() {
+	s.mu.Lock()
+	s.closed = closedStats{}
+	for _, ac := range s.connections {
+		ac.conn.ResetStats()
+	}
+	s.mu.Unlock()
+
+	atomic.StoreUint64(&s.connectionsAccepted, 0)
+	atomic.StoreUint64(&s.handlerErrors, 0)
+	atomic.StoreUint64(&s.unregisteredMessages, 0)
+}
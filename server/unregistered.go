@@ -0,0 +1,93 @@
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/moov-io/iso8583-connection/iso8583util"
+)
+
+// DefaultInvalidTransactionCode is the response code (field 39) of the
+// default response to the messages with no registered handler
+const DefaultInvalidTransactionCode = "12"
+
+// unregisteredResponseFields are the fields of the message with no
+// registered handler copied into the default response
+var unregisteredResponseFields = []int{2, 3, 4, 7, 11, 12, 13, 32, 37, 41, 42, 49}
+
+// HandleUnregistered sets the handler of the requests that have neither
+// handler registered with connection.InboundMessageHandlerFor nor
+// connection.InboundMessageHandler. By default such requests are responded
+// by RespondInvalidTransaction. Unmatched responses, e.g. the late ones,
+// are dropped. It should be called before Start.
+func (s *Server) HandleUnregistered(handler connection.InboundMessageHandlerFunc) {
+	s.unregisteredHandler = handler
+}
+
+// RespondInvalidTransaction replies to the message with the response built
+// by iso8583util.NewResponseFrom with field 39 set to
+// InvalidTransactionCode, when the spec has it. It's the default handler of the messages with no
+// registered handler.
+func (s *Server) RespondInvalidTransaction(c *connection.Connection, message *iso8583.Message) {
+	response, err := s.invalidTransactionResponse(message)
+	if err != nil {
+		s.handleError(err)
+		return
+	}
+
+	if err := c.Reply(response); err != nil {
+		s.handleError(fmt.Errorf("replying to unregistered message: %w", err))
+	}
+}
+
+// invalidTransactionResponse builds the response to the unregistered
+// message. Response code is not set when the spec has no field 39.
+func (s *Server) invalidTransactionResponse(message *iso8583.Message) (*iso8583.Message, error) {
+	response, err := iso8583util.NewResponseFrom(message, unregisteredResponseFields)
+	if err != nil {
+		return nil, fmt.Errorf("building response to unregistered message: %w", err)
+	}
+
+	if _, found := message.GetSpec().Fields[39]; !found {
+		return response, nil
+	}
+
+	if err := response.Field(39, s.InvalidTransactionCode); err != nil {
+		return nil, fmt.Errorf("setting response code of unregistered message: %w", err)
+	}
+
+	return response, nil
+}
+
+// respondUnregistered returns the responder of the messages with no
+// registered handler. Requests are passed to the handler set by
+// HandleUnregistered or responded by RespondInvalidTransaction. MTI
+// version of the connection is passed, as Opts of the connection may be
+// replaced by SetOptions meanwhile.
+func (s *Server) respondUnregistered(version iso8583util.Version) ResponderFunc {
+	return func(c *connection.Connection, message *iso8583.Message) (*iso8583.Message, error) {
+		// unmatched responses, e.g. late ones, are dropped, as there is
+		// nothing to respond to
+		mti, err := message.GetMTI()
+		if err != nil || !version.IsRequest(mti) {
+			return nil, nil
+		}
+
+		atomic.AddUint64(&s.unregisteredMessages, 1)
+
+		if s.unregisteredHandler != nil {
+			s.unregisteredHandler(c, message)
+			return nil, nil
+		}
+
+		response, err := s.invalidTransactionResponse(message)
+		if err != nil {
+			s.handleError(err)
+			return nil, nil
+		}
+
+		return response, nil
+	}
+}
@@ -0,0 +1,13 @@
+package server
+
+import (
+	connection "github.com/moov-io/iso8583-connection"
+)
+
+// WireEncoding makes the server translate messages of the clients with
+// enc like the clients created with connection.WireEncoding do, e.g. to
+// simulate the host speaking EBCDIC. When fields are given, only they are
+// translated. It should be called before Start.
+func (s *Server) WireEncoding(enc connection.Encoding, fields ...int) {
+	s.connectionOpts = append(s.connectionOpts, connection.WireEncoding(enc, fields...))
+}
@@ -0,0 +1,14 @@
+package server
+
+import (
+	connection "github.com/moov-io/iso8583-connection"
+)
+
+// WrapConn sets the function that wraps each accepted connection like
+// connection.WrapConn does for the client, e.g. to decompress the stream
+// of the clients compressing it. Connection is wrapped after TLS handshake
+// and before the framing is selected. When wrap returns error, connection
+// is closed. It should be called before Start.
+func (s *Server) WrapConn(wrap connection.ConnWrapper) {
+	s.wrapConn = wrap
+}
@@ -0,0 +1,223 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/moov-io/iso8583"
+)
+
+// Session is the logical session, e.g. of the terminal, multiplexed over
+// the connection. Messages sent with the session carry its ID in
+// SessionField, and their responses are matched within the session, so
+// STANs of different sessions may collide.
+type Session struct {
+	c          *Connection
+	id         string
+	maxPending int
+
+	// counters are accessed atomically
+	pending  int32
+	sent     uint64
+	failed   uint64
+	rejected uint64
+
+	// to protect following: closed, cancels, nextSend
+	mu       sync.Mutex
+	closed   bool
+	cancels  map[uint64]context.CancelFunc
+	nextSend uint64
+
+	// Send calls of the session Close waits for
+	sends sync.WaitGroup
+}
+
+// SessionOption configures a Session
+type SessionOption func(s *Session) error
+
+// SessionMaxPending limits the number of pending requests of the session.
+// Send fails with ErrSessionPendingLimit when session has n pending
+// requests. Zero means no limit.
+func SessionMaxPending(n int) SessionOption {
+	return func(s *Session) error {
+		if n < 0 {
+			return fmt.Errorf("max pending requests should not be negative, got %d", n)
+		}
+		s.maxPending = n
+		return nil
+	}
+}
+
+// SessionStats are the counters of the session
+type SessionStats struct {
+	// PendingRequests is the number of requests of the session waiting
+	// for the response
+	PendingRequests int
+
+	// Sent is the number of Send calls which returned the response
+	Sent uint64
+
+	// Failed is the number of Send calls which returned an error
+	Failed uint64
+
+	// Rejected is the number of Send calls which failed because session
+	// had max pending requests
+	Rejected uint64
+}
+
+// Session opens the session with id. It fails with ErrSessionExists when
+// session with id is open.
+func (c *Connection) Session(id string, opts ...SessionOption) (*Session, error) {
+	if id == "" {
+		return nil, errors.New("session ID should not be empty")
+	}
+
+	s := &Session{
+		c:       c,
+		id:      id,
+		cancels: make(map[uint64]context.CancelFunc),
+	}
+
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, fmt.Errorf("setting session option: %w", err)
+		}
+	}
+
+	if _, loaded := c.sessions.LoadOrStore(id, s); loaded {
+		return nil, ErrSessionExists
+	}
+	atomic.AddInt32(&c.openSessions, 1)
+
+	return s, nil
+}
+
+// ID returns the ID of the session
+func (s *Session) ID() string {
+	return s.id
+}
+
+// Send sets SessionField of the message to the session ID, sends it and
+// waits for the response like Connection.Send
+func (s *Session) Send(message *iso8583.Message, opts ...SendOption) (*iso8583.Message, error) {
+	return s.SendCtx(context.Background(), message, opts...)
+}
+
+// SendCtx is Send with the context like Connection.SendCtx
+func (s *Session) SendCtx(ctx context.Context, message *iso8583.Message, opts ...SendOption) (*iso8583.Message, error) {
+	if err := message.Field(s.c.options().SessionField, s.id); err != nil {
+		return nil, fmt.Errorf("setting session field: %w", err)
+	}
+
+	sendCtx, done, err := s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	resp, err := s.c.SendCtx(sendCtx, message, opts...)
+	if err != nil {
+		atomic.AddUint64(&s.failed, 1)
+
+		// request was canceled by Close rather than by ctx
+		if ctx.Err() == nil && errors.Is(err, context.Canceled) {
+			return nil, s.c.wrapError(ErrSessionClosed)
+		}
+
+		return nil, err
+	}
+
+	atomic.AddUint64(&s.sent, 1)
+
+	return resp, nil
+}
+
+// begin registers the Send of the session and returns its context, which
+// is canceled by Close, and the function to call when Send returns
+func (s *Session) begin(ctx context.Context) (context.Context, func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, nil, ErrSessionClosed
+	}
+
+	if s.maxPending > 0 && int(atomic.LoadInt32(&s.pending)) >= s.maxPending {
+		atomic.AddUint64(&s.rejected, 1)
+		return nil, nil, ErrSessionPendingLimit
+	}
+
+	sendCtx, cancel := context.WithCancel(ctx)
+	n := s.nextSend
+	s.nextSend++
+	s.cancels[n] = cancel
+	atomic.AddInt32(&s.pending, 1)
+	s.sends.Add(1)
+
+	return sendCtx, func() {
+		s.mu.Lock()
+		delete(s.cancels, n)
+		s.mu.Unlock()
+
+		cancel()
+		atomic.AddInt32(&s.pending, -1)
+		s.sends.Done()
+	}, nil
+}
+
+// Close closes the session. Its pending requests fail with
+// ErrSessionClosed, while requests of other sessions are not affected.
+// Close returns when Send calls of the session returned.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	for _, cancel := range s.cancels {
+		cancel()
+	}
+	s.mu.Unlock()
+
+	s.sends.Wait()
+
+	s.c.sessions.Delete(s.id)
+	atomic.AddInt32(&s.c.openSessions, -1)
+
+	return nil
+}
+
+// Stats returns the counters of the session
+func (s *Session) Stats() SessionStats {
+	return SessionStats{
+		PendingRequests: int(atomic.LoadInt32(&s.pending)),
+		Sent:            atomic.LoadUint64(&s.sent),
+		Failed:          atomic.LoadUint64(&s.failed),
+		Rejected:        atomic.LoadUint64(&s.rejected),
+	}
+}
+
+// sessionRequestID scopes the request ID by the session the message
+// belongs to, so requests of different sessions with the same STAN don't
+// collide
+func (c *Connection) sessionRequestID(message Message, reqID string) string {
+	if atomic.LoadInt32(&c.openSessions) == 0 {
+		return reqID
+	}
+
+	id, err := matchFieldValue(message, strconv.Itoa(c.options().SessionField))
+	if err != nil || id == "" {
+		return reqID
+	}
+
+	if _, open := c.sessions.Load(id); !open {
+		return reqID
+	}
+
+	return id + matchKeySeparator + reqID
+}
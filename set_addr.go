@@ -0,0 +1,85 @@
+package connection
+
+import (
+	"fmt"
+)
+
+// SetAddr changes the address of the server. When migrate is false, the
+// new address is used by the next Connect or reconnect attempt. When it's
+// true and connection is established, SetAddr connects to the new address
+// and the following Send and Reply calls use the new connection. The
+// previous connection is closed when Send and Reply calls that use it
+// return, so pending requests get their responses. The new connection is
+// signed off and ConnectionEstablishedHandler is called for it like after
+// Connect. If connection to the new address fails, the address is not
+// changed and the error is returned. Connection with TLSUpgrade or SRV
+// option can't be migrated.
+func (c *Connection) SetAddr(addr string, migrate bool) error {
+	// concurrent migrations would dial at the same time
+	c.migrateMu.Lock()
+	defer c.migrateMu.Unlock()
+
+	c.mutex.Lock()
+	oldAddr := c.addr
+
+	if !migrate || c.conn == nil || c.closing {
+		c.addr = addr
+		c.mutex.Unlock()
+		c.addrChanged(oldAddr, addr)
+		return nil
+	}
+	c.mutex.Unlock()
+
+	// hello can't be sent while the lock is held
+	if c.options().TLSUpgrade != nil {
+		return c.wrapError(fmt.Errorf("migrating connection with TLS upgrade: %w", ErrTLSUpgradeNotAllowed))
+	}
+
+	// address is not used when servers are looked up with SRV records
+	if c.options().SRV != nil {
+		return c.wrapError(fmt.Errorf("migrating connection to %s: servers are looked up with SRV records of %s", addr, c.options().SRV))
+	}
+
+	// Send and Reply use the current connection while the new one is
+	// dialed
+	conn, err := c.dial(addr)
+	if err != nil {
+		return c.wrapError(fmt.Errorf("connecting to server %s: %w", addr, err))
+	}
+
+	c.mutex.Lock()
+	if c.conn == nil || c.closing {
+		c.mutex.Unlock()
+		conn.Close()
+		return c.wrapError(fmt.Errorf("migrating connection to %s: %w", addr, ErrConnectionClosed))
+	}
+
+	oldConn, oldDone, oldInflight := c.conn, c.done, c.inflight
+
+	c.addr = addr
+	c.switchConn(conn)
+
+	// close the previous connection when its requests are done. Close
+	// waits for it as well.
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+
+		oldInflight.Wait()
+		close(oldDone)
+		oldConn.Close()
+	}()
+	c.mutex.Unlock()
+
+	c.addrChanged(oldAddr, addr)
+	c.connectionEstablished()
+
+	return nil
+}
+
+// addrChanged calls AddrChangedHandler
+func (c *Connection) addrChanged(oldAddr, newAddr string) {
+	if c.options().AddrChangedHandler != nil {
+		go c.options().AddrChangedHandler(c, oldAddr, newAddr)
+	}
+}
@@ -0,0 +1,114 @@
+package connection
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"github.com/moov-io/iso8583"
+)
+
+// SignOnState is the sign-on state of the connection
+type SignOnState int32
+
+const (
+	// SignedOff is the state after Connect and reconnect and after the
+	// sign-off request from the host
+	SignedOff SignOnState = iota
+
+	// SignedOn is the state after the sign-on exchange
+	SignedOn
+)
+
+func (s SignOnState) String() string {
+	if s == SignedOn {
+		return "signed on"
+	}
+
+	return "signed off"
+}
+
+// SignOnState returns the sign-on state of the connection
+func (c *Connection) SignOnState() SignOnState {
+	return SignOnState(atomic.LoadInt32(&c.signOnState))
+}
+
+// MarkSignedOn moves the connection to SignedOn state, e.g. when sign-on
+// exchange can't be detected with SignOnDetector
+func (c *Connection) MarkSignedOn() {
+	c.setSignOnState(SignedOn)
+}
+
+// MarkSignedOff moves the connection to SignedOff state
+func (c *Connection) MarkSignedOff() {
+	c.setSignOnState(SignedOff)
+}
+
+// setSignOnState sets the state and calls SignOnStateHandler if it was
+// changed
+func (c *Connection) setSignOnState(state SignOnState) {
+	if state == SignedOn {
+		atomic.StoreInt32(&c.draining, 0)
+	}
+
+	previous := SignOnState(atomic.SwapInt32(&c.signOnState, int32(state)))
+	if previous == state {
+		return
+	}
+
+	if c.options().SignOnStateHandler != nil {
+		go c.options().SignOnStateHandler(c, state)
+	}
+}
+
+// checkSignedOn returns ErrNotSignedOn when RequireSignOn is set or
+// connection is drained, connection is signed off and MTI of the message
+// is not allowed before sign-on
+func (c *Connection) checkSignedOn(message Message) error {
+	required := c.options().SignOnRequired || atomic.LoadInt32(&c.draining) == 1
+	if !required || c.SignOnState() == SignedOn {
+		return nil
+	}
+
+	mti, _ := message.GetMTI()
+
+	if len(c.options().SignOnAllowedMTIs) == 0 {
+		if c.options().MTIVersion.IsNetworkManagement(mti) {
+			return nil
+		}
+		return ErrNotSignedOn
+	}
+
+	for _, prefix := range c.options().SignOnAllowedMTIs {
+		if strings.HasPrefix(mti, prefix) {
+			return nil
+		}
+	}
+
+	return ErrNotSignedOn
+}
+
+// detectSignOn moves the connection to SignedOn state when SignOnDetector
+// reports that response completed the sign-on exchange
+func (c *Connection) detectSignOn(request, response *iso8583.Message) {
+	detector := c.options().SignOnDetector
+	if detector == nil || c.SignOnState() == SignedOn {
+		return
+	}
+
+	if detector(request, response) {
+		c.setSignOnState(SignedOn)
+	}
+}
+
+// detectSignOff moves the connection to SignedOff state when
+// SignOffDetector reports that inbound message is the sign-off request
+func (c *Connection) detectSignOff(message *iso8583.Message) {
+	detector := c.options().SignOffDetector
+	if detector == nil || c.SignOnState() == SignedOff {
+		return
+	}
+
+	if detector(message) {
+		c.setSignOnState(SignedOff)
+	}
+}
@@ -0,0 +1,105 @@
+package connection
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/moov-io/iso8583"
+)
+
+// STANProvider returns System Trace Audit Numbers (field 11) for outgoing
+// requests when auto-STAN is enabled. Implementations backed by external
+// storage can be used to keep STANs unique across processes. Next should
+// be safe for concurrent use.
+type STANProvider interface {
+	Next() (string, error)
+}
+
+// maxSTAN is the largest 6 digits STAN
+const maxSTAN = 999999
+
+// stanCounter is the in-memory STANProvider which rolls over from max to
+// 000001
+type stanCounter struct {
+	n   uint32
+	max uint32
+}
+
+func newSTANCounter(max uint32) *stanCounter {
+	return &stanCounter{max: max}
+}
+
+func (s *stanCounter) Next() (string, error) {
+	for {
+		n := atomic.LoadUint32(&s.n)
+		next := n%s.max + 1
+
+		if atomic.CompareAndSwapUint32(&s.n, n, next) {
+			return fmt.Sprintf("%06d", next), nil
+		}
+	}
+}
+
+// setSTAN sets STAN (field 11) of the message received from STANProvider
+// unless the message has it already. STANs of pending requests are skipped,
+// so responses are not matched to the wrong request after STAN rolls over.
+func (c *Connection) setSTAN(message *iso8583.Message) error {
+	if paths := c.options().MatchFields; len(paths) > 0 {
+		return c.setMatchSTAN(message, paths[len(paths)-1])
+	}
+
+	if isFieldSet(message, 11) {
+		return nil
+	}
+
+	for skips := 0; ; skips++ {
+		stan, err := c.options().STANProvider.Next()
+		if err != nil {
+			return fmt.Errorf("getting next STAN: %w", err)
+		}
+
+		if !c.pendingRequests.has(stan) {
+			return message.Field(11, stan)
+		}
+
+		atomic.AddUint64(&c.stanSkips, 1)
+
+		// each pending request may be skipped once before the
+		// provider rolls over to the first skipped STAN
+		if skips >= c.pendingRequests.len() {
+			return ErrSTANExhausted
+		}
+	}
+}
+
+// setMatchSTAN is setSTAN for the last of MatchFields. Pending requests
+// are checked by the request ID built from all match fields.
+func (c *Connection) setMatchSTAN(message *iso8583.Message, path string) error {
+	if value, err := matchFieldValue(message, path); err != nil || value != "" {
+		return err
+	}
+
+	for skips := 0; ; skips++ {
+		stan, err := c.options().STANProvider.Next()
+		if err != nil {
+			return fmt.Errorf("getting next STAN: %w", err)
+		}
+
+		if err := setMatchFieldValue(message, path, stan); err != nil {
+			return err
+		}
+
+		// request ID can't be built until other match fields are set,
+		// and then Send fails anyway
+		reqID, err := c.requestID(message)
+		if err != nil || !c.pendingRequests.has(reqID) {
+			return nil
+		}
+
+		atomic.AddUint64(&c.stanSkips, 1)
+
+		if skips >= c.pendingRequests.len() {
+			return ErrSTANExhausted
+		}
+	}
+}
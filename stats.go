@@ -0,0 +1,126 @@
+package connection
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats contains connection statistics
+type Stats struct {
+	// PendingRequests is the number of requests waiting for the reply
+	PendingRequests int
+
+	// OutgoingQueueDepth is the number of messages waiting to be written
+	// into the connection
+	OutgoingQueueDepth int
+
+	// STANSkips is the number of auto-STAN values skipped because they
+	// were used by pending requests
+	STANSkips uint64
+
+	// MACVerificationFailures is the number of inbound messages rejected
+	// by MACVerifier
+	MACVerificationFailures uint64
+
+	// LateResponses is the number of responses received during
+	// LateResponseGrace and passed to LateResponseHandler
+	LateResponses uint64
+
+	// UnmatchedResponses is the number of responses without matching
+	// pending or late request
+	UnmatchedResponses uint64
+
+	// InboundQueueDepth is the number of inbound messages waiting for
+	// InboundWorkers
+	InboundQueueDepth int
+
+	// InboundDropped is the number of inbound messages dropped because
+	// inbound queue was full
+	InboundDropped uint64
+
+	// MessagesReceived is the number of inbound messages received and
+	// unpacked
+	MessagesReceived uint64
+
+	// MessagesSent is the number of messages written into the connection
+	MessagesSent uint64
+
+	// SendTimeouts is the number of requests for which Send returned
+	// ErrSendTimeout
+	SendTimeouts uint64
+
+	// Reconnects is the number of connections established by the
+	// reconnect loop
+	Reconnects uint64
+
+	// DeduplicatedSends is the number of Sends with idempotency key that
+	// returned the response of the previous Send with the same key
+	DeduplicatedSends uint64
+
+	// CorrelationIDMismatches is the number of responses with the
+	// correlation ID other than the one of their requests
+	CorrelationIDMismatches uint64
+
+	// UnpackErrors is the number of inbound messages that were read, but
+	// couldn't be unpacked
+	UnpackErrors uint64
+
+	// FrameIntegrityFailures is the number of inbound frames which
+	// failed FrameIntegrity verification
+	FrameIntegrityFailures uint64
+}
+
+// Stats returns connection statistics
+func (c *Connection) Stats() Stats {
+	c.mutex.Lock()
+	requestsCh := c.requestsCh
+	c.mutex.Unlock()
+
+	return Stats{
+		PendingRequests:         c.pendingRequests.len(),
+		OutgoingQueueDepth:      len(requestsCh),
+		STANSkips:               atomic.LoadUint64(&c.stanSkips),
+		MACVerificationFailures: atomic.LoadUint64(&c.macVerificationFailures),
+		LateResponses:           atomic.LoadUint64(&c.lateResponses),
+		UnmatchedResponses:      atomic.LoadUint64(&c.unmatchedResponses),
+		InboundQueueDepth:       int(atomic.LoadInt64(&c.inboundQueueDepth)),
+		InboundDropped:          atomic.LoadUint64(&c.inboundDropped),
+		MessagesReceived:        atomic.LoadUint64(&c.messagesReceived),
+		MessagesSent:            atomic.LoadUint64(&c.messagesSent),
+		SendTimeouts:            atomic.LoadUint64(&c.sendTimeouts),
+		Reconnects:              atomic.LoadUint64(&c.reconnects),
+		DeduplicatedSends:       atomic.LoadUint64(&c.deduplicatedSends),
+		CorrelationIDMismatches: atomic.LoadUint64(&c.correlationIDMismatches),
+		UnpackErrors:            atomic.LoadUint64(&c.unpackErrors),
+		FrameIntegrityFailures:  atomic.LoadUint64(&c.frameIntegrityFailures),
+	}
+}
+
+// ResetStats sets counters of Stats to zero. Gauges, e.g. PendingRequests,
+// are not changed.
+func (c *Connection) ResetStats() {
+	counters := []*uint64{
+		&c.stanSkips,
+		&c.macVerificationFailures,
+		&c.lateResponses,
+		&c.unmatchedResponses,
+		&c.inboundDropped,
+		&c.messagesReceived,
+		&c.messagesSent,
+		&c.sendTimeouts,
+		&c.reconnects,
+		&c.deduplicatedSends,
+		&c.correlationIDMismatches,
+		&c.unpackErrors,
+		&c.frameIntegrityFailures,
+	}
+	for _, counter := range counters {
+		atomic.StoreUint64(counter, 0)
+	}
+}
+
+// LastReceived returns the time when the last inbound message was received
+// or, if there was none, when connection was established
+func (c *Connection) LastReceived() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastReceived))
+}
@@ -0,0 +1,171 @@
+package connection
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/moov-io/iso8583"
+)
+
+// errMessageAbandoned is returned when message packed by the writer was
+// abandoned by Send or Reply, or when Send returned before the message
+// was written
+var errMessageAbandoned = errors.New("message was abandoned")
+
+// TimeFieldKind defines how the field is populated with the time when
+// message is written
+type TimeFieldKind int
+
+const (
+	// TimeFieldTransmissionDateTime is GMT date and time, like field 7.
+	// Layout is MMDDhhmmss, YYMMDDhhmmss or YYYYMMDDhhmmss depending on
+	// the field length.
+	TimeFieldTransmissionDateTime TimeFieldKind = iota + 1
+
+	// TimeFieldLocalDateTime is date and time in TimeLocation. Layout
+	// depends on the field length as for TimeFieldTransmissionDateTime.
+	TimeFieldLocalDateTime
+
+	// TimeFieldLocalTime is time hhmmss in TimeLocation, like field 12
+	TimeFieldLocalTime
+
+	// TimeFieldLocalDate is date MMDD in TimeLocation, like field 13
+	TimeFieldLocalDate
+)
+
+// dateTimeLayouts are the layouts of date and time fields by the field
+// length
+var dateTimeLayouts = map[int]string{
+	10: DefaultTransmissionDateTimeFormat, // MMDDhhmmss
+	12: "060102150405",                    // YYMMDDhhmmss
+	14: "20060102150405",                  // YYYYMMDDhhmmss
+}
+
+// layout returns time layout for the field of kind with length
+func (k TimeFieldKind) layout(length int) (string, error) {
+	switch k {
+	case TimeFieldTransmissionDateTime, TimeFieldLocalDateTime:
+		layout, found := dateTimeLayouts[length]
+		if !found {
+			return "", fmt.Errorf("unsupported length of date and time field: %d", length)
+		}
+		return layout, nil
+	case TimeFieldLocalTime:
+		return "150405", nil
+	case TimeFieldLocalDate:
+		return "0102", nil
+	default:
+		return "", fmt.Errorf("unknown time field kind: %d", k)
+	}
+}
+
+// lateMessage is the message packed by the write loop right before it's
+// written, so fields with the time of writing are not stale when message
+// waits in the outgoing queue
+type lateMessage struct {
+	mu        sync.Mutex
+	message   *iso8583.Message
+	abandoned bool
+}
+
+// abandon prevents message from being packed after Send or Reply has
+// returned, so the caller may reuse the message
+func (m *lateMessage) abandon() {
+	m.mu.Lock()
+	m.abandoned = true
+	m.mu.Unlock()
+}
+
+// prepareMessage packs the message or, if some fields should be set when
+// message is written, returns it to be packed by the write loop
+func (c *Connection) prepareMessage(message *iso8583.Message) (*bytes.Buffer, *lateMessage, error) {
+	for id := range c.options().AutoSetFields {
+		if !isFieldSet(message, id) {
+			return nil, &lateMessage{message: message}, nil
+		}
+	}
+
+	buf, err := c.packMessage(message)
+
+	return buf, nil, err
+}
+
+// packLate sets time fields of the message and packs it
+func (c *Connection) packLate(m *lateMessage) (*bytes.Buffer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.abandoned {
+		return nil, errMessageAbandoned
+	}
+
+	err := c.setTimeFields(m.message)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.packMessage(m.message)
+}
+
+// setTimeFields sets AutoSetFields which are not set in the message. All
+// fields are formatted from the same instant, so local fields are
+// consistent with the GMT ones during DST transitions.
+func (c *Connection) setTimeFields(message *iso8583.Message) error {
+	now := c.options().Clock.Now()
+
+	location := c.options().TimeLocation
+	if location == nil {
+		location = time.Local
+	}
+
+	ids := make([]int, 0, len(c.options().AutoSetFields))
+	for id := range c.options().AutoSetFields {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		if isFieldSet(message, id) {
+			continue
+		}
+
+		f, found := message.GetSpec().Fields[id]
+		if !found {
+			return fmt.Errorf("setting time field %d: field is not defined in the spec", id)
+		}
+
+		kind := c.options().AutoSetFields[id]
+		layout, err := kind.layout(f.Spec().Length)
+		if err != nil {
+			return fmt.Errorf("setting time field %d: %w", id, err)
+		}
+
+		t := now.In(location)
+		if kind == TimeFieldTransmissionDateTime {
+			t = now.UTC()
+		}
+
+		err = message.Field(id, t.Format(layout))
+		if err != nil {
+			return fmt.Errorf("setting time field %d: %w", id, err)
+		}
+	}
+
+	return nil
+}
+
+// isFieldSet reports whether the message has non empty field
+func isFieldSet(message *iso8583.Message, id int) bool {
+	f, set := message.GetFields()[id]
+	if !set {
+		return false
+	}
+
+	value, _ := f.String()
+
+	return value != ""
+}
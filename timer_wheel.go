@@ -0,0 +1,166 @@
+package connection
+
+import (
+	"sync"
+	"time"
+)
+
+// timerWheelTick is the duration of one timer wheel slot. Timers fire at
+// the tick following their expiration, so they are accurate within one
+// tick.
+const timerWheelTick = 10 * time.Millisecond
+
+// timerWheelSlots is the number of slots in the timer wheel. Timers that
+// expire later than one full turn of the wheel wait for more rounds.
+const timerWheelSlots = 512
+
+// timerWheel is a coarse timer that runs expired functions in batches. It
+// lets many pending requests share one clock timer instead of arming a
+// runtime timer for each of them. Wheel is turned only while there are
+// active timers.
+type timerWheel struct {
+	clock Clock
+
+	mu    sync.Mutex
+	slots []map[*wheelTimer]struct{}
+	pos   int
+	count int
+
+	// time when wheel was moved to the current position
+	lastTick time.Time
+	running  bool
+
+	// signals the wheel goroutine that all timers were stopped, so it
+	// doesn't wait for the next tick to exit
+	idle chan struct{}
+}
+
+type wheelTimer struct {
+	slot   int
+	rounds int
+	f      func()
+}
+
+func newTimerWheel(clock Clock) *timerWheel {
+	w := &timerWheel{
+		clock: clock,
+		slots: make([]map[*wheelTimer]struct{}, timerWheelSlots),
+		idle:  make(chan struct{}, 1),
+	}
+
+	for i := range w.slots {
+		w.slots[i] = make(map[*wheelTimer]struct{})
+	}
+
+	return w
+}
+
+// afterFunc calls f in the timer wheel goroutine after d passes. f should
+// not block.
+func (w *timerWheel) afterFunc(d time.Duration, f func()) *wheelTimer {
+	ticks := int((d + timerWheelTick - 1) / timerWheelTick)
+	if ticks < 1 {
+		ticks = 1
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	t := &wheelTimer{
+		slot:   (w.pos + ticks) % timerWheelSlots,
+		rounds: (ticks - 1) / timerWheelSlots,
+		f:      f,
+	}
+
+	w.slots[t.slot][t] = struct{}{}
+	w.count++
+
+	if !w.running {
+		w.running = true
+		w.lastTick = w.clock.Now()
+		go w.run()
+	}
+
+	return t
+}
+
+// stop prevents the timer from firing
+func (w *timerWheel) stop(t *wheelTimer) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, found := w.slots[t.slot][t]; found {
+		delete(w.slots[t.slot], t)
+		w.count--
+	}
+
+	if w.count == 0 && w.running {
+		select {
+		case w.idle <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (w *timerWheel) run() {
+	for {
+		// wait for the next tick counting from the last move, so the
+		// wheel doesn't drift
+		w.mu.Lock()
+		d := w.lastTick.Add(timerWheelTick).Sub(w.clock.Now())
+		w.mu.Unlock()
+
+		timer := w.clock.NewTimer(d)
+
+		select {
+		case now := <-timer.C():
+			if !w.advance(now) {
+				return
+			}
+		case <-w.idle:
+			timer.Stop()
+
+			// timers may have been added after the signal
+			w.mu.Lock()
+			if w.count == 0 {
+				w.running = false
+				w.mu.Unlock()
+				return
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+// advance moves the wheel one slot forward for each tick passed since the
+// last move and runs expired timers. It reports whether there are timers
+// left.
+func (w *timerWheel) advance(now time.Time) bool {
+	var expired []*wheelTimer
+
+	w.mu.Lock()
+	for ; !now.Before(w.lastTick.Add(timerWheelTick)); w.lastTick = w.lastTick.Add(timerWheelTick) {
+		w.pos = (w.pos + 1) % timerWheelSlots
+		for t := range w.slots[w.pos] {
+			if t.rounds > 0 {
+				t.rounds--
+				continue
+			}
+			delete(w.slots[w.pos], t)
+			w.count--
+			expired = append(expired, t)
+		}
+	}
+
+	if w.count == 0 {
+		w.running = false
+	}
+	running := w.running
+	w.mu.Unlock()
+
+	for _, t := range expired {
+		t.f()
+	}
+
+	return running
+}
@@ -0,0 +1,240 @@
+package connection
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/moov-io/iso8583"
+)
+
+// upgradableConn is the network connection which can be switched to TLS
+// while read and write loops use it. Deadlines and addresses are those of
+// the underlying connection.
+type upgradableConn struct {
+	net.Conn
+
+	// host of the server used as TLS server name
+	host string
+
+	// readMu is held by Read while it waits for data, so upgrade can
+	// take over reading
+	readMu sync.Mutex
+
+	// writeMu is held by Write, so nothing is written during handshake
+	writeMu sync.Mutex
+
+	// mu guards following
+	mu        sync.Mutex
+	current   net.Conn
+	upgrading chan struct{}
+}
+
+func newUpgradableConn(conn net.Conn, host string) *upgradableConn {
+	return &upgradableConn{
+		Conn:    conn,
+		host:    host,
+		current: conn,
+	}
+}
+
+// state returns the current connection and the channel closed when the
+// running upgrade is done or nil if there is no upgrade running
+func (u *upgradableConn) state() (net.Conn, chan struct{}) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.current, u.upgrading
+}
+
+func (u *upgradableConn) Read(p []byte) (int, error) {
+	for {
+		u.readMu.Lock()
+		conn, _ := u.state()
+		n, err := conn.Read(p)
+		u.readMu.Unlock()
+
+		if err == nil {
+			return n, nil
+		}
+
+		// read was interrupted by the upgrade, continue on the
+		// upgraded connection
+		if _, upgrading := u.state(); upgrading != nil {
+			if n > 0 {
+				return n, nil
+			}
+
+			<-upgrading
+			continue
+		}
+
+		return n, err
+	}
+}
+
+func (u *upgradableConn) Write(p []byte) (int, error) {
+	u.writeMu.Lock()
+	defer u.writeMu.Unlock()
+
+	conn, _ := u.state()
+
+	return conn.Write(p)
+}
+
+func (u *upgradableConn) Close() error {
+	conn, _ := u.state()
+
+	return conn.Close()
+}
+
+// upgrade pauses reading, calls before, e.g. to send the reply that
+// precedes the handshake, and replaces the connection with TLS
+// connection created by handshake when its handshake succeeds
+func (u *upgradableConn) upgrade(before func() error, handshake func(conn net.Conn) *tls.Conn, timeout time.Duration) error {
+	upgrading := make(chan struct{})
+
+	u.mu.Lock()
+	if _, ok := u.current.(*tls.Conn); ok || u.upgrading != nil {
+		u.mu.Unlock()
+		return fmt.Errorf("connection is upgraded already: %w", ErrTLSUpgradeNotAllowed)
+	}
+	u.upgrading = upgrading
+	u.mu.Unlock()
+
+	defer func() {
+		u.mu.Lock()
+		u.upgrading = nil
+		u.mu.Unlock()
+
+		close(upgrading)
+	}()
+
+	// interrupt Read waiting for data and take over reading
+	if err := u.Conn.SetReadDeadline(time.Now()); err != nil {
+		return fmt.Errorf("interrupting read: %w", err)
+	}
+	u.readMu.Lock()
+	defer u.readMu.Unlock()
+
+	if before != nil {
+		if err := before(); err != nil {
+			return err
+		}
+	}
+
+	u.writeMu.Lock()
+	defer u.writeMu.Unlock()
+
+	if err := u.Conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return fmt.Errorf("setting handshake deadline: %w", err)
+	}
+
+	tlsConn := handshake(u.Conn)
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("TLS handshake: %w", err)
+	}
+
+	if err := u.Conn.SetDeadline(time.Time{}); err != nil {
+		return fmt.Errorf("resetting deadline: %w", err)
+	}
+
+	u.mu.Lock()
+	u.current = tlsConn
+	u.mu.Unlock()
+
+	return nil
+}
+
+// tlsConn returns TLS connection of conn
+func tlsConn(conn io.ReadWriteCloser) (*tls.Conn, bool) {
+	if u, ok := conn.(*upgradableConn); ok {
+		conn, _ = u.state()
+	}
+
+	tlsConn, ok := conn.(*tls.Conn)
+
+	return tlsConn, ok
+}
+
+// upgradeTLS checks that connection can be upgraded and upgrades it
+func (c *Connection) upgradeTLS(conn io.ReadWriteCloser, before func() error, handshake func(conn net.Conn) *tls.Conn) error {
+	u, ok := conn.(*upgradableConn)
+	if !ok {
+		return ErrTLSUpgradeNotAllowed
+	}
+
+	if c.pendingRequests.len() > 0 {
+		return ErrTLSUpgradePendingRequests
+	}
+
+	return u.upgrade(before, handshake, c.options().SendTimeout)
+}
+
+// helloAndUpgrade calls TLSUpgrade hello and upgrades connection to TLS.
+// Connection is closed if either of them fails.
+func (c *Connection) helloAndUpgrade(conn io.ReadWriteCloser) error {
+	if c.options().TLSUpgrade == nil {
+		return nil
+	}
+
+	err := c.options().TLSUpgrade(c)
+	if err != nil {
+		err = fmt.Errorf("sending hello before TLS upgrade: %w", err)
+	} else {
+		err = c.upgradeTLS(conn, nil, func(raw net.Conn) *tls.Conn {
+			return tls.Client(raw, c.upgradeTLSConfig(conn.(*upgradableConn).host))
+		})
+	}
+
+	if err != nil {
+		err = fmt.Errorf("upgrading to TLS: %w", err)
+		c.handleConnectionError(conn, err)
+		return err
+	}
+
+	return nil
+}
+
+// upgradeTLSConfig returns TLSConfig or the default config with the server
+// name set to host
+func (c *Connection) upgradeTLSConfig(host string) *tls.Config {
+	config := c.options().TLSConfig
+	if config == nil {
+		config = defaultTLSConfig()
+	}
+
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	return config
+}
+
+// ReplyAndUpgradeTLS replies with the message and accepts TLS handshake of
+// the client on the same connection, e.g. after the plaintext hello
+// exchange. It's called by the inbound message handler of the connection
+// created with AcceptTLSUpgrade option. Inbound messages are not read
+// until handshake is done. It returns ErrTLSUpgradePendingRequests if
+// there are pending requests.
+func (c *Connection) ReplyAndUpgradeTLS(message *iso8583.Message) error {
+	if c.options().AcceptTLSUpgradeConfig == nil {
+		return ErrTLSUpgradeNotAllowed
+	}
+
+	conn := c.currentConn()
+	err := c.upgradeTLS(conn, func() error {
+		return c.reply(message)
+	}, func(raw net.Conn) *tls.Conn {
+		return tls.Server(raw, c.options().AcceptTLSUpgradeConfig)
+	})
+	if err != nil {
+		return c.wrapError(fmt.Errorf("upgrading to TLS: %w", err))
+	}
+
+	return nil
+}
@@ -0,0 +1,81 @@
+package connection
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/moov-io/iso8583"
+)
+
+// tpduID is the ID of the TPDU header
+const tpduID = 0x60
+
+// tpduLength is the length of the TPDU header
+const tpduLength = 5
+
+// ErrTPDUMismatch is returned by Send when TPDU validation is enabled and
+// addresses of the response TPDU are not the swapped addresses of the
+// request TPDU
+var ErrTPDUMismatch = errors.New("TPDU of the response doesn't match TPDU of the request")
+
+// TPDUHeader is the Transport Protocol Data Unit header that goes between
+// the length header and the MTI: ID followed by the destination and the
+// source addresses
+type TPDUHeader [tpduLength]byte
+
+// NewTPDUHeader returns TPDU header with dest and src addresses
+func NewTPDUHeader(dest, src [2]byte) TPDUHeader {
+	return TPDUHeader{tpduID, dest[0], dest[1], src[0], src[1]}
+}
+
+// ID returns the ID of the TPDU
+func (t TPDUHeader) ID() byte {
+	return t[0]
+}
+
+// Destination returns the destination address
+func (t TPDUHeader) Destination() [2]byte {
+	return [2]byte{t[1], t[2]}
+}
+
+// Source returns the source address
+func (t TPDUHeader) Source() [2]byte {
+	return [2]byte{t[3], t[4]}
+}
+
+// Swapped returns TPDU with swapped destination and source addresses, as
+// it's expected in the response
+func (t TPDUHeader) Swapped() TPDUHeader {
+	return NewTPDUHeader(t.Source(), t.Destination())
+}
+
+func (t TPDUHeader) String() string {
+	return fmt.Sprintf("%X", t[:])
+}
+
+// validateTPDU checks that TPDU of the response has swapped addresses of
+// the TPDU we send
+func (c *Connection) validateTPDU(tpdu TPDUHeader) error {
+	if !c.options().ValidateTPDU || c.options().TPDU == nil {
+		return nil
+	}
+
+	expected := c.options().TPDU.Swapped()
+	if tpdu.Destination() != expected.Destination() || tpdu.Source() != expected.Source() {
+		return fmt.Errorf("%w: expected %s, got %s", ErrTPDUMismatch, expected, tpdu)
+	}
+
+	return nil
+}
+
+// InboundTPDU returns TPDU of the message passed to InboundMessageHandler.
+// It's available only until the handler returns. TPDU of the response
+// returned by Send is available in SendInfo.
+func (c *Connection) InboundTPDU(message *iso8583.Message) (TPDUHeader, bool) {
+	tpdu, found := c.inboundTPDUs.Load(message)
+	if !found {
+		return TPDUHeader{}, false
+	}
+
+	return tpdu.(TPDUHeader), true
+}
@@ -0,0 +1,165 @@
+package connection
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moov-io/iso8583"
+)
+
+// traceEntry is the message waiting to be rendered to TraceWriter
+type traceEntry struct {
+	sent  bool
+	at    time.Time
+	spec  *iso8583.MessageSpec
+	frame []byte
+}
+
+// tracer renders messages in the background. Its goroutine runs only
+// while there are messages to render.
+type tracer struct {
+	mu      sync.Mutex
+	entries []traceEntry
+	running bool
+}
+
+// trace hands the copy of the frame of the sent or received message over
+// to the tracer. Only spec of the message is used, as the message may be
+// changed or released before it's rendered. It does nothing when
+// TraceWriter is not set.
+func (c *Connection) trace(sent bool, at time.Time, message *iso8583.Message, frame []byte) {
+	w := c.options().TraceWriter
+	if w == nil {
+		return
+	}
+
+	spec := c.spec
+	if message != nil {
+		spec = message.GetSpec()
+	}
+
+	t := c.traces
+	t.mu.Lock()
+	t.entries = append(t.entries, traceEntry{
+		sent:  sent,
+		at:    at,
+		spec:  spec,
+		frame: append([]byte(nil), frame...),
+	})
+	if t.running {
+		t.mu.Unlock()
+		return
+	}
+	t.running = true
+	t.mu.Unlock()
+
+	go c.renderTraces(w)
+}
+
+// renderTraces renders queued messages until there are none left
+func (c *Connection) renderTraces(w io.Writer) {
+	t := c.traces
+
+	for {
+		t.mu.Lock()
+		entries := t.entries
+		t.entries = nil
+		if len(entries) == 0 {
+			t.running = false
+			t.mu.Unlock()
+			return
+		}
+		t.mu.Unlock()
+
+		for _, entry := range entries {
+			io.WriteString(w, c.renderTrace(entry))
+		}
+	}
+}
+
+// renderTrace renders the message as the line with the time, direction,
+// MTI and frame length followed by the lines with number, description and
+// value of each field
+func (c *Connection) renderTrace(entry traceEntry) string {
+	arrow := "<-"
+	if entry.sent {
+		arrow = "->"
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s%s %s", c.logPrefix(), entry.at.UTC().Format(time.RFC3339Nano), arrow)
+
+	message, err := c.unpackTrace(entry)
+	if err != nil {
+		fmt.Fprintf(&sb, " frame=%d: %v\n", len(entry.frame), err)
+		return sb.String()
+	}
+
+	mti, _ := message.GetMTI()
+	fmt.Fprintf(&sb, " %s frame=%d\n", mti, len(entry.frame))
+
+	values := MaskedFields(message, c.options().TraceMaskFields)
+	ids := make([]int, 0, len(values))
+	for id := range values {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		var description string
+		if f := message.GetField(id); f != nil && f.Spec() != nil {
+			description = f.Spec().Description
+		}
+		fmt.Fprintf(&sb, "  F%-3d %s: %s\n", id, description, values[id])
+	}
+
+	return sb.String()
+}
+
+// unpackTrace unpacks the message of the frame skipping the length header,
+// TPDU and the checksum of FrameIntegrity, and decoding WireEncoding as
+// the read loop does. Received frames read by Framer are payloads already.
+func (c *Connection) unpackTrace(entry traceEntry) (*iso8583.Message, error) {
+	frame := entry.frame
+	headerLength := 0
+
+	switch framer := c.options().Framer; {
+	case framer != nil && entry.sent:
+		payload, err := framer.ReadFrame(bytes.NewReader(frame))
+		if err != nil {
+			return nil, fmt.Errorf("reading frame: %w", err)
+		}
+		frame = payload
+	case framer == nil:
+		r := bytes.NewReader(frame)
+		if _, err := c.readMessageLength(r); err != nil {
+			return nil, fmt.Errorf("reading message length: %w", err)
+		}
+		headerLength = len(frame) - r.Len()
+	}
+
+	if c.options().TPDU != nil {
+		headerLength += tpduLength
+	}
+	trailerLength := c.checksumLength()
+	if headerLength+trailerLength > len(frame) {
+		return nil, fmt.Errorf("frame is shorter than header and checksum")
+	}
+
+	packed, err := c.decodeWire(frame[headerLength : len(frame)-trailerLength])
+	if err != nil {
+		return nil, fmt.Errorf("decoding message from the wire: %w", err)
+	}
+
+	message := iso8583.NewMessage(entry.spec)
+	if err := message.Unpack(packed); err != nil {
+		return nil, fmt.Errorf("unpacking message: %w", err)
+	}
+
+	return message, nil
+}
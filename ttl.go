@@ -0,0 +1,51 @@
+package connection
+
+import (
+	"time"
+
+	"github.com/moov-io/iso8583"
+)
+
+// SetMessageTTL overrides QueuedMessageTTL for the message passed to the
+// next Send or Reply. Zero ttl means message doesn't expire.
+func (c *Connection) SetMessageTTL(message *iso8583.Message, ttl time.Duration) {
+	c.messageTTLs.Store(message, ttl)
+}
+
+// messageTTL returns TTL of the message set with SetMessageTTL or
+// QueuedMessageTTL
+func (c *Connection) messageTTL(message *iso8583.Message) time.Duration {
+	if ttl, found := c.messageTTLs.LoadAndDelete(message); found {
+		return ttl.(time.Duration)
+	}
+
+	return c.options().QueuedMessageTTL
+}
+
+// expiresAt returns the time after which message queued at queuedAt is
+// not written or zero time if ttl is not positive
+func expiresAt(queuedAt time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+
+	return queuedAt.Add(ttl)
+}
+
+// expired reports whether request waited in the outgoing queue longer than
+// its TTL
+func (c *Connection) expired(req request) bool {
+	return !req.expiresAt.IsZero() && c.options().Clock.Now().After(req.expiresAt)
+}
+
+// dropExpired releases request received from the outgoing queue that
+// won't be written because it expired
+func (c *Connection) dropExpired(req request) {
+	c.deadLetter(req, ErrMessageExpired)
+
+	if req.rawMessage != nil {
+		c.releaseBuffer(req.rawMessage)
+	}
+
+	c.failRequest(req, ErrMessageExpired)
+}
@@ -0,0 +1,347 @@
+// Package websocket tunnels ISO 8583 messages over WebSocket connections,
+// e.g. when only HTTP(S) egress is allowed. Each message is sent as one
+// binary WebSocket message without the length header.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// ErrMessageTooLarge is returned when received WebSocket message is larger
+// than MaxMessageLength
+var ErrMessageTooLarge = errors.New("websocket message is too large")
+
+// MaxMessageLength is the maximum length of the received WebSocket message
+const MaxMessageLength = 1 << 20
+
+// headerLength is the length of the message length header Conn adds to
+// the received messages and expects in the written data
+const headerLength = 4
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// ReadMessageLength is connection.MessageLengthReader of the connections
+// established with DialFunc or accepted by Listener. It reads the length
+// header Conn adds to each received WebSocket message.
+func ReadMessageLength(r io.Reader) (int, error) {
+	header := make([]byte, headerLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, err
+	}
+
+	return int(binary.BigEndian.Uint32(header)), nil
+}
+
+// WriteMessageLength is connection.MessageLengthWriter of the connections
+// established with DialFunc or accepted by Listener. The header it writes
+// is used by Conn to find the message boundaries and is not sent.
+func WriteMessageLength(w io.Writer, length int) (int, error) {
+	header := make([]byte, headerLength)
+	binary.BigEndian.PutUint32(header, uint32(length))
+
+	return w.Write(header)
+}
+
+// Conn is net.Conn which reads and writes messages as binary WebSocket
+// messages. Data read from it is the stream of received messages, each
+// prefixed with the length header read by ReadMessageLength. Data written
+// into it should be the stream of messages, each prefixed with the header
+// written by WriteMessageLength.
+type Conn struct {
+	net.Conn
+
+	// r reads frames from the connection, it may contain data read
+	// during the handshake
+	r *bufio.Reader
+
+	// client masks the frames it writes as RFC 6455 requires
+	client bool
+
+	// handshake is done on the first Read or Write, for the connections
+	// accepted by Listener
+	handshakeOnce sync.Once
+	handshake     func() error
+	handshakeErr  error
+
+	readMu sync.Mutex
+	// unread data of the received message with its header
+	unread []byte
+
+	writeMu sync.Mutex
+	// written data of the incomplete message
+	written []byte
+	// open is set when handshake is done and frames can be written
+	open bool
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func newConn(conn net.Conn, r *bufio.Reader, client bool) *Conn {
+	return &Conn{
+		Conn:   conn,
+		r:      r,
+		client: client,
+		open:   true,
+	}
+}
+
+// Read reads the received messages prefixed with their length headers
+func (c *Conn) Read(p []byte) (int, error) {
+	if err := c.doHandshake(); err != nil {
+		return 0, err
+	}
+
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if len(c.unread) == 0 {
+		payload, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+
+		c.unread = make([]byte, headerLength+len(payload))
+		binary.BigEndian.PutUint32(c.unread, uint32(len(payload)))
+		copy(c.unread[headerLength:], payload)
+	}
+
+	n := copy(p, c.unread)
+	c.unread = c.unread[n:]
+
+	return n, nil
+}
+
+// Write sends each complete message of the written data as one binary
+// WebSocket message. Incomplete message is kept until the rest of it is
+// written.
+func (c *Conn) Write(p []byte) (int, error) {
+	if err := c.doHandshake(); err != nil {
+		return 0, err
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.written = append(c.written, p...)
+
+	for len(c.written) >= headerLength {
+		length := int(binary.BigEndian.Uint32(c.written))
+		if len(c.written) < headerLength+length {
+			break
+		}
+
+		if err := c.writeFrame(opBinary, c.written[headerLength:headerLength+length]); err != nil {
+			c.written = nil
+			return 0, err
+		}
+
+		c.written = c.written[headerLength+length:]
+	}
+
+	// don't keep the sent messages in memory
+	if len(c.written) == 0 {
+		c.written = nil
+	}
+
+	return len(p), nil
+}
+
+// Close sends the close frame and closes the connection
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		c.writeMu.Lock()
+		if c.open {
+			// best effort, peer may be gone already
+			_ = c.writeFrame(opClose, nil)
+		}
+		c.writeMu.Unlock()
+
+		c.closeErr = c.Conn.Close()
+	})
+
+	return c.closeErr
+}
+
+// doHandshake does the handshake of the accepted connection once
+func (c *Conn) doHandshake() error {
+	if c.handshake == nil {
+		return nil
+	}
+
+	c.handshakeOnce.Do(func() {
+		c.handshakeErr = c.handshake()
+		if c.handshakeErr == nil {
+			c.writeMu.Lock()
+			c.open = true
+			c.writeMu.Unlock()
+		}
+	})
+
+	return c.handshakeErr
+}
+
+// readMessage reads frames until the data message is complete. Control
+// frames received meanwhile are handled. io.EOF is returned when peer
+// closed the connection.
+func (c *Conn) readMessage() ([]byte, error) {
+	var message []byte
+	started := false
+
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch op {
+		case opPing:
+			c.writeMu.Lock()
+			err = c.writeFrame(opPong, payload)
+			c.writeMu.Unlock()
+			if err != nil {
+				return nil, fmt.Errorf("writing pong: %w", err)
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			c.writeMu.Lock()
+			_ = c.writeFrame(opClose, nil)
+			c.writeMu.Unlock()
+			return nil, io.EOF
+		case opBinary, opText:
+			if started {
+				return nil, fmt.Errorf("unexpected data frame in fragmented message")
+			}
+			started = true
+		case opContinuation:
+			if !started {
+				return nil, fmt.Errorf("unexpected continuation frame")
+			}
+		default:
+			return nil, fmt.Errorf("unknown opcode %d", op)
+		}
+
+		if len(message)+len(payload) > MaxMessageLength {
+			return nil, ErrMessageTooLarge
+		}
+		message = append(message, payload...)
+
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+// readFrame reads one frame and unmasks its payload
+func (c *Conn) readFrame() (bool, byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := header[0]&0x80 != 0
+	op := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(c.r, ext); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(c.r, ext); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+
+	if length > MaxMessageLength {
+		return false, 0, nil, ErrMessageTooLarge
+	}
+
+	var mask []byte
+	if masked {
+		mask = make([]byte, 4)
+		if _, err := io.ReadFull(c.r, mask); err != nil {
+			return false, 0, nil, err
+		}
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return false, 0, nil, err
+	}
+
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+
+	return fin, op, payload, nil
+}
+
+// writeFrame writes payload as one final frame. Payload of the client is
+// masked. It should be called with writeMu held.
+func (c *Conn) writeFrame(op byte, payload []byte) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|op)
+
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+
+	length := len(payload)
+	switch {
+	case length < 126:
+		frame = append(frame, maskBit|byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, maskBit|126, byte(length>>8), byte(length))
+	default:
+		ext := make([]byte, 8)
+		binary.BigEndian.PutUint64(ext, uint64(length))
+		frame = append(frame, maskBit|127)
+		frame = append(frame, ext...)
+	}
+
+	if !c.client {
+		frame = append(frame, payload...)
+		_, err := c.Conn.Write(frame)
+		return err
+	}
+
+	mask := make([]byte, 4)
+	if _, err := rand.Read(mask); err != nil {
+		return fmt.Errorf("generating mask: %w", err)
+	}
+	frame = append(frame, mask...)
+
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	_, err := c.Conn.Write(frame)
+
+	return err
+}
@@ -0,0 +1,166 @@
+package websocket_test
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/moov-io/iso8583"
+	connection "github.com/moov-io/iso8583-connection"
+	"github.com/moov-io/iso8583-connection/iso8583util"
+	"github.com/moov-io/iso8583-connection/server"
+	"github.com/moov-io/iso8583-connection/websocket"
+	"github.com/moov-io/iso8583/specs"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+// TestMain checks that goroutines started by the tests exit by the time
+// they are done
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m)
+}
+
+var testSpec = specs.Spec87ASCII
+
+// reply responds to the message with STAN copied from it
+func reply(c *connection.Connection, message *iso8583.Message) {
+	response, err := iso8583util.NewResponseFrom(message, []int{11})
+	if err != nil {
+		return
+	}
+
+	c.Reply(response)
+}
+
+// startServer starts the server which accepts WebSocket connections and
+// returns its address. Server is closed when the test finishes.
+func startServer(t *testing.T, opts ...connection.Option) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := server.New(testSpec, websocket.ReadMessageLength, websocket.WriteMessageLength, opts...)
+	srv.Serve(websocket.NewListener(ln))
+	t.Cleanup(srv.Close)
+
+	return srv.Addr
+}
+
+// dial connects to the WebSocket server at addr
+func dial(t *testing.T, addr string) *connection.Connection {
+	t.Helper()
+
+	c, err := connection.New(addr, testSpec, websocket.ReadMessageLength, websocket.WriteMessageLength,
+		connection.WithDialFunc(websocket.DialFunc("ws://"+addr+"/iso8583", nil)),
+	)
+	require.NoError(t, err)
+	require.NoError(t, c.Connect())
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+// newMessage returns the network management request with STAN
+func newMessage(t *testing.T, stan string) *iso8583.Message {
+	t.Helper()
+
+	message := iso8583.NewMessage(testSpec)
+	message.MTI("0800")
+	require.NoError(t, message.Field(11, stan))
+
+	return message
+}
+
+func TestRoundTrip(t *testing.T) {
+	addr := startServer(t, connection.InboundMessageHandler(reply))
+
+	t.Run("sends messages and receives responses", func(t *testing.T) {
+		c := dial(t, addr)
+
+		for i := 1; i <= 3; i++ {
+			stan := fmt.Sprintf("%06d", i)
+
+			response, err := c.Send(newMessage(t, stan))
+			require.NoError(t, err)
+
+			mti, err := response.GetMTI()
+			require.NoError(t, err)
+			require.Equal(t, "0810", mti)
+
+			got, err := response.GetString(11)
+			require.NoError(t, err)
+			require.Equal(t, stan, got)
+		}
+	})
+
+	t.Run("matches responses to concurrent requests", func(t *testing.T) {
+		c := dial(t, addr)
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 20)
+		for i := 1; i <= 20; i++ {
+			stan := fmt.Sprintf("%06d", i)
+			message := newMessage(t, stan)
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				response, err := c.Send(message)
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				if got, _ := response.GetString(11); got != stan {
+					errs <- fmt.Errorf("expected response with STAN %s, got %s", stan, got)
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			require.NoError(t, err)
+		}
+	})
+
+	t.Run("sends large message", func(t *testing.T) {
+		c := dial(t, addr)
+
+		// messages longer than 125 bytes are sent in frames with
+		// extended payload length
+		message := newMessage(t, "000001")
+		require.NoError(t, message.Field(48, strings.Repeat("x", 900)))
+
+		response, err := c.Send(message)
+		require.NoError(t, err)
+
+		got, err := response.GetString(11)
+		require.NoError(t, err)
+		require.Equal(t, "000001", got)
+	})
+}
+
+func TestDialFunc_HandshakeFailed(t *testing.T) {
+	// HTTP server which doesn't upgrade connections
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	c, err := connection.New(addr, testSpec, websocket.ReadMessageLength, websocket.WriteMessageLength,
+		connection.WithDialFunc(websocket.DialFunc("ws://"+addr+"/iso8583", nil)),
+	)
+	require.NoError(t, err)
+
+	err = c.Connect()
+	require.ErrorIs(t, err, websocket.ErrHandshake)
+	require.NoError(t, c.Close())
+}
@@ -0,0 +1,221 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1" // #nosec G505 -- required by RFC 6455 handshake
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	connection "github.com/moov-io/iso8583-connection"
+)
+
+// ErrHandshake is returned when WebSocket handshake failed
+var ErrHandshake = errors.New("websocket handshake failed")
+
+// HandshakeTimeout limits the time of the WebSocket handshake
+const HandshakeTimeout = 10 * time.Second
+
+// acceptGUID is appended to the key of the client to get the accept key
+// of the server
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// DialFunc returns connection.DialFunc which upgrades the connection with
+// the address resolved by the connection to WebSocket at rawURL. Address
+// of the connection should be the host and the port of the URL, e.g.
+// connection.New("gateway.example.com:443", ...) for
+// "wss://gateway.example.com/iso8583". For wss URLs TLS is established
+// with tlsConfig before the upgrade, so connection.ClientCert,
+// connection.RootCAs and connection.SetTLSConfig options should not be
+// used. Connection should use ReadMessageLength and WriteMessageLength.
+func DialFunc(rawURL string, tlsConfig *tls.Config) connection.DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("parsing WebSocket URL: %w", err)
+		}
+
+		if u.Scheme != "ws" && u.Scheme != "wss" {
+			return nil, fmt.Errorf("WebSocket URL scheme should be ws or wss, got %q", u.Scheme)
+		}
+
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		if u.Scheme == "wss" {
+			config := tlsConfig
+			if config == nil {
+				config = &tls.Config{MinVersion: tls.VersionTLS12}
+			}
+			if config.ServerName == "" {
+				config = config.Clone()
+				config.ServerName = u.Hostname()
+			}
+
+			conn = tls.Client(conn, config)
+		}
+
+		wsConn, err := clientHandshake(conn, u)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		return wsConn, nil
+	}
+}
+
+// clientHandshake upgrades conn to WebSocket at u
+func clientHandshake(conn net.Conn, u *url.URL) (*Conn, error) {
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	keyBytes := make([]byte, 16)
+	if _, err := rand.Read(keyBytes); err != nil {
+		return nil, fmt.Errorf("generating key: %w", err)
+	}
+	key := base64.StdEncoding.EncodeToString(keyBytes)
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("writing upgrade request: %w", err)
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, fmt.Errorf("reading upgrade response: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("%w: unexpected status %s", ErrHandshake, resp.Status)
+	}
+
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		return nil, fmt.Errorf("%w: unexpected upgrade %q", ErrHandshake, resp.Header.Get("Upgrade"))
+	}
+
+	if resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return nil, fmt.Errorf("%w: invalid accept key", ErrHandshake)
+	}
+
+	return newConn(conn, r, true), nil
+}
+
+// Listener accepts WebSocket connections. Handshake of the accepted
+// connection is done on its first Read or Write, so slow clients don't
+// block Accept. Server of the connections should use ReadMessageLength
+// and WriteMessageLength.
+type Listener struct {
+	net.Listener
+}
+
+// NewListener returns Listener which accepts WebSocket connections from
+// ln, e.g. to pass it to Serve of the server
+func NewListener(ln net.Listener) *Listener {
+	return &Listener{Listener: ln}
+}
+
+// Accept returns the next accepted connection as *Conn
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	wsConn := newConn(conn, r, false)
+	wsConn.open = false
+	wsConn.handshake = func() error {
+		return serverHandshake(conn, r)
+	}
+
+	return wsConn, nil
+}
+
+// serverHandshake reads the upgrade request of the client and accepts it
+func serverHandshake(conn net.Conn, r *bufio.Reader) error {
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return fmt.Errorf("reading upgrade request: %w", err)
+	}
+	req.Body.Close()
+
+	key := req.Header.Get("Sec-WebSocket-Key")
+
+	var reason string
+	switch {
+	case req.Method != http.MethodGet:
+		reason = "unexpected method " + req.Method
+	case !strings.EqualFold(req.Header.Get("Upgrade"), "websocket"):
+		reason = "unexpected upgrade " + req.Header.Get("Upgrade")
+	case !headerContains(req.Header, "Connection", "upgrade"):
+		reason = "connection is not upgraded"
+	case req.Header.Get("Sec-WebSocket-Version") != "13":
+		reason = "unsupported version " + req.Header.Get("Sec-WebSocket-Version")
+	case key == "":
+		reason = "key is missing"
+	}
+
+	if reason != "" {
+		fmt.Fprint(conn, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n")
+		return fmt.Errorf("%w: %s", ErrHandshake, reason)
+	}
+
+	_, err = fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", acceptKey(key))
+	if err != nil {
+		return fmt.Errorf("writing upgrade response: %w", err)
+	}
+
+	return nil
+}
+
+// acceptKey returns the accept key of the server for the key of the
+// client
+func acceptKey(key string) string {
+	// #nosec G401 -- required by RFC 6455 handshake
+	sum := sha1.Sum([]byte(key + acceptGUID))
+
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerContains returns true if comma separated values of the header
+// contain token
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,184 @@
+package connection
+
+import (
+	"fmt"
+
+	"github.com/moov-io/iso8583/field"
+)
+
+// Encoding translates bytes of the packed message between the character
+// set of the spec and the one used on the wire. It must translate each
+// byte into exactly one byte, so lengths of fields are not changed.
+type Encoding interface {
+	// Encode translates bytes packed with the spec into the wire bytes
+	Encode(src []byte) []byte
+
+	// Decode translates wire bytes into the bytes the spec unpacks
+	Decode(src []byte) []byte
+}
+
+// byteTable is Encoding which translates bytes with the table
+type byteTable struct {
+	encode [256]byte
+	decode [256]byte
+}
+
+// newByteTable returns byteTable that decodes byte b into decode[b]
+func newByteTable(decode [256]byte) *byteTable {
+	t := &byteTable{decode: decode}
+	for b, d := range decode {
+		t.encode[d] = byte(b)
+	}
+
+	return t
+}
+
+func (t *byteTable) Encode(src []byte) []byte {
+	dst := make([]byte, len(src))
+	for i, b := range src {
+		dst[i] = t.encode[b]
+	}
+
+	return dst
+}
+
+func (t *byteTable) Decode(src []byte) []byte {
+	dst := make([]byte, len(src))
+	for i, b := range src {
+		dst[i] = t.decode[b]
+	}
+
+	return dst
+}
+
+// EBCDIC1047 is Encoding between ISO 8859-1 (ASCII) and EBCDIC code page
+// 1047 used by IBM mainframes. All 256 byte values are translated both
+// ways, so binary data survives the round trip unchanged.
+var EBCDIC1047 Encoding = newByteTable([256]byte{
+	0x00, 0x01, 0x02, 0x03, 0x9C, 0x09, 0x86, 0x7F, 0x97, 0x8D, 0x8E, 0x0B, 0x0C, 0x0D, 0x0E, 0x0F,
+	0x10, 0x11, 0x12, 0x13, 0x9D, 0x85, 0x08, 0x87, 0x18, 0x19, 0x92, 0x8F, 0x1C, 0x1D, 0x1E, 0x1F,
+	0x80, 0x81, 0x82, 0x83, 0x84, 0x0A, 0x17, 0x1B, 0x88, 0x89, 0x8A, 0x8B, 0x8C, 0x05, 0x06, 0x07,
+	0x90, 0x91, 0x16, 0x93, 0x94, 0x95, 0x96, 0x04, 0x98, 0x99, 0x9A, 0x9B, 0x14, 0x15, 0x9E, 0x1A,
+	0x20, 0xA0, 0xE2, 0xE4, 0xE0, 0xE1, 0xE3, 0xE5, 0xE7, 0xF1, 0xA2, 0x2E, 0x3C, 0x28, 0x2B, 0x7C,
+	0x26, 0xE9, 0xEA, 0xEB, 0xE8, 0xED, 0xEE, 0xEF, 0xEC, 0xDF, 0x21, 0x24, 0x2A, 0x29, 0x3B, 0x5E,
+	0x2D, 0x2F, 0xC2, 0xC4, 0xC0, 0xC1, 0xC3, 0xC5, 0xC7, 0xD1, 0xA6, 0x2C, 0x25, 0x5F, 0x3E, 0x3F,
+	0xF8, 0xC9, 0xCA, 0xCB, 0xC8, 0xCD, 0xCE, 0xCF, 0xCC, 0x60, 0x3A, 0x23, 0x40, 0x27, 0x3D, 0x22,
+	0xD8, 0x61, 0x62, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69, 0xAB, 0xBB, 0xF0, 0xFD, 0xFE, 0xB1,
+	0xB0, 0x6A, 0x6B, 0x6C, 0x6D, 0x6E, 0x6F, 0x70, 0x71, 0x72, 0xAA, 0xBA, 0xE6, 0xB8, 0xC6, 0xA4,
+	0xB5, 0x7E, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79, 0x7A, 0xA1, 0xBF, 0xD0, 0x5B, 0xDE, 0xAE,
+	0xAC, 0xA3, 0xA5, 0xB7, 0xA9, 0xA7, 0xB6, 0xBC, 0xBD, 0xBE, 0xDD, 0xA8, 0xAF, 0x5D, 0xB4, 0xD7,
+	0x7B, 0x41, 0x42, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49, 0xAD, 0xF4, 0xF6, 0xF2, 0xF3, 0xF5,
+	0x7D, 0x4A, 0x4B, 0x4C, 0x4D, 0x4E, 0x4F, 0x50, 0x51, 0x52, 0xB9, 0xFB, 0xFC, 0xF9, 0xFA, 0xFF,
+	0x5C, 0xF7, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59, 0x5A, 0xB2, 0xD4, 0xD6, 0xD2, 0xD3, 0xD5,
+	0x30, 0x31, 0x32, 0x33, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39, 0xB3, 0xDB, 0xDC, 0xD9, 0xDA, 0x9F,
+})
+
+// encodeWire translates the packed message into the wire bytes with
+// WireEncoding
+func (c *Connection) encodeWire(packed []byte) ([]byte, error) {
+	enc := c.options().WireEncoding
+	if enc == nil {
+		return packed, nil
+	}
+
+	if len(c.options().WireEncodingFields) == 0 {
+		return enc.Encode(packed), nil
+	}
+
+	return c.translateFields(packed, func(src []byte, f field.Field) ([]byte, int, error) {
+		n, err := f.Unpack(src)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		return enc.Encode(src[:n]), n, nil
+	})
+}
+
+// decodeWire translates the wire bytes into the packed message with
+// WireEncoding
+func (c *Connection) decodeWire(wire []byte) ([]byte, error) {
+	enc := c.options().WireEncoding
+	if enc == nil {
+		return wire, nil
+	}
+
+	if len(c.options().WireEncodingFields) == 0 {
+		return enc.Decode(wire), nil
+	}
+
+	return c.translateFields(wire, func(src []byte, f field.Field) ([]byte, int, error) {
+		// length of the field is known once its prefix is decoded
+		decoded := enc.Decode(src)
+		n, err := f.Unpack(decoded)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		return decoded[:n], n, nil
+	})
+}
+
+// translateFunc translates the field at the start of src and unpacks it
+// from the bytes of the spec. It returns the translated bytes of the field
+// and their number.
+type translateFunc func(src []byte, f field.Field) ([]byte, int, error)
+
+// translateFields walks the fields of the packed message like Unpack does
+// and translates the bytes of WireEncodingFields with translate. Other
+// fields are copied as is.
+func (c *Connection) translateFields(src []byte, translate translateFunc) ([]byte, error) {
+	translated := c.options().WireEncodingFields
+	fields := c.spec.CreateMessageFields()
+
+	dst := make([]byte, 0, len(src))
+	off := 0
+
+	next := func(id int) error {
+		f, found := fields[id]
+		if !found {
+			return fmt.Errorf("translating field %d: no specification found", id)
+		}
+
+		var n int
+		var err error
+		if translated[id] {
+			var out []byte
+			out, n, err = translate(src[off:], f)
+			dst = append(dst, out...)
+		} else {
+			n, err = f.Unpack(src[off:])
+			dst = append(dst, src[off:off+n]...)
+		}
+		if err != nil {
+			return fmt.Errorf("translating field %d: %w", id, err)
+		}
+
+		off += n
+
+		return nil
+	}
+
+	// MTI and bitmap
+	for id := 0; id < 2; id++ {
+		if err := next(id); err != nil {
+			return nil, err
+		}
+	}
+
+	bitmap, ok := fields[1].(*field.Bitmap)
+	if !ok {
+		return nil, fmt.Errorf("translating fields: field 1 is %T, not bitmap", fields[1])
+	}
+
+	for id := 2; id <= bitmap.Len(); id++ {
+		if !bitmap.IsSet(id) {
+			continue
+		}
+		if err := next(id); err != nil {
+			return nil, err
+		}
+	}
+
+	return append(dst, src[off:]...), nil
+}
@@ -0,0 +1,49 @@
+package connection
+
+import (
+	"fmt"
+	"io"
+	"net"
+)
+
+// ConnWrapper wraps the network connection with the layer applied to the
+// whole stream below the message framing, e.g. compression or link
+// encryption. The returned conn is used for reading and writing frames and
+// its Close should close the wrapped conn.
+type ConnWrapper func(conn net.Conn) (net.Conn, error)
+
+// wrapConn wraps conn with WrapConn when it's set. conn is closed if
+// wrapping fails.
+func (c *Connection) wrapConn(conn net.Conn) (net.Conn, error) {
+	wrap := c.options().WrapConn
+	if wrap == nil {
+		return conn, nil
+	}
+
+	wrapped, err := wrap(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("wrapping connection: %w", err)
+	}
+
+	return wrapped, nil
+}
+
+// wrapTransport wraps the transport passed to NewFrom. It should be
+// net.Conn when WrapConn is set.
+func (c *Connection) wrapTransport(conn io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+	if c.options().WrapConn == nil {
+		return conn, nil
+	}
+
+	if c.options().AcceptTLSUpgradeConfig != nil {
+		return nil, fmt.Errorf("wrapping connection with TLS upgrade: %w", ErrTLSUpgradeNotAllowed)
+	}
+
+	netConn, ok := conn.(net.Conn)
+	if !ok {
+		return nil, fmt.Errorf("wrapping connection: %T is not net.Conn", conn)
+	}
+
+	return c.wrapConn(netConn)
+}